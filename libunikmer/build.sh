@@ -0,0 +1,17 @@
+#!/usr/bin/env sh
+
+# Building the shared library (libunikmer.so, or .dylib on macOS)
+# and the static library (libunikmer.a), along with the header file libunikmer.h.
+# A C compiler is needed, as cgo is required.
+
+set -e
+
+cd "$(dirname "$0")"
+
+ext=so
+if [ "$(go env GOOS)" = "darwin" ]; then
+    ext=dylib
+fi
+
+CGO_ENABLED=1 go build -buildmode=c-shared -trimpath -ldflags '-w -s' -o libunikmer.$ext .
+CGO_ENABLED=1 go build -buildmode=c-archive -trimpath -ldflags '-w -s' -o libunikmer.a .
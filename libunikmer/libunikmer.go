@@ -0,0 +1,393 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+
+// Package main exports a minimal C ABI for reading and writing .unik files,
+// built as a shared (or static) library with cgo. See README.md for details.
+package main
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/shenwei356/kmers"
+	"github.com/shenwei356/unik/v5"
+)
+
+// abiVersion is increased when any exported function is changed or removed.
+// Adding new functions does not change it.
+const abiVersion = 1
+
+// handle is an opened .unik file for reading or writing.
+type handle struct {
+	file string
+	fh   *os.File
+
+	gr     *gzip.Reader
+	reader *unik.Reader
+
+	bw     *bufio.Writer
+	gw     *gzip.Writer
+	writer *unik.Writer
+}
+
+var (
+	mu      sync.Mutex
+	handles = make(map[int64]*handle)
+	lastID  int64
+	lastErr string
+)
+
+func setErr(err error) {
+	mu.Lock()
+	lastErr = err.Error()
+	mu.Unlock()
+}
+
+func addHandle(h *handle) C.int64_t {
+	mu.Lock()
+	lastID++
+	handles[lastID] = h
+	id := lastID
+	mu.Unlock()
+	return C.int64_t(id)
+}
+
+func getHandle(id C.int64_t) (*handle, error) {
+	mu.Lock()
+	h, ok := handles[int64(id)]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid handle: %d", int64(id))
+	}
+	return h, nil
+}
+
+//export unikmer_abi_version
+func unikmer_abi_version() C.int {
+	return abiVersion
+}
+
+// unikmer_last_error copies the message of the last error into buf,
+// which is truncated to size-1 bytes and NUL-terminated.
+// It returns the full length of the message.
+//
+//export unikmer_last_error
+func unikmer_last_error(buf *C.char, size C.int) C.int {
+	mu.Lock()
+	msg := lastErr
+	mu.Unlock()
+
+	if buf != nil && size > 0 {
+		b := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))
+		n := copy(b[:size-1], msg)
+		b[n] = 0
+	}
+	return C.int(len(msg))
+}
+
+// unikmer_open opens a .unik file (gzipped or not) for reading.
+// It returns a positive handle, or -1 on error.
+//
+//export unikmer_open
+func unikmer_open(path *C.char) C.int64_t {
+	file := C.GoString(path)
+	fh, err := os.Open(file)
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+
+	h := &handle{file: file, fh: fh}
+	br := bufio.NewReaderSize(fh, 65536)
+	var r io.Reader = br
+	if m, err := br.Peek(2); err == nil && m[0] == 0x1f && m[1] == 0x8b {
+		h.gr, err = gzip.NewReader(br)
+		if err != nil {
+			fh.Close()
+			setErr(fmt.Errorf("%s: %s", file, err))
+			return -1
+		}
+		r = bufio.NewReaderSize(h.gr, 65536)
+	}
+
+	h.reader, err = unik.NewReader(r)
+	if err != nil {
+		h.close()
+		setErr(fmt.Errorf("%s: %s", file, err))
+		return -1
+	}
+	return addHandle(h)
+}
+
+// unikmer_header returns header fields of a file opened for reading.
+// Any of the pointers can be NULL. flag is a bitwise OR of
+// 1 (compact), 2 (canonical), 4 (sorted), 8 (include taxid), 16 (hashed), 32 (scaled).
+// number is the number of k-mers, 0 for unknown.
+//
+//export unikmer_header
+func unikmer_header(id C.int64_t, k *C.int, flag *C.uint32_t, number *C.uint64_t,
+	globalTaxid *C.uint32_t, scale *C.uint32_t, maxHash *C.uint64_t) C.int {
+	h, err := getHandle(id)
+	if err == nil && h.reader == nil {
+		err = errors.New("handle not opened for reading")
+	}
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+
+	r := h.reader
+	if k != nil {
+		*k = C.int(r.K)
+	}
+	if flag != nil {
+		*flag = C.uint32_t(r.Flag)
+	}
+	if number != nil {
+		*number = C.uint64_t(r.Number)
+	}
+	if globalTaxid != nil {
+		*globalTaxid = C.uint32_t(r.GetGlobalTaxid())
+	}
+	if scale != nil {
+		*scale = C.uint32_t(r.GetScale())
+	}
+	if maxHash != nil {
+		*maxHash = C.uint64_t(r.GetMaxHash())
+	}
+	return 0
+}
+
+// unikmer_read reads at most n k-mers (codes or hashes) into codes, and
+// their taxids into taxids if it's not NULL. It returns the number of
+// k-mers read, 0 for the end of file, or -1 on error.
+//
+//export unikmer_read
+func unikmer_read(id C.int64_t, codes *C.uint64_t, taxids *C.uint32_t, n C.int64_t) C.int64_t {
+	h, err := getHandle(id)
+	if err == nil && h.reader == nil {
+		err = errors.New("handle not opened for reading")
+	}
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	_codes := unsafe.Slice((*uint64)(unsafe.Pointer(codes)), int(n))
+	var _taxids []uint32
+	if taxids != nil {
+		_taxids = unsafe.Slice((*uint32)(unsafe.Pointer(taxids)), int(n))
+	}
+
+	var code uint64
+	var taxid uint32
+	var i int
+	for i = 0; i < int(n); i++ {
+		code, taxid, err = h.reader.ReadCodeWithTaxid()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			setErr(fmt.Errorf("%s: %s", h.file, err))
+			return -1
+		}
+		_codes[i] = code
+		if _taxids != nil {
+			_taxids[i] = taxid
+		}
+	}
+	return C.int64_t(i)
+}
+
+// unikmer_create creates a .unik file for writing, flag is the same as in
+// unikmer_header. Output is gzipped if compress is not 0.
+// It returns a positive handle, or -1 on error.
+//
+//export unikmer_create
+func unikmer_create(path *C.char, k C.int, flag C.uint32_t, compress C.int) C.int64_t {
+	file := C.GoString(path)
+	fh, err := os.Create(file)
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+
+	h := &handle{file: file, fh: fh}
+	var w io.Writer = fh
+	if compress != 0 {
+		h.gw = gzip.NewWriter(fh)
+		w = h.gw
+	}
+	h.bw = bufio.NewWriterSize(w, 65536)
+
+	h.writer, err = unik.NewWriter(h.bw, int(k), uint32(flag))
+	if err != nil {
+		h.close()
+		os.Remove(file)
+		setErr(fmt.Errorf("%s: %s", file, err))
+		return -1
+	}
+	return addHandle(h)
+}
+
+// unikmer_write writes n k-mers (codes or hashes), taxids are needed
+// if the file is created with the flag 8 (include taxid).
+// It returns 0, or -1 on error.
+//
+//export unikmer_write
+func unikmer_write(id C.int64_t, codes *C.uint64_t, taxids *C.uint32_t, n C.int64_t) C.int {
+	h, err := getHandle(id)
+	if err == nil && h.writer == nil {
+		err = errors.New("handle not opened for writing")
+	}
+	if err == nil && taxids == nil && h.writer.Flag&unik.UnikIncludeTaxID > 0 {
+		err = errors.New("taxids needed for files including taxids")
+	}
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	_codes := unsafe.Slice((*uint64)(unsafe.Pointer(codes)), int(n))
+	if taxids != nil && h.writer.Flag&unik.UnikIncludeTaxID > 0 {
+		_taxids := unsafe.Slice((*uint32)(unsafe.Pointer(taxids)), int(n))
+		for i, code := range _codes {
+			if err = h.writer.WriteCodeWithTaxid(code, _taxids[i]); err != nil {
+				break
+			}
+		}
+	} else {
+		for _, code := range _codes {
+			if err = h.writer.WriteCode(code); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		setErr(fmt.Errorf("%s: %s", h.file, err))
+		return -1
+	}
+	return 0
+}
+
+func (h *handle) close() error {
+	var err error
+	if h.writer != nil {
+		err = h.writer.Flush()
+	}
+	if h.bw != nil {
+		if _err := h.bw.Flush(); err == nil {
+			err = _err
+		}
+	}
+	if h.gw != nil {
+		if _err := h.gw.Close(); err == nil {
+			err = _err
+		}
+	}
+	if h.gr != nil {
+		h.gr.Close()
+	}
+	if _err := h.fh.Close(); err == nil {
+		err = _err
+	}
+	return err
+}
+
+// unikmer_close closes a handle, data are flushed for files opened for writing.
+// It returns 0, or -1 on error.
+//
+//export unikmer_close
+func unikmer_close(id C.int64_t) C.int {
+	h, err := getHandle(id)
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+
+	mu.Lock()
+	delete(handles, int64(id))
+	mu.Unlock()
+
+	if err = h.close(); err != nil {
+		setErr(fmt.Errorf("%s: %s", h.file, err))
+		return -1
+	}
+	return 0
+}
+
+// unikmer_encode encodes a k-mer of length k (k <= 32) into code.
+// It returns 0, or -1 on error.
+//
+//export unikmer_encode
+func unikmer_encode(kmer *C.char, k C.int, code *C.uint64_t) C.int {
+	if k <= 0 || k > 32 {
+		setErr(kmers.ErrKOverflow)
+		return -1
+	}
+	c, err := kmers.Encode(C.GoBytes(unsafe.Pointer(kmer), k))
+	if err != nil {
+		setErr(err)
+		return -1
+	}
+	*code = C.uint64_t(c)
+	return 0
+}
+
+// unikmer_decode decodes a code into a k-mer of length k (k <= 32),
+// buf should have at least k+1 bytes, and the k-mer is NUL-terminated.
+// It returns 0, or -1 on error.
+//
+//export unikmer_decode
+func unikmer_decode(code C.uint64_t, k C.int, buf *C.char) C.int {
+	if k <= 0 || k > 32 {
+		setErr(kmers.ErrKOverflow)
+		return -1
+	}
+	if uint64(code) > kmers.MaxCode[k] {
+		setErr(kmers.ErrCodeOverflow)
+		return -1
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(k)+1)
+	copy(b, kmers.MustDecode(uint64(code), int(k)))
+	b[k] = 0
+	return 0
+}
+
+func main() {}
@@ -0,0 +1,918 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var apiCmd = &cobra.Command{
+	Use:   "api",
+	Short: "Run a local REST server for count/inter/diff/grep jobs",
+	Long: `Run a local REST server for count/inter/diff/grep jobs
+
+This command starts an HTTP server exposing some subcommands as jobs,
+for integrating unikmer into LIMS or web services without wrapping the
+command line and parsing logs. Every job is run with this executable
+in its own directory in --work-dir, and jobs are queued and run with
+at most --max-jobs jobs at the same time.
+
+Endpoints (the OpenAPI 3 definition is served at /openapi.json):
+
+  POST   /jobs                  submit a job
+  GET    /jobs                  list jobs
+  GET    /jobs/{id}             status of a job, including output files
+  GET    /jobs/{id}/log         log (stdout and stderr) of a job
+  GET    /jobs/{id}/result      download the main output file
+  GET    /jobs/{id}/files/{f}   download an output file
+  DELETE /jobs/{id}             cancel a job and remove its directory
+
+Submitting jobs:
+  1. JSON body (Content-Type: application/json), with input files
+     referenced by paths:
+       {"command": "diff", "args": ["-s"], "inputs": ["a.unik", "b.unik"]}
+  2. multipart/form-data, with fields "command", "args" (repeatable) and
+     "inputs" (repeatable), and uploaded files. Files uploaded in parts
+     named "input" are appended to the input list in order, while those
+     in parts named "file" are only saved, e.g., for query files of grep.
+     Uploaded files are saved as "inputs/<file name>" in the job
+     directory, which can be referred to in "args".
+     As web pages can post forms to local servers, multipart/form-data
+     is only accepted when the server is started with --token.
+
+Attention:
+  1. Paths in "inputs" are relative to --data-root, and not allowed to
+     point outside of it. Path references are disabled if --data-root
+     is not given.
+  2. The output is always written to files with a prefix of "result"
+     in the job directory, so -o/--out-prefix is not allowed in "args".
+  3. Only some flags of each subcommand are allowed in "args", and most
+     global flags are not (e.g., --config, -i/--infile-list, -j/--threads,
+     and --cpu-profile). Files in values of flags should be uploaded files
+     ("inputs/<file name>"), or paths relative to --data-root. Output files
+     in values of flags should be plain file names, saved in the job
+     directory. Short flags and values should be given as separate args,
+     e.g., ["-k", "21"] or ["--kmer-len=21"], not ["-k21"].
+  4. With --token, all requests should have the header
+     "Authorization: Bearer <token>". The server is designed for trusted
+     local clients, please do not expose it to public networks.
+  5. Requests larger than --max-request-size are rejected, and files
+     uploaded in them are removed.
+  6. Jobs are kept in memory, and lost after the server exits, while job
+     directories are left in --work-dir.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr := getFlagNonEmptyString(cmd, "addr")
+		workDir := getFlagNonEmptyString(cmd, "work-dir")
+		dataRoot := getFlagString(cmd, "data-root")
+		maxJobs := getFlagPositiveInt(cmd, "max-jobs")
+		maxQueue := getFlagPositiveInt(cmd, "max-queue")
+		token := getFlagString(cmd, "token")
+		maxRequestSize, err := ParseByteSize(getFlagString(cmd, "max-request-size"))
+		if err != nil || maxRequestSize <= 0 {
+			checkError(fmt.Errorf("invalid value of flag --max-request-size: %s", getFlagString(cmd, "max-request-size")))
+		}
+
+		exe, err := os.Executable()
+		checkError(err)
+
+		checkError(os.MkdirAll(workDir, 0777))
+		workDir, err = filepath.Abs(workDir)
+		checkError(err)
+		if dataRoot != "" {
+			dataRoot, err = filepath.Abs(dataRoot)
+			checkError(err)
+		}
+
+		s := &apiServer{
+			exe:      exe,
+			workDir:  workDir,
+			dataRoot: dataRoot,
+			token:    token,
+			maxSize:  int64(maxRequestSize),
+			jobs:     make(map[string]*apiJob),
+			queue:    make(chan *apiJob, maxQueue),
+		}
+		for i := 0; i < maxJobs; i++ {
+			go s.worker()
+		}
+
+		log.Infof("unikmer api listening on http://%s, job directory: %s", addr, workDir)
+		checkError(http.ListenAndServe(addr, s))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(apiCmd)
+
+	apiCmd.Flags().StringP("addr", "", "127.0.0.1:8080", "address to listen on")
+	apiCmd.Flags().StringP("work-dir", "", "unikmer-api-jobs", "directory for saving job directories")
+	apiCmd.Flags().StringP("data-root", "", "", `root directory of input files referenced by paths, path references are disabled if not given`)
+	apiCmd.Flags().IntP("max-jobs", "", 1, "maximum number of jobs running at the same time")
+	apiCmd.Flags().IntP("max-queue", "", 1000, "maximum number of queued jobs")
+	apiCmd.Flags().StringP("max-request-size", "", "1G", `maximum size of a request body, including uploaded files, supported units: K, M, G`)
+	apiCmd.Flags().StringP("token", "", "", `token for authorizing requests with the header "Authorization: Bearer <token>", required for multipart/form-data submissions`)
+}
+
+// kinds of flags allowed in args of jobs.
+const (
+	apiFlagBool   = iota
+	apiFlagValue  // any value
+	apiFlagInput  // input files, uploaded or under --data-root, comma-separated
+	apiFlagOutput // a plain file name in the job directory
+)
+
+// apiFlag is a flag allowed in args of jobs.
+type apiFlag struct {
+	long  string
+	short string
+	kind  int
+}
+
+// global flags allowed in args of all jobs, others like --config,
+// --cpu-profile and -i/--infile-list are not allowed as they access
+// files outside of the job directory.
+var apiGlobalFlags = []apiFlag{
+	{"verbose", "", apiFlagBool},
+	{"compact", "c", apiFlagBool},
+	{"no-compress", "C", apiFlagBool},
+	{"compression-level", "", apiFlagValue},
+	{"ignore-taxid", "I", apiFlagBool},
+	{"max-taxid", "", apiFlagValue},
+}
+
+// subcommands available as jobs, and flags allowed in their args.
+var apiCommands = map[string][]apiFlag{
+	"count": {
+		{"seq-name-filter", "B", apiFlagValue},
+		{"kmer-len", "k", apiFlagValue},
+		{"canonical", "K", apiFlagBool},
+		{"strand-specific", "", apiFlagBool},
+		{"sort", "s", apiFlagBool},
+		{"taxid", "t", apiFlagValue},
+		{"parse-taxid", "T", apiFlagBool},
+		{"parse-taxid-regexp", "r", apiFlagValue},
+		{"repeated", "d", apiFlagBool},
+		{"unique", "u", apiFlagBool},
+		{"more-verbose", "V", apiFlagBool},
+		{"hash", "H", apiFlagBool},
+		{"circular", "", apiFlagBool},
+		{"bed", "", apiFlagInput},
+		{"filter-file", "", apiFlagInput},
+		{"read1", "1", apiFlagInput},
+		{"read2", "2", apiFlagInput},
+		{"interleaved", "", apiFlagBool},
+		{"properly-paired-only", "", apiFlagBool},
+		{"scale", "D", apiFlagValue},
+		{"minimizer-w", "W", apiFlagValue},
+		{"syncmer-s", "S", apiFlagValue},
+		{"linear", "l", apiFlagBool},
+		{"chunk-size", "m", apiFlagValue},
+		{"max-open-files", "", apiFlagValue},
+	},
+	"inter": {
+		{"mix-taxid", "m", apiFlagBool},
+		{"seq-file", "s", apiFlagInput},
+		{"scale", "D", apiFlagValue},
+		{"require-sorted", "", apiFlagBool},
+		{"auto-rescale", "", apiFlagBool},
+		{"skip-err", "e", apiFlagBool},
+		{"skipped-list", "", apiFlagOutput},
+	},
+	"diff": {
+		{"sort", "s", apiFlagBool},
+		{"compare-taxid", "t", apiFlagBool},
+		{"min-exclusive-fraction", "", apiFlagValue},
+		{"fraction-action", "", apiFlagValue},
+		{"exclusive-summary", "", apiFlagOutput},
+		{"removal-summary", "", apiFlagOutput},
+		{"out-format", "", apiFlagValue},
+		{"scale", "D", apiFlagValue},
+		{"require-sorted", "", apiFlagBool},
+		{"auto-rescale", "", apiFlagBool},
+		{"skip-err", "e", apiFlagBool},
+		{"skipped-list", "", apiFlagOutput},
+	},
+	"grep": {
+		{"query", "q", apiFlagValue},
+		{"query-file", "f", apiFlagInput},
+		{"query-unik-file", "F", apiFlagInput},
+		{"query-fasta", "Q", apiFlagInput},
+		{"query-is-taxid", "t", apiFlagBool},
+		{"query-is-code", "", apiFlagBool},
+		{"degenerate", "D", apiFlagBool},
+		{"max-mismatch", "M", apiFlagValue},
+		{"max-mismatch-kmers", "", apiFlagValue},
+		{"invert-match", "v", apiFlagBool},
+		{"report", "", apiFlagValue},
+		{"min-matches", "", apiFlagValue},
+		{"min-match-frac", "", apiFlagValue},
+		{"out-format", "", apiFlagValue},
+		{"multiple-outfiles", "m", apiFlagBool},
+		{"out-dir", "O", apiFlagOutput},
+		{"out-suffix", "S", apiFlagOutput},
+		{"force", "", apiFlagBool},
+		{"sort", "s", apiFlagBool},
+		{"unique", "u", apiFlagBool},
+		{"repeated", "d", apiFlagBool},
+		{"query-set", "", apiFlagValue},
+		{"query-set-threshold", "", apiFlagValue},
+		{"auto-rescale", "", apiFlagBool},
+		{"deterministic", "", apiFlagBool},
+	},
+}
+
+// prefix of output files of a job.
+const apiOutPrefix = "result"
+
+// name of the log file in a job directory.
+const apiLogFile = "job.log"
+
+// directory of uploaded files in a job directory.
+const apiInputDir = "inputs"
+
+const (
+	apiJobQueued   = "queued"
+	apiJobRunning  = "running"
+	apiJobDone     = "done"
+	apiJobFailed   = "failed"
+	apiJobCanceled = "canceled"
+)
+
+type apiJob struct {
+	ID        string   `json:"id"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Inputs    []string `json:"inputs"`
+	Status    string   `json:"status"`
+	ExitCode  int      `json:"exit_code"`
+	Error     string   `json:"error,omitempty"`
+	Submitted string   `json:"submitted"`
+	Started   string   `json:"started,omitempty"`
+	Finished  string   `json:"finished,omitempty"`
+	Files     []string `json:"files,omitempty"`
+
+	dir    string
+	cancel context.CancelFunc
+}
+
+type apiServer struct {
+	exe      string
+	workDir  string
+	dataRoot string
+	token    string
+	maxSize  int64 // maximum size of a request body
+
+	mu    sync.Mutex
+	jobs  map[string]*apiJob
+	n     int
+	queue chan *apiJob
+}
+
+func (s *apiServer) worker() {
+	for job := range s.queue {
+		s.mu.Lock()
+		if job.Status != apiJobQueued { // canceled
+			s.mu.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(interruptCtx)
+		job.cancel = cancel
+		job.Status = apiJobRunning
+		job.Started = time.Now().Format(time.RFC3339)
+		args := make([]string, 0, len(job.Args)+len(job.Inputs)+3)
+		args = append(args, job.Command)
+		args = append(args, job.Args...)
+		args = append(args, "-o", apiOutPrefix)
+		args = append(args, job.Inputs...)
+		dir := job.dir
+		s.mu.Unlock()
+
+		err := s.run(ctx, dir, args)
+		cancel()
+
+		s.mu.Lock()
+		job.cancel = nil
+		job.Finished = time.Now().Format(time.RFC3339)
+		if job.Status == apiJobRunning {
+			if err != nil {
+				job.Status = apiJobFailed
+				job.Error = err.Error()
+				if e, ok := err.(*exec.ExitError); ok {
+					job.ExitCode = e.ExitCode()
+				} else {
+					job.ExitCode = -1
+				}
+			} else {
+				job.Status = apiJobDone
+			}
+			job.Files = apiOutputFiles(dir)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// run runs a subcommand in the job directory, with stdout and stderr
+// saved in the log file.
+func (s *apiServer) run(ctx context.Context, dir string, args []string) error {
+	fh, err := os.Create(filepath.Join(dir, apiLogFile))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	c := exec.CommandContext(ctx, s.exe, args...)
+	c.Dir = dir
+	c.Stdout = fh
+	c.Stderr = fh
+	return c.Run()
+}
+
+// apiOutputFiles returns names of files in a job directory, excluding
+// uploaded files.
+func apiOutputFiles(dir string) []string {
+	files := make([]string, 0, 4)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			if rel == apiInputDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+		apiError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "openapi.json" {
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, apiOpenAPI)
+		return
+	}
+
+	items := strings.Split(path, "/")
+	if items[0] != "jobs" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case len(items) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.listJobs(w)
+		case http.MethodPost:
+			s.submitJob(w, r)
+		default:
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	case len(items) == 2 && r.Method == http.MethodDelete:
+		s.deleteJob(w, items[1])
+		return
+	case r.Method != http.MethodGet:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.Lock()
+	job, ok := s.jobs[items[1]]
+	var snapshot apiJob
+	if ok {
+		snapshot = *job
+	}
+	s.mu.Unlock()
+	if !ok {
+		apiError(w, http.StatusNotFound, "job not found: "+items[1])
+		return
+	}
+
+	switch {
+	case len(items) == 2:
+		apiJSON(w, http.StatusOK, snapshot)
+	case len(items) == 3 && items[2] == "log":
+		if snapshot.Status == apiJobQueued {
+			apiError(w, http.StatusConflict, "job not started yet")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(snapshot.dir, apiLogFile))
+	case len(items) == 3 && items[2] == "result":
+		if snapshot.Status != apiJobDone {
+			apiError(w, http.StatusConflict, "job not done: "+snapshot.Status)
+			return
+		}
+		for _, file := range snapshot.Files {
+			if strings.HasPrefix(file, apiOutPrefix) {
+				s.serveFile(w, r, snapshot.dir, file)
+				return
+			}
+		}
+		apiError(w, http.StatusNotFound, "no result file")
+	case len(items) >= 4 && items[2] == "files":
+		file := strings.Join(items[3:], "/")
+		for _, f := range snapshot.Files {
+			if f == file {
+				s.serveFile(w, r, snapshot.dir, file)
+				return
+			}
+		}
+		apiError(w, http.StatusNotFound, "file not found: "+file)
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *apiServer) serveFile(w http.ResponseWriter, r *http.Request, dir string, file string) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(file)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, filepath.Join(dir, filepath.FromSlash(file)))
+}
+
+func (s *apiServer) listJobs(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]apiJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	apiJSON(w, http.StatusOK, jobs)
+}
+
+func (s *apiServer) deleteJob(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		apiError(w, http.StatusNotFound, "job not found: "+id)
+		return
+	}
+	if job.Status == apiJobQueued || job.Status == apiJobRunning {
+		job.Status = apiJobCanceled
+		if job.cancel != nil {
+			job.cancel()
+		}
+	}
+	delete(s.jobs, id)
+	dir := job.dir
+	s.mu.Unlock()
+
+	// the process of a running job is killed, wait a while before
+	// removing the directory.
+	go func() {
+		time.Sleep(time.Second)
+		if err := removeAllWithRetry(dir); err != nil {
+			log.Warningf("fail to remove job directory: %s", dir)
+		}
+	}()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSubmission is the JSON body of a job submission.
+type apiSubmission struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Inputs  []string `json:"inputs"`
+}
+
+func (s *apiServer) submitJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.n++
+	id := strconv.Itoa(s.n)
+	s.mu.Unlock()
+
+	dir := filepath.Join(s.workDir, id)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize)
+	job, status, err := s.parseSubmission(r, dir)
+	if err != nil {
+		// the error type of http.MaxBytesReader is not exported in go1.17.
+		if strings.Contains(err.Error(), "http: request body too large") {
+			status = http.StatusRequestEntityTooLarge
+		}
+		removeAllWithRetry(dir)
+		apiError(w, status, err.Error())
+		return
+	}
+	job.ID = id
+	job.dir = dir
+	job.Status = apiJobQueued
+	job.Submitted = time.Now().Format(time.RFC3339)
+
+	s.mu.Lock()
+	select {
+	case s.queue <- job:
+		s.jobs[id] = job
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		removeAllWithRetry(dir)
+		apiError(w, http.StatusServiceUnavailable, "too many queued jobs")
+		return
+	}
+
+	s.mu.Lock()
+	snapshot := *job
+	s.mu.Unlock()
+	apiJSON(w, http.StatusCreated, snapshot)
+}
+
+// parseSubmission parses a submission in JSON or multipart/form-data,
+// uploaded files are saved in the job directory.
+func (s *apiServer) parseSubmission(r *http.Request, dir string) (*apiJob, int, error) {
+	var sub apiSubmission
+	var uploaded []string
+
+	// forms can be posted by any web page to the local server without
+	// preflight requests of CORS, so they are only accepted with a token.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+	case "multipart/form-data":
+		if s.token == "" {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("multipart/form-data is only accepted when the server is started with --token")
+		}
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type: %q, please use application/json or multipart/form-data", mediaType)
+	}
+
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		names := make(map[string]struct{})
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+
+			name := part.FormName()
+			if name != "input" && name != "file" {
+				value, err := io.ReadAll(io.LimitReader(part, 1<<20))
+				if err != nil {
+					return nil, http.StatusBadRequest, err
+				}
+				switch name {
+				case "command":
+					sub.Command = string(value)
+				case "args":
+					sub.Args = append(sub.Args, string(value))
+				case "inputs":
+					sub.Inputs = append(sub.Inputs, string(value))
+				default:
+					return nil, http.StatusBadRequest, fmt.Errorf("unknown field: %s", name)
+				}
+				continue
+			}
+
+			base := filepath.Base(filepath.Clean("/" + filepath.FromSlash(part.FileName())))
+			if base == "" || base == "." || base == string(filepath.Separator) {
+				return nil, http.StatusBadRequest, fmt.Errorf("invalid file name: %s", part.FileName())
+			}
+			if _, ok := names[base]; ok {
+				return nil, http.StatusBadRequest, fmt.Errorf("duplicate file name: %s", base)
+			}
+			names[base] = struct{}{}
+
+			if err = os.MkdirAll(filepath.Join(dir, apiInputDir), 0777); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			file := apiInputDir + "/" + base
+			fh, err := os.Create(filepath.Join(dir, filepath.FromSlash(file)))
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			_, err = io.Copy(fh, part)
+			fh.Close()
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			if name == "input" {
+				uploaded = append(uploaded, file)
+			}
+		}
+	} else {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&sub); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %s", err)
+		}
+	}
+
+	if _, ok := apiCommands[sub.Command]; !ok {
+		return nil, http.StatusBadRequest, fmt.Errorf("unsupported command: %q, available: count, inter, diff, grep", sub.Command)
+	}
+	args, err := s.checkArgs(sub.Command, sub.Args, dir)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	inputs := make([]string, 0, len(sub.Inputs)+len(uploaded))
+	if len(sub.Inputs) > 0 {
+		if s.dataRoot == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("path references are disabled, please upload files")
+		}
+		for _, file := range sub.Inputs {
+			path := filepath.Join(s.dataRoot, filepath.Clean("/"+filepath.FromSlash(file)))
+			if _, err := os.Stat(path); err != nil {
+				return nil, http.StatusBadRequest, fmt.Errorf("input file not found: %s", file)
+			}
+			inputs = append(inputs, path)
+		}
+	}
+	inputs = append(inputs, uploaded...)
+	if len(inputs) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no input files given")
+	}
+
+	return &apiJob{Command: sub.Command, Args: args, Inputs: inputs}, 0, nil
+}
+
+// checkArgs checks args of a job with the allowlist of flags of the command,
+// and returns args with values of input files resolved. Flags should be
+// given separately, and values of short flags can't be attached,
+// e.g., "-k 21" and "--kmer-len=21" are fine, while "-k21" and "-Ks" are not.
+func (s *apiServer) checkArgs(command string, args []string, dir string) ([]string, error) {
+	flags := make(map[string]apiFlag, 64)
+	for _, fs := range [][]apiFlag{apiGlobalFlags, apiCommands[command]} {
+		for _, f := range fs {
+			flags["--"+f.long] = f
+			if f.short != "" {
+				flags["-"+f.short] = f
+			}
+		}
+	}
+
+	_args := make([]string, 0, len(args))
+	var arg, name, value string
+	var hasValue bool
+	for i := 0; i < len(args); i++ {
+		arg = args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			return nil, fmt.Errorf("positional arguments are not allowed in args, please use inputs: %q", arg)
+		}
+
+		name, value, hasValue = arg, "", false
+		if j := strings.Index(arg, "="); j > 0 {
+			name, value, hasValue = arg[:j], arg[j+1:], true
+		}
+		if !strings.HasPrefix(name, "--") && len(name) > 2 {
+			return nil, fmt.Errorf("please give short flags and their values as separate args: %q", arg)
+		}
+		f, ok := flags[name]
+		if !ok {
+			return nil, fmt.Errorf("flag not allowed for %s jobs: %q", command, name)
+		}
+
+		if f.kind == apiFlagBool {
+			if hasValue {
+				if _, err := strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid value of flag %s: %q", name, value)
+				}
+			}
+			_args = append(_args, arg)
+			continue
+		}
+
+		if !hasValue {
+			i++
+			if i == len(args) {
+				return nil, fmt.Errorf("value of flag %s needed", name)
+			}
+			value = args[i]
+		}
+
+		switch f.kind {
+		case apiFlagInput:
+			files := strings.Split(value, ",")
+			for j, file := range files {
+				path, err := s.resolveInput(file, dir)
+				if err != nil {
+					return nil, fmt.Errorf("flag %s: %s", name, err)
+				}
+				files[j] = path
+			}
+			value = strings.Join(files, ",")
+		case apiFlagOutput:
+			if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+				return nil, fmt.Errorf("value of flag %s should be a file name without directories: %q", name, value)
+			}
+		}
+		_args = append(_args, "--"+f.long+"="+value)
+	}
+	return _args, nil
+}
+
+// resolveInput returns the path of an input file, which should be an
+// uploaded file in "inputs/", or a file under --data-root.
+func (s *apiServer) resolveInput(file string, dir string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(file)))
+	if strings.HasPrefix(clean, apiInputDir+"/") {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(clean))); err == nil {
+			return clean, nil
+		}
+	}
+	if s.dataRoot == "" {
+		return "", fmt.Errorf("uploaded file not found and path references are disabled: %s", file)
+	}
+	path := filepath.Join(s.dataRoot, filepath.Clean("/"+filepath.FromSlash(file)))
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("input file not found: %s", file)
+	}
+	return path, nil
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	apiJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiOpenAPI is the OpenAPI 3 definition of the server.
+var apiOpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {"title": "unikmer api", "version": "` + VERSION + `"},
+  "security": [{}, {"bearer": []}],
+  "paths": {
+    "/jobs": {
+      "get": {
+        "summary": "List jobs",
+        "responses": {"200": {"description": "jobs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}}}
+      },
+      "post": {
+        "summary": "Submit a job",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/Submission"}},
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "command": {"type": "string", "enum": ["count", "inter", "diff", "grep"]},
+                  "args": {"type": "array", "items": {"type": "string"}},
+                  "inputs": {"type": "array", "items": {"type": "string"}},
+                  "input": {"type": "array", "items": {"type": "string", "format": "binary"}, "description": "uploaded files appended to input files"},
+                  "file": {"type": "array", "items": {"type": "string", "format": "binary"}, "description": "uploaded files only saved in inputs/"}
+                },
+                "required": ["command"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {"description": "job queued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/ID"}],
+      "get": {
+        "summary": "Get the status of a job",
+        "responses": {"200": {"description": "job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Cancel a job and remove its directory",
+        "responses": {"204": {"description": "deleted"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/log": {
+      "parameters": [{"$ref": "#/components/parameters/ID"}],
+      "get": {
+        "summary": "Get the log of a job",
+        "responses": {"200": {"description": "log", "content": {"text/plain": {"schema": {"type": "string"}}}}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/result": {
+      "parameters": [{"$ref": "#/components/parameters/ID"}],
+      "get": {
+        "summary": "Download the main output file of a finished job",
+        "responses": {"200": {"description": "file", "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/files/{file}": {
+      "parameters": [{"$ref": "#/components/parameters/ID"}, {"name": "file", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Download an output file of a job",
+        "responses": {"200": {"description": "file", "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "description": "only required when the server is started with --token"}
+    },
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}}
+    },
+    "schemas": {
+      "Submission": {
+        "type": "object",
+        "properties": {
+          "command": {"type": "string", "enum": ["count", "inter", "diff", "grep"]},
+          "args": {"type": "array", "items": {"type": "string"}},
+          "inputs": {"type": "array", "items": {"type": "string"}, "description": "paths relative to --data-root"}
+        },
+        "required": ["command", "inputs"]
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "command": {"type": "string"},
+          "args": {"type": "array", "items": {"type": "string"}},
+          "inputs": {"type": "array", "items": {"type": "string"}},
+          "status": {"type": "string", "enum": ["queued", "running", "done", "failed", "canceled"]},
+          "exit_code": {"type": "integer"},
+          "error": {"type": "string"},
+          "submitted": {"type": "string", "format": "date-time"},
+          "started": {"type": "string", "format": "date-time"},
+          "finished": {"type": "string", "format": "date-time"},
+          "files": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,211 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/kmers"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var attrCmd = &cobra.Command{
+	Use:   "attr",
+	Short: "Compute attributes of k-mers, e.g., GC content and entropy",
+	Long: `Compute attributes of k-mers, e.g., GC content and entropy
+
+Attributes:
+  gc           GC content, in range of [0, 1]
+  entropy      Shannon entropy of base composition in bits, in range of [0, 2]
+  homopolymer  length of the longest homopolymer
+  palindrome   whether the k-mer equals its reverse complement (-p/--palindrome)
+
+Attentions:
+  1. K-mers are processed in a streaming way, and only k-mers
+     (not hashed) are supported.
+  2. Values are rounded to 4 decimal places.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-file")
+		palindrome := getFlagBool(cmd, "palindrome")
+		showTaxid := getFlagBool(cmd, "show-taxid") && !opt.IgnoreTaxid
+		format := getFlagTableFormat(cmd)
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		colnames := []string{"kmer"}
+		if showTaxid {
+			colnames = append(colnames, "taxid")
+		}
+		colnames = append(colnames, "gc", "entropy", "homopolymer")
+		if palindrome {
+			colnames = append(colnames, "palindrome")
+		}
+		tw := newTableWriter(outfh, format, colnames)
+		tw.WriteHeader()
+
+		values := make([]interface{}, 0, len(colnames))
+
+		var infh *bufio.Reader
+		var r *os.File
+		var reader *unik.Reader
+		var k int
+		var code uint64
+		var taxid uint32
+		var kmer []byte
+		var gc, entropy float64
+		var maxRun int
+
+		for _, file := range files {
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err = unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				if reader.IsHashed() {
+					checkError(fmt.Errorf("hashed k-mers are not supported: %s", file))
+				}
+				if showTaxid && !reader.HasTaxidInfo() {
+					checkError(fmt.Errorf("no taxids found in file: %s", file))
+				}
+				k = reader.K
+
+				for {
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					kmer = kmers.MustDecode(code, k)
+					gc, entropy, maxRun = kmerAttributes(kmer)
+
+					values = values[:0]
+					values = append(values, string(kmer))
+					if showTaxid {
+						values = append(values, taxid)
+					}
+					values = append(values, roundFloat(gc, 4), roundFloat(entropy, 4), maxRun)
+					if palindrome {
+						values = append(values, code == kmers.MustRevComp(code, k))
+					}
+					tw.WriteRecord(values...)
+				}
+			}()
+		}
+	},
+}
+
+// kmerAttributes returns the GC content, Shannon entropy of base composition,
+// and the length of the longest homopolymer of a k-mer.
+func kmerAttributes(kmer []byte) (gc float64, entropy float64, maxRun int) {
+	var counts [4]int // A, C, G, T
+	var run int
+	var prev byte
+	for i, b := range kmer {
+		switch b {
+		case 'A':
+			counts[0]++
+		case 'C':
+			counts[1]++
+		case 'G':
+			counts[2]++
+		case 'T':
+			counts[3]++
+		}
+
+		if i > 0 && b == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > maxRun {
+			maxRun = run
+		}
+		prev = b
+	}
+
+	k := float64(len(kmer))
+	gc = float64(counts[1]+counts[2]) / k
+
+	var p float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p = float64(c) / k
+		entropy -= p * math.Log2(p)
+	}
+	return gc, entropy, maxRun
+}
+
+func roundFloat(v float64, n int) float64 {
+	p := math.Pow10(n)
+	return math.Round(v*p) / p
+}
+
+func init() {
+	RootCmd.AddCommand(attrCmd)
+
+	attrCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	attrCmd.Flags().BoolP("palindrome", "p", false, `output whether k-mers are reverse-complement palindromes`)
+	attrCmd.Flags().BoolP("show-taxid", "t", false, "show taxid")
+	attrCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var checksortedCmd = &cobra.Command{
+	Use:   "checksorted",
+	Short: "Check whether k-mers in binary files are sorted",
+	Long: `Check whether k-mers in binary files are sorted
+
+K-mers of each file are read in a streaming way and compared with the
+previous ones, and the checking of a file stops at the first k-mer out
+of order. Several commands assume inputs are sorted, and a wrong 'sorted'
+flag in the header leads to subtly wrong results.
+
+Output columns:
+  file          file name
+  sorted-flag   whether the 'sorted' flag is set in the header
+  in-order      whether k-mers are in ascending order (duplicates allowed)
+  kmers         number of k-mers checked
+  offset        offset (0-based) of the first k-mer out of order, -1 for none
+
+The exit status is 1 if k-mers of any file with the 'sorted' flag
+are not in order.
+
+Tips:
+  1. Use --require-sorted in commands consuming sorted files, including
+     inter, diff, xor, merge, tsplit, and concat, to validate the order
+     while reading.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-file")
+		onlyUnsorted := getFlagBool(cmd, "only-unsorted")
+		format := getFlagTableFormat(cmd)
+
+		type sortedInfo struct {
+			flag    bool
+			inOrder bool
+			n       uint64
+			offset  int64
+		}
+		infos := make([]sortedInfo, len(files))
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i, file := range files {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int, file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				infh, r, _, err := inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				info := sortedInfo{flag: reader.IsSorted(), inOrder: true, offset: -1}
+				var code, last uint64
+				for {
+					code, _, err = reader.ReadCodeWithTaxid()
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+					if info.n > 0 && code < last {
+						info.inOrder = false
+						info.offset = int64(info.n)
+						break
+					}
+					last = code
+					info.n++
+				}
+				infos[i] = info
+			}(i, file)
+		}
+		wg.Wait()
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"file", "sorted-flag", "in-order", "kmers", "offset"})
+		tw.WriteHeader()
+
+		var nBad int
+		for i, info := range infos {
+			if info.flag && !info.inOrder {
+				nBad++
+			}
+			if onlyUnsorted && info.inOrder {
+				continue
+			}
+			tw.WriteRecord(files[i], info.flag, info.inOrder, info.n, info.offset)
+		}
+		outfh.Flush()
+
+		if nBad > 0 {
+			log.Errorf("%d of %d files with the 'sorted' flag are not in order", nBad, len(files))
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checksortedCmd)
+
+	checksortedCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	checksortedCmd.Flags().BoolP("only-unsorted", "x", false, "only output files with k-mers not in order")
+	checksortedCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
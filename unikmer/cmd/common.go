@@ -32,7 +32,6 @@ import (
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts/sortutil"
 )
 
 var commonCmd = &cobra.Command{
@@ -126,7 +125,7 @@ Tips:
 			}
 			infh, r, _, err = inStream(files[0])
 			checkError(err)
-			defer r.Close()
+			defer closeInStream(r)
 
 			if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 				outFile += extDataFile
@@ -158,7 +157,7 @@ Tips:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -208,7 +207,7 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				var code uint64
 				var taxid, lca uint32
@@ -220,7 +219,7 @@ Tips:
 				if firstFile {
 					if hasTaxid {
 						for {
-							code, taxid, err = reader.ReadCodeWithTaxid()
+							code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 							if err != nil {
 								if err == io.EOF {
 									break
@@ -233,7 +232,7 @@ Tips:
 						}
 					} else {
 						for {
-							code, _, err = reader.ReadCodeWithTaxid()
+							code, _, err = readCodeWithTaxid(reader, opt.Sampler)
 							if err != nil {
 								if err == io.EOF {
 									break
@@ -251,7 +250,7 @@ Tips:
 
 				if hasTaxid {
 					for {
-						code, taxid, err = reader.ReadCodeWithTaxid()
+						code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
@@ -270,7 +269,7 @@ Tips:
 				}
 
 				for {
-					code, _, err = reader.ReadCodeWithTaxid()
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -339,9 +338,7 @@ Tips:
 		if opt.Verbose && len(codes) == 0 {
 			log.Infof("no shared k-mers found")
 		}
-
-		// sort.Sort(kmers.CodeSlice(codes))
-		sortutil.Uint64s(codes)
+		sortCodes(codes)
 
 		if hasTaxid || hasMixTaxid {
 			for _, code := range codes {
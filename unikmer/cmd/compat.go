@@ -0,0 +1,160 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var compatCmd = &cobra.Command{
+	Use:   "compat",
+	Short: "Check compatibility of binary files",
+	Long: `Check compatibility of binary files
+
+Headers of all files are compared with the first file (or the file given
+by -r/--ref-file), which is fast as only headers are read. It helps find
+incompatible files before long jobs start.
+
+Checked header fields:
+  k, canonical, hashed, scaled, scale, taxid-bytes
+
+Output columns:
+  file          file name
+  compatible    whether the file is compatible with the reference file
+  diffs         differences of fields, in format of "field: ref != this",
+                where taxid-bytes does not affect compatibility.
+
+The exit status is 1 if any incompatible file is found.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-file")
+		refFile := getFlagString(cmd, "ref-file")
+		onlyIncompatible := getFlagBool(cmd, "only-incompatible")
+		format := getFlagTableFormat(cmd)
+
+		readHeader := func(file string) *unik.Reader {
+			var infh *bufio.Reader
+			var r *os.File
+			infh, r, _, err = inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+			return reader
+		}
+
+		var reader0 *unik.Reader
+		if refFile != "" {
+			reader0 = readHeader(refFile)
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"file", "compatible", "diffs"})
+		tw.WriteHeader()
+
+		var reader *unik.Reader
+		var diffs []headerDiff
+		var compatible bool
+		var nIncompatible int
+		var diffStrs []string
+		for _, file := range files {
+			reader = readHeader(file)
+			if reader0 == nil {
+				reader0 = reader
+			}
+
+			diffs = compareHeaders(reader0, reader, false)
+			compatible = true
+			diffStrs = diffStrs[:0]
+			for _, d := range diffs {
+				if d.fatal {
+					compatible = false
+				}
+				diffStrs = append(diffStrs, d.String())
+			}
+			if !compatible {
+				nIncompatible++
+			} else if onlyIncompatible {
+				continue
+			}
+
+			tw.WriteRecord(file, compatible, strings.Join(diffStrs, "; "))
+		}
+		outfh.Flush()
+
+		if nIncompatible > 0 {
+			log.Errorf("%d of %d files are not compatible", nIncompatible, len(files))
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+			os.Exit(1)
+		}
+		if opt.Verbose {
+			log.Infof("all %d files are compatible", len(files))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(compatCmd)
+
+	compatCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	compatCmd.Flags().StringP("ref-file", "r", "", "reference file to compare with, default: the first input file")
+	compatCmd.Flags().BoolP("only-incompatible", "x", false, "only output incompatible files")
+	compatCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
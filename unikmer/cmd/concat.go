@@ -22,12 +22,17 @@ package cmd
 
 import (
 	"bufio"
+	"compress/flate"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
+	gzip "github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/taxdump"
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/spf13/cobra"
@@ -42,6 +47,24 @@ Attentions:
   1. The 'canonical/scaled/hashed' flags of all files should be consistent.
   2. Input files should ALL have or don't have taxid information.
 
+Removing duplicates of sorted k-mers (-u/--unique):
+  1. All input files should be sorted, i.e., produced by "unikmer sort",
+     or other commands with the flag -s/--sort.
+  2. K-mers are merged and deduplicated in a streaming pass, the output
+     is sorted. If there are more than -M/--max-open-files input files,
+     they are merged in two rounds, with temporary files in --tmp-dir.
+  3. Taxids of duplicated k-mers are replaced with their LCA.
+  4. Reading from stdin is not supported.
+
+Appending to an existing file (-a/--append):
+  1. K-mers are appended to the end of the output file, which should exist
+     and not be sorted. Headers of input files should be compatible with it.
+  2. Taxids are kept only if the output file includes taxids.
+  3. The number of k-mers in the header can only be updated for files not
+     gzipped. So for datasets built incrementally, please create the file
+     with -C/--no-compress. Gzipped files are only supported when the
+     number is not recorded, where a new gzip member is appended.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -61,12 +84,38 @@ Attentions:
 		}
 
 		checkFileSuffix(opt, extDataFile, files...)
+		if getFlagBool(cmd, "skip-err") {
+			files = skipErrFiles(opt, files, false, getFlagString(cmd, "skipped-list"), false)
+		} else {
+			preflightCheck(opt, files, false)
+		}
 
 		outFile := getFlagString(cmd, "out-prefix")
 		sortedKmers := getFlagBool(cmd, "sorted")
 		globalTaxid := getFlagUint32(cmd, "taxid")
 		hasGlobalTaxid := globalTaxid > 0
 		number := uint64(getFlagInt64(cmd, "number"))
+		unique := getFlagBool(cmd, "unique")
+		if unique && hasGlobalTaxid {
+			checkError(fmt.Errorf("flag -u/--unique and -t/--taxid are not compatible"))
+		}
+		writeScale := getFlagWriteScale(cmd)
+		requireSorted := getFlagBool(cmd, "require-sorted")
+		if requireSorted && !(sortedKmers || unique) {
+			checkError(fmt.Errorf("flag --require-sorted only works with -s/--sorted or -u/--unique"))
+		}
+		if writeScale > 0 && cmd.Flags().Changed("number") {
+			checkError(fmt.Errorf("flag -D/--scale and -n/--number are not compatible"))
+		}
+		appendMode := getFlagBool(cmd, "append")
+		if appendMode {
+			if unique || sortedKmers || hasGlobalTaxid || cmd.Flags().Changed("number") || writeScale > 0 {
+				checkError(fmt.Errorf("flag -a/--append is not compatible with -u/--unique, -s/--sorted, -t/--taxid, -n/--number and -D/--scale"))
+			}
+			if isStdout(outFile) {
+				checkError(fmt.Errorf("flag -o/--out-prefix needed when given -a/--append"))
+			}
+		}
 
 		if hasGlobalTaxid && opt.Verbose {
 			log.Warningf("discarding all taxids and assigning new global taxid: %d", globalTaxid)
@@ -75,6 +124,26 @@ Attentions:
 		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 			outFile += extDataFile
 		}
+		if appendMode {
+			n := concatAppend(opt, files, outFile)
+			if opt.Verbose {
+				log.Infof("%d k-mers appended to %s", n, outFile)
+			}
+			return
+		}
+		if unique {
+			maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
+			if maxOpenFiles < 2 {
+				checkError(fmt.Errorf("value of -M/--max-open-files should be >= 2"))
+			}
+			n := concatSortedUnique(opt, files, outFile, sortedKmers, writeScale, requireSorted,
+				maxOpenFiles, getTmpRoot(cmd), getTmpOptions(cmd, opt))
+			if opt.Verbose {
+				log.Infof("%d unique k-mers saved to %s", n, outFile)
+			}
+			return
+		}
+
 		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
 		checkError(err)
 		defer func() {
@@ -86,6 +155,7 @@ Attentions:
 		}()
 
 		var writer *unik.Writer
+		var scaler *writeScaler
 
 		var infh *bufio.Reader
 		var r *os.File
@@ -107,7 +177,7 @@ Attentions:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -143,6 +213,8 @@ Attentions:
 					if number > 0 {
 						writer.Number = number
 					}
+					scaler = newWriteScaler(writeScale, reader, file)
+					scaler.setHeader(writer)
 				} else {
 					checkCompatibility(reader0, reader, file)
 					if !hasGlobalTaxid && !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
@@ -155,15 +227,20 @@ Attentions:
 					}
 				}
 
+				checker := newSortedChecker(requireSorted, file)
 				if hasGlobalTaxid {
 					for {
-						code, _, err = reader.ReadCodeWithTaxid()
+						code, _, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
 							}
 							checkError(errors.Wrap(err, file))
 						}
+						checker.check(code)
+						if !scaler.keep(code) {
+							continue
+						}
 
 						checkError(writer.WriteCode(code))
 						n++
@@ -173,13 +250,17 @@ Attentions:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
 						}
 						checkError(errors.Wrap(err, file))
 					}
+					checker.check(code)
+					if !scaler.keep(code) {
+						continue
+					}
 
 					checkError(writer.WriteCodeWithTaxid(code, taxid))
 					n++
@@ -209,4 +290,231 @@ func init() {
 	concatCmd.Flags().BoolP("sorted", "s", false, "input k-mers are sorted")
 	concatCmd.Flags().Uint32P("taxid", "t", 0, "global taxid")
 	concatCmd.Flags().Int64P("number", "n", -1, "number of k-mers")
+	concatCmd.Flags().BoolP("unique", "u", false, "remove duplicates of sorted k-mers, all input files should be sorted")
+	concatCmd.Flags().BoolP("append", "a", false, "append k-mers to the existing output file, which should not be sorted")
+	concatCmd.Flags().IntP("scale", "D", 0, helpWriteScale)
+	concatCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
+	concatCmd.Flags().BoolP("skip-err", "e", false, helpSkipErr)
+	concatCmd.Flags().StringP("skipped-list", "", "", "file for saving names of files skipped by -e/--skip-err")
+
+	concatCmd.Flags().IntP("max-open-files", "M", 400, `max number of open files when given -u/--unique`)
+	concatCmd.Flags().StringP("tmp-dir", "", "./", `directory for intermediate files when given -u/--unique, the environment variable `+envTmpDir+` is used if not given`)
+	concatCmd.Flags().StringP("tmp-compress", "", "auto", `compress intermediate files or not, available: auto (same as the output), yes, no`)
+	concatCmd.Flags().IntP("tmp-compression-level", "", flate.DefaultCompression, `compression level of intermediate files, the global --compression-level is used if not given`)
+	concatCmd.Flags().StringP("tmp-io-limit", "", "", `maximum speed (bytes per second) of writing intermediate files, supports K/M/G suffix, e.g., 100M. 0 or empty for no limit`)
+}
+
+// headerSkipper discards data written when skip is true,
+// it's used to avoid writing a second header when appending k-mers.
+type headerSkipper struct {
+	w    io.Writer
+	skip bool
+}
+
+func (s *headerSkipper) Write(p []byte) (int, error) {
+	if s.skip {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+// concatAppend appends k-mers of files to an existing unsorted binary file,
+// it returns the number of appended k-mers.
+func concatAppend(opt *Options, files []string, outFile string) int64 {
+	// header of the existing file
+	infh, r, gzipped, err := inStream(outFile)
+	checkError(errors.Wrap(err, outFile))
+	reader0, err := unik.NewReader(infh)
+	checkError(errors.Wrap(err, outFile))
+	closeInStream(r)
+
+	if reader0.IsSorted() {
+		checkError(fmt.Errorf("can not append k-mers to a sorted file: %s", outFile))
+	}
+	updateNumber := reader0.Number > 0 && reader0.Number != ^uint64(0)
+	if updateNumber && gzipped {
+		checkError(fmt.Errorf("can not update the number of k-mers in header of a gzipped file, please create it with -C/--no-compress for appending: %s", outFile))
+	}
+	hasTaxid := !opt.IgnoreTaxid && reader0.IsIncludeTaxid()
+
+	for _, file := range files {
+		if filepath.Clean(file) == filepath.Clean(outFile) {
+			checkError(fmt.Errorf("input file should not be the output file: %s", file))
+		}
+	}
+
+	fh, err := os.OpenFile(outFile, os.O_WRONLY|os.O_APPEND, 0644)
+	checkError(errors.Wrap(err, outFile))
+	var gw io.WriteCloser
+	skipper := &headerSkipper{w: fh, skip: true}
+	if gzipped {
+		gw, err = gzip.NewWriterLevel(fh, opt.CompressionLevel)
+		checkError(errors.Wrap(err, outFile))
+		skipper.w = gw
+	}
+	outfh := bufio.NewWriterSize(skipper, BufferSize)
+
+	writer, err := unik.NewWriter(outfh, reader0.K, reader0.Flag)
+	checkError(errors.Wrap(err, outFile))
+	writer.SetMaxTaxid(maxUint32N(reader0.GetTaxidBytesLength())) // follow the existing file
+	checkError(writer.WriteHeader())
+	checkError(outfh.Flush())
+	skipper.skip = false
+
+	var n int64
+	var code uint64
+	var taxid uint32
+	var nfiles = len(files)
+	for i, file := range files {
+		if opt.Verbose {
+			log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+		}
+
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			checkCompatibility(reader0, reader, file)
+			if hasTaxid && !reader.HasTaxidInfo() {
+				checkError(fmt.Errorf(`taxid information found in the output file, but missing in this: %s`, file))
+			}
+
+			for {
+				code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				checkError(writer.WriteCodeWithTaxid(code, taxid))
+				n++
+			}
+		}()
+	}
+
+	checkError(writer.Flush())
+	checkError(outfh.Flush())
+	if gw != nil {
+		checkError(gw.Close())
+	}
+
+	if updateNumber {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, reader0.Number+uint64(n))
+		checkError(errors.Wrap(fh.Close(), outFile))
+		fh, err = os.OpenFile(outFile, os.O_WRONLY, 0644)
+		checkError(errors.Wrap(err, outFile))
+		_, err = fh.WriteAt(buf, 16) // magic number (8 bytes), meta info (4 bytes), flags (4 bytes)
+		checkError(errors.Wrap(err, outFile))
+	}
+	checkError(fh.Close())
+
+	return n
+}
+
+// concatSortedUnique merges sorted k-mers from multiple files and removes
+// duplicates, it returns the number of unique k-mers. If there are more than
+// maxOpenFiles files, they are merged in batches into temporary files in
+// a directory of tmpRoot first.
+func concatSortedUnique(opt *Options, files []string, outFile string, assumeSorted bool, writeScale int, requireSorted bool,
+	maxOpenFiles int, tmpRoot string, tmpOpt *Options) int64 {
+	var reader0 *unik.Reader
+	var hasTaxid bool
+	for _, file := range files {
+		if isStdin(file) {
+			checkError(fmt.Errorf("stdin is not supported when flag -u/--unique given"))
+		}
+
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if !assumeSorted && !reader.IsSorted() {
+				checkError(fmt.Errorf("input file should be sorted when flag -u/--unique given: %s", file))
+			}
+
+			if reader0 == nil {
+				reader0 = reader
+				hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+				return
+			}
+
+			checkCompatibility(reader0, reader, file)
+			if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
+				if reader.HasTaxidInfo() {
+					checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
+				} else {
+					checkError(fmt.Errorf(`taxid information found in previous files, but missing in this: %s`, file))
+				}
+			}
+		}()
+	}
+
+	mode := unik.UnikSorted
+	if reader0.IsCanonical() {
+		mode |= unik.UnikCanonical
+	}
+	if reader0.IsHashed() {
+		mode |= unik.UnikHashed
+	}
+
+	var taxondb *taxdump.Taxonomy
+	if hasTaxid {
+		mode |= unik.UnikIncludeTaxID
+		taxondb = loadTaxonomy(opt, false)
+	}
+
+	scaler := newWriteScaler(writeScale, reader0, files[0])
+	if len(files) <= maxOpenFiles {
+		n, _ := mergeChunksFile(opt, taxondb, files, outFile, reader0.K, uint32(mode), true, false, nil, scaler, requireSorted, true)
+		return n
+	}
+
+	tmpDir, err := makeTmpDir(tmpRoot, "unikmer-concat")
+	checkError(err)
+	registerTmpDir(tmpDir)
+
+	if opt.Verbose {
+		log.Infof("merging from %d files (round: 1/2)", len(files))
+	}
+	tmpFiles := make([]string, 0, len(files)/maxOpenFiles+1)
+	var outFile1 string
+	var n int64
+	for i := 0; i < len(files); i += maxOpenFiles {
+		j := i + maxOpenFiles
+		if j > len(files) {
+			j = len(files)
+		}
+		outFile1 = chunkFileName(tmpDir, len(tmpFiles)+1)
+		n, _ = mergeChunksFile(tmpOpt, taxondb, files[i:j], outFile1, reader0.K, uint32(mode), true, false, nil, nil, requireSorted, false)
+		if opt.Verbose {
+			log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", len(tmpFiles)+1, n, outFile1)
+		}
+		tmpFiles = append(tmpFiles, outFile1)
+	}
+
+	if opt.Verbose {
+		log.Infof("merging from %d chunks (round: 2/2)", len(tmpFiles))
+	}
+	n, _ = mergeChunksFile(opt, taxondb, tmpFiles, outFile, reader0.K, uint32(mode), true, false, nil, scaler, false, true)
+
+	if opt.Verbose {
+		log.Infof("removing tmp dir: %s", tmpDir)
+	}
+	if err = removeAllWithRetry(tmpDir); err != nil {
+		checkError(fmt.Errorf("fail to remove temp directory, please manually delete it: %s", tmpDir))
+	}
+	unregisterTmpDir(tmpDir)
+
+	return n
 }
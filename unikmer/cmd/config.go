@@ -0,0 +1,392 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration file of parameters",
+	Long: `Configuration file of parameters
+
+A configuration file, given by the global flag --config, stores parameters
+of subcommands, so pipelines can share reproducible parameter sets instead
+of long flag lists.
+
+Format (a subset of YAML):
+
+  # global flags for all subcommands
+  global:
+    threads: 8
+    data-dir: /path/to/taxdump
+
+  # flags of a subcommand, in long format
+  count:
+    kmer-len: 31
+    canonical: true
+    seq-name-filter: [plasmid, phage]
+
+  # global flags can also be overridden for a subcommand
+  merge:
+    compression-level: 1
+    buffer-size: 1M
+
+  # flags of a nested subcommand
+  taxdump download:
+    skip-md5: true
+
+Priority: command line > subcommand section > global section.
+The TOML style, i.e., '[count]' and 'kmer-len = 31', is also supported.
+
+`,
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate a configuration file with all flags and default values",
+	Long: `Generate a configuration file with all flags and default values
+
+All flags are commented out, just uncomment and edit what you need.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outFile := getFlagString(cmd, "out-file")
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString(`# configuration file of unikmer, generated by "unikmer config init".
+# Usage: unikmer <command> --config <this file>
+# Priority: command line > subcommand section > global section.
+
+`)
+		outfh.WriteString("global:\n")
+		writeConfigFlags(outfh, RootCmd.PersistentFlags())
+
+		var walk func(c *cobra.Command)
+		walk = func(c *cobra.Command) {
+			for _, sub := range c.Commands() {
+				if sub.Hidden || sub == configCmd {
+					continue
+				}
+				if sub.Runnable() && sub.HasAvailableLocalFlags() {
+					outfh.WriteString("\n" + configSectionName(sub) + ":\n")
+					writeConfigFlags(outfh, sub.LocalNonPersistentFlags())
+				}
+				walk(sub)
+			}
+		}
+		walk(RootCmd)
+	},
+}
+
+func writeConfigFlags(outfh *bufio.Writer, flags *pflag.FlagSet) {
+	var value string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" || f.Name == "config" || f.Hidden {
+			return
+		}
+		value = f.DefValue
+		if value == `[]` || value == `[""]` {
+			value = "[]"
+		}
+		fmt.Fprintf(outfh, "  # %s: %s    # %s\n", f.Name, value, strings.ReplaceAll(f.Usage, "\n", " "))
+	})
+}
+
+// configSectionName returns the section name of a command, e.g.,
+// "count" and "taxdump download".
+func configSectionName(cmd *cobra.Command) string {
+	return strings.TrimSpace(strings.TrimPrefix(cmd.CommandPath(), RootCmd.Name()))
+}
+
+// readConfig reads a configuration file, returning section -> flag -> value.
+func readConfig(file string) (map[string]map[string]string, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	return parseConfig(fh)
+}
+
+// parseConfig parses configuration data, returning section -> flag -> value.
+// Values of lists are joined with commas in the CSV format accepted by
+// slice flags.
+func parseConfig(r io.Reader) (map[string]map[string]string, error) {
+	config := make(map[string]map[string]string)
+	var section string
+	var line, key, value string
+	var i, lineNum int
+	var err error
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+
+		// comments
+		line, err = stripConfigComment(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// TOML section
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := config[section]; !ok {
+				config[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		// YAML section
+		if line[0] != ' ' && line[0] != '\t' && line[len(line)-1] == ':' {
+			section = strings.TrimSpace(line[:len(line)-1])
+			if _, ok := config[section]; !ok {
+				config[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("line %d: no section given for: %s", lineNum, line)
+		}
+
+		// flag names contain neither ':' nor '=', so the first one is the separator.
+		if i = strings.IndexAny(line, ":="); i < 0 {
+			return nil, fmt.Errorf("line %d: invalid format: %s", lineNum, line)
+		}
+		key = strings.TrimSpace(line[:i])
+		value = strings.TrimSpace(line[i+1:])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: no flag name given: %s", lineNum, line)
+		}
+
+		// list
+		if len(value) >= 2 && value[0] == '[' && value[len(value)-1] == ']' {
+			items := splitConfigList(value[1 : len(value)-1])
+			for j, item := range items {
+				items[j] = csvQuoteConfigValue(unquoteConfigValue(strings.TrimSpace(item)))
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquoteConfigValue(value)
+		}
+
+		config[section][key] = value
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// isConfigQuoteStart tells whether a quote at line[i] opens a quoted string,
+// i.e., it starts a value or a list item, so apostrophes in plain values
+// like "it's" are kept as they are.
+func isConfigQuoteStart(line string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	switch line[i-1] {
+	case ' ', '\t', ':', '=', '[', ',':
+		return true
+	}
+	return false
+}
+
+// stripConfigComment removes the comment of a line. A comment starts with a
+// '#' at the beginning of the line or after a space or tab, outside quotes.
+func stripConfigComment(line string) (string, error) {
+	var quote byte
+	var c byte
+	for i := 0; i < len(line); i++ {
+		c = line[i]
+		switch {
+		case quote == '"':
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quote = 0
+			}
+		case quote == '\'':
+			if c == '\'' {
+				if i+1 < len(line) && line[i+1] == '\'' { // escaped single quote: ''
+					i++
+				} else {
+					quote = 0
+				}
+			}
+		case (c == '"' || c == '\'') && isConfigQuoteStart(line, i):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i], nil
+		}
+	}
+	if quote != 0 {
+		return "", fmt.Errorf("unterminated quoted string: %s", line)
+	}
+	return line, nil
+}
+
+// splitConfigList splits items of a list by commas outside quotes.
+func splitConfigList(s string) []string {
+	items := make([]string, 0, 8)
+	var quote byte
+	var c byte
+	var begin int
+	for i := 0; i < len(s); i++ {
+		c = s[i]
+		switch {
+		case quote == '"':
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quote = 0
+			}
+		case quote == '\'':
+			if c == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					i++
+				} else {
+					quote = 0
+				}
+			}
+		case (c == '"' || c == '\'') && isConfigQuoteStart(s, i):
+			quote = c
+		case c == ',':
+			items = append(items, s[begin:i])
+			begin = i + 1
+		}
+	}
+	if strings.TrimSpace(s[begin:]) != "" || len(items) > 0 {
+		items = append(items, s[begin:])
+	}
+	return items
+}
+
+// unquoteConfigValue removes the quotes of a value. Escape sequences in
+// double-quoted values are interpreted when valid, and two single quotes in
+// single-quoted values stand for one, as in YAML.
+func unquoteConfigValue(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	switch {
+	case s[0] == '"' && s[len(s)-1] == '"':
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+		return s[1 : len(s)-1]
+	case s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
+
+// csvQuoteConfigValue quotes a list item containing commas or quotes, as
+// slice flags parse their values in the CSV format.
+func csvQuoteConfigValue(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// applyConfig sets flags not given in command line with values in the
+// configuration file given by the global flag --config.
+func applyConfig(cmd *cobra.Command) {
+	file := getFlagString(cmd, "config")
+	if file == "" {
+		return
+	}
+
+	config, err := readConfig(file)
+	checkError(errors.Wrapf(err, "read config file: %s", file))
+
+	// flags given in command line
+	changed := make(map[string]struct{})
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		changed[f.Name] = struct{}{}
+	})
+
+	// the subcommand section has a higher priority than the global section.
+	for _, section := range []string{configSectionName(cmd), "global"} {
+		kvs, ok := config[section]
+		if !ok {
+			continue
+		}
+
+		keys := make([]string, 0, len(kvs))
+		for key := range kvs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, ok = changed[key]; ok {
+				continue
+			}
+			if cmd.Flags().Lookup(key) == nil {
+				if section == "global" {
+					continue
+				}
+				checkError(fmt.Errorf("config file %s: unknown flag in section '%s': %s", file, section, key))
+			}
+			if err = cmd.Flags().Set(key, kvs[key]); err != nil {
+				checkError(fmt.Errorf("config file %s: invalid value of flag '%s' in section '%s': %s", file, key, section, err))
+			}
+			changed[key] = struct{}{}
+		}
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+
+	configCmd.AddCommand(configInitCmd)
+	configInitCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout)`)
+}
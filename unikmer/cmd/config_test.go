@@ -0,0 +1,159 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]map[string]string
+	}{
+		{
+			name: "YAML",
+			data: "# comment\nglobal:\n  threads: 8\n\ncount:\n  kmer-len: 31 # k\n  canonical: true\n",
+			want: map[string]map[string]string{
+				"global": {"threads": "8"},
+				"count":  {"kmer-len": "31", "canonical": "true"},
+			},
+		},
+		{
+			name: "TOML",
+			data: "[taxdump download]\nskip-md5 = true\n\t# indented comment\n",
+			want: map[string]map[string]string{
+				"taxdump download": {"skip-md5": "true"},
+			},
+		},
+		{
+			name: "tab-prefixed comment",
+			data: "count:\n  kmer-len: 31\t# k\n",
+			want: map[string]map[string]string{
+				"count": {"kmer-len": "31"},
+			},
+		},
+		{
+			name: "quoted values",
+			data: "count:\n  seq-name-filter: \"plasmid #1\" # comment\n  out-prefix: 'a: #b'\n  data-dir: \"x=y\"\n  name: 'it''s'\n  tab: \"a\\tb\"\n",
+			want: map[string]map[string]string{
+				"count": {
+					"seq-name-filter": "plasmid #1",
+					"out-prefix":      "a: #b",
+					"data-dir":        "x=y",
+					"name":            "it's",
+					"tab":             "a\tb",
+				},
+			},
+		},
+		{
+			name: "hash and apostrophe in plain values",
+			data: "count:\n  out-prefix: a#b\n  name: it's # comment\n",
+			want: map[string]map[string]string{
+				"count": {"out-prefix": "a#b", "name": "it's"},
+			},
+		},
+		{
+			name: "TOML value with colon",
+			data: "[global]\ndata-dir = \"C:/taxdump\"\n",
+			want: map[string]map[string]string{
+				"global": {"data-dir": "C:/taxdump"},
+			},
+		},
+		{
+			name: "lists",
+			data: "count:\n  a: [plasmid, phage]\n  b: [\"x, y\", 'z # 1'] # comment\n  c: []\n  d: [\"say \\\"hi\\\"\"]\n",
+			want: map[string]map[string]string{
+				"count": {
+					"a": "plasmid,phage",
+					"b": `"x, y",z # 1`,
+					"c": "",
+					"d": `"say ""hi"""`,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseConfig(strings.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"no section", "threads: 8\n"},
+		{"invalid format", "count:\n  kmer-len 31\n"},
+		{"no flag name", "count:\n  : 31\n"},
+		{"unterminated quote", "count:\n  out-prefix: \"abc # d\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseConfig(strings.NewReader(test.data)); err == nil {
+				t.Errorf("error expected for: %q", test.data)
+			}
+		})
+	}
+}
+
+func TestParseConfigSliceFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"[plasmid, phage]", []string{"plasmid", "phage"}},
+		{`["x, y", 'z']`, []string{"x, y", "z"}},
+		{`['say "hi"']`, []string{`say "hi"`}},
+	}
+
+	for _, test := range tests {
+		config, err := parseConfig(strings.NewReader("count:\n  filter: " + test.value + "\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.StringSlice("filter", nil, "")
+		if err = flags.Set("filter", config["count"]["filter"]); err != nil {
+			t.Fatalf("%s: set flag: %s", test.value, err)
+		}
+		got, _ := flags.GetStringSlice("filter")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var containedInCmd = &cobra.Command{
+	Use:   "contained-in",
+	Short: "Fast containment screening of a query binary file against many sorted files",
+	Long: `Fast containment screening of a query binary file against many sorted files
+
+For each target file, this command computes the containment of the query
+k-mers in the target, i.e., |Q ∩ T| / |Q|, without producing intersection
+outputs, which is far cheaper than running "unikmer inter" for each target.
+
+K-mers of the query and each target are compared with a streaming merge,
+and reading a target stops early when all query k-mers are checked,
+or when the remaining query k-mers can't reach the threshold
+(-t/--threshold), so a high threshold speeds up screening.
+
+Attentions:
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. Target files should be sorted. The query file is sorted in memory
+     if it's not sorted.
+  3. Only targets with containment >= -t/--threshold are outputted.
+  4. Taxids are ignored.
+
+Output columns:
+  target       target file
+  query        number of (unique) k-mers in the query
+  shared       number of query k-mers found in the target
+  containment  shared / query
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		queryFile := getFlagString(cmd, "query")
+		if queryFile == "" {
+			checkError(fmt.Errorf("flag -q/--query needed"))
+		}
+		threshold := getFlagFloat64(cmd, "threshold")
+		if threshold < 0 || threshold > 1 {
+			checkError(fmt.Errorf("value of flag -t/--threshold should be in range of [0, 1]"))
+		}
+		outFile := getFlagString(cmd, "out-file")
+		format := getFlagTableFormat(cmd)
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if len(files) == 1 && isStdin(files[0]) {
+			checkError(fmt.Errorf("target files needed"))
+		}
+		if opt.Verbose {
+			log.Infof("%d target file(s) given", len(files))
+		}
+
+		checkFileSuffix(opt, extDataFile, append([]string{queryFile}, files...)...)
+		preflightCheck(opt, append([]string{queryFile}, files...), false)
+
+		// ---------------------------------------------------------------
+		// query
+
+		if opt.Verbose {
+			log.Infof("loading query k-mers from: %s", queryFile)
+		}
+		infh, r, _, err := inStream(queryFile)
+		checkError(err)
+		reader0, err := unik.NewReader(infh)
+		checkError(errors.Wrap(err, queryFile))
+		closeInStream(r)
+
+		query, err := loadCodeSet([]string{queryFile}, reader0.K, reader0.IsCanonical(), reader0.IsHashed())
+		checkError(err)
+		query = query.sample(opt.Sampler)
+		nq := len(query)
+		if opt.Verbose {
+			log.Infof("%d k-mers loaded", nq)
+		}
+
+		// minimum number of shared k-mers
+		minShared := int(math.Ceil(threshold * float64(nq)))
+
+		// ---------------------------------------------------------------
+		// targets
+
+		type containedInResult struct {
+			shared int
+			pass   bool
+		}
+		results := make([]containedInResult, len(files))
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i, file := range files {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int, file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				var infh *bufio.Reader
+				var r *os.File
+				infh, r, _, err := inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+				checkCompatibility(reader0, reader, file)
+				if !reader.IsSorted() {
+					checkError(fmt.Errorf("target file should be sorted: %s", file))
+				}
+
+				var code uint64
+				var j, shared int // j is the index of the next query k-mer to check
+				for j < nq {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					for j < nq && query[j] < code {
+						j++
+					}
+					if j < nq && query[j] == code {
+						shared++
+						j++
+					}
+
+					// the remaining query k-mers can't reach the threshold
+					if shared+nq-j < minShared {
+						break
+					}
+				}
+
+				results[i] = containedInResult{shared: shared, pass: shared >= minShared}
+			}(i, file)
+		}
+		wg.Wait()
+
+		// ---------------------------------------------------------------
+		// output
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"target", "query", "shared", "containment"})
+		tw.WriteHeader()
+
+		var nPass int
+		var c float64
+		for i, result := range results {
+			if !result.pass {
+				continue
+			}
+			nPass++
+			c = 0
+			if nq > 0 {
+				c = float64(result.shared) / float64(nq)
+			}
+			tw.WriteRecord(files[i], nq, result.shared, roundFloat(c, 4))
+		}
+
+		if opt.Verbose {
+			log.Infof("%d of %d targets with containment >= %v", nPass, len(files), threshold)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(containedInCmd)
+
+	containedInCmd.Flags().StringP("query", "q", "", `query binary file`)
+	containedInCmd.Flags().Float64P("threshold", "t", 0, `minimum containment of the query in targets for output`)
+	containedInCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	containedInCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
@@ -21,8 +21,11 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -35,7 +38,6 @@ import (
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts/sortutil"
 )
 
 var countCmd = &cobra.Command{
@@ -52,6 +54,34 @@ K-mer sketches:
   2. Minimizer
   3. Closed Syncmer
 
+Strands:
+  1. With -K/--canonical, only canonical k-mers are kept.
+  2. Without -K/--canonical, k-mers on both strands are kept for k-mer
+     codes, while hashed k-mers are only computed on the positive strand.
+  3. With --strand-specific, only k-mers on the positive strand are kept,
+     for both k-mer codes and hashed k-mers.
+
+Paired-end reads:
+  1. Give read 1 and read 2 files via -1/--read1 and -2/--read2,
+     or interleaved files (mates in adjacent records) with --interleaved.
+  2. K-mers of both mates are counted into the same output.
+  3. With --properly-paired-only, read pairs are skipped if mates have
+     different IDs, either mate is shorter than k, or either mate is
+     filtered out by -B/--seq-name-filter.
+
+Regions:
+  1. Use --bed to only count k-mers falling entirely inside the regions of
+     a BED file, sequences not in the BED file are skipped. Only the first
+     three columns are used, and overlapping regions are merged.
+
+Limiting memory for taxid-labelled k-mers:
+  1. With -T/--parse-taxid, all k-mers and their LCAs are kept in memory.
+     For massive datasets, use -m/--chunk-size along with -s/--sort to
+     write k-mers into sorted chunk files when the number of k-mers in
+     memory reaches N, and LCAs of k-mers in different chunks are computed
+     when merging chunk files, just like "unikmer sort -m".
+  2. Not compatible with -u/--unique, -d/--repeated and -l/--linear.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -76,6 +106,10 @@ K-mer sketches:
 		outFile := getFlagString(cmd, "out-prefix")
 		k := getFlagPositiveInt(cmd, "kmer-len")
 		canonical := getFlagBool(cmd, "canonical")
+		strandSpecific := getFlagBool(cmd, "strand-specific")
+		if canonical && strandSpecific {
+			checkError(fmt.Errorf("flag -K/--canonical and --strand-specific are not compatible"))
+		}
 
 		hashed := getFlagBool(cmd, "hash")
 		if k > 32 && !hashed {
@@ -131,10 +165,29 @@ K-mer sketches:
 		if minimizer && syncmer {
 			checkError(fmt.Errorf("flag --minimizer-w and --syncmer-s can not be given simultaneously"))
 		}
+		if strandSpecific && (minimizer || syncmer) {
+			checkError(fmt.Errorf("flag --strand-specific is not supported for --minimizer-w and --syncmer-s"))
+		}
 
 		sortKmers := getFlagBool(cmd, "sort")
 		circular := getFlagBool(cmd, "circular")
 
+		bedFile := getFlagString(cmd, "bed")
+		var bedRegions map[string][][2]int
+		if bedFile != "" {
+			if circular {
+				checkError(fmt.Errorf("flag --bed and --circular are not compatible"))
+			}
+			bedRegions, err = loadBedRegions(bedFile)
+			checkError(err)
+			if opt.Verbose {
+				log.Infof("regions of %d sequences loaded from BED file: %s", len(bedRegions), bedFile)
+			}
+		}
+
+		filterFiles := getFlagStringSlice(cmd, "filter-file")
+		filterKmers := len(filterFiles) > 0
+
 		if opt.Compact {
 			if sortKmers {
 				log.Infof("flag -s/--sort overides -c/--compact")
@@ -165,6 +218,22 @@ K-mer sketches:
 			checkError(fmt.Errorf("flag -l/--linear and -s/--sort are not compatible"))
 		}
 
+		maxElem, err := ParseByteSize(getFlagString(cmd, "chunk-size"))
+		if err != nil {
+			checkError(fmt.Errorf("parsing byte size: %s", err))
+		}
+		limitMem := maxElem > 0
+		if limitMem {
+			if !(parseTaxid && sortKmers) {
+				checkError(fmt.Errorf("flag -m/--chunk-size only works with -T/--parse-taxid and -s/--sort"))
+			}
+			if repeated || unique || linear {
+				checkError(fmt.Errorf("flag -m/--chunk-size is not compatible with -u/--unique, -d/--repeated and -l/--linear"))
+			}
+		}
+		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
+		keepTmpDir := getFlagBool(cmd, "keep-tmp-dir")
+
 		moreVerbose := getFlagBool(cmd, "more-verbose")
 
 		if moreVerbose {
@@ -195,8 +264,36 @@ K-mer sketches:
 			log.Info("checking input files ...")
 		}
 		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+
+		// paired-end reads
+		reads1 := getFlagStringSlice(cmd, "read1")
+		reads2 := getFlagStringSlice(cmd, "read2")
+		interleaved := getFlagBool(cmd, "interleaved")
+		properlyPairedOnly := getFlagBool(cmd, "properly-paired-only")
+		paired := len(reads1) > 0 || len(reads2) > 0
+		var files1, files2 []string
+		if paired {
+			if interleaved {
+				checkError(fmt.Errorf("flag -1/--read1 and -2/--read2 are not compatible with --interleaved"))
+			}
+			if len(reads1) != len(reads2) {
+				checkError(fmt.Errorf("numbers of files given by -1/--read1 (%d) and -2/--read2 (%d) do not match", len(reads1), len(reads2)))
+			}
+			if len(args) > 0 || getFlagString(cmd, "infile-list") != "" {
+				checkError(fmt.Errorf("positional input files and -i/--infile-list are not allowed when -1/--read1 and -2/--read2 given"))
+			}
+			files1 = getFileList(reads1, !opt.SkipFileCheck)
+			files2 = getFileList(reads2, !opt.SkipFileCheck)
+		} else if interleaved {
+			files1 = files
+		} else if properlyPairedOnly {
+			checkError(fmt.Errorf("flag --properly-paired-only needs -1/--read1 and -2/--read2, or --interleaved"))
+		}
+
 		if opt.Verbose {
-			if len(files) == 1 && isStdin(files[0]) {
+			if paired {
+				log.Infof("%d pair(s) of paired-end read files given", len(files1))
+			} else if len(files) == 1 && isStdin(files[0]) {
 				log.Info("no files given, reading from stdin")
 			} else {
 				log.Infof("%d input file(s) given", len(files))
@@ -206,9 +303,19 @@ K-mer sketches:
 		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 			outFile += extDataFile
 		}
-		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
-		checkError(err)
+		// the output file is opened lazily, as it's written by mergeChunksFile
+		// when k-mers are saved in chunk files.
+		var outfh *bufio.Writer
+		var gw io.WriteCloser
+		var w *os.File
+		openOutStream := func() {
+			outfh, gw, w, err = outStream(outFile, opt.Compress, opt.CompressionLevel)
+			checkError(err)
+		}
 		defer func() {
+			if outfh == nil {
+				return
+			}
 			outfh.Flush()
 			if gw != nil {
 				gw.Close()
@@ -220,6 +327,16 @@ K-mer sketches:
 			log.Infof("set global taxid: %d", taxid)
 		}
 
+		var filterSet codeSet
+		if filterKmers {
+			checkFileSuffix(opt, extDataFile, filterFiles...)
+			filterSet, err = loadCodeSet(filterFiles, k, canonical, hashed)
+			checkError(errors.Wrap(err, "load k-mers to filter out"))
+			if opt.Verbose {
+				log.Infof("%d k-mers to filter out loaded from %d file(s)", len(filterSet), len(filterFiles))
+			}
+		}
+
 		var writer *unik.Writer
 		var mode uint32
 		var n uint64
@@ -245,6 +362,7 @@ K-mer sketches:
 			if hashed {
 				mode |= unik.UnikHashed
 			}
+			openOutStream()
 			writer, err = unik.NewWriter(outfh, k, mode)
 			checkError(errors.Wrap(err, outFile))
 			writer.SetMaxTaxid(opt.MaxTaxid)
@@ -268,6 +386,42 @@ K-mer sketches:
 			}
 		}
 
+		// sorted chunk files of k-mers and taxids for -m/--chunk-size
+		var tmpDir string
+		var tmpFiles []string
+		var chunkMode uint32 = unik.UnikSorted | unik.UnikIncludeTaxID
+		if canonical {
+			chunkMode |= unik.UnikCanonical
+		}
+		if hashed {
+			chunkMode |= unik.UnikHashed
+		}
+		dumpChunk := func() {
+			if tmpDir == "" {
+				tmpDir, err = makeTmpDir(getTmpRoot(cmd), "unikmer-count")
+				checkError(errors.Wrap(err, "create tmp dir"))
+				if !keepTmpDir {
+					registerTmpDir(tmpDir)
+				}
+			}
+
+			cts := make([]CodeTaxid, 0, len(mt))
+			for _code, _taxid := range mt {
+				cts = append(cts, CodeTaxid{Code: _code, Taxid: _taxid})
+			}
+			for _code := range mt { // reuse the map
+				delete(mt, _code)
+			}
+			sortCodesTaxids(cts)
+
+			outFile1 := chunkFileName(tmpDir, len(tmpFiles)+1)
+			tmpFiles = append(tmpFiles, outFile1)
+			_n := dumpCodesTaxids2File(cts, taxondb, k, chunkMode, outFile1, opt, false, false)
+			if opt.Verbose {
+				log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", len(tmpFiles), _n, outFile1)
+			}
+		}
+
 		var record *fastx.Record
 		var fastxReader *fastx.Reader
 		var ok bool
@@ -276,168 +430,297 @@ K-mer sketches:
 		var lca uint32
 		var mark bool
 		var nseq int64
+		var nFiltered, nShort, nNonACGT int64 // for the summary in verbose mode
 		var code uint64
 		var iter *sketches.Iterator
+		var nFwd, iFwd int // for strand-specific k-mers
 		var sketch *sketches.Sketch
-		var ignoreSeq bool
 		var re *regexp.Regexp
 
-		for _, file := range files {
-			if opt.Verbose {
-				log.Infof("reading sequence file: %s", file)
+		// filteredOut checks if a sequence is filtered out by its name.
+		filteredOut := func(record *fastx.Record) bool {
+			if !filterNames {
+				return false
 			}
-			fastxReader, err = fastx.NewDefaultReader(file)
-			checkError(errors.Wrap(err, file))
-			for {
-				record, err = fastxReader.Read()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					checkError(errors.Wrap(err, file))
+			for _, re = range reSeqNames {
+				if re.Match(record.Name) {
+					return true
+				}
+			}
+			return false
+		}
+
+		var countSeq func(record *fastx.Record)
+
+		enableGracefulInterrupt()
+		countRecord := func(record *fastx.Record) {
+			exitIfInterrupted()
+
+			if filteredOut(record) {
+				nFiltered++
+				return
+			}
+
+			if bedRegions == nil {
+				countSeq(record)
+				return
+			}
+
+			// only k-mers in the regions
+			regions, ok := bedRegions[string(record.ID)]
+			if !ok {
+				return
+			}
+			for _, r := range regions {
+				if r[0] >= len(record.Seq.Seq) {
 					break
 				}
+				countSeq(&fastx.Record{
+					ID:   record.ID,
+					Name: record.Name,
+					Seq:  record.Seq.SubSeq(r[0]+1, r[1]),
+				})
+			}
+		}
 
-				if filterNames {
-					ignoreSeq = false
-					for _, re = range reSeqNames {
-						if re.Match(record.Name) {
-							ignoreSeq = true
-							break
-						}
-					}
-					if ignoreSeq {
-						continue
+		countSeq = func(record *fastx.Record) {
+			if opt.Verbose {
+				nNonACGT += int64(nKmersWithNonACGT(record.Seq.Seq, k, circular))
+			}
+
+			if syncmer {
+				sketch, err = sketches.NewSyncmerSketch(record.Seq, k, syncmerS, circular)
+			} else if minimizer {
+				sketch, err = sketches.NewMinimizerSketch(record.Seq, k, minimizerW, circular)
+			} else {
+				if circular {
+					extendCircularSeq(record.Seq, k)
+				}
+				if hashed {
+					iter, err = sketches.NewHashIterator(record.Seq, k, canonical, false)
+				} else {
+					iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, false)
+				}
+			}
+			if err != nil {
+				if err == sketches.ErrShortSeq {
+					nShort++
+					if opt.Verbose && moreVerbose {
+						log.Infof("ignore short seq: %s", record.Name)
 					}
+					return
+				} else {
+					checkError(errors.Wrapf(err, "seq: %s", record.Name))
 				}
+			}
 
-				if syncmer {
-					sketch, err = sketches.NewSyncmerSketch(record.Seq, k, syncmerS, circular)
-				} else if minimizer {
-					sketch, err = sketches.NewMinimizerSketch(record.Seq, k, minimizerW, circular)
-				} else if hashed {
-					iter, err = sketches.NewHashIterator(record.Seq, k, canonical, circular)
-				} else {
-					iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, circular)
+			if parseTaxid {
+				founds = reParseTaxid.FindAllSubmatch(record.Name, 1)
+				if len(founds) == 0 {
+					checkError(fmt.Errorf("failed to parse taxid in header: %s", record.Name))
 				}
+				val, err = strconv.ParseUint(string(founds[0][1]), 10, 32)
 				if err != nil {
-					if err == sketches.ErrShortSeq {
-						if opt.Verbose && moreVerbose {
-							log.Infof("ignore short seq: %s", record.Name)
-						}
-						continue
-					} else {
-						checkError(errors.Wrapf(err, "seq: %s", record.Name))
-					}
+					checkError(fmt.Errorf("failed to parse taxid '%s' in header: %s", founds[0][1], record.Name))
 				}
+				taxid = uint32(val)
+			}
 
+			nseq++
+			if opt.Verbose && moreVerbose {
 				if parseTaxid {
-					founds = reParseTaxid.FindAllSubmatch(record.Name, 1)
-					if len(founds) == 0 {
-						checkError(fmt.Errorf("failed to parse taxid in header: %s", record.Name))
+					log.Infof("processing sequence #%d: %s, taxid: %d", nseq, record.ID, taxid)
+				} else {
+					log.Infof("processing sequence #%d: %s", nseq, record.ID)
+				}
+			}
+
+			if strandSpecific {
+				// circular sequences are already extended
+				nFwd = nKmersOnPositiveStrand(len(record.Seq.Seq), k, false)
+				iFwd = 0
+			}
+
+			for {
+				if syncmer {
+					code, ok = sketch.NextSyncmer()
+				} else if minimizer {
+					code, ok = sketch.NextMinimizer()
+				} else if hashed {
+					code, ok = iter.NextHash()
+				} else {
+					if strandSpecific {
+						if iFwd == nFwd { // do not go to the negative strand
+							break
+						}
+						iFwd++
 					}
-					val, err = strconv.ParseUint(string(founds[0][1]), 10, 32)
+					code, ok, err = iter.NextKmer()
 					if err != nil {
-						checkError(fmt.Errorf("failed to parse taxid '%s' in header: %s", founds[0][1], record.Name))
+						checkError(errors.Wrapf(err, "seq: %s", record.Name))
 					}
-					taxid = uint32(val)
 				}
 
-				nseq++
-				if opt.Verbose && moreVerbose {
-					if parseTaxid {
-						log.Infof("processing sequence #%d: %s, taxid: %d", nseq, record.ID, taxid)
-					} else {
-						log.Infof("processing sequence #%d: %s", nseq, record.ID)
-					}
+				if !ok {
+					break
 				}
 
-				for {
-					if syncmer {
-						code, ok = sketch.NextSyncmer()
-					} else if minimizer {
-						code, ok = sketch.NextMinimizer()
-					} else if hashed {
-						code, ok = iter.NextHash()
-					} else {
-						code, ok, err = iter.NextKmer()
-						if err != nil {
-							checkError(errors.Wrapf(err, "seq: %s", record.Name))
-						}
-					}
-
-					if !ok {
-						break
-					}
+				if scaled && code > maxHash {
+					continue
+				}
 
-					if scaled && code > maxHash {
-						continue
-					}
+				if filterKmers && filterSet.has(code) {
+					continue
+				}
 
-					if parseTaxid {
-						if repeated {
-							if mark, ok = marks[code]; !ok {
+				if parseTaxid {
+					if repeated {
+						if mark, ok = marks[code]; !ok {
+							mt[code] = taxid
+							marks[code] = false
+						} else {
+							if lca, ok = mt[code]; !ok {
 								mt[code] = taxid
-								marks[code] = false
 							} else {
-								if lca, ok = mt[code]; !ok {
-									mt[code] = taxid
-								} else {
-									mt[code] = taxondb.LCA(lca, taxid) // update with LCA
-								}
-								if !mark {
-									marks[code] = true
-								}
+								mt[code] = taxondb.LCA(lca, taxid) // update with LCA
 							}
-
-							continue
-						} else if unique {
-							if mark, ok = marks[code]; !ok {
-								mt[code] = taxid // though added here, but can't ensure it's uniuqe.
-								marks[code] = false
-							} else if !mark {
+							if !mark {
 								marks[code] = true
 							}
-
-							continue
 						}
 
-						if lca, ok = mt[code]; !ok {
-							mt[code] = taxid
-						} else {
-							mt[code] = taxondb.LCA(lca, taxid) // update with LCA
+						continue
+					} else if unique {
+						if mark, ok = marks[code]; !ok {
+							mt[code] = taxid // though added here, but can't ensure it's uniuqe.
+							marks[code] = false
+						} else if !mark {
+							marks[code] = true
 						}
+
 						continue
 					}
 
-					if linear {
-						if parseTaxid {
-							writer.WriteCodeWithTaxid(code, taxid)
-						} else {
-							writer.WriteCode(code)
+					if lca, ok = mt[code]; !ok {
+						mt[code] = taxid
+						if limitMem && len(mt) >= maxElem {
+							dumpChunk()
 						}
-						n++
+					} else {
+						mt[code] = taxondb.LCA(lca, taxid) // update with LCA
+					}
+					continue
+				}
 
-						continue
+				if linear {
+					if parseTaxid {
+						writer.WriteCodeWithTaxid(code, taxid)
+					} else {
+						writer.WriteCode(code)
 					}
+					n++
 
-					if repeated || unique {
-						if mark, ok = marks[code]; !ok {
-							marks[code] = false
-						} else if !mark {
-							marks[code] = true
+					continue
+				}
+
+				if repeated || unique {
+					if mark, ok = marks[code]; !ok {
+						marks[code] = false
+					} else if !mark {
+						marks[code] = true
+					}
+
+					continue
+				}
+
+				if _, ok = m[code]; !ok {
+					m[code] = struct{}{}
+				}
+			}
+		}
+
+		if paired || interleaved {
+			var pairReader *readPairReader
+			var rec1, rec2 *fastx.Record
+			var nPairs, nImproper int64
+			var file1, file2 string
+
+			for i := range files1 {
+				file1 = files1[i]
+				if interleaved {
+					file2 = ""
+					if opt.Verbose {
+						log.Infof("reading interleaved paired-end file: %s", file1)
+					}
+				} else {
+					file2 = files2[i]
+					if opt.Verbose {
+						log.Infof("reading paired-end files: %s and %s", file1, file2)
+					}
+				}
+
+				pairReader, err = newReadPairReader(file1, file2)
+				checkError(err)
+				for {
+					rec1, rec2, err = pairReader.Read()
+					if err != nil {
+						if err == io.EOF {
+							break
 						}
+						checkError(err)
+						break
+					}
+					nPairs++
 
+					if properlyPairedOnly &&
+						(!isMatePair(rec1.ID, rec2.ID) ||
+							len(rec1.Seq.Seq) < k || len(rec2.Seq.Seq) < k ||
+							filteredOut(rec1) || filteredOut(rec2)) {
+						nImproper++
 						continue
 					}
 
-					if _, ok = m[code]; !ok {
-						m[code] = struct{}{}
+					countRecord(rec1)
+					countRecord(rec2)
+				}
+			}
+
+			if opt.Verbose {
+				if properlyPairedOnly {
+					log.Infof("%d read pairs processed, %d pairs are not properly paired and ignored", nPairs, nImproper)
+				} else {
+					log.Infof("%d read pairs processed", nPairs)
+				}
+			}
+		} else {
+			for _, file := range files {
+				if opt.Verbose {
+					log.Infof("reading sequence file: %s", file)
+				}
+				fastxReader, err = fastx.NewDefaultReader(file)
+				checkError(errors.Wrap(err, file))
+				for {
+					record, err = fastxReader.Read()
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+						break
 					}
+
+					countRecord(record)
 				}
 			}
 		}
 
+		if opt.Verbose {
+			log.Infof("%d sequences processed, %d skipped as shorter than k, %d filtered out by -B/--seq-name-filter", nseq, nShort, nFiltered)
+			if nNonACGT > 0 {
+				log.Warningf("%d k-mers (on the positive strand) with non-ACGT bases are counted, where degenerate bases are encoded as one of ACGT (e.g., N as A)", nNonACGT)
+			}
+		}
+
 		if linear {
 			checkError(writer.Flush())
 			if opt.Verbose {
@@ -446,6 +729,66 @@ K-mer sketches:
 			return
 		}
 
+		if len(tmpFiles) > 0 {
+			if len(mt) > 0 {
+				dumpChunk()
+			}
+
+			var scaler *writeScaler
+			if scaled {
+				scaler = &writeScaler{scale: uint32(scale), maxHash: maxHash}
+			}
+
+			if len(tmpFiles) < maxOpenFiles {
+				if opt.Verbose {
+					log.Infof("merging from %d chunks", len(tmpFiles))
+				}
+				n, _ := mergeChunksFile(opt, taxondb, tmpFiles, outFile, k, chunkMode, true, false, nil, scaler, false, true)
+				if opt.Verbose {
+					log.Infof("%d unique k-mers saved to %s", n, outFile)
+				}
+			} else {
+				if opt.Verbose {
+					log.Infof("merging from %d chunks (round: 1/2)", len(tmpFiles))
+				}
+				files2 := make([]string, 0, len(tmpFiles)/maxOpenFiles+1)
+				var iTmpFile = len(tmpFiles)
+				for i := 0; i < len(tmpFiles); i += maxOpenFiles {
+					j := i + maxOpenFiles
+					if j > len(tmpFiles) {
+						j = len(tmpFiles)
+					}
+					iTmpFile++
+					outFile1 := chunkFileName(tmpDir, iTmpFile)
+					n, _ := mergeChunksFile(opt, taxondb, tmpFiles[i:j], outFile1, k, chunkMode, true, false, nil, nil, false, false)
+					if opt.Verbose {
+						log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", iTmpFile, n, outFile1)
+					}
+					files2 = append(files2, outFile1)
+				}
+				if opt.Verbose {
+					log.Infof("merging from %d chunks (round: 2/2)", len(files2))
+				}
+				n, _ := mergeChunksFile(opt, taxondb, files2, outFile, k, chunkMode, true, false, nil, scaler, false, true)
+				if opt.Verbose {
+					log.Infof("%d unique k-mers saved to %s", n, outFile)
+				}
+			}
+
+			if keepTmpDir {
+				return
+			}
+			if opt.Verbose {
+				log.Infof("removing tmp dir: %s", tmpDir)
+			}
+			err = removeAllWithRetry(tmpDir)
+			if err != nil {
+				checkError(fmt.Errorf("fail to remove temp directory, please manually delete it: %s", tmpDir))
+			}
+			unregisterTmpDir(tmpDir)
+			return
+		}
+
 		if sortKmers {
 			mode |= unik.UnikSorted
 		} else if opt.Compact && !hashed {
@@ -460,6 +803,7 @@ K-mer sketches:
 		if hashed {
 			mode |= unik.UnikHashed
 		}
+		openOutStream()
 		writer, err = unik.NewWriter(outfh, k, mode)
 		checkError(errors.Wrap(err, outFile))
 		writer.SetMaxTaxid(opt.MaxTaxid)
@@ -577,8 +921,7 @@ K-mer sketches:
 			if opt.Verbose {
 				log.Infof("sorting %d k-mers", len(codes))
 			}
-			// sort.Sort(sketches.CodeSlice(codes))
-			sortutil.Uint64s(codes)
+			sortCodes(codes)
 			if opt.Verbose {
 				log.Infof("done sorting")
 			}
@@ -609,6 +952,7 @@ func init() {
 	countCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	countCmd.Flags().IntP("kmer-len", "k", 0, "k-mer length")
 	countCmd.Flags().BoolP("canonical", "K", false, "only keep the canonical k-mers")
+	countCmd.Flags().BoolP("strand-specific", "", false, "only keep k-mers on the positive strand, for strand-specific analysis")
 	countCmd.Flags().BoolP("sort", "s", false, helpSort)
 	countCmd.Flags().Uint32P("taxid", "t", 0, "global taxid")
 	countCmd.Flags().BoolP("parse-taxid", "T", false, `parse taxid from FASTA/Q header`)
@@ -618,6 +962,12 @@ func init() {
 	countCmd.Flags().BoolP("more-verbose", "V", false, `print extra verbose information`)
 	countCmd.Flags().BoolP("hash", "H", false, `save hash of k-mer, automatically on for k>32. This flag overides global flag -c/--compact`)
 	countCmd.Flags().BoolP("circular", "", false, "circular genome")
+	countCmd.Flags().StringP("bed", "", "", "only count k-mers inside regions in this BED file")
+	countCmd.Flags().StringSliceP("filter-file", "", []string{}, "binary files of k-mers to filter out, e.g., k-mers of host genomes or vectors. k-mer size and 'canonical/hashed' flags should be consistent with the output")
+	countCmd.Flags().StringSliceP("read1", "1", []string{}, `read 1 file(s) of paired-end reads, in the same order as -2/--read2`)
+	countCmd.Flags().StringSliceP("read2", "2", []string{}, `read 2 file(s) of paired-end reads, in the same order as -1/--read1`)
+	countCmd.Flags().BoolP("interleaved", "", false, `input files are interleaved paired-end reads`)
+	countCmd.Flags().BoolP("properly-paired-only", "", false, `only count k-mers of properly paired reads, i.e., both mates share the same ID (ignoring suffixes /1 and /2), are not shorter than k, and are not filtered out by -B/--seq-name-filter`)
 
 	countCmd.Flags().IntP("scale", "D", 1, `scale/down-sample factor`)
 	countCmd.Flags().IntP("minimizer-w", "W", 0, `minimizer window size`)
@@ -625,9 +975,87 @@ func init() {
 
 	countCmd.Flags().BoolP("linear", "l", false, `output k-mers in linear order, duplicate k-mers are not removed`)
 
+	countCmd.Flags().StringP("chunk-size", "m", "", `split k-mers into sorted chunk files of N k-mers when given -T/--parse-taxid and -s/--sort, supports K/M/G suffix, type "unikmer count -h" for detail`)
+	countCmd.Flags().StringP("tmp-dir", "", "./", `directory for intermediate files of -m/--chunk-size, the environment variable `+envTmpDir+` is used if not given`)
+	countCmd.Flags().IntP("max-open-files", "", 400, `max number of open files when merging chunk files`)
+	countCmd.Flags().BoolP("keep-tmp-dir", "", false, `keep tmp dir`)
+
 	countCmd.SetUsageTemplate(usageTemplate("-K -k <k> -u -s [-t <taxid>] <seq files> -o <out prefix>"))
 
 }
 
 var reIgnoreCaseStr = "(?i)"
 var reIgnoreCase = regexp.MustCompile(`\(\?i\)`)
+
+// readPairReader reads read pairs from two paired-end files,
+// or an interleaved file.
+type readPairReader struct {
+	file1, file2 string
+	r1, r2       *fastx.Reader
+}
+
+// newReadPairReader creates a readPairReader. file2 should be empty for
+// an interleaved file.
+func newReadPairReader(file1, file2 string) (*readPairReader, error) {
+	r1, err := fastx.NewDefaultReader(file1)
+	if err != nil {
+		return nil, errors.Wrap(err, file1)
+	}
+	r := &readPairReader{file1: file1, file2: file2, r1: r1}
+	if file2 != "" {
+		r.r2, err = fastx.NewDefaultReader(file2)
+		if err != nil {
+			return nil, errors.Wrap(err, file2)
+		}
+	}
+	return r, nil
+}
+
+// Read returns the next read pair.
+func (r *readPairReader) Read() (*fastx.Record, *fastx.Record, error) {
+	rec1, err := r.r1.Read()
+	if err != nil {
+		if err == io.EOF && r.r2 != nil {
+			if _, err2 := r.r2.Read(); err2 != io.EOF {
+				return nil, nil, fmt.Errorf("more reads in %s than %s", r.file2, r.file1)
+			}
+		}
+		if err == io.EOF {
+			return nil, nil, err
+		}
+		return nil, nil, errors.Wrap(err, r.file1)
+	}
+
+	if r.r2 == nil { // interleaved
+		rec1 = rec1.Clone() // the record is reused by the reader
+		rec2, err := r.r1.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil, fmt.Errorf("odd number of reads in interleaved file: %s", r.file1)
+			}
+			return nil, nil, errors.Wrap(err, r.file1)
+		}
+		return rec1, rec2, nil
+	}
+
+	rec2, err := r.r2.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("more reads in %s than %s", r.file1, r.file2)
+		}
+		return nil, nil, errors.Wrap(err, r.file2)
+	}
+	return rec1, rec2, nil
+}
+
+// isMatePair checks if two read IDs are from the same pair,
+// ignoring suffixes of /1 and /2.
+func isMatePair(id1, id2 []byte) bool {
+	if len(id1) > 2 && id1[len(id1)-2] == '/' && id1[len(id1)-1] == '1' {
+		id1 = id1[:len(id1)-2]
+	}
+	if len(id2) > 2 && id2[len(id2)-2] == '/' && id2[len(id2)-1] == '2' {
+		id2 = id2[:len(id2)-2]
+	}
+	return bytes.Equal(id1, id2)
+}
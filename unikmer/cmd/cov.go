@@ -0,0 +1,249 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/unik/v5"
+
+	"github.com/spf13/cobra"
+)
+
+var covCmd = &cobra.Command{
+	Use:   "cov",
+	Short: "Per-base k-mer coverage depth of genomes from multiple binary files",
+	Long: `Per-base k-mer coverage depth of genomes from multiple binary files
+
+For each base of the genomes, the depth is the number of binary files
+(k-mer sets) having at least one k-mer covering it, which can be used
+for plotting the conservation along a genome in a pan-genome.
+
+Attention:
+  0. All files should have the 'canonical' flag.
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. Output is bedGraph format (0-based, half-open), adjacent bases with
+     the same depth are merged. Use --skip-zero to omit regions of depth 0.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		reSeqNameStrs := getFlagStringSlice(cmd, "seq-name-filter")
+		reSeqNames := make([]*regexp.Regexp, 0, len(reSeqNameStrs))
+		for _, kw := range reSeqNameStrs {
+			if !reIgnoreCase.MatchString(kw) {
+				kw = reIgnoreCaseStr + kw
+			}
+			re, err := regexp.Compile(kw)
+			if err != nil {
+				checkError(errors.Wrapf(err, "failed to parse regular expression for matching sequence header: %s", kw))
+			}
+			reSeqNames = append(reSeqNames, re)
+		}
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		if len(files) == 1 && isStdin(files[0]) {
+			checkError(fmt.Errorf("stdin not supported, please give me .unik files"))
+		}
+
+		outFile := getFlagString(cmd, "out-file")
+
+		genomes := getFlagStringSlice(cmd, "genome")
+		if len(genomes) == 0 {
+			checkError(fmt.Errorf("flag -g/--genome needed"))
+		}
+
+		skipZero := getFlagBool(cmd, "skip-zero")
+
+		// -----------------------------------------------------------------------
+
+		var infh *bufio.Reader
+		var r *os.File
+		var nfiles = len(files)
+
+		reader0 := preReadCanonicalFiles(opt, files)
+		k := reader0.K
+
+		// -----------------------------------------------------------------------
+
+		var code uint64
+		var ok bool
+
+		gk := &genomeKmers{
+			files:      genomes,
+			k:          k,
+			hashed:     reader0.IsHashed(),
+			maxHash:    ^uint64(0),
+			reSeqNames: reSeqNames,
+		}
+
+		// k-mers of genomes
+
+		if opt.Verbose {
+			log.Infof("collecting k-mers of genomes")
+		}
+		m := make(map[uint64][]uint32, mapInitSize) // code -> indexes of files containing it
+		gk.each(nil, func(code uint64, i int) {
+			m[code] = nil
+		})
+		if opt.Verbose {
+			log.Infof("%d k-mers collected", len(m))
+		}
+
+		// k-mers in binary files
+
+		var locs []uint32
+		for i, file := range files {
+			if opt.Verbose {
+				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+			}
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				for {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					if locs, ok = m[code]; !ok {
+						continue
+					}
+					if len(locs) > 0 && locs[len(locs)-1] == uint32(i) { // duplicated k-mer
+						continue
+					}
+					m[code] = append(locs, uint32(i))
+				}
+			}()
+		}
+
+		// -----------------------------------------------------------------------
+
+		if opt.Verbose {
+			log.Infof("computing coverage depth")
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		var id []byte
+		var diff []int32                   // difference array of depth
+		lastEnd := make([]int, len(files)) // end of the last covered region of each file
+
+		// dump outputs merged regions of the current sequence.
+		dump := func() {
+			if id == nil {
+				return
+			}
+			var depth, depth0 int32
+			var start int
+			L := len(diff) - 1
+			for i := 0; i <= L; i++ {
+				if i < L {
+					depth += diff[i]
+				}
+				if i > 0 && (i == L || depth != depth0) {
+					if !(skipZero && depth0 == 0) {
+						outfh.Write(id)
+						outfh.WriteString("\t" + strconv.Itoa(start) + "\t" + strconv.Itoa(i) +
+							"\t" + strconv.Itoa(int(depth0)) + "\n")
+					}
+					start = i
+				}
+				depth0 = depth
+			}
+		}
+
+		var s uint32
+		var start int
+		gk.each(func(record *fastx.Record) {
+			dump()
+
+			id = []byte(string(record.ID))
+			diff = make([]int32, len(record.Seq.Seq)+1)
+			for i := range lastEnd {
+				lastEnd[i] = 0
+			}
+		}, func(code uint64, i int) {
+			for _, s = range m[code] {
+				start = i
+				if lastEnd[s] > start {
+					start = lastEnd[s]
+				}
+				diff[start]++
+				diff[i+k]--
+				lastEnd[s] = i + k
+			}
+		})
+		dump()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(covCmd)
+
+	covCmd.Flags().StringSliceP("seq-name-filter", "B", []string{}, `list of regular expressions for filtering out sequences by header/name, case ignored`)
+
+	covCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	covCmd.Flags().StringSliceP("genome", "g", []string{}, "genomes in (gzipped) fasta file(s)")
+	covCmd.Flags().BoolP("skip-zero", "Z", false, `skip regions with depth of 0`)
+}
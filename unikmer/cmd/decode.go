@@ -22,7 +22,6 @@ package cmd
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -37,6 +36,8 @@ var decodeCmd = &cobra.Command{
 	Short: "Decode encoded integer to k-mer text",
 	Long: `Decode encoded integer to k-mer text
 
+Encoded integers can be in decimal or hexadecimal (with a prefix of "0x") format.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -91,7 +92,7 @@ var decodeCmd = &cobra.Command{
 						continue
 					}
 
-					code, err = strconv.ParseUint(line, 10, 64)
+					code, err = parseCode(line)
 					if err != nil {
 						checkError(fmt.Errorf("encode kmer should be non-negative integer: %s", line))
 					}
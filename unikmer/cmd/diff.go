@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 
@@ -33,7 +34,6 @@ import (
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts/sortutil"
 )
 
 var diffCmd = &cobra.Command{
@@ -44,6 +44,7 @@ var diffCmd = &cobra.Command{
 Attentions:
   0. The first file should be sorted.
   1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+     Non-canonical (strand-specific) k-mers are compared as they are.
   2. By default taxids in the 2nd and later files are ignored.
   3. You can switch on flag -t/--compare-taxid, and input
      files should ALL have or don't have taxid information.
@@ -53,6 +54,18 @@ Attentions:
 Tips:
   1. Increasing threads number (-j/--threads) to accelerate computation
      when dealing with lots of files, in cost of more memory occupation.
+  2. Use --removal-summary to find out where the removed k-mers come from,
+     e.g., for contamination attribution. Each removed k-mer is assigned
+     to the first file (in input order) containing it, and the numbers
+     of removed k-mers are reported per file and per taxid (and rank)
+     of the k-mers in the first file. This needs another pass of files.
+  3. Use --min-exclusive-fraction as a quality gate when building marker
+     sets in pipelines: it fails (or warns with --fraction-action warn)
+     when the fraction of k-mers of the first file remaining after the
+     difference is below the threshold, before writing the output.
+     The numbers can also be saved via --exclusive-summary, with columns:
+     file, kmers, exclusive, fraction, min_fraction, passed.
+  4. Summaries are in TSV format, or JSON lines with --out-format json.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -73,12 +86,40 @@ Tips:
 		}
 
 		checkFileSuffix(opt, extDataFile, files...)
+		autoRescale := getFlagBool(cmd, "auto-rescale")
+		if getFlagBool(cmd, "skip-err") {
+			files = skipErrFiles(opt, files, true, getFlagString(cmd, "skipped-list"), autoRescale)
+		} else {
+			preflightCheck(opt, files, autoRescale)
+		}
 
 		var nfiles = len(files)
 
 		outFile := getFlagString(cmd, "out-prefix")
 		sortKmers := getFlagBool(cmd, "sort")
 		compareTaxid := getFlagBool(cmd, "compare-taxid")
+		removalSummary := getFlagString(cmd, "removal-summary")
+		minExclusiveFrac := getFlagNonNegativeFloat64(cmd, "min-exclusive-fraction")
+		if minExclusiveFrac > 1 {
+			checkError(fmt.Errorf("value of --min-exclusive-fraction should be in range of [0, 1]"))
+		}
+		fractionAction := strings.ToLower(getFlagString(cmd, "fraction-action"))
+		switch fractionAction {
+		case "fail", "warn":
+		default:
+			checkError(fmt.Errorf("invalid value of --fraction-action: %s, available: fail, warn", fractionAction))
+		}
+		exclusiveSummary := getFlagString(cmd, "exclusive-summary")
+		format := getFlagTableFormat(cmd)
+		writeScale := getFlagWriteScale(cmd)
+		requireSorted := getFlagBool(cmd, "require-sorted")
+		var autoScaler *writeScaler
+		if autoRescale {
+			autoScaler = getAutoRescaler(opt, files)
+			if autoScaler != nil && int(autoScaler.scale) > writeScale {
+				writeScale = int(autoScaler.scale)
+			}
+		}
 
 		threads := opt.NumCPUs
 
@@ -121,38 +162,85 @@ Tips:
 		canonical = reader.IsCanonical()
 		hashed = reader.IsHashed()
 		hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+		scaler := newWriteScaler(writeScale, reader, file)
 		if compareTaxid {
 			if hasTaxid {
 				if opt.Verbose {
 					log.Infof("taxids found in file: %s", file)
 				}
-				taxondb = loadTaxonomy(opt, false)
+				taxondb = loadTaxonomy(opt, removalSummary != "")
 			} else {
 				log.Warningf("not taxids found in file: %s, flag -t/--compare-taxid ignored", file)
 			}
 		}
 
 		var n0 int
+		checker := newSortedChecker(requireSorted, file)
 		for {
-			code, taxid, err = reader.ReadCodeWithTaxid()
+			code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
 				checkError(errors.Wrap(err, file))
 			}
+			checker.check(code)
+			if !scaler.keep(code) {
+				continue
+			}
 
 			mc = append(mc, CodeTaxid{Code: code, Taxid: taxid})
 		}
 		n0 = len(mc)
 
-		r.Close()
+		closeInStream(r)
 
 		if opt.Verbose {
 			log.Infof("%d k-mers loaded", n0)
 		}
 
+		// checkExclusiveFraction checks the fraction of remaining k-mers
+		// (--min-exclusive-fraction) and writes the summary.
+		checkExclusiveFraction := func(nExclusive int) {
+			if minExclusiveFrac == 0 && exclusiveSummary == "" {
+				return
+			}
+			var frac float64
+			if n0 > 0 {
+				frac = float64(nExclusive) / float64(n0)
+			}
+			passed := frac >= minExclusiveFrac
+
+			if exclusiveSummary != "" {
+				outfh, gw, w, err := outStream(exclusiveSummary, strings.HasSuffix(strings.ToLower(exclusiveSummary), ".gz"), opt.CompressionLevel)
+				checkError(err)
+				tw := newTableWriter(outfh, format, []string{"file", "kmers", "exclusive", "fraction", "min_fraction", "passed"})
+				tw.WriteHeader()
+				tw.WriteRecord(files[0], n0, nExclusive, roundFloat(frac, 6), minExclusiveFrac, passed)
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			}
+
+			if passed {
+				if opt.Verbose && minExclusiveFrac > 0 {
+					log.Infof("fraction of exclusive k-mers: %d/%d = %.6f", nExclusive, n0, frac)
+				}
+				return
+			}
+			err := fmt.Errorf("fraction of exclusive k-mers (%d/%d = %.6f) < %v (--min-exclusive-fraction)", nExclusive, n0, frac, minExclusiveFrac)
+			if fractionAction == "warn" {
+				log.Warning(err)
+				return
+			}
+			checkError(err)
+		}
+
 		if n0 == 0 {
+			checkExclusiveFraction(0)
+
 			if opt.Verbose {
 				log.Infof("exporting k-mers")
 			}
@@ -189,6 +277,7 @@ Tips:
 			writer, err := unik.NewWriter(outfh, k, mode)
 			checkError(errors.Wrap(err, outFile))
 			writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+			scaler.setHeader(writer)
 
 			writer.Number = 0
 			checkError(writer.WriteHeader())
@@ -197,6 +286,10 @@ Tips:
 			if opt.Verbose {
 				log.Infof("%d k-mers saved to %s", 0, outFile)
 			}
+
+			if removalSummary != "" {
+				summarizeRemovedKmers(opt, files, mc, nil, compareTaxid, hasTaxid, taxondb, removalSummary, format)
+			}
 			return
 		}
 
@@ -326,7 +419,7 @@ Tips:
 					reader, err = unik.NewReader(infh)
 					checkError(errors.Wrap(err, file))
 
-					checkCompatibility(reader0, reader, file)
+					checkCompatibilityRescaled(reader0, reader, file, autoScaler)
 					if compareTaxid && reader.HasTaxidInfo() != hasTaxid {
 						if reader.HasTaxidInfo() {
 							checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
@@ -348,7 +441,7 @@ Tips:
 						}
 
 						for {
-							code, taxid, err = reader.ReadCodeWithTaxid()
+							code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 							if err != nil {
 								if err == io.EOF {
 									break
@@ -366,7 +459,7 @@ Tips:
 							}
 						}
 
-						r.Close()
+						closeInStream(r)
 
 						if opt.Verbose {
 							log.Infof("worker %02d: finished processing file (%d/%d): %s, %d k-mers remain", i, ifile.i+1, nfiles, file, len(m1))
@@ -377,6 +470,7 @@ Tips:
 							return
 						}
 					} else {
+						checker := newSortedChecker(requireSorted, file)
 						mc2 := make([]CodeTaxid, 0, len(mc1))
 						var qCode, code uint64
 						var qtaxid, taxid uint32
@@ -384,13 +478,14 @@ Tips:
 
 						qCode = mc1[ii].Code
 						qtaxid = mc1[ii].Taxid
-						code, taxid, err = reader.ReadCodeWithTaxid()
+						code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
 							}
 							checkError(errors.Wrap(err, file))
 						}
+						checker.check(code)
 
 						for {
 							if qCode < code {
@@ -415,26 +510,28 @@ Tips:
 								qCode = mc1[ii].Code
 								qtaxid = mc1[ii].Taxid
 
-								code, taxid, err = reader.ReadCodeWithTaxid()
+								code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 								if err != nil {
 									if err == io.EOF {
 										break
 									}
 									checkError(errors.Wrap(err, file))
 								}
+								checker.check(code)
 							} else {
-								code, taxid, err = reader.ReadCodeWithTaxid()
+								code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 								if err != nil {
 									if err == io.EOF {
 										break
 									}
 									checkError(errors.Wrap(err, file))
 								}
+								checker.check(code)
 							}
 						}
 						mc2 = append(mc2, mc1[ii:]...)
 
-						r.Close()
+						closeInStream(r)
 
 						mc1 = mc2
 						if opt.Verbose {
@@ -522,6 +619,12 @@ Tips:
 			}
 		}
 
+		if removalSummary != "" {
+			summarizeRemovedKmers(opt, files, mc, m0, compareTaxid, hasTaxid, taxondb, removalSummary, format)
+		}
+
+		checkExclusiveFraction(len(m0))
+
 		// -----------------------------------------------------------------------
 
 		// output
@@ -562,6 +665,7 @@ Tips:
 		writer, err := unik.NewWriter(outfh, k, mode)
 		checkError(errors.Wrap(err, outFile))
 		writer.SetMaxTaxid(opt.MaxTaxid)
+		scaler.setHeader(writer)
 
 		if sortKmers {
 			writer.Number = uint64(len(m0))
@@ -583,8 +687,7 @@ Tips:
 				if opt.Verbose {
 					log.Infof("sorting %d k-mers", len(codes))
 				}
-				// sort.Sort(unikmer.CodeSlice(codes))
-				sortutil.Uint64s(codes)
+				sortCodes(codes)
 				if opt.Verbose {
 					log.Infof("done sorting")
 				}
@@ -611,4 +714,123 @@ func init() {
 	diffCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	diffCmd.Flags().BoolP("sort", "s", false, helpSort)
 	diffCmd.Flags().BoolP("compare-taxid", "t", false, `take taxid into consideration. type unikmer "diff -h" for detail`)
+	diffCmd.Flags().Float64P("min-exclusive-fraction", "", 0, `minimum fraction of k-mers in the first file remaining after the difference, 0 for no checking. type unikmer "diff -h" for detail`)
+	diffCmd.Flags().StringP("fraction-action", "", "fail", `action when the fraction is below --min-exclusive-fraction, available: fail, warn`)
+	diffCmd.Flags().StringP("exclusive-summary", "", "", `output the numbers and fraction of exclusive k-mers to this file`)
+	diffCmd.Flags().StringP("removal-summary", "", "", `output numbers of removed k-mers per file and taxid to this file. type unikmer "diff -h" for detail`)
+	diffCmd.Flags().StringP("out-format", "", "tsv", `output format of --exclusive-summary and --removal-summary, available: "tsv", "json" (JSON lines)`)
+	diffCmd.Flags().IntP("scale", "D", 0, helpWriteScale)
+	diffCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
+	diffCmd.Flags().BoolP("auto-rescale", "", false, helpAutoRescale)
+	diffCmd.Flags().BoolP("skip-err", "e", false, helpSkipErr)
+	diffCmd.Flags().StringP("skipped-list", "", "", "file for saving names of files skipped by -e/--skip-err")
+}
+
+// summarizeRemovedKmers assigns each removed k-mer of the first file to the first
+// later file containing it, and outputs the numbers of removed k-mers per file
+// and per taxid (and rank) of the k-mers in the first file.
+func summarizeRemovedKmers(opt *Options, files []string, mc []CodeTaxid, m0 map[uint64]uint32,
+	compareTaxid bool, hasTaxid bool, taxondb *taxdump.Taxonomy, outFile string, format string) {
+
+	if opt.Verbose {
+		log.Infof("summarizing removed k-mers")
+	}
+
+	removed := make(map[uint64]uint32, len(mc)-len(m0))
+	var ok bool
+	for _, ct := range mc {
+		if _, ok = m0[ct.Code]; !ok {
+			removed[ct.Code] = ct.Taxid
+		}
+	}
+
+	if hasTaxid && (taxondb == nil || len(taxondb.Ranks) == 0) {
+		taxondb = loadTaxonomy(opt, true)
+	}
+
+	type fileTaxid struct {
+		i     int // index of file
+		taxid uint32
+	}
+	counts := make(map[fileTaxid]int64, 1024)
+
+	var code uint64
+	var qtaxid, taxid uint32
+	var err error
+	for i, file := range files[1:] {
+		if len(removed) == 0 {
+			break
+		}
+		if file == files[0] {
+			continue
+		}
+
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			for {
+				code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				if qtaxid, ok = removed[code]; !ok {
+					continue
+				}
+				if compareTaxid && (qtaxid == taxid ||
+					taxondb.LCA(taxid, qtaxid) == qtaxid) {
+					continue
+				}
+				counts[fileTaxid{i: i + 1, taxid: qtaxid}]++
+				delete(removed, code)
+			}
+		}()
+	}
+
+	keys := make([]fileTaxid, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].i != keys[j].i {
+			return keys[i].i < keys[j].i
+		}
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i].taxid < keys[j].taxid
+	})
+
+	outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+	checkError(err)
+	defer func() {
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}()
+
+	tw := newTableWriter(outfh, format, []string{"file", "taxid", "rank", "kmers"})
+	tw.WriteHeader()
+	var rank string
+	for _, key := range keys {
+		rank = ""
+		if hasTaxid {
+			rank = taxondb.Rank(key.taxid)
+		}
+		tw.WriteRecord(files[key.i], key.taxid, rank, counts[key])
+	}
+
+	if opt.Verbose {
+		log.Infof("summary of removed k-mers saved to %s", outFile)
+	}
 }
@@ -0,0 +1,191 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+
+	"github.com/spf13/cobra"
+)
+
+var downsampleCmd = &cobra.Command{
+	Use:   "downsample",
+	Short: "Down-sample hashed k-mers to a coarser scale",
+	Long: `Down-sample hashed k-mers to a coarser scale
+
+Hashes greater than the new max hash (the max uint64 / scale) are dropped,
+and the scale and max hash in the header are updated, so there's no need
+to re-count k-mers from sequences to change the scale.
+
+Attentions:
+  1. Only hashed k-mers are supported, i.e., 'hashed' flag is on.
+  2. The new scale (-D/--scale) should not be smaller than that of input.
+  3. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  4. Input files should ALL have or don't have taxid information.
+  5. Only a single sorted input file results in sorted output, k-mers of
+     multiple files are concatenated, use "unikmer sort" to sort them.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-prefix")
+
+		scale := getFlagPositiveInt(cmd, "scale")
+		if scale > 1<<31-1 {
+			checkError(fmt.Errorf("value of flag -D/--scale is too big"))
+		}
+		maxHash := uint64(float64(^uint64(0)) / float64(scale))
+
+		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
+			outFile += extDataFile
+		}
+		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		var writer *unik.Writer
+
+		var infh *bufio.Reader
+		var r *os.File
+		var reader0 *unik.Reader
+		var code uint64
+		var taxid uint32
+		var k int = -1
+		var hasTaxid bool
+		var nfiles = len(files)
+		var n, n0 uint64
+		for i, file := range files {
+			if opt.Verbose {
+				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+			}
+
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				if k == -1 {
+					reader0 = reader
+					k = reader.K
+					hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+
+					if !reader.IsHashed() {
+						checkError(fmt.Errorf("k-mers not hashed: %s", file))
+					}
+					if readerMaxHash(reader) < maxHash {
+						checkError(fmt.Errorf("the new scale (%d) should not be smaller than that of input (%d): %s", scale, reader.GetScale(), file))
+					}
+					if opt.Verbose {
+						log.Infof("down-sampling from scale %d to %d", reader.GetScale(), scale)
+					}
+
+					mode := reader.Flag
+					if nfiles > 1 { // k-mers of multiple files are concatenated
+						mode &^= unik.UnikSorted
+					}
+					if hasTaxid {
+						mode |= unik.UnikIncludeTaxID // for multiple input files
+					}
+					writer, err = unik.NewWriter(outfh, k, mode)
+					checkError(errors.Wrap(err, outFile))
+					writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+					writer.SetGlobalTaxid(reader.GetGlobalTaxid())
+					writer.Description = reader.Description
+					writer.SetScale(uint32(scale))
+					writer.SetMaxHash(maxHash)
+				} else {
+					checkCompatibility(reader0, reader, file)
+					if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
+						if reader.HasTaxidInfo() {
+							checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
+						} else {
+							checkError(fmt.Errorf(`taxid information found in previous files, but missing in this: %s`, file))
+						}
+					}
+				}
+
+				for {
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					n0++
+					if code > maxHash {
+						continue
+					}
+
+					n++
+					writer.WriteCodeWithTaxid(code, taxid)
+				}
+			}()
+		}
+
+		checkError(writer.Flush())
+		if opt.Verbose {
+			log.Infof("%d of %d k-mers saved to %s", n, n0, outFile)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(downsampleCmd)
+
+	downsampleCmd.Flags().IntP("scale", "D", 1, `new scale/down-sample factor`)
+
+	downsampleCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
+}
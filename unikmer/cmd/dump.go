@@ -71,6 +71,20 @@ Attentions:
 		taxid := getFlagUint32(cmd, "taxid")
 		hashed := getFlagBool(cmd, "hash")          // to compue the hash values of k-mers
 		hashedAlready := getFlagBool(cmd, "hashed") // what given are hash values
+		keepTaxids, err := parseTaxidList(getFlagStringSlice(cmd, "keep-taxid"))
+		checkError(err)
+		filterTaxid := len(keepTaxids) > 0
+
+		var filter *exprFilter
+		if expr := getFlagString(cmd, "filter-expr"); expr != "" {
+			filter, err = newExprFilter(expr)
+			checkError(errors.Wrap(err, "invalid value of --filter-expr"))
+			if hashedAlready && (filter.uses("kmer") || filter.uses("gc")) {
+				checkError(fmt.Errorf("fields 'kmer' and 'gc' in --filter-expr are not available for --hashed"))
+			}
+		}
+		var rec exprRecord
+		filterKmer := filter != nil && (filter.uses("kmer") || filter.uses("gc"))
 
 		if hashed && canonicalOnly {
 			checkError(fmt.Errorf("flag -H/--hash and -k/--canonical-only are not compatible"))
@@ -194,6 +208,16 @@ Attentions:
 						}
 
 						_taxid = uint32(tmp)
+
+						if filterTaxid {
+							if _, ok = keepTaxids[_taxid]; !ok {
+								continue
+							}
+						}
+					} else if filterTaxid {
+						checkError(fmt.Errorf("flag --keep-taxid given, but no taxids found in input"))
+					} else if filter != nil && !hasGlobalTaxid && filter.uses("taxid") {
+						checkError(fmt.Errorf("field 'taxid' in --filter-expr is not available, as no taxids found in input"))
 					}
 
 					if writer == nil {
@@ -223,11 +247,22 @@ Attentions:
 					}
 
 					if hashedAlready {
-						hash, err = strconv.ParseUint(line, 10, 64)
+						hash, err = parseCode(line)
 						if err != nil {
 							checkError(err)
 						}
 
+						if !opt.Sampler.keep(hash) {
+							continue
+						}
+
+						if filter != nil {
+							rec.code, rec.taxid, rec.kmer = hash, _taxid, nil
+							if !filter.pass(&rec) {
+								continue
+							}
+						}
+
 						if unique {
 							if _, ok = m[hash]; !ok {
 								m[hash] = struct{}{}
@@ -259,6 +294,17 @@ Attentions:
 						// }
 						hash, _ = hasher.Next(canonical)
 
+						if !opt.Sampler.keep(hash) {
+							continue
+						}
+
+						if filter != nil {
+							rec.code, rec.taxid, rec.kmer = hash, _taxid, linebytes
+							if !filter.pass(&rec) {
+								continue
+							}
+						}
+
 						if unique {
 							if _, ok = m[hash]; !ok {
 								m[hash] = struct{}{}
@@ -294,6 +340,20 @@ Attentions:
 						kcode = kcode.Canonical()
 					}
 
+					if !opt.Sampler.keep(kcode.Code) {
+						continue
+					}
+
+					if filter != nil {
+						rec.code, rec.taxid, rec.kmer = kcode.Code, _taxid, nil
+						if filterKmer {
+							rec.kmer = kcode.Bytes()
+						}
+						if !filter.pass(&rec) {
+							continue
+						}
+					}
+
 					if unique {
 						if _, ok = m[kcode.Code]; !ok {
 							m[kcode.Code] = struct{}{}
@@ -332,6 +392,8 @@ func init() {
 	dumpCmd.Flags().Uint32P("taxid", "t", 0, "global taxid")
 	dumpCmd.Flags().BoolP("hash", "H", false, `save hash of k-mer, automatically on for k>32. This flag overides global flag -c/--compact`)
 
-	dumpCmd.Flags().BoolP("hashed", "", false, `giving hash values of k-mers, This flag overides global flag -c/--compact`)
+	dumpCmd.Flags().BoolP("hashed", "", false, `giving hash values of k-mers (in decimal or hexadecimal with a prefix of "0x"), This flag overides global flag -c/--compact`)
 	dumpCmd.Flags().IntP("kmer-len", "k", 0, "k-mer length")
+	dumpCmd.Flags().StringP("filter-expr", "", "", helpFilterExpr)
+	dumpCmd.Flags().StringSliceP("keep-taxid", "", []string{}, "only keep k-mers with these taxids in the 2nd column (multiple values delimited by comma supported)")
 }
@@ -0,0 +1,217 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var editHeaderCmd = &cobra.Command{
+	Use:     "edit-header",
+	Aliases: []string{"rename-desc"},
+	Short:   "Edit header metadata of binary files",
+	Long: `Edit header metadata of binary files
+
+Editable fields:
+  1. Description  (-d/--desc)
+  2. Global taxid (-t/--global-taxid), 0 for removing it.
+  3. Scale and max hash of hashed k-mers (--scale, --max-hash), for
+     correcting wrong annotations. Hashes are not checked or changed,
+     please use "unikmer sample" for down-sampling.
+
+K-mers are not decoded, the payload is copied as it is.
+
+Output:
+  1. By default, the edited file is written to -o/--out-prefix,
+     only one input file is allowed.
+  2. With -w/--in-place, input files are edited in place.
+     For uncompressed files with the same description length,
+     only the header is rewritten, otherwise files are rewritten
+     via temporary files, with compression status kept.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-prefix")
+		inPlace := getFlagBool(cmd, "in-place")
+
+		setDesc := cmd.Flags().Changed("desc")
+		desc := []byte(getFlagString(cmd, "desc"))
+		setTaxid := cmd.Flags().Changed("global-taxid")
+		taxid := getFlagUint32(cmd, "global-taxid")
+		setScale := cmd.Flags().Changed("scale")
+		scale := getFlagUint32(cmd, "scale")
+		setMaxHash := cmd.Flags().Changed("max-hash")
+		maxHash := getFlagUint64(cmd, "max-hash")
+
+		if !(setDesc || setTaxid || setScale || setMaxHash) {
+			checkError(fmt.Errorf("at least one of -d/--desc, -t/--global-taxid, --scale and --max-hash needed"))
+		}
+		if len(desc) > 1024 {
+			checkError(fmt.Errorf("description too long (%d bytes), should be <= 1024 bytes", len(desc)))
+		}
+		if setScale && scale == 0 {
+			checkError(fmt.Errorf("value of --scale should be positive"))
+		}
+
+		if inPlace {
+			if cmd.Flags().Changed("out-prefix") {
+				checkError(fmt.Errorf("flag -w/--in-place and -o/--out-prefix are not compatible"))
+			}
+			for _, file := range files {
+				if isStdin(file) {
+					checkError(fmt.Errorf("flag -w/--in-place does not support stdin"))
+				}
+				if _, ok := tarMembers[file]; ok {
+					checkError(fmt.Errorf("flag -w/--in-place does not support files in tar archives: %s", file))
+				}
+				if _, ok := muxMembers[file]; ok {
+					checkError(fmt.Errorf("flag -w/--in-place does not support files in multiplexed stream: %s", file))
+				}
+			}
+		} else if len(files) > 1 {
+			checkError(fmt.Errorf("only one input file allowed, please use -w/--in-place for multiple files"))
+		}
+
+		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
+			outFile += extDataFile
+		}
+
+		// editHeader copies data from a file to another one with the edited header.
+		// It returns whether the header was rewritten in place.
+		editHeader := func(file string, outFile string) bool {
+			infh, r, gzipped, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if (setScale || setMaxHash) && !reader.IsHashed() {
+				checkError(fmt.Errorf("--scale and --max-hash are only for hashed k-mers: %s", file))
+			}
+
+			var buf bytes.Buffer
+			writer, err := unik.NewWriter(&buf, reader.K, reader.Flag)
+			checkError(errors.Wrap(err, file))
+			writer.Number = reader.Number
+			writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+			writer.Description = reader.Description
+			if setDesc {
+				writer.Description = desc
+			}
+			writer.SetGlobalTaxid(reader.GetGlobalTaxid())
+			if setTaxid {
+				writer.SetGlobalTaxid(taxid)
+			}
+			writer.Scale = reader.Scale
+			if setScale {
+				writer.SetScale(scale)
+			}
+			writer.MaxHash = reader.MaxHash
+			if setMaxHash {
+				writer.SetMaxHash(maxHash)
+			}
+			checkError(errors.Wrap(writer.WriteHeader(), file))
+
+			if inPlace && !gzipped && len(writer.Description) == len(reader.Description) {
+				fh, err := os.OpenFile(file, os.O_WRONLY, 0644)
+				checkError(errors.Wrap(err, file))
+				_, err = fh.WriteAt(buf.Bytes(), 0)
+				checkError(errors.Wrap(err, file))
+				checkError(errors.Wrap(fh.Close(), file))
+				return true
+			}
+
+			outfh, gw, w, err := outStream(outFile, gzipped || (!inPlace && opt.Compress), opt.CompressionLevel)
+			checkError(err)
+
+			_, err = outfh.Write(buf.Bytes())
+			checkError(errors.Wrap(err, outFile))
+			_, err = io.Copy(outfh, infh)
+			checkError(errors.Wrap(err, outFile))
+
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+			return false
+		}
+
+		if !inPlace {
+			editHeader(files[0], outFile)
+			if opt.Verbose {
+				log.Infof("edited file saved to %s", outFile)
+			}
+			return
+		}
+
+		var tmpFile string
+		for _, file := range files {
+			tmpFile = file + ".tmp"
+			if editHeader(file, tmpFile) {
+				if opt.Verbose {
+					log.Infof("header rewritten in place: %s", file)
+				}
+				continue
+			}
+			checkError(renameWithRetry(tmpFile, file))
+			if opt.Verbose {
+				log.Infof("file rewritten: %s", file)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(editHeaderCmd)
+
+	editHeaderCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
+	editHeaderCmd.Flags().BoolP("in-place", "w", false, `edit files in place`)
+	editHeaderCmd.Flags().StringP("desc", "d", "", `description, empty string for removing it`)
+	editHeaderCmd.Flags().Uint32P("global-taxid", "t", 0, `global taxid, 0 for removing it`)
+	editHeaderCmd.Flags().Uint32P("scale", "", 0, `scale of hashed k-mers`)
+	editHeaderCmd.Flags().Uint64P("max-hash", "", 0, `max hash of hashed k-mers`)
+}
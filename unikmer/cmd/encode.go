@@ -59,6 +59,7 @@ var encodeCmd = &cobra.Command{
 		all := getFlagBool(cmd, "all")
 		canonical := getFlagBool(cmd, "canonical")
 		hashed := getFlagBool(cmd, "hash")
+		hexCode := getFlagBool(cmd, "hex")
 
 		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
 		checkError(err)
@@ -107,7 +108,7 @@ var encodeCmd = &cobra.Command{
 						checkError(errors.Wrap(err, line))
 						// for hash = range hasher.Hash(canonical) {
 						hash, _ = hasher.Next(canonical)
-						outfh.WriteString(fmt.Sprintf("%d\n", hash))
+						outfh.WriteString(formatCode(hash, hexCode) + "\n")
 
 						continue
 					}
@@ -121,9 +122,9 @@ var encodeCmd = &cobra.Command{
 					}
 
 					if all {
-						outfh.WriteString(fmt.Sprintf("%s\t%s\t%d\t%s\n", line, kcode.String(), kcode.Code, kcode.BitsString()))
+						outfh.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\n", line, kcode.String(), formatCode(kcode.Code, hexCode), kcode.BitsString()))
 					} else {
-						outfh.WriteString(fmt.Sprintf("%d\n", kcode.Code))
+						outfh.WriteString(formatCode(kcode.Code, hexCode) + "\n")
 					}
 				}
 			}
@@ -139,4 +140,5 @@ func init() {
 	encodeCmd.Flags().BoolP("all", "a", false, `output all data: orginial k-mer, parsed k-mer, encoded integer, encode bits`)
 	encodeCmd.Flags().BoolP("canonical", "K", false, "keep the canonical k-mers")
 	encodeCmd.Flags().BoolP("hash", "H", false, `save hash of k-mer, automatically on for k>32`)
+	encodeCmd.Flags().BoolP("hex", "x", false, `output encoded integers (or hashes) in hexadecimal format with a prefix of "0x"`)
 }
@@ -24,6 +24,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -31,14 +32,15 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
 	"github.com/shenwei356/breader"
 	"github.com/shenwei356/kmers"
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts"
-	"github.com/twotwotwo/sorts/sortutil"
 	"github.com/will-rowe/nthash"
 )
 
@@ -57,6 +59,31 @@ Tips:
      lots of files, especially on SDD.
   2. For searching using binary .unik file, use 'unikmer inter --mix-taxid',
      which is faster than 'unikmer grep' in single-thread mode.
+  3. Query k-mers can also be generated from FASTA/Q sequences (-Q/--query-fasta),
+     k-mers are hashed or encoded following the 'k/canonical/hashed/scaled'
+     setting of the first binary file.
+  4. For hashed k-mers, use --query-is-code to search with hash values
+     (decimal or hexadecimal with a prefix of "0x"), e.g., from
+     'unikmer view -N'.
+  5. To find files containing the queries, use "--report files" to output
+     the number of distinct matched queries in each file, with a pass/fail
+     column given --min-matches and --min-match-frac.
+  6. For SNP-tolerant searching of (not hashed) k-mers from -q/--query and
+     -f/--query-file, use -M/--max-mismatch to also search all k-mers within
+     the given Hamming distance. The number of k-mers grows fast, i.e.,
+     sum_{i=0..M} C(k,i)*3^i for each query, which is limited by
+     --max-mismatch-kmers. Expanded k-mers are also counted as queries
+     in "--report files".
+  7. Matched k-mers of multiple files are outputted in the order of reading,
+     which varies between runs when using multiple threads. Use
+     --deterministic to output them in the order of input files, at the
+     cost of buffering matched k-mers of files finished in advance.
+     Or use -s/--sort for sorted output.
+  8. For huge query sets from -F/--query-unik-file, e.g., billions of k-mers,
+     use "--query-set sorted" to store them in a sorted list with binary
+     search, which uses ~4X less memory than a hash map but is slower,
+     especially for big input files. The default "auto" mode keeps queries
+     in a sorted list when there are more than --query-set-threshold k-mers.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -77,15 +104,26 @@ Tips:
 		}
 
 		checkFileSuffix(opt, extDataFile, files...)
+		autoRescale := getFlagBool(cmd, "auto-rescale")
+		preflightCheck(opt, files, autoRescale)
 
 		outFile := getFlagString(cmd, "out-prefix")
-		queries := getFlagStringSlice(cmd, "query")
-		queryFiles := getFlagStringSlice(cmd, "query-file")
-		queryUnikFiles := getFlagStringSlice(cmd, "query-unik-file")
+		queries := getFlagNonEmptyStringSlice(cmd, "query")
+		queryFiles := getFlagNonEmptyStringSlice(cmd, "query-file")
+		queryUnikFiles := getFlagNonEmptyStringSlice(cmd, "query-unik-file")
+		queryFastaFiles := getFlagNonEmptyStringSlice(cmd, "query-fasta")
 		queryWithTaxids := getFlagBool(cmd, "query-is-taxid")
+		queryWithCodes := getFlagBool(cmd, "query-is-code")
+
+		var autoScaler *writeScaler
+		if autoRescale {
+			autoScaler = getAutoRescaler(opt, append(append([]string{}, queryUnikFiles...), files...))
+		}
 
 		invertMatch := getFlagBool(cmd, "invert-match")
 		degenerate := getFlagBool(cmd, "degenerate")
+		maxMismatch := getFlagNonNegativeInt(cmd, "max-mismatch")
+		maxMismatchKmers := getFlagPositiveInt(cmd, "max-mismatch-kmers")
 
 		mOutputs := getFlagBool(cmd, "multiple-outfiles")
 		outdir := getFlagString(cmd, "out-dir")
@@ -95,14 +133,59 @@ Tips:
 		sortKmers := getFlagBool(cmd, "sort")
 		unique := getFlagBool(cmd, "unique")
 		repeated := getFlagBool(cmd, "repeated")
+		deterministic := getFlagBool(cmd, "deterministic")
+		querySetMode := strings.ToLower(getFlagString(cmd, "query-set"))
+		querySetThreshold := getFlagPositiveInt(cmd, "query-set-threshold")
+		switch querySetMode {
+		case "auto", "map", "sorted":
+		default:
+			checkError(fmt.Errorf("invalid value of --query-set: %s, available: auto, map, sorted", querySetMode))
+		}
 
 		if (unique || repeated) && !sortKmers {
 			log.Infof("flag -s/--sort is switched on when given -u/--unique or -d/--repeated")
 			sortKmers = true
 		}
 
-		if len(queries) == 0 && len(queryFiles) == 0 && len(queryUnikFiles) == 0 {
-			checkError(fmt.Errorf("one of flags -q/--query, -f/--query-file and -F/--query-unik-file needed"))
+		if len(queries) == 0 && len(queryFiles) == 0 && len(queryUnikFiles) == 0 && len(queryFastaFiles) == 0 {
+			checkError(fmt.Errorf("one of flags -q/--query, -f/--query-file, -F/--query-unik-file and -Q/--query-fasta needed"))
+		}
+		if queryWithTaxids && len(queryFastaFiles) > 0 {
+			checkError(fmt.Errorf("flag -t/--query-is-taxid and -Q/--query-fasta are not compatible"))
+		}
+		if queryWithTaxids && queryWithCodes {
+			checkError(fmt.Errorf("flag -t/--query-is-taxid and --query-is-code are not compatible"))
+		}
+		if maxMismatch > 0 && queryWithTaxids {
+			checkError(fmt.Errorf("flag -t/--query-is-taxid and -M/--max-mismatch are not compatible"))
+		}
+		if maxMismatch > 0 && queryWithCodes {
+			checkError(fmt.Errorf("flag --query-is-code and -M/--max-mismatch are not compatible"))
+		}
+
+		report := strings.ToLower(getFlagString(cmd, "report"))
+		var reportFiles bool
+		switch report {
+		case "kmers":
+		case "files":
+			reportFiles = true
+		default:
+			checkError(fmt.Errorf(`invalid value of flag --report: %s, available: "kmers", "files"`, report))
+		}
+		minMatches := getFlagNonNegativeInt(cmd, "min-matches")
+		minMatchFrac := getFlagNonNegativeFloat64(cmd, "min-match-frac")
+		if minMatchFrac > 1 {
+			checkError(fmt.Errorf("value of flag --min-match-frac should be in range of [0, 1]"))
+		}
+		var format string
+		if reportFiles {
+			if mOutputs {
+				checkError(fmt.Errorf("flag -m/--multiple-outfiles and --report files are not compatible"))
+			}
+			if invertMatch {
+				checkError(fmt.Errorf("flag -v/--invert-match and --report files are not compatible"))
+			}
+			format = getFlagTableFormat(cmd)
 		}
 
 		if mOutputs && !isStdin(outFile) {
@@ -122,10 +205,7 @@ Tips:
 		// load k-mers from cli
 		queryList := make([]string, 0, mapInitSize) // for plain k-mer text from -q and -f.
 		for _, query := range queries {
-			if query == "" {
-				continue
-			}
-			if !queryWithTaxids {
+			if !queryWithTaxids && !queryWithCodes {
 				if k == -1 {
 					k = len(query)
 				} else if len(query) != k {
@@ -152,7 +232,10 @@ Tips:
 					checkError(chunk.Err)
 					for _, data = range chunk.Data {
 						query = data.(string)
-						if !queryWithTaxids {
+						if query == "" {
+							continue
+						}
+						if !queryWithTaxids && !queryWithCodes {
 							if k == -1 {
 								k = len(query)
 							} else if len(query) != k {
@@ -167,9 +250,10 @@ Tips:
 
 		// encode k-mers or parse taxids
 		var kcode kmers.KmerCode
-		var mer []byte
 		var _queries [][]byte
+		var dqueries [][]byte
 		var val uint64
+		var queryCodes []uint64
 		for _, query := range queryList {
 			if queryWithTaxids {
 				val, err = strconv.ParseUint(query, 10, 32)
@@ -180,18 +264,73 @@ Tips:
 				mt[uint32(val)] = struct{}{}
 				continue
 			}
+			if queryWithCodes {
+				val, err = parseCode(query)
+				if err != nil {
+					checkError(fmt.Errorf("query code should be non-negative integer in decimal or hexadecimal format: %s", query))
+				}
+
+				queryCodes = append(queryCodes, val)
+				continue
+			}
 			if degenerate {
-				_queries, err = extendDegenerateSeq([]byte(query))
+				dqueries, err = extendDegenerateSeq([]byte(query))
 				if err != nil {
 					checkError(fmt.Errorf("fail to extend degenerate sequence '%s': %s", query, err))
 				}
+				_queries = append(_queries, dqueries...)
 			} else {
-				_queries = [][]byte{[]byte(query)}
+				_queries = append(_queries, []byte(query))
 			}
 
 			// encode later, cause we have to chose hash/encode depends on the file
 		}
 
+		// guard on the number of k-mers with mismatches
+		if maxMismatch > 0 && len(_queries) > 0 {
+			if maxMismatch > k {
+				checkError(fmt.Errorf("value of -M/--max-mismatch (%d) should not be greater than k (%d)", maxMismatch, k))
+			}
+			n := hammingNeighborhoodSize(k, maxMismatch)
+			if n < 0 || n > int64(maxMismatchKmers)/int64(len(_queries)) {
+				checkError(fmt.Errorf("too many k-mers (> %d) to search with -M/--max-mismatch %d for %d queries of k=%d, please decrease the value of -M/--max-mismatch or increase --max-mismatch-kmers",
+					maxMismatchKmers, maxMismatch, len(_queries), k))
+			}
+			if opt.Verbose {
+				log.Infof("up to %d k-mers with <= %d mismatches will be searched for each query", n, maxMismatch)
+			}
+		}
+
+		// load sequences for generating query k-mers
+		var querySeqs []*seq.Seq
+		if len(queryFastaFiles) > 0 {
+			querySeqs = make([]*seq.Seq, 0, 8)
+			nfiles = len(queryFastaFiles)
+			var fastxReader *fastx.Reader
+			var record *fastx.Record
+			for i, file := range queryFastaFiles {
+				if opt.Verbose {
+					log.Infof("loading query sequences from FASTA/Q file [%d/%d]: %s", i+1, nfiles, file)
+				}
+				fastxReader, err = fastx.NewDefaultReader(file)
+				checkError(errors.Wrap(err, file))
+				for {
+					record, err = fastxReader.Read()
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+						break
+					}
+					querySeqs = append(querySeqs, record.Seq.Clone())
+				}
+			}
+			if opt.Verbose {
+				log.Infof("%d query sequences loaded", len(querySeqs))
+			}
+		}
+
 		var infh *bufio.Reader
 		var r *os.File
 		var reader0 *unik.Reader
@@ -204,6 +343,15 @@ Tips:
 
 		loadQueryFromUnik = len(queryUnikFiles) != 0
 
+		// k-mers from .unik files can be stored in a sorted list to save memory
+		var useQuerySet bool
+		var querySet codeSet
+		var queryCodesUnik []uint64
+		if loadQueryFromUnik && !queryWithTaxids && querySetMode != "map" {
+			useQuerySet = true
+			queryCodesUnik = make([]uint64, 0, mapInitSize)
+		}
+
 		// load k-mers/taxids from .unik files
 		if loadQueryFromUnik {
 			nfiles = len(queryUnikFiles)
@@ -215,7 +363,7 @@ Tips:
 				flag = func() int {
 					infh, r, _, err = inStream(file)
 					checkError(err)
-					defer r.Close()
+					defer closeInStream(r)
 
 					reader, err := unik.NewReader(infh)
 					checkError(errors.Wrap(err, file))
@@ -237,8 +385,18 @@ Tips:
 						}
 						reader0 = reader
 					} else {
-						checkCompatibility(reader0, reader, file)
+						checkCompatibilityRescaled(reader0, reader, file, autoScaler)
 					}
+
+					// avoid growing the list by doubling
+					if useQuerySet && reader.Number > 0 && reader.Number < 1<<40 {
+						if n := len(queryCodesUnik) + int(reader.Number); n > cap(queryCodesUnik) {
+							tmp := make([]uint64, len(queryCodesUnik), n)
+							copy(tmp, queryCodesUnik)
+							queryCodesUnik = tmp
+						}
+					}
+
 					for {
 						code, taxid, err = reader.ReadCodeWithTaxid()
 						if err != nil {
@@ -252,9 +410,16 @@ Tips:
 							mt[taxid] = struct{}{}
 							continue
 						}
+						if !autoScaler.keep(code) {
+							continue
+						}
 						if !canonical && !hashed {
 							code = kmers.Canonical(code, k)
 						}
+						if useQuerySet {
+							queryCodesUnik = append(queryCodesUnik, code)
+							continue
+						}
 						m[code] = struct{}{}
 					}
 
@@ -267,6 +432,20 @@ Tips:
 					break
 				}
 			}
+
+			if useQuerySet {
+				querySet = newCodeSet(queryCodesUnik)
+				queryCodesUnik = nil
+				if querySetMode == "auto" && len(querySet) <= querySetThreshold {
+					for _, code = range querySet {
+						m[code] = struct{}{}
+					}
+					useQuerySet = false
+					querySet = nil
+				} else if opt.Verbose {
+					log.Infof("query k-mers from binary files are stored in a sorted list")
+				}
+			}
 		}
 
 		if opt.Verbose {
@@ -278,11 +457,11 @@ Tips:
 				log.Infof("%d taxids loaded", len(mt))
 			} else {
 				if loadQueryFromUnik {
-					if len(m) == 0 {
-						log.Warningf("%d k-mers loaded from binary files", len(m))
+					if len(m)+len(querySet) == 0 {
+						log.Warningf("%d k-mers loaded from binary files", len(m)+len(querySet))
 						return
 					}
-					log.Infof("%d k-mers loaded from binary files", len(m))
+					log.Infof("%d k-mers loaded from binary files", len(m)+len(querySet))
 				}
 			}
 			log.Info()
@@ -387,14 +566,54 @@ Tips:
 		var once sync.Once
 		chEncodeQueries := make(chan int)
 
-		if !mOutputs {
+		// matched queries of each file, for --report files
+		var nMatches []int
+		if reportFiles {
+			nMatches = make([]int, len(files))
+		}
+
+		if !mOutputs && !reportFiles {
 			done = make(chan int)
 			chCodes = make(chan uint64, threads)
 			chCodesTaxids = make(chan CodeTaxid, threads)
 		}
 
+		// for --deterministic, matched k-mers of each file are buffered,
+		// and sent to the global writer in the order of input files.
+		deterministic = deterministic && !mOutputs && !reportFiles && !sortKmers && len(files) > 1
+		var fileDone []chan int
+		var buffers [][]CodeTaxid
+		var doneEmit chan int
+		if deterministic {
+			fileDone = make([]chan int, len(files))
+			for i := range fileDone {
+				fileDone[i] = make(chan int)
+			}
+			buffers = make([][]CodeTaxid, len(files))
+			doneEmit = make(chan int)
+
+			go func() {
+				for i := range files {
+					<-fileDone[i]
+					for _, codeT := range buffers[i] {
+						if hasTaxid {
+							chCodesTaxids <- codeT
+						} else {
+							chCodes <- codeT.Code
+						}
+					}
+					buffers[i] = nil
+				}
+				doneEmit <- 1
+			}()
+		}
+
 		nfiles = len(files)
+		enableGracefulInterrupt()
 		for i, file := range files {
+			if interrupted() {
+				break
+			}
 			tokens <- 1
 			wg.Add(1)
 
@@ -404,6 +623,14 @@ Tips:
 					wg.Done()
 				}()
 
+				var _buffer []CodeTaxid
+				if deterministic {
+					defer func() {
+						buffers[i] = _buffer
+						close(fileDone[i])
+					}()
+				}
+
 				var infh *bufio.Reader
 				var r *os.File
 				var reader *unik.Reader
@@ -424,7 +651,7 @@ Tips:
 
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err = unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -437,7 +664,7 @@ Tips:
 				_sorted = reader.IsSorted()
 
 				if loadQueryFromUnik {
-					checkCompatibility(reader0, reader, file)
+					checkCompatibilityRescaled(reader0, reader, file, autoScaler)
 				}
 
 				// if the input files is already sorted, we don't have to sort again in mOutput mode.
@@ -449,7 +676,11 @@ Tips:
 						hashed = reader.IsHashed()
 					}
 					// lazily encode queries
+					nKmers0 := len(m)
 					if hashed {
+						if maxMismatch > 0 && len(_queries) > 0 {
+							checkError(fmt.Errorf("flag -M/--max-mismatch is not supported for hashed k-mers"))
+						}
 						var hasher *nthash.NTHi
 						var hash uint64
 						for _, q := range _queries {
@@ -462,31 +693,72 @@ Tips:
 						for _, q := range _queries {
 							kcode, err = kmers.NewKmerCode(q)
 							if err != nil {
-								checkError(fmt.Errorf("fail to encode query '%s': %s", mer, err))
+								checkError(fmt.Errorf("fail to encode query '%s': %s", q, err))
+							}
+							if maxMismatch > 0 {
+								addHammingNeighbors(m, kcode.Code, k, maxMismatch)
+								continue
 							}
 							m[kcode.Canonical().Code] = struct{}{}
 						}
 					}
+					nQueries := len(_queries)
+					if maxMismatch > 0 && !hashed {
+						nQueries = len(m) - nKmers0
+					}
+
+					// codes/hashes
+					if len(queryCodes) > 0 {
+						if k == -1 {
+							k = reader.K
+						}
+						for _, code := range queryCodes {
+							if !hashed {
+								code = kmers.Canonical(code, k)
+							}
+							m[code] = struct{}{}
+						}
+						nQueries += len(queryCodes)
+					}
+
+					// k-mers from sequences
+					if len(querySeqs) > 0 {
+						if k == -1 {
+							k = reader.K
+						}
+						n0 := len(m)
+						addQueryKmersFromSeqs(m, querySeqs, k, hashed, _canonical, reader)
+						nQueries += len(m) - n0
+					}
+
+					// remove additional queries existing in the sorted list
+					if useQuerySet {
+						for code := range m {
+							if querySet.has(code) {
+								delete(m, code)
+							}
+						}
+					}
+
 					if loadQueryFromUnik {
-						if len(_queries) > 0 && opt.Verbose {
-							log.Infof("additional %d k-mers loaded", len(_queries))
+						if nQueries > 0 && opt.Verbose {
+							log.Infof("additional %d k-mers loaded", nQueries)
 						}
 					} else if !queryWithTaxids {
-						if len(_queries) == 0 {
-							log.Warningf("%d k-mers loaded", len(_queries))
+						if nQueries == 0 {
+							log.Warningf("%d k-mers loaded", nQueries)
 							os.Exit(0)
 						} else if opt.Verbose {
-							log.Infof("%d k-mers loaded", len(_queries))
+							log.Infof("%d k-mers loaded", nQueries)
 						}
 					}
 
-					if !mOutputs { // set global writer
-						if !loadQueryFromUnik {
-							reader0 = reader
-						}
-
-						hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+					if !loadQueryFromUnik {
+						reader0 = reader
+					}
+					hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
 
+					if !mOutputs && !reportFiles { // set global writer
 						if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 							outFile += extDataFile
 						}
@@ -514,6 +786,7 @@ Tips:
 						writer, err = unik.NewWriter(outfh, reader.K, mode)
 						checkError(errors.Wrap(err, outFile))
 						writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+						autoScaler.setHeader(writer)
 
 						go func() {
 							if hasTaxid {
@@ -548,7 +821,7 @@ Tips:
 				}
 
 				if !loadQueryFromUnik {
-					checkCompatibility(reader0, reader, file)
+					checkCompatibilityRescaled(reader0, reader, file, autoScaler)
 				}
 				if !queryWithTaxids && k != reader.K {
 					checkError(fmt.Errorf("K (%d) of binary file '%s' not equal to query K (%d)", reader.K, file, k))
@@ -598,6 +871,7 @@ Tips:
 					_writer, err = unik.NewWriter(_outfh, reader.K, mode)
 					checkError(errors.Wrap(err, _outFile))
 					_writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+					autoScaler.setHeader(_writer)
 					if _hasGlobalTaxid {
 						checkError(_writer.SetGlobalTaxid(reader.GetGlobalTaxid()))
 					}
@@ -614,16 +888,36 @@ Tips:
 					checkError(_writer.Flush())
 				}
 
+				// distinct matched queries
+				var matchedCodes map[uint64]struct{}
+				var matchedTaxids map[uint32]struct{}
+				if reportFiles {
+					if queryWithTaxids {
+						matchedTaxids = make(map[uint32]struct{}, len(mt))
+					} else {
+						matchedCodes = make(map[uint64]struct{}, len(m))
+					}
+				}
+
 				var code uint64
 				var taxid uint32
+				var nRead int
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					nRead++
+					if nRead&(1<<20-1) == 0 && interrupted() {
+						return
+					}
+
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
 						}
 						checkError(errors.Wrap(err, file))
 					}
+					if !autoScaler.keep(code) {
+						continue
+					}
 
 					if queryWithTaxids {
 						if singleTaxidQuery {
@@ -642,6 +936,9 @@ Tips:
 								code = kmers.Canonical(code, _k)
 							}
 							_, ok = m[code]
+							if !ok && useQuerySet {
+								ok = querySet.has(code)
+							}
 						}
 					}
 
@@ -655,6 +952,15 @@ Tips:
 						continue
 					}
 
+					if reportFiles {
+						if queryWithTaxids {
+							matchedTaxids[taxid] = struct{}{}
+						} else {
+							matchedCodes[code] = struct{}{}
+						}
+						continue
+					}
+
 					if mOutputs {
 						if sortKmers && _mustSort {
 							if _isIncludeTaxid {
@@ -667,7 +973,9 @@ Tips:
 							n++
 						}
 					} else {
-						if hasTaxid {
+						if deterministic {
+							_buffer = append(_buffer, CodeTaxid{Code: code, Taxid: taxid})
+						} else if hasTaxid {
 							chCodesTaxids <- CodeTaxid{Code: code, Taxid: taxid}
 						} else {
 							chCodes <- code
@@ -675,6 +983,18 @@ Tips:
 					}
 				}
 
+				if reportFiles {
+					if queryWithTaxids {
+						nMatches[i] = len(matchedTaxids)
+					} else {
+						nMatches[i] = len(matchedCodes)
+					}
+					if opt.Verbose {
+						log.Infof("[file %d/%d] %d queries matched", i+1, nfiles, nMatches[i])
+					}
+					return
+				}
+
 				if !mOutputs {
 					return
 				}
@@ -684,14 +1004,12 @@ Tips:
 						if opt.Verbose {
 							log.Infof("[file %d/%d] sorting %d k-mers", i+1, nfiles, len(_codesTaxids))
 						}
-						// sort.Sort(CodeTaxidSlice(_codesTaxids))
-						sorts.Quicksort(CodeTaxidSlice(_codesTaxids))
+						sortCodesTaxids(_codesTaxids)
 					} else {
 						if opt.Verbose {
 							log.Infof("[file %d/%d] sorting %d k-mers", i+1, nfiles, len(_codes))
 						}
-						// sort.Sort(unikmer.CodeSlice(_codes))
-						sortutil.Uint64s(_codes)
+						sortCodes(_codes)
 					}
 
 					if opt.Verbose {
@@ -776,8 +1094,50 @@ Tips:
 		}
 
 		wg.Wait()
+		exitIfInterrupted()
+
+		if reportFiles {
+			var nQueries int
+			if queryWithTaxids {
+				nQueries = len(mt)
+			} else {
+				nQueries = len(m) + len(querySet)
+			}
+			outfh, gw, w, err = outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+			checkError(err)
+			defer func() {
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			}()
+
+			tw := newTableWriter(outfh, format, []string{"file", "matched", "queries", "fraction", "pass"})
+			tw.WriteHeader()
+			var frac float64
+			var nPass int
+			for i, file := range files {
+				frac = 0
+				if nQueries > 0 {
+					frac = float64(nMatches[i]) / float64(nQueries)
+				}
+				pass := nMatches[i] >= minMatches && frac >= minMatchFrac
+				if pass {
+					nPass++
+				}
+				tw.WriteRecord(file, nMatches[i], nQueries, roundFloat(frac, 4), pass)
+			}
+			if opt.Verbose {
+				log.Infof("%d of %d files passed", nPass, len(files))
+			}
+			return
+		}
 
 		if !mOutputs {
+			if deterministic {
+				<-doneEmit
+			}
 			close(chCodes)
 			close(chCodesTaxids)
 			<-done
@@ -792,14 +1152,12 @@ Tips:
 				if opt.Verbose {
 					log.Infof("sorting %d k-mers", len(codesTaxids))
 				}
-				// sort.Sort(CodeTaxidSlice(codesTaxids))
-				sorts.Quicksort(CodeTaxidSlice(codesTaxids))
+				sortCodesTaxids(codesTaxids)
 			} else {
 				if opt.Verbose {
 					log.Infof("sorting %d k-mers", len(codes))
 				}
-				// sort.Sort(unikmer.CodeSlice(codes))
-				sortutil.Uint64s(codes)
+				sortCodes(codes)
 			}
 			if opt.Verbose {
 				log.Infof("done sorting")
@@ -895,11 +1253,20 @@ func init() {
 	grepCmd.Flags().StringSliceP("query", "q", []string{""}, `query k-mers/taxids (multiple values delimted by comma supported)`)
 	grepCmd.Flags().StringSliceP("query-file", "f", []string{""}, "query file (one k-mer/taxid per line)")
 	grepCmd.Flags().StringSliceP("query-unik-file", "F", []string{""}, "query file in .unik format")
+	grepCmd.Flags().StringSliceP("query-fasta", "Q", []string{}, "query FASTA/Q file, k-mers are generated following the settings of the first binary file")
 	grepCmd.Flags().BoolP("query-is-taxid", "t", false, "queries are taxids")
+	grepCmd.Flags().BoolP("query-is-code", "", false, `queries are encoded integers or hashes of k-mers, in decimal or hexadecimal (with a prefix of "0x") format`)
 
 	grepCmd.Flags().BoolP("degenerate", "D", false, "query k-mers contains degenerate base")
+	grepCmd.Flags().IntP("max-mismatch", "M", 0, "also search k-mers with at most M mismatches (Hamming distance) to query k-mers from -q/--query and -f/--query-file, only for k-mers not hashed")
+	grepCmd.Flags().IntP("max-mismatch-kmers", "", 10000000, "maximum number of k-mers to search with -M/--max-mismatch, to avoid combinatorial explosion")
 	grepCmd.Flags().BoolP("invert-match", "v", false, "invert the sense of matching, to select non-matching records")
 
+	grepCmd.Flags().StringP("report", "", "kmers", `what to report: "kmers" (matched k-mers in binary format), "files" (numbers of matched queries of each file in tabular format)`)
+	grepCmd.Flags().IntP("min-matches", "", 1, `minimum number of matched queries for a file to pass, for "--report files"`)
+	grepCmd.Flags().Float64P("min-match-frac", "", 0, `minimum fraction of matched queries for a file to pass, for "--report files"`)
+	grepCmd.Flags().StringP("out-format", "", "tsv", `output format of "--report files", available: "tsv", "json" (JSON lines)`)
+
 	grepCmd.Flags().BoolP("multiple-outfiles", "m", false, "write results into separated files for multiple input files")
 	grepCmd.Flags().StringP("out-dir", "O", "unikmer-grep", "output directory")
 	grepCmd.Flags().StringP("out-suffix", "S", grepDefaultOutSuffix, "output suffix")
@@ -908,7 +1275,106 @@ func init() {
 	grepCmd.Flags().BoolP("sort", "s", false, helpSort)
 	grepCmd.Flags().BoolP("unique", "u", false, `remove duplicate k-mers`)
 	grepCmd.Flags().BoolP("repeated", "d", false, `only print duplicate k-mers`)
+	grepCmd.Flags().StringP("query-set", "", "auto", `data structure of query k-mers from -F/--query-unik-file: "map" (hash map, fast), "sorted" (sorted list, less memory), "auto" (sorted list for more than --query-set-threshold k-mers)`)
+	grepCmd.Flags().IntP("query-set-threshold", "", 100000000, `number of query k-mers above which a sorted list is used in "--query-set auto" mode`)
+	grepCmd.Flags().BoolP("auto-rescale", "", false, helpAutoRescale)
+	grepCmd.Flags().BoolP("deterministic", "", false, `output matched k-mers in the order of input files, for byte-identical outputs between runs`)
 
 }
 
 var grepDefaultOutSuffix = ".grep"
+
+// addQueryKmersFromSeqs hashes or encodes k-mers of sequences following
+// the 'canonical/hashed/scaled' flags of a binary file, and adds them to m.
+func addQueryKmersFromSeqs(m map[uint64]struct{}, seqs []*seq.Seq, k int, hashed bool, canonical bool, reader *unik.Reader) {
+	scaled := reader.IsScaled()
+	maxHash := readerMaxHash(reader)
+
+	var iter *sketches.Iterator
+	var code uint64
+	var ok bool
+	var err error
+	for _, s := range seqs {
+		if len(s.Seq) < k {
+			continue
+		}
+		if hashed {
+			iter, err = sketches.NewHashIterator(s, k, canonical, false)
+		} else {
+			// non-hashed k-mers are always compared in canonical form
+			iter, err = sketches.NewKmerIterator(s, k, true, false)
+		}
+		if err != nil {
+			if err == sketches.ErrShortSeq {
+				continue
+			}
+			checkError(errors.Wrap(err, "generating query k-mers"))
+		}
+
+		for {
+			if hashed {
+				code, ok = iter.NextHash()
+			} else {
+				code, ok, err = iter.NextKmer()
+				if err != nil {
+					checkError(errors.Wrap(err, "generating query k-mers"))
+				}
+			}
+			if !ok {
+				break
+			}
+			if scaled && code > maxHash {
+				continue
+			}
+			m[code] = struct{}{}
+		}
+	}
+}
+
+// hammingNeighborhoodSize returns the number of k-mers within
+// the Hamming distance of d, i.e., sum_{i=0..d} C(k,i)*3^i.
+// A negative value is returned on overflow.
+func hammingNeighborhoodSize(k int, d int) int64 {
+	var n, c int64 = 1, 1 // c = C(k,i)*3^i
+	for i := 1; i <= d; i++ {
+		if c > math.MaxInt64/int64(k-i+1) {
+			return -1
+		}
+		c = c * int64(k-i+1) / int64(i)
+		if c > math.MaxInt64/3 {
+			return -1
+		}
+		c *= 3
+		if n > math.MaxInt64-c {
+			return -1
+		}
+		n += c
+	}
+	return n
+}
+
+// addHammingNeighbors adds canonical codes of all k-mers within
+// the Hamming distance of d from the k-mer code, including itself.
+func addHammingNeighbors(m map[uint64]struct{}, code uint64, k int, d int) {
+	m[kmers.Canonical(code, k)] = struct{}{}
+
+	var mutate func(code uint64, start int, d int)
+	mutate = func(code uint64, start int, d int) {
+		var shift uint
+		var b, mutant uint64
+		for i := start; i < k; i++ {
+			shift = uint(i << 1)
+			for b = 0; b < 4; b++ {
+				if b == (code>>shift)&3 {
+					continue
+				}
+				mutant = code&^(3<<shift) | b<<shift
+				m[kmers.Canonical(mutant, k)] = struct{}{}
+				if d > 1 {
+					mutate(mutant, i+1, d-1)
+				}
+			}
+		}
+	}
+	mutate(code, 0, d)
+}
@@ -0,0 +1,354 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Cluster binary files by pairwise containment of k-mers",
+	Long: `Cluster binary files by pairwise containment of k-mers
+
+Binary files (e.g., k-mers of genomes) are clustered with single-linkage,
+i.e., two files are linked if the containment of their k-mers is not lower
+than the threshold (-t/--threshold), and linked files form a cluster.
+The file with the most k-mers in a cluster is chosen as the representative.
+It's useful for removing near-identical genomes before building databases.
+
+Containment of two k-mer sets A and B is |A ∩ B| / min(|A|, |B|).
+
+For speed, only a fraction (1/scale) of k-mers of each file are used,
+i.e., k-mers with hash values not greater than the max uint64 / scale,
+where k-mer codes are scrambled with a hash function, and hashed k-mers are
+used directly. Use -D/--scale 1 to compute containment with all k-mers.
+
+Attentions:
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. For scaled input files, the larger one of the two scales is used.
+  3. Taxids are ignored.
+
+Output columns:
+  cluster          cluster number, in the order of first members in input
+  file             file name
+  kmers            number of k-mers in the file
+  representative   whether the file is the representative of the cluster
+  containment      containment between the file and the representative
+
+Tips:
+  1. Use --rep-list to write representative files, which can be passed
+     to other commands via -i/--infile-list.
+  2. Use --pairs-file to save linked pairs of files with containment values.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+		preflightCheck(opt, files, false)
+
+		outFile := getFlagString(cmd, "out-file")
+		threshold := getFlagFloat64(cmd, "threshold")
+		if threshold <= 0 || threshold > 1 {
+			checkError(fmt.Errorf("value of flag -t/--threshold should be in range of (0, 1]"))
+		}
+		scale := getFlagPositiveInt(cmd, "scale")
+		if scale > 1<<31-1 {
+			checkError(fmt.Errorf("value of flag -D/--scale is too big"))
+		}
+		maxHash := ^uint64(0)
+		if scale > 1 {
+			maxHash = uint64(float64(^uint64(0)) / float64(scale))
+		}
+		pairsFile := getFlagString(cmd, "pairs-file")
+		repFile := getFlagString(cmd, "rep-list")
+		format := getFlagTableFormat(cmd)
+
+		// ---------------------------------------------------------------
+		// sketching all files
+
+		if opt.Verbose {
+			log.Infof("sketching %d files with scale %d ...", len(files), scale)
+		}
+
+		nfiles := len(files)
+		sets := make([]codeSet, nfiles)
+		nKmers := make([]int, nfiles)
+		readers := make([]*unik.Reader, nfiles) // only for headers
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i, file := range files {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int, file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				var infh *bufio.Reader
+				var r *os.File
+				infh, r, _, err := inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				hashed := reader.IsHashed()
+				_maxHash := maxHash
+				if hashed && readerMaxHash(reader) < _maxHash {
+					_maxHash = readerMaxHash(reader)
+				}
+
+				codes := make([]uint64, 0, 1024)
+				var code, h uint64
+				var n int
+				for {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					n++
+					if hashed {
+						h = code
+					} else {
+						h = mixCode(code)
+					}
+					if h <= _maxHash {
+						codes = append(codes, h)
+					}
+				}
+
+				readers[i] = reader
+				nKmers[i] = n
+				sets[i] = newCodeSet(codes)
+			}(i, file)
+		}
+		wg.Wait()
+
+		for i := 1; i < nfiles; i++ {
+			checkCompatibility(readers[0], readers[i], files[i])
+		}
+
+		// ---------------------------------------------------------------
+		// pairwise containment
+
+		if opt.Verbose {
+			log.Infof("computing containment of %d pairs ...", nfiles*(nfiles-1)/2)
+		}
+
+		type groupPair struct {
+			i, j        int
+			shared      int
+			containment float64
+		}
+		linked := make([][]groupPair, nfiles) // linked pairs of each row
+
+		containment := func(i, j int) (int, float64) {
+			shared := sets[i].intersectionSize(sets[j])
+			_min := len(sets[i])
+			if len(sets[j]) < _min {
+				_min = len(sets[j])
+			}
+			if _min == 0 {
+				return shared, 0
+			}
+			return shared, float64(shared) / float64(_min)
+		}
+
+		for i := 0; i < nfiles-1; i++ {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				for j := i + 1; j < nfiles; j++ {
+					shared, c := containment(i, j)
+					if shared > 0 && c >= threshold {
+						linked[i] = append(linked[i], groupPair{i, j, shared, c})
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// ---------------------------------------------------------------
+		// single-linkage clustering with union-find
+
+		parents := make([]int, nfiles)
+		for i := range parents {
+			parents[i] = i
+		}
+		var find func(i int) int
+		find = func(i int) int {
+			if parents[i] != i {
+				parents[i] = find(parents[i])
+			}
+			return parents[i]
+		}
+		var nLinked int
+		for _, pairs := range linked {
+			for _, p := range pairs {
+				nLinked++
+				ri, rj := find(p.i), find(p.j)
+				if ri == rj {
+					continue
+				}
+				if ri < rj {
+					parents[rj] = ri
+				} else {
+					parents[ri] = rj
+				}
+			}
+		}
+
+		// clusters are numbered in the order of their first members
+		root2cluster := make(map[int]int, nfiles)
+		clusters := make([][]int, 0, 8)
+		var root, c int
+		var ok bool
+		for i := range files {
+			root = find(i)
+			if c, ok = root2cluster[root]; !ok {
+				c = len(clusters)
+				root2cluster[root] = c
+				clusters = append(clusters, make([]int, 0, 1))
+			}
+			clusters[c] = append(clusters[c], i)
+		}
+
+		if opt.Verbose {
+			log.Infof("%d linked pairs with containment >= %v, %d clusters of %d files", nLinked, threshold, len(clusters), nfiles)
+		}
+
+		// ---------------------------------------------------------------
+		// output
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"cluster", "file", "kmers", "representative", "containment"})
+		tw.WriteHeader()
+
+		reps := make([]int, len(clusters))
+		var rep int
+		var frac float64
+		for c, members := range clusters {
+			rep = members[0]
+			for _, i := range members[1:] {
+				if nKmers[i] > nKmers[rep] {
+					rep = i
+				}
+			}
+			reps[c] = rep
+
+			for _, i := range members {
+				if i == rep {
+					frac = 1
+				} else {
+					_, frac = containment(i, rep)
+				}
+				tw.WriteRecord(c+1, files[i], nKmers[i], i == rep, roundFloat(frac, 4))
+			}
+		}
+
+		if repFile != "" {
+			outfh2, gw2, w2, err := outStream(repFile, strings.HasSuffix(strings.ToLower(repFile), ".gz"), opt.CompressionLevel)
+			checkError(err)
+			for _, i := range reps {
+				outfh2.WriteString(files[i] + "\n")
+			}
+			outfh2.Flush()
+			if gw2 != nil {
+				gw2.Close()
+			}
+			w2.Close()
+		}
+
+		if pairsFile != "" {
+			outfh2, gw2, w2, err := outStream(pairsFile, strings.HasSuffix(strings.ToLower(pairsFile), ".gz"), opt.CompressionLevel)
+			checkError(err)
+			tw2 := newTableWriter(outfh2, format, []string{"file1", "file2", "shared", "containment"})
+			tw2.WriteHeader()
+			for _, pairs := range linked {
+				for _, p := range pairs {
+					tw2.WriteRecord(files[p.i], files[p.j], p.shared, roundFloat(p.containment, 4))
+				}
+			}
+			outfh2.Flush()
+			if gw2 != nil {
+				gw2.Close()
+			}
+			w2.Close()
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(groupCmd)
+
+	groupCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	groupCmd.Flags().Float64P("threshold", "t", 0.95, `minimum containment for linking two files`)
+	groupCmd.Flags().IntP("scale", "D", 1000, `only use 1/scale of k-mers for computing containment, 1 for all`)
+	groupCmd.Flags().StringP("rep-list", "r", "", `file for saving representative files, one per line`)
+	groupCmd.Flags().StringP("pairs-file", "p", "", `file for saving linked pairs of files and their containment`)
+	groupCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
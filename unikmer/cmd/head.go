@@ -99,7 +99,7 @@ Attentions:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -128,7 +128,7 @@ Attentions:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -22,6 +22,7 @@ package cmd
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -48,6 +49,25 @@ var statCmd = &cobra.Command{
 Tips:
   1. For lots of small files (especially on SDD), use big value of '-j' to
      parallelize counting.
+  2. Use '--out-format json' to output in JSON lines format, which is easier
+     to parse in Python/R.
+  3. Use '--per-taxid' to count k-mers of each taxid in files with taxids,
+     the output has three columns: file, taxid, and number of k-mers.
+     For files with a global taxid, the global taxid is reported, and for
+     files without taxids, the taxid is 0.
+  4. Use '--json' to output all header fields of each file in JSON lines
+     format, for cataloging files. The JSON schema of records can be
+     shown with '--schema'. The number of k-mers is the value in header,
+     which is counted when it's 0 and -a/--all is given.
+  5. Use '--histogram N' to count k-mers in N equal-width bins of the code
+     (hash) space, for checking the uniformity of hashed k-mers. The output
+     has seven columns: file, bin, from, to, kmers, expected, and ratio
+     (kmers/expected). For hashed files, bins with ratios far from 1
+     indicate non-random hashing or mixing files of different scales, and
+     a warning is shown if the number of k-mers does not match the header,
+     which indicates truncated files. Note that canonical hashes are the
+     smaller ones of both strands, so the expected ratios decrease linearly
+     from 2 to 0, e.g., 1.75, 1.25, 0.75, and 0.25 for 4 bins.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -76,6 +96,21 @@ Tips:
 		sTrue := getFlagString(cmd, "symbol-true")
 		sFalse := getFlagString(cmd, "symbol-false")
 		basename := getFlagBool(cmd, "basename")
+		format := getFlagTableFormat(cmd)
+		perTaxid := getFlagBool(cmd, "per-taxid")
+		jsonOut := getFlagBool(cmd, "json")
+		bins := getFlagNonNegativeInt(cmd, "histogram")
+
+		if getFlagBool(cmd, "schema") {
+			fmt.Print(infoJSONSchema)
+			return
+		}
+		if jsonOut && perTaxid {
+			checkError(fmt.Errorf("flag --json and --per-taxid are not compatible"))
+		}
+		if bins > 0 && (jsonOut || perTaxid) {
+			checkError(fmt.Errorf("flag --histogram is not compatible with --json and --per-taxid"))
+		}
 
 		if sTrue == sFalse {
 			checkError(fmt.Errorf("values of -/--symbol-true and -F/--symbol--false should be different"))
@@ -91,8 +126,22 @@ Tips:
 			w.Close()
 		}()
 
+		if perTaxid {
+			countKmersPerTaxid(opt, files, outfh, format, basename)
+			return
+		}
+		if bins > 0 {
+			countKmersInBins(opt, files, outfh, format, basename, bins)
+			return
+		}
+
+		if format != "tsv" || jsonOut {
+			tabular = true
+		}
+
 		// tabular output
-		if tabular {
+		var tw *tableWriter
+		if tabular && !jsonOut {
 			colnames := []string{
 				"file",
 				"k",
@@ -113,13 +162,60 @@ Tips:
 						"description",
 					}...)
 			}
-			outfh.WriteString(strings.Join(colnames, "\t") + "\n")
+			tw = newTableWriter(outfh, format, colnames)
+			tw.sTrue, tw.sFalse = sTrue, sFalse
+			tw.WriteHeader()
 			outfh.Flush()
 		}
 
 		ch := make(chan statInfo, opt.NumCPUs)
 		statInfos := make([]statInfo, 0, 256)
 
+		writeInfo := func(info statInfo) {
+			if !tabular {
+				statInfos = append(statInfos, info)
+				return
+			}
+
+			if jsonOut {
+				data, err := json.Marshal(info.header())
+				checkError(err)
+				outfh.Write(data)
+				outfh.WriteByte('\n')
+				outfh.Flush()
+				return
+			}
+
+			var scaled interface{}
+			if info.scaled {
+				scaled = info.scale
+			} else {
+				scaled = false
+			}
+
+			values := []interface{}{
+				info.file,
+				info.k,
+				info.canonical,
+				info.hashed,
+				scaled,
+				info.includeTaxid,
+				info.globalTaxid,
+				info.sorted,
+			}
+			if all {
+				values = append(values,
+					info.compact,
+					info.gzipped,
+					info.version,
+					info.number,
+					info.description,
+				)
+			}
+			tw.WriteRecord(values...)
+			outfh.Flush()
+		}
+
 		cancel := make(chan struct{})
 
 		done := make(chan int)
@@ -141,96 +237,12 @@ Tips:
 				}
 
 				if id == info.id { // right the one
-					if !tabular {
-						statInfos = append(statInfos, info)
-					} else {
-						var scaled string
-						if info.scaled {
-							scaled = fmt.Sprintf("%d", info.scale)
-						} else {
-							scaled = sFalse
-						}
-
-						if !all {
-							outfh.WriteString(fmt.Sprintf(
-								"%s\t%v\t%v\t%v\t%v\t%v\t%v\t%s\n",
-								info.file,
-								info.k,
-								boolStr(sTrue, sFalse, info.canonical),
-								boolStr(sTrue, sFalse, info.hashed),
-								scaled,
-								boolStr(sTrue, sFalse, info.includeTaxid),
-								info.globalTaxid,
-								boolStr(sTrue, sFalse, info.sorted),
-							))
-						} else {
-							outfh.WriteString(fmt.Sprintf(
-								"%s\t%v\t%v\t%v\t%s\t%v\t%s\t%v\t%v\t%v\t%s\t%d\t%s\n",
-								info.file,
-								info.k,
-								boolStr(sTrue, sFalse, info.canonical),
-								boolStr(sTrue, sFalse, info.hashed),
-								scaled,
-								boolStr(sTrue, sFalse, info.includeTaxid),
-								info.globalTaxid,
-								boolStr(sTrue, sFalse, info.sorted),
-
-								boolStr(sTrue, sFalse, info.compact),
-								boolStr(sTrue, sFalse, info.gzipped),
-								info.version,
-								info.number,
-								info.description,
-							))
-						}
-						outfh.Flush()
-					}
+					writeInfo(info)
 					id++
 				} else { // check bufferd result
 					for true {
 						if info1, ok := buf[id]; ok {
-							if !tabular {
-								statInfos = append(statInfos, info1)
-							} else {
-								var scaled string
-								if info.scaled {
-									scaled = fmt.Sprintf("%d", info.scale)
-								} else {
-									scaled = sFalse
-								}
-
-								if !all {
-									outfh.WriteString(fmt.Sprintf(
-										"%s\t%v\t%v\t%v\t%v\t%v\t%v\t%s\n",
-										info.file,
-										info.k,
-										boolStr(sTrue, sFalse, info.canonical),
-										boolStr(sTrue, sFalse, info.hashed),
-										scaled,
-										boolStr(sTrue, sFalse, info.includeTaxid),
-										info.globalTaxid,
-										boolStr(sTrue, sFalse, info.sorted),
-									))
-								} else {
-									outfh.WriteString(fmt.Sprintf(
-										"%s\t%v\t%v\t%v\t%s\t%v\t%s\t%v\t%v\t%v\t%s\t%d\t%s\n",
-										info.file,
-										info.k,
-										boolStr(sTrue, sFalse, info.canonical),
-										boolStr(sTrue, sFalse, info.hashed),
-										scaled,
-										boolStr(sTrue, sFalse, info.includeTaxid),
-										info.globalTaxid,
-										boolStr(sTrue, sFalse, info.sorted),
-
-										boolStr(sTrue, sFalse, info.compact),
-										boolStr(sTrue, sFalse, info.gzipped),
-										info.version,
-										info.number,
-										info.description,
-									))
-								}
-								outfh.Flush()
-							}
+							writeInfo(info1)
 
 							delete(buf, info1.id)
 							id++
@@ -251,50 +263,7 @@ Tips:
 				}
 				sortutil.Uint64s(ids)
 				for _, id := range ids {
-					info := buf[id]
-					if !tabular {
-						statInfos = append(statInfos, info)
-					} else {
-						var scaled string
-						if info.scaled {
-							scaled = fmt.Sprintf("%d", info.scale)
-						} else {
-							scaled = sFalse
-						}
-
-						if !all {
-							outfh.WriteString(fmt.Sprintf(
-								"%s\t%v\t%v\t%v\t%v\t%v\t%v\t%s\n",
-								info.file,
-								info.k,
-								boolStr(sTrue, sFalse, info.canonical),
-								boolStr(sTrue, sFalse, info.hashed),
-								scaled,
-								boolStr(sTrue, sFalse, info.includeTaxid),
-								info.globalTaxid,
-								boolStr(sTrue, sFalse, info.sorted),
-							))
-						} else {
-							outfh.WriteString(fmt.Sprintf(
-								"%s\t%v\t%v\t%v\t%s\t%v\t%s\t%v\t%v\t%v\t%s\t%d\t%s\n",
-								info.file,
-								info.k,
-								boolStr(sTrue, sFalse, info.canonical),
-								boolStr(sTrue, sFalse, info.hashed),
-								scaled,
-								boolStr(sTrue, sFalse, info.includeTaxid),
-								info.globalTaxid,
-								boolStr(sTrue, sFalse, info.sorted),
-
-								boolStr(sTrue, sFalse, info.compact),
-								boolStr(sTrue, sFalse, info.gzipped),
-								info.version,
-								info.number,
-								info.description,
-							))
-						}
-						outfh.Flush()
-					}
+					writeInfo(buf[id])
 				}
 			}
 
@@ -356,7 +325,7 @@ Tips:
 					ch <- statInfo{file: file, err: err, id: id}
 					return
 				}
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err = unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -375,6 +344,9 @@ Tips:
 				}
 
 				n = 0
+				if jsonOut {
+					n = reader.Number
+				}
 				if all {
 					if reader.Number > 0 {
 						n = reader.Number
@@ -415,6 +387,10 @@ Tips:
 					scaled:       reader.IsScaled(),
 					scale:        reader.GetScale(),
 					version:      fmt.Sprintf("v%d.%d", reader.MainVersion, reader.MinorVersion),
+					flag:         reader.Flag,
+					maxHash:      reader.MaxHash,
+					taxidBytes:   reader.GetTaxidBytesLength(),
+					taxid:        reader.GetGlobalTaxid(),
 
 					err: nil,
 					id:  id,
@@ -520,20 +496,167 @@ type statInfo struct {
 	scale   uint32
 	version string
 
+	flag       uint32
+	maxHash    uint64
+	taxidBytes int
+	taxid      uint32 // global taxid
+
 	err error
 	id  uint64
 }
 
+// statHeader is the JSON record of a file, the schema is infoJSONSchema.
+type statHeader struct {
+	File         string `json:"file"`
+	Version      string `json:"version"`
+	K            int    `json:"k"`
+	Flag         uint32 `json:"flag"`
+	Canonical    bool   `json:"canonical"`
+	Hashed       bool   `json:"hashed"`
+	Scaled       bool   `json:"scaled"`
+	Scale        uint32 `json:"scale"`
+	MaxHash      uint64 `json:"max-hash"`
+	Sorted       bool   `json:"sorted"`
+	Compact      bool   `json:"compact"`
+	IncludeTaxid bool   `json:"include-taxid"`
+	GlobalTaxid  uint32 `json:"global-taxid"`
+	TaxidBytes   int    `json:"taxid-bytes"`
+	Gzipped      bool   `json:"gzipped"`
+	Number       uint64 `json:"number"`
+	Description  string `json:"description"`
+}
+
+func (info statInfo) header() statHeader {
+	return statHeader{
+		File:         info.file,
+		Version:      info.version,
+		K:            info.k,
+		Flag:         info.flag,
+		Canonical:    info.canonical,
+		Hashed:       info.hashed,
+		Scaled:       info.scaled,
+		Scale:        info.scale,
+		MaxHash:      info.maxHash,
+		Sorted:       info.sorted,
+		Compact:      info.compact,
+		IncludeTaxid: info.includeTaxid,
+		GlobalTaxid:  info.taxid,
+		TaxidBytes:   info.taxidBytes,
+		Gzipped:      info.gzipped,
+		Number:       info.number,
+		Description:  info.description,
+	}
+}
+
+const infoJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "unikmer info --json",
+  "description": "Header of a unikmer binary file (.unik), one JSON object per line",
+  "type": "object",
+  "properties": {
+    "file":          {"type": "string", "description": "file path"},
+    "version":       {"type": "string", "description": "format version, e.g., v5.0"},
+    "k":             {"type": "integer", "minimum": 1, "maximum": 64, "description": "k-mer size"},
+    "flag":          {"type": "integer", "minimum": 0, "description": "raw flags, bits: 1 compact, 2 canonical, 4 sorted, 8 include-taxid, 16 hashed, 32 scaled"},
+    "canonical":     {"type": "boolean", "description": "only canonical k-mers are saved"},
+    "hashed":        {"type": "boolean", "description": "hashes of k-mers are saved"},
+    "scaled":        {"type": "boolean", "description": "hashes are down-sampled"},
+    "scale":         {"type": "integer", "minimum": 0, "description": "scale of down-sampling, 1 for none"},
+    "max-hash":      {"type": "integer", "minimum": 0, "description": "max hash of down-sampling, 0 for none"},
+    "sorted":        {"type": "boolean", "description": "k-mers are sorted"},
+    "compact":       {"type": "boolean", "description": "k-mers are saved in fixed-length byte arrays"},
+    "include-taxid": {"type": "boolean", "description": "every k-mer is followed by a taxid"},
+    "global-taxid":  {"type": "integer", "minimum": 0, "description": "taxid of all k-mers, 0 for none"},
+    "taxid-bytes":   {"type": "integer", "minimum": 1, "maximum": 4, "description": "number of bytes to store a taxid"},
+    "gzipped":       {"type": "boolean", "description": "file is gzipped"},
+    "number":        {"type": "integer", "minimum": 0, "description": "number of k-mers, 0 for unknown"},
+    "description":   {"type": "string", "description": "description of the file"}
+  },
+  "required": ["file", "version", "k", "flag", "canonical", "hashed", "scaled", "scale", "max-hash",
+    "sorted", "compact", "include-taxid", "global-taxid", "taxid-bytes", "gzipped", "number", "description"],
+  "additionalProperties": false
+}
+`
+
 func init() {
 	RootCmd.AddCommand(statCmd)
 
 	statCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
 	statCmd.Flags().BoolP("all", "a", false, "all information, including number of k-mers")
 	statCmd.Flags().BoolP("tabular", "T", false, "output in machine-friendly tabular format")
+	statCmd.Flags().StringP("out-format", "", "tsv", `output format of machine-friendly output, available: "tsv", "json" (JSON lines). "json" implies -T/--tabular`)
 	statCmd.Flags().BoolP("skip-err", "e", false, "skip error, only show warning message")
 	statCmd.Flags().StringP("symbol-true", "", "✓", "smybol for true")
 	statCmd.Flags().StringP("symbol-false", "", "✕", "smybol for false")
 	statCmd.Flags().BoolP("basename", "b", false, "only output basename of files")
+	statCmd.Flags().BoolP("per-taxid", "", false, "count k-mers of each taxid, in tabular format")
+	statCmd.Flags().BoolP("json", "", false, `output all header fields in JSON lines format, type "unikmer info -h" for details`)
+	statCmd.Flags().BoolP("schema", "", false, "show JSON schema of records of --json and exit")
+	statCmd.Flags().IntP("histogram", "", 0, `count k-mers in N equal-width bins of the code/hash space, in tabular format. type "unikmer info -h" for details`)
+}
+
+// countKmersPerTaxid counts k-mers of each taxid in every file, and
+// outputs the numbers in ascending order of taxids.
+func countKmersPerTaxid(opt *Options, files []string, outfh *bufio.Writer, format string, basename bool) {
+	tw := newTableWriter(outfh, format, []string{"file", "taxid", "kmers"})
+	tw.WriteHeader()
+
+	var infh *bufio.Reader
+	var r *os.File
+	var reader *unik.Reader
+	var taxid uint32
+	var err error
+	nfiles := len(files)
+	for i, file := range files {
+		if opt.Verbose {
+			log.Infof("[file %d/%d] counting k-mers of each taxid: %s", i+1, nfiles, file)
+		}
+
+		counts := make(map[uint32]uint64, 1024)
+		func() {
+			infh, r, _, err = inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err = unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if !reader.IsIncludeTaxid() && reader.Number > 0 {
+				counts[reader.GetGlobalTaxid()] = reader.Number
+				return
+			}
+
+			for {
+				_, taxid, err = reader.ReadCodeWithTaxid()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				counts[taxid]++
+			}
+		}()
+
+		taxids := make([]uint32, 0, len(counts))
+		for taxid = range counts {
+			taxids = append(taxids, taxid)
+		}
+		sortutil.Uint32s(taxids)
+
+		if basename {
+			file = filepath.Base(file)
+		}
+		for _, taxid = range taxids {
+			tw.WriteRecord(file, taxid, counts[taxid])
+		}
+		outfh.Flush()
+
+		if opt.Verbose {
+			log.Infof("[file %d/%d] %d distinct taxids found", i+1, nfiles, len(taxids))
+		}
+	}
 }
 
 func boolStr(sTrue, sFalse string, v bool) string {
@@ -542,3 +665,84 @@ func boolStr(sTrue, sFalse string, v bool) string {
 	}
 	return sFalse
 }
+
+// countKmersInBins counts k-mers in equal-width bins of the code space,
+// i.e., [0, 4^k-1] for k-mers, and [0, max hash] for hashed k-mers.
+func countKmersInBins(opt *Options, files []string, outfh *bufio.Writer, format string, basename bool, bins int) {
+	tw := newTableWriter(outfh, format, []string{"file", "bin", "from", "to", "kmers", "expected", "ratio"})
+	tw.WriteHeader()
+
+	var infh *bufio.Reader
+	var r *os.File
+	var reader *unik.Reader
+	var code uint64
+	var err error
+	nfiles := len(files)
+	for i, file := range files {
+		if opt.Verbose {
+			log.Infof("[file %d/%d] counting k-mers in %d bins: %s", i+1, nfiles, bins, file)
+		}
+
+		var maxCode, width uint64
+		var total uint64
+		counts := make([]uint64, bins)
+		func() {
+			infh, r, _, err = inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err = unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if reader.IsHashed() {
+				maxCode = readerMaxHash(reader)
+			} else if reader.K < 32 {
+				maxCode = 1<<(uint(reader.K)<<1) - 1
+			} else {
+				maxCode = ^uint64(0)
+			}
+			width = maxCode/uint64(bins) + 1
+
+			for {
+				code, _, err = reader.ReadCodeWithTaxid()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				counts[code/width]++
+				total++
+			}
+
+			if reader.Number > 0 && reader.Number != total {
+				log.Warningf("%s: %d k-mers read, but %d recorded in the header, the file might be truncated", file, total, reader.Number)
+			}
+		}()
+
+		if basename {
+			file = filepath.Base(file)
+		}
+		var from, to uint64
+		var expected float64
+		for b, c := range counts {
+			from = uint64(b) * width
+			if from > maxCode { // more bins than codes
+				break
+			}
+			if b == bins-1 || maxCode-from < width {
+				to = maxCode
+			} else {
+				to = from + width - 1
+			}
+			expected = float64(total) * (float64(to-from) + 1) / (float64(maxCode) + 1)
+			if expected > 0 {
+				tw.WriteRecord(file, b+1, from, to, c, roundFloat(expected, 2), roundFloat(float64(c)/expected, 4))
+			} else {
+				tw.WriteRecord(file, b+1, from, to, c, 0, 0)
+			}
+		}
+		outfh.Flush()
+	}
+}
@@ -25,9 +25,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
 	"github.com/shenwei356/bio/taxdump"
 	"github.com/shenwei356/unik/v5"
 
@@ -42,7 +45,11 @@ var interCmd = &cobra.Command{
 Attentions:
   0. All input files should be sorted, and output file is sorted.
   1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+     Non-canonical (strand-specific) k-mers are compared as they are.
   2. Taxid information could be inconsistent when using flag --mix-taxid.
+  3. FASTA/Q files can also be given via flag -s/--seq-file, k-mers of which
+     are generated with the 'k/canonical/hashed/scaled' setting of the
+     first binary file, avoiding a full 'count' and 'sort' round trip.
   
 Tips:
   1. For comparing TWO files with really huge number of k-mers,
@@ -69,10 +76,28 @@ Tips:
 		}
 
 		checkFileSuffix(opt, extDataFile, files...)
+		autoRescale := getFlagBool(cmd, "auto-rescale")
+		if getFlagBool(cmd, "skip-err") {
+			files = skipErrFiles(opt, files, false, getFlagString(cmd, "skipped-list"), autoRescale)
+		} else {
+			preflightCheck(opt, files, autoRescale)
+		}
+
 		var nfiles = len(files)
 
 		outFile := getFlagString(cmd, "out-prefix")
 		mixTaxid := getFlagBool(cmd, "mix-taxid")
+		seqFiles := getFlagStringSlice(cmd, "seq-file")
+		writeScale := getFlagWriteScale(cmd)
+		requireSorted := getFlagBool(cmd, "require-sorted")
+		var autoScaler *writeScaler
+		if autoRescale {
+			autoScaler = getAutoRescaler(opt, files)
+			if autoScaler != nil && int(autoScaler.scale) > writeScale {
+				writeScale = int(autoScaler.scale)
+			}
+		}
+		var scaler *writeScaler
 		var hasMixTaxid bool
 
 		var taxondb *taxdump.Taxonomy
@@ -86,6 +111,8 @@ Tips:
 		var k int = -1
 		var canonical bool
 		var hashed bool
+		var scaled bool
+		var maxHash uint64
 		var hasTaxid bool
 		var firstFile = true
 		var hasInter = true
@@ -93,13 +120,13 @@ Tips:
 		var taxid uint32
 		var flag int
 
-		if len(files) == 1 {
+		if len(files) == 1 && len(seqFiles) == 0 && writeScale == 0 && !requireSorted {
 			if opt.Verbose {
 				log.Infof("directly copy the only one input file to output file")
 			}
 			infh, r, _, err = inStream(files[0])
 			checkError(err)
-			defer r.Close()
+			defer closeInStream(r)
 
 			if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 				outFile += extDataFile
@@ -131,7 +158,7 @@ Tips:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -154,7 +181,7 @@ Tips:
 						taxondb = loadTaxonomy(opt, false)
 					}
 				} else {
-					checkCompatibility(reader0, reader, file)
+					checkCompatibilityRescaled(reader0, reader, file, autoScaler)
 					if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
 						if mixTaxid {
 							hasMixTaxid = true
@@ -180,25 +207,41 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err = unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
+				checker := newSortedChecker(requireSorted, file)
 
 				if firstFile {
+					k = reader.K
+					canonical = reader.IsCanonical()
+					hashed = reader.IsHashed()
+					scaled = reader.IsScaled()
+					maxHash = readerMaxHash(reader)
+					scaler = newWriteScaler(writeScale, reader, file)
+
 					for {
-						code, taxid, err = reader.ReadCodeWithTaxid()
+						code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
 							}
 							checkError(errors.Wrap(err, file))
 						}
+						checker.check(code)
+						if !scaler.keep(code) {
+							continue
+						}
 
 						mc = append(mc, CodeTaxid{Code: code, Taxid: taxid})
 						m = append(m, false)
 					}
 					firstFile = false
+					if len(mc) == 0 {
+						hasInter = false
+						return flagBreak
+					}
 					return flagContinue
 				}
 
@@ -208,13 +251,14 @@ Tips:
 				qCode = mc[ii].Code
 				qtaxid = mc[ii].Taxid
 
-				code, taxid, err = reader.ReadCodeWithTaxid()
+				code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 				if err != nil {
 					if err == io.EOF {
 						return flagBreak
 					}
 					checkError(errors.Wrap(err, file))
 				}
+				checker.check(code)
 
 				n := 0
 				for {
@@ -248,34 +292,27 @@ Tips:
 						qCode = mc[ii].Code
 						qtaxid = mc[ii].Taxid
 
-						code, taxid, err = reader.ReadCodeWithTaxid()
+						code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
 							}
 							checkError(errors.Wrap(err, file))
 						}
+						checker.check(code)
 					} else {
-						code, taxid, err = reader.ReadCodeWithTaxid()
+						code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 						if err != nil {
 							if err == io.EOF {
 								break
 							}
 							checkError(errors.Wrap(err, file))
 						}
+						checker.check(code)
 					}
 				}
 
-				mc1 := make([]CodeTaxid, 0, n)
-				n = 0
-				for ii, found := range m {
-					if found {
-						mc1 = append(mc1, mc[ii])
-						n++
-					}
-				}
-				mc = mc1
-				m = make([]bool, n)
+				mc, m = keepMarkedCodeTaxids(mc, m, n)
 
 				if opt.Verbose {
 					log.Infof("%d k-mers remain", n)
@@ -295,6 +332,28 @@ Tips:
 			}
 		}
 
+		// k-mers from sequence files
+		if hasInter {
+			var n int
+			nSeqFiles := len(seqFiles)
+			for i, file := range seqFiles {
+				if opt.Verbose {
+					log.Infof("processing sequence file (%d/%d): %s", i+1, nSeqFiles, file)
+				}
+
+				n = markCodeTaxidsInSeqFile(file, mc, m, k, canonical, hashed, scaled, maxHash)
+				mc, m = keepMarkedCodeTaxids(mc, m, n)
+
+				if opt.Verbose {
+					log.Infof("%d k-mers remain", n)
+				}
+				if n == 0 {
+					hasInter = false
+					break
+				}
+			}
+		}
+
 		if !hasInter {
 			if opt.Verbose {
 				log.Infof("no intersection found")
@@ -336,6 +395,7 @@ Tips:
 		writer, err := unik.NewWriter(outfh, k, mode)
 		checkError(errors.Wrap(err, outFile))
 		writer.SetMaxTaxid(opt.MaxTaxid) // follow taxondb
+		scaler.setHeader(writer)
 
 		writer.Number = uint64(len(mc))
 
@@ -361,4 +421,82 @@ func init() {
 
 	interCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	interCmd.Flags().BoolP("mix-taxid", "m", false, `allow part of files being whithout taxids`)
+	interCmd.Flags().StringSliceP("seq-file", "s", []string{}, `FASTA/Q files, k-mers of which are generated following the first binary file`)
+	interCmd.Flags().IntP("scale", "D", 0, helpWriteScale)
+	interCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
+	interCmd.Flags().BoolP("auto-rescale", "", false, helpAutoRescale)
+	interCmd.Flags().BoolP("skip-err", "e", false, helpSkipErr)
+	interCmd.Flags().StringP("skipped-list", "", "", "file for saving names of files skipped by -e/--skip-err")
+}
+
+// keepMarkedCodeTaxids returns the n marked elements, and a new marking list.
+func keepMarkedCodeTaxids(mc []CodeTaxid, m []bool, n int) ([]CodeTaxid, []bool) {
+	mc1 := make([]CodeTaxid, 0, n)
+	for ii, found := range m {
+		if found {
+			mc1 = append(mc1, mc[ii])
+		}
+	}
+	return mc1, make([]bool, len(mc1))
+}
+
+// markCodeTaxidsInSeqFile marks sorted k-mers existing in a sequence file,
+// and returns the number of marked k-mers.
+func markCodeTaxidsInSeqFile(file string, mc []CodeTaxid, m []bool, k int, canonical bool, hashed bool, scaled bool, maxHash uint64) int {
+	fastxReader, err := fastx.NewDefaultReader(file)
+	checkError(errors.Wrap(err, file))
+
+	var record *fastx.Record
+	var iter *sketches.Iterator
+	var code uint64
+	var ok bool
+	var ii, n int
+	nc := len(mc)
+	for {
+		record, err = fastxReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			checkError(errors.Wrap(err, file))
+			break
+		}
+
+		if hashed {
+			iter, err = sketches.NewHashIterator(record.Seq, k, canonical, false)
+		} else {
+			iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, false)
+		}
+		if err != nil {
+			if err == sketches.ErrShortSeq {
+				continue
+			}
+			checkError(errors.Wrapf(err, "file: %s, seq: %s", file, record.Name))
+		}
+
+		for {
+			if hashed {
+				code, ok = iter.NextHash()
+			} else {
+				code, ok, err = iter.NextKmer()
+				if err != nil {
+					checkError(errors.Wrapf(err, "file: %s, seq: %s", file, record.Name))
+				}
+			}
+			if !ok {
+				break
+			}
+
+			if scaled && code > maxHash {
+				continue
+			}
+
+			ii = sort.Search(nc, func(i int) bool { return mc[i].Code >= code })
+			if ii < nc && mc[ii].Code == code && !m[ii] {
+				m[ii] = true
+				n++
+			}
+		}
+	}
+	return n
 }
@@ -20,6 +20,8 @@
 
 package cmd
 
+import "strconv"
+
 // CodeTaxid is the code-taxid pair
 type CodeTaxid struct {
 	Code uint64
@@ -44,3 +46,25 @@ func (pairs CodeTaxidSlice) Swap(i, j int) {
 func (pairs CodeTaxidSlice) Less(i, j int) bool {
 	return pairs[i].Code < pairs[j].Code
 }
+
+// Key returns the sorting key, for parallel radix sort with sorts.ByUint64
+func (pairs CodeTaxidSlice) Key(i int) uint64 {
+	return pairs[i].Code
+}
+
+// parseCode parses a k-mer code (or hash) in decimal or hexadecimal
+// (with a prefix of "0x" or "0X") format.
+func parseCode(s string) (uint64, error) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return strconv.ParseUint(s[2:], 16, 64)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// formatCode formats a k-mer code (or hash) in decimal or hexadecimal format.
+func formatCode(code uint64, hex bool) string {
+	if hex {
+		return "0x" + strconv.FormatUint(code, 16)
+	}
+	return strconv.FormatUint(code, 10)
+}
@@ -45,7 +45,10 @@ var locateCmd = &cobra.Command{
 Attention:
   0. All files should have the 'canonical' flag.
   1. The 'canonical/scaled/hashed' flags of all files should be consistent.
-  2. Output is BED6 format.
+  2. Output is BED6 format. The strand is "." by default, use --kmer-strand
+     to report the strand where the canonical k-mer comes from, i.e.,
+     "+" for the k-mer on the positive strand, and "-" for its reverse
+     complement ("." for palindromic k-mers).
   3. When using experimental flag --circular, leading subsequence of k-1 bp
      is appending to end of sequence. End position of k-mers that crossing
      sequence end would be greater than sequence length.
@@ -97,6 +100,7 @@ Attention:
 		}
 
 		circular := getFlagBool(cmd, "circular")
+		kmerStrands := getFlagBool(cmd, "kmer-strand")
 
 		// -----------------------------------------------------------------------
 
@@ -118,7 +122,7 @@ Attention:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -186,11 +190,15 @@ Attention:
 					}
 				}
 
+				if circular {
+					extendCircularSeq(record.Seq, k)
+				}
+
 				// using ntHash
 				if hashed {
-					iter, err = sketches.NewHashIterator(record.Seq, k, true, circular)
+					iter, err = sketches.NewHashIterator(record.Seq, k, true, false)
 				} else {
-					iter, err = sketches.NewKmerIterator(record.Seq, k, true, circular)
+					iter, err = sketches.NewKmerIterator(record.Seq, k, true, false)
 				}
 				if err != nil {
 					if err == sketches.ErrShortSeq {
@@ -203,11 +211,7 @@ Attention:
 					}
 				}
 
-				seqClone := record.Seq.Clone().Seq
-				if circular {
-					seqClone = append(seqClone, seqClone[0:k-1]...)
-				}
-				sequences = append(sequences, seqClone)
+				sequences = append(sequences, record.Seq.Clone().Seq)
 				ids = append(ids, []byte(string(record.ID)))
 
 				for {
@@ -247,6 +251,7 @@ Attention:
 		var loc [2]int
 		var j int
 		var kmer []byte
+		var strand byte = '.'
 		for i, file := range files {
 			if isStdin(file) {
 				log.Warningf("ignoring stdin")
@@ -257,13 +262,13 @@ Attention:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err = unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
 
 				for {
-					code, _, err = reader.ReadCodeWithTaxid()
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -277,8 +282,12 @@ Attention:
 
 							kmer = sequences[i][j : j+k]
 
-							outfh.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s\t0\t.\n",
-								ids[i], j, j+k, kmer))
+							if kmerStrands {
+								strand = kmerStrand(kmer, hashed)
+							}
+
+							outfh.WriteString(fmt.Sprintf("%s\t%d\t%d\t%s\t0\t%c\n",
+								ids[i], j, j+k, kmer, strand))
 						}
 
 						delete(m, code)
@@ -297,4 +306,5 @@ func init() {
 	locateCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	locateCmd.Flags().StringSliceP("genome", "g", []string{}, "genomes in (gzipped) fasta file(s)")
 	locateCmd.Flags().BoolP("circular", "", false, `circular genome. type "unikmer locate -h" for details`)
+	locateCmd.Flags().BoolP("kmer-strand", "", false, `report the strand where the canonical k-mers come from. type "unikmer locate -h" for details`)
 }
@@ -0,0 +1,298 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Census of binary files in directories",
+	Long: `Census of binary files in directories
+
+Directories are walked recursively for binary files (with the suffix .unik),
+and only headers are read (in parallel), so it's fast for large collections
+where "unikmer info -a" would take hours to count k-mers.
+
+Files are grouped by k, flags, scale and version. Numbers of k-mers are
+only known for files with the number recorded in the header (e.g., sorted
+files), others are counted in the column "no-number".
+
+Output columns:
+  k           k-mer size
+  flags       flags in the header, e.g., "canonical,sorted,hashed"
+  scale       scale of down-sampling, 0 for not scaled
+  version     version of the binary format
+  files       number of files
+  kmers       sum of k-mer numbers recorded in headers
+  no-number   number of files without the number of k-mers in headers
+  bytes       total size of files
+
+Tips:
+  1. Use -l/--long to list information of each file, instead of the census.
+  2. Unreadable files are reported with warnings, and skipped.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		outFile := getFlagString(cmd, "out-file")
+		long := getFlagBool(cmd, "long")
+		suffix := getFlagString(cmd, "suffix")
+		format := getFlagTableFormat(cmd)
+
+		dirs := args
+		if len(dirs) == 0 {
+			dirs = []string{"."}
+		}
+
+		// ---------------------------------------------------------------
+		// collecting files
+
+		files := make([]string, 0, 1024)
+		for _, dir := range dirs {
+			err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && strings.HasSuffix(path, suffix) {
+					files = append(files, path)
+				}
+				return nil
+			})
+			checkError(errors.Wrap(err, dir))
+		}
+		if opt.Verbose {
+			log.Infof("%d files found in %d directories", len(files), len(dirs))
+		}
+
+		// ---------------------------------------------------------------
+		// reading headers
+
+		type lsInfo struct {
+			k       int
+			flags   string
+			scale   uint32
+			version string
+			number  uint64
+			known   bool // the number is recorded in the header
+			bytes   int64
+			err     error
+		}
+
+		infos := make([]lsInfo, len(files))
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i, file := range files {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int, file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				info, err := os.Stat(file)
+				if err != nil {
+					infos[i].err = err
+					return
+				}
+				infos[i].bytes = info.Size()
+
+				infh, r, _, err := inStream(file)
+				if err != nil {
+					infos[i].err = err
+					return
+				}
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				if err != nil {
+					infos[i].err = err
+					return
+				}
+
+				infos[i].k = reader.K
+				infos[i].flags = lsFlags(reader)
+				if reader.IsScaled() {
+					infos[i].scale = reader.GetScale()
+				}
+				infos[i].version = fmt.Sprintf("v%d.%d", reader.MainVersion, reader.MinorVersion)
+				if reader.Number > 0 && reader.Number != ^uint64(0) {
+					infos[i].number = reader.Number
+					infos[i].known = true
+				}
+			}(i, file)
+		}
+		wg.Wait()
+
+		var nErr int
+		for i, info := range infos {
+			if info.err != nil {
+				log.Warningf("skip unreadable file: %s: %s", files[i], info.err)
+				nErr++
+			}
+		}
+
+		// ---------------------------------------------------------------
+		// output
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		if long {
+			tw := newTableWriter(outfh, format, []string{"file", "k", "flags", "scale", "version", "kmers", "bytes"})
+			tw.WriteHeader()
+			var number int64
+			for i, info := range infos {
+				if info.err != nil {
+					continue
+				}
+				number = -1
+				if info.known {
+					number = int64(info.number)
+				}
+				tw.WriteRecord(files[i], info.k, info.flags, info.scale, info.version, number, info.bytes)
+			}
+			return
+		}
+
+		type lsKey struct {
+			k       int
+			flags   string
+			scale   uint32
+			version string
+		}
+		type lsGroup struct {
+			files    int
+			kmers    uint64
+			noNumber int
+			bytes    int64
+		}
+		groups := make(map[lsKey]*lsGroup, 8)
+		var key lsKey
+		var g *lsGroup
+		var ok bool
+		for _, info := range infos {
+			if info.err != nil {
+				continue
+			}
+			key = lsKey{info.k, info.flags, info.scale, info.version}
+			if g, ok = groups[key]; !ok {
+				g = &lsGroup{}
+				groups[key] = g
+			}
+			g.files++
+			if info.known {
+				g.kmers += info.number
+			} else {
+				g.noNumber++
+			}
+			g.bytes += info.bytes
+		}
+
+		keys := make([]lsKey, 0, len(groups))
+		for key = range groups {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i], keys[j]
+			if a.k != b.k {
+				return a.k < b.k
+			}
+			if a.flags != b.flags {
+				return a.flags < b.flags
+			}
+			if a.scale != b.scale {
+				return a.scale < b.scale
+			}
+			return a.version < b.version
+		})
+
+		tw := newTableWriter(outfh, format, []string{"k", "flags", "scale", "version", "files", "kmers", "no-number", "bytes"})
+		tw.WriteHeader()
+		for _, key = range keys {
+			g = groups[key]
+			tw.WriteRecord(key.k, key.flags, key.scale, key.version, g.files, g.kmers, g.noNumber, g.bytes)
+		}
+
+		if opt.Verbose {
+			log.Infof("%d files in %d groups, %d unreadable", len(files)-nErr, len(groups), nErr)
+		}
+	},
+}
+
+// lsFlags returns names of flags in the header, joined by commas.
+func lsFlags(reader *unik.Reader) string {
+	flags := make([]string, 0, 6)
+	if reader.IsCompact() {
+		flags = append(flags, "compact")
+	}
+	if reader.IsCanonical() {
+		flags = append(flags, "canonical")
+	}
+	if reader.IsSorted() {
+		flags = append(flags, "sorted")
+	}
+	if reader.IsIncludeTaxid() {
+		flags = append(flags, "include-taxid")
+	}
+	if reader.IsHashed() {
+		flags = append(flags, "hashed")
+	}
+	if reader.IsScaled() {
+		flags = append(flags, "scaled")
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, ",")
+}
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+
+	lsCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	lsCmd.Flags().BoolP("long", "l", false, "list information of each file, -1 for unknown numbers of k-mers")
+	lsCmd.Flags().StringP("suffix", "s", extDataFile, "suffix of binary files")
+	lsCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
@@ -37,6 +37,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// characters not allowed in GFF3 seqid
+var reInvalidSeqIDChars = regexp.MustCompile(`[^a-zA-Z0-9.:^*$@!+_?|\-]`)
+
 var mapCmd = &cobra.Command{
 	Use:     "map",
 	Aliases: []string{"uniqs"},
@@ -48,9 +51,33 @@ Attention:
      You can use -M/--allow-multiple-mapped-kmerss to allow mutiple-mapped k-mers.
   1. The 'canonical/scaled/hashed' flags of all files should be consistent.
   2. Default output is in BED3 format, with left-closed and right-open
-     0-based interval.
+     0-based interval. Other formats (--out-format):
+       bed6:  name is "seqid:start-end" (1-based), score is the number of
+              matched k-mers, strand is "+" for non-canonical k-mers
+              (--strand-specific), or "." otherwise. For canonical k-mers,
+              use --kmer-strand to report "+" ("-") if all matched k-mers
+              in a region come from the positive (negative) strand, i.e.,
+              the canonical k-mer is the k-mer (its reverse complement).
+       gff3:  the feature type is "region", with the same score and strand
+              as bed6.
+       fasta: subsequences, the same as -a/--output-fasta.
   3. When using flag --circular, end position of subsequences that 
      crossing genome sequence end would be greater than sequence length.
+  4. Binary files should have the 'canonical' flag, unless the flag
+     --strand-specific is given, where k-mers (not canonical) are only
+     searched on the positive strand of genomes.
+  5. Use --bed to only consider k-mers falling entirely inside the regions
+     of a BED file, other k-mers are treated as unmatched, and sequences not
+     in the BED file are skipped. Output coordinates are still relative to
+     the whole sequences. Multiple-mapped k-mers are still checked in whole
+     genomes.
+  6. Use --merge-across-seqs to lift regions of contigs onto scaffolds with
+     an AGP file or a contig-order file, and merge regions only separated by
+     gaps, e.g., at the ends of adjacent contigs. The contig-order file has
+     2-4 tab-delimited columns: scaffold, contig, orientation (+/-, default +),
+     and the length of the gap after the contig (default 100). Regions of
+     sequences not in the file are kept unchanged. Output is sorted by
+     scaffold and start position, and only BED3/BED6/GFF3 formats are supported.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -97,10 +124,52 @@ Attention:
 		minLen := getFlagPositiveInt(cmd, "min-len")
 		mMapped := getFlagBool(cmd, "allow-multiple-mapped-kmers")
 		outputFASTA := getFlagBool(cmd, "output-fasta")
+		outFormat := strings.ToLower(getFlagString(cmd, "out-format"))
+		switch outFormat {
+		case "bed3", "bed6", "gff3", "fasta":
+		default:
+			checkError(fmt.Errorf("invalid value of flag --out-format: %s, available: bed3, bed6, gff3, fasta", outFormat))
+		}
+		if outputFASTA {
+			outFormat = "fasta"
+		}
+		idRegexp := getFlagString(cmd, "id-regexp")
+		sanitizeID := getFlagBool(cmd, "sanitize-id")
 		maxGapSize := getFlagNonNegativeInt(cmd, "max-gap-size")
 		maxGapNum := getFlagNonNegativeInt(cmd, "max-gap-num")
 		seqsAsOneGenome := getFlagBool(cmd, "seqs-in-a-file-as-one-genome")
 		circular := getFlagBool(cmd, "circular")
+		strandSpecific := getFlagBool(cmd, "strand-specific")
+		kmerStrands := getFlagBool(cmd, "kmer-strand")
+
+		var layout *scaffoldLayout
+		var seqLengths map[string]int // lengths of sequences, for contig-order files
+		var contigRegions []mapRegion // regions to be lifted onto scaffolds
+		if layoutFile := getFlagString(cmd, "merge-across-seqs"); layoutFile != "" {
+			if outFormat == "fasta" {
+				checkError(fmt.Errorf("flag --merge-across-seqs only supports BED3/BED6/GFF3 formats"))
+			}
+			if circular {
+				checkError(fmt.Errorf("flag --merge-across-seqs and --circular are not compatible"))
+			}
+			layout, err = loadScaffoldLayout(layoutFile)
+			checkError(err)
+			seqLengths = make(map[string]int, 1024)
+			contigRegions = make([]mapRegion, 0, 1024)
+		}
+
+		bedFile := getFlagString(cmd, "bed")
+		var bedRegions map[string][][2]int
+		if bedFile != "" {
+			if circular {
+				checkError(fmt.Errorf("flag --bed and --circular are not compatible"))
+			}
+			bedRegions, err = loadBedRegions(bedFile)
+			checkError(err)
+			if opt.Verbose {
+				log.Infof("regions of %d sequences loaded from BED file: %s", len(bedRegions), bedFile)
+			}
+		}
 
 		if seqsAsOneGenome && mMapped {
 			checkError(fmt.Errorf("flag -M/--allow-multiple-mapped-kmers and -W/--seqs-in-a-file-as-one-genome are not compatible"))
@@ -133,7 +202,7 @@ Attention:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -143,15 +212,18 @@ Attention:
 					k = reader.K
 					hashed = reader.IsHashed()
 					canonical = reader.IsCanonical()
-					if !canonical {
-						checkError(fmt.Errorf("%s: 'canonical' flag is needed", file))
+					if !canonical && !strandSpecific {
+						checkError(fmt.Errorf("%s: 'canonical' flag is needed, or use --strand-specific for non-canonical k-mers", file))
+					}
+					if canonical && strandSpecific {
+						log.Warningf("flag --strand-specific is ignored for file with 'canonical' flag: %s", file)
 					}
 				} else {
 					checkCompatibility(reader0, reader, file)
 				}
 
 				for {
-					code, _, err = reader.ReadCodeWithTaxid()
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -174,12 +246,13 @@ Attention:
 
 		var record *fastx.Record
 		var fastxReader *fastx.Reader
-		var iter *sketches.Iterator
+		var iter kmerIterator
 		var i int
 		var ok bool
 		var multipleMapped bool
 		var ignoreSeq bool
 		var re *regexp.Regexp
+		var nFwd, iFwd int // for strand-specific k-mers
 
 		if !mMapped {
 			m2 = make(map[int]map[uint64]bool, 8)
@@ -190,7 +263,7 @@ Attention:
 					log.Infof("pre-reading genome file: %s", genomeFile)
 				}
 
-				fastxReader, err = fastx.NewDefaultReader(genomeFile)
+				fastxReader, err = fastx.NewReader(nil, genomeFile, idRegexp)
 				checkError(errors.Wrap(err, genomeFile))
 				for {
 					record, err = fastxReader.Read()
@@ -219,10 +292,13 @@ Attention:
 						continue
 					}
 
+					if circular {
+						extendCircularSeq(record.Seq, k)
+					}
 					if hashed {
-						iter, err = sketches.NewHashIterator(record.Seq, k, true, circular)
+						iter, err = sketches.NewHashIterator(record.Seq, k, canonical, false)
 					} else {
-						iter, err = sketches.NewKmerIterator(record.Seq, k, true, circular)
+						iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, false)
 					}
 					if err != nil {
 						if err == sketches.ErrShortSeq {
@@ -240,7 +316,18 @@ Attention:
 						m2[genomeIdx] = _m2
 					}
 
+					if !canonical {
+						nFwd = nKmersOnPositiveStrand(len(record.Seq.Seq), k, false)
+						iFwd = 0
+					}
+
 					for {
+						if !canonical {
+							if iFwd == nFwd { // do not go to the negative strand
+								break
+							}
+							iFwd++
+						}
 						code, ok, err = iter.Next()
 						if hashed && err != nil {
 							checkError(errors.Wrapf(err, "%s: %s", record.Name, record.Seq.Seq[iter.Index():iter.Index()+k]))
@@ -295,16 +382,80 @@ Attention:
 			w.Close()
 		}()
 
+		if outFormat == "gff3" {
+			outfh.WriteString("##gff-version 3\n")
+		}
+
+		// strand of regions, only determinable for non-canonical k-mers,
+		// or canonical ones with --kmer-strand
+		strand0 := "."
+		if !canonical {
+			strand0 = "+"
+		}
+		kmerStrands = kmerStrands && canonical
+		var strand string
+
+		var seqID string
+		var regions [][2]int // regions of the current sequence
+		var iReg int
+
+		writeRegion := func(r mapRegion) {
+			switch outFormat {
+			case "bed6":
+				fmt.Fprintf(outfh, "%s\t%d\t%d\t%s:%d-%d\t%d\t%s\n", r.seqID, r.start, r.end,
+					r.seqID, r.start+1, r.end, r.nMatched, r.strand)
+			case "gff3":
+				fmt.Fprintf(outfh, "%s\tunikmer\tregion\t%d\t%d\t%d\t%s\t.\tID=%s:%d-%d;matched_kmers=%d\n", r.seqID, r.start+1, r.end,
+					r.nMatched, r.strand, r.seqID, r.start+1, r.end, r.nMatched)
+			default:
+				fmt.Fprintf(outfh, "%s\t%d\t%d\n", r.seqID, r.start, r.end)
+			}
+		}
+
 		var genomeIdx int
 		for _, genomeFile := range genomes {
 			var c, start, gaps, gapNums, lastGapNum, lastmatch int // c is the number of continuous sites
+			var nMatched int                                       // number of matched k-mers in a region
+			var nPlus, nMinus int                                  // numbers of matched k-mers from the two strands
+
+			var length0 int // origninal length of sequence
+
+			// start: 0-based, end: 1-based
+			outputRegion := func(start, end, nMatched int) {
+				strand = strand0
+				if kmerStrands {
+					if nPlus > 0 && nMinus == 0 {
+						strand = "+"
+					} else if nMinus > 0 && nPlus == 0 {
+						strand = "-"
+					}
+				}
+				if layout != nil {
+					contigRegions = append(contigRegions, mapRegion{seqID, start, end, nMatched, strand})
+					return
+				}
+				if outFormat == "fasta" {
+					var subseq *seq.Seq
+					if end <= len(record.Seq.Seq) {
+						subseq = record.Seq.SubSeq(start+1, end)
+					} else if start >= length0 { // in the second round of a circular sequence
+						subseq = record.Seq.SubSeq(start-length0+1, end-length0)
+					} else { // crossing the end of a circular sequence
+						subseq = record.Seq.SubSeq(start+1, length0)
+						subseq.Seq = append(subseq.Seq, record.Seq.Seq[:end-length0]...)
+					}
+					fmt.Fprintf(outfh, ">%s:%d-%d\n%s\n", seqID, start+1, end, subseq.FormatSeq(60))
+				} else {
+					writeRegion(mapRegion{seqID, start, end, nMatched, strand})
+				}
+				outfh.Flush()
+			}
 
-			var length0 int      // origninal length of sequence
 			var flag bool = true // re-count
 			if opt.Verbose {
 				log.Infof("reading genome file: %s", genomeFile)
 			}
-			fastxReader, err = fastx.NewDefaultReader(genomeFile)
+			fastxReader, err = fastx.NewReader(nil, genomeFile, idRegexp)
 			checkError(errors.Wrap(err, genomeFile))
 			for {
 				record, err = fastxReader.Read()
@@ -316,6 +467,15 @@ Attention:
 					break
 				}
 
+				if sanitizeID {
+					seqID = reInvalidSeqIDChars.ReplaceAllString(string(record.ID), "_")
+				} else {
+					seqID = string(record.ID)
+				}
+				if seqLengths != nil {
+					seqLengths[seqID] = len(record.Seq.Seq)
+				}
+
 				if filterNames {
 					ignoreSeq = false
 					for _, re = range reSeqNames {
@@ -329,14 +489,21 @@ Attention:
 					}
 				}
 
+				if bedRegions != nil {
+					if regions, ok = bedRegions[string(record.ID)]; !ok {
+						continue
+					}
+					iReg = 0
+				}
+
 				if len(record.Seq.Seq) < k {
 					continue
 				}
 
 				length0 = len(record.Seq.Seq)
 
-				if circular { // concat two copies of sequence
-					record.Seq.Seq = append(record.Seq.Seq, record.Seq.Seq...)
+				if circular {
+					extendCircularSeq(record.Seq, k)
 				}
 
 				if opt.Verbose {
@@ -348,10 +515,12 @@ Attention:
 				gaps = 0
 				gapNums = 0
 
-				if hashed {
-					iter, err = sketches.NewHashIterator(record.Seq, k, true, false)
+				if circular { // two rounds, for regions crossing the sequence end
+					iter, err = newCircularIterator(record.Seq, k, length0, 2*length0-k+1, hashed, canonical)
+				} else if hashed {
+					iter, err = sketches.NewHashIterator(record.Seq, k, canonical, false)
 				} else {
-					iter, err = sketches.NewKmerIterator(record.Seq, k, true, false)
+					iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, false)
 				}
 				checkError(errors.Wrapf(err, "seq: %s", record.Name))
 
@@ -359,10 +528,25 @@ Attention:
 					_m2 = m2[genomeIdx]
 				}
 
+				if !canonical {
+					if circular {
+						nFwd = 2*length0 - k + 1
+					} else {
+						nFwd = nKmersOnPositiveStrand(len(record.Seq.Seq), k, false)
+					}
+					iFwd = 0
+				}
+
 				for {
+					if !canonical {
+						if iFwd == nFwd { // do not go to the negative strand
+							break
+						}
+						iFwd++
+					}
 					code, ok, err = iter.Next()
 					if !hashed && err != nil {
-						checkError(errors.Wrapf(err, "%s: %s", record.Name, record.Seq.Seq[iter.Index():iter.Index()+k]))
+						checkError(errors.Wrapf(err, "%s: %s", record.Name, record.Seq.Seq[iter.Index()%length0:iter.Index()%length0+k]))
 					}
 					if !ok {
 						break
@@ -370,7 +554,14 @@ Attention:
 
 					i = iter.Index()
 
-					if _, ok = m[code]; ok {
+					_, ok = m[code]
+					if ok && bedRegions != nil { // k-mer should be inside a region
+						for iReg < len(regions) && regions[iReg][1] < i+k {
+							iReg++
+						}
+						ok = iReg < len(regions) && regions[iReg][0] <= i
+					}
+					if ok {
 						gaps = 0
 						if !mMapped {
 							if multipleMapped, ok = _m2[code]; ok && multipleMapped {
@@ -382,13 +573,7 @@ Attention:
 										lastmatch = length0 - k + start
 									}
 
-									if outputFASTA {
-										fmt.Fprintf(outfh, ">%s:%d-%d\n%s\n", record.ID, start+1, lastmatch+k,
-											record.Seq.SubSeq(start+1, lastmatch+k).FormatSeq(60))
-									} else {
-										fmt.Fprintf(outfh, "%s\t%d\t%d\n", record.ID, start, lastmatch+k)
-									}
-									outfh.Flush()
+									outputRegion(start, lastmatch+k, nMatched)
 								}
 
 								c = 0
@@ -399,6 +584,8 @@ Attention:
 								if c == 1 { // re-count
 									if flag {
 										start = i
+										nMatched = 0
+										nPlus, nMinus = 0, 0
 										gapNums = 0
 										gaps = 0
 										lastGapNum = 0
@@ -415,6 +602,8 @@ Attention:
 							if c == 1 { // re-count
 								if flag {
 									start = i
+									nMatched = 0
+									nPlus, nMinus = 0, 0
 									gapNums = 0
 									gaps = 0
 									lastGapNum = 0
@@ -430,6 +619,15 @@ Attention:
 						if c >= 1 { // at least 1 continuous sites.
 							lastmatch = i
 							lastGapNum = gapNums
+							nMatched++
+							if kmerStrands {
+								switch kmerStrand(record.Seq.Seq[i%length0:i%length0+k], hashed) {
+								case '+':
+									nPlus++
+								case '-':
+									nMinus++
+								}
+							}
 						}
 					} else { // k-mer not found
 						gaps++
@@ -450,13 +648,7 @@ Attention:
 									lastmatch = length0 - k + start
 								}
 
-								if outputFASTA {
-									fmt.Fprintf(outfh, ">%s:%d-%d\n%s\n", record.ID, start+1, lastmatch+k,
-										record.Seq.SubSeq(start+1, lastmatch+k).FormatSeq(60))
-								} else {
-									fmt.Fprintf(outfh, "%s\t%d\t%d\n", record.ID, start, lastmatch+k)
-								}
-								outfh.Flush()
+								outputRegion(start, lastmatch+k, nMatched)
 							}
 							// re-count
 							c = 0
@@ -479,16 +671,22 @@ Attention:
 						lastmatch = length0 - k + start
 					}
 
-					if outputFASTA {
-						fmt.Fprintf(outfh, ">%s:%d-%d\n%s\n", record.ID, start+1, lastmatch+k,
-							record.Seq.SubSeq(start+1, lastmatch+k).FormatSeq(60))
-					} else {
-						fmt.Fprintf(outfh, "%s\t%d\t%d\n", record.ID, start, lastmatch+k)
-					}
-					outfh.Flush()
+					outputRegion(start, lastmatch+k, nMatched)
 				}
 			}
 		}
+
+		if layout != nil {
+			// positions of contigs in contig-order files are known after reading all sequences
+			checkError(layout.resolve(seqLengths))
+			lifted := make([]mapRegion, 0, len(contigRegions))
+			for _, r := range contigRegions {
+				lifted = append(lifted, layout.lift(r)...)
+			}
+			for _, r := range layout.mergeLiftedRegions(lifted) {
+				writeRegion(r)
+			}
+		}
 	},
 }
 
@@ -502,9 +700,16 @@ func init() {
 	mapCmd.Flags().IntP("min-len", "m", 200, "minimum length of subsequence")
 	mapCmd.Flags().BoolP("allow-multiple-mapped-kmers", "M", false, "allow multiple mapped k-mers")
 	mapCmd.Flags().BoolP("seqs-in-a-file-as-one-genome", "W", false, "treat seqs in a genome file as one genome")
-	mapCmd.Flags().BoolP("output-fasta", "a", false, "output fasta format instead of BED3")
+	mapCmd.Flags().BoolP("output-fasta", "a", false, "output fasta format instead of BED3, i.e., --out-format fasta")
+	mapCmd.Flags().StringP("out-format", "", "bed3", `output format, available: "bed3", "bed6", "gff3", "fasta"`)
+	mapCmd.Flags().StringP("id-regexp", "", fastx.DefaultIDRegexp, "regular expression for parsing sequence IDs from headers")
+	mapCmd.Flags().BoolP("sanitize-id", "", false, "replace characters in sequence IDs that are not allowed in GFF3 with '_'")
 
 	mapCmd.Flags().IntP("max-gap-size", "x", 0, "max gap size (the number of consecutive unmapped k-mers)")
 	mapCmd.Flags().IntP("max-gap-num", "X", 0, "max number of gaps (consecutive unmapped k-mers)")
 	mapCmd.Flags().BoolP("circular", "", false, `circular genome. type "unikmer uniqs -h" for details`)
+	mapCmd.Flags().StringP("bed", "", "", "only consider k-mers inside regions in this BED file")
+	mapCmd.Flags().StringP("merge-across-seqs", "", "", `AGP file or contig-order file for lifting regions onto scaffolds and merging them across gaps. type "unikmer map -h" for details`)
+	mapCmd.Flags().BoolP("kmer-strand", "", false, `report the strand of regions where the canonical k-mers come from, for bed6 and gff3 formats. type "unikmer map -h" for details`)
+	mapCmd.Flags().BoolP("strand-specific", "", false, `strand-specific mode for non-canonical k-mers, only the positive strand of genomes is searched`)
 }
@@ -0,0 +1,489 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/breader"
+	"github.com/spf13/cobra"
+)
+
+var markersCmd = &cobra.Command{
+	Use:   "markers",
+	Short: "Discover strain-specific marker regions with a sample sheet",
+	Long: `Discover strain-specific marker regions with a sample sheet
+
+This command wraps the common workflow of finding marker regions specific
+to some target genomes (e.g., strains), by running subcommands with this
+executable in stages:
+
+  1. count    counting k-mers of each sample (count -K -s).
+  2. core     k-mers shared by all targets (inter).
+  3. markers  removing k-mers found in background samples (diff).
+  4. regions  mapping marker k-mers back to the reference genome and
+              extracting successive regions (map), in BED6 and FASTA format.
+  5. stats    summarizing regions.
+
+Sample sheet:
+  Tab-delimited, with 3 columns: sample name, role (target or background),
+  and sequence files of the sample (comma-separated). Lines starting with
+  "#" and a header line with the role column of "role" are ignored.
+  Sample names should only contain letters, numbers, '.', '_' and '-'.
+  The reference genome for mapping is the first target by default.
+
+Resuming:
+  Each finished stage is recorded in <out-dir>/stages/, with its command
+  line (-j/--threads excluded), and sizes and modification times of its
+  input files. When running again with the same out directory, stages
+  are skipped if they finished with the same command line and inputs,
+  and their outputs exist, so interrupted runs continue from the failed
+  stage, and changing a parameter (e.g., -m/--min-len) or an input file
+  only reruns the affected stages and the following ones. Use --force to
+  rerun all stages. Logs of stages are saved in <out-dir>/logs/.
+
+Output files in the out directory:
+  count/<sample>.unik  k-mers of samples
+  core.unik            k-mers shared by all targets
+  markers.unik         marker k-mers
+  regions.bed          marker regions in the reference genome (BED6,
+                       score is the number of marker k-mers)
+  regions.fa           sequences of marker regions
+  regions.tsv          stats of regions, with columns: name, chrom, start,
+                       end, length, kmers, density (kmers / (length-k+1))
+
+The status of stages is written to stdout, with columns: stage, status
+(done/skipped), and time (seconds).
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		sheetFile := getFlagString(cmd, "sample-sheet")
+		if sheetFile == "" {
+			checkError(fmt.Errorf("flag -s/--sample-sheet needed"))
+		}
+		outDir := getFlagString(cmd, "out-dir")
+		k := getFlagPositiveInt(cmd, "kmer-len")
+		if k > 32 {
+			checkError(fmt.Errorf("value of -k/--kmer-len should be <= 32"))
+		}
+		reference := getFlagString(cmd, "reference")
+		minLen := getFlagPositiveInt(cmd, "min-len")
+		circular := getFlagBool(cmd, "circular")
+		force := getFlagBool(cmd, "force")
+		format := getFlagTableFormat(cmd)
+
+		samples, err := readMarkersSampleSheet(sheetFile)
+		checkError(err)
+
+		var targets, backgrounds []*markersSample
+		var ref *markersSample
+		for _, s := range samples {
+			if s.target {
+				targets = append(targets, s)
+				if ref == nil && (reference == "" || s.name == reference) {
+					ref = s
+				}
+			} else {
+				backgrounds = append(backgrounds, s)
+			}
+		}
+		if len(targets) == 0 {
+			checkError(fmt.Errorf("no target samples found in sample sheet: %s", sheetFile))
+		}
+		if len(backgrounds) == 0 {
+			checkError(fmt.Errorf("no background samples found in sample sheet: %s", sheetFile))
+		}
+		if ref == nil {
+			checkError(fmt.Errorf("reference not found in target samples: %s", reference))
+		}
+		if opt.Verbose {
+			log.Infof("%d target(s) and %d background sample(s) given, reference: %s", len(targets), len(backgrounds), ref.name)
+		}
+
+		exe, err := os.Executable()
+		checkError(err)
+
+		for _, dir := range []string{"count", "stages", "logs"} {
+			checkError(os.MkdirAll(filepath.Join(outDir, dir), 0777))
+		}
+
+		// ---------------------------------------------------------------
+		// stages
+
+		type markersStage struct {
+			name    string
+			args    []string // arguments of a subcommand, without -j/--threads
+			inputs  []string
+			outputs []string
+			run     func() error // for stages not running subcommands
+		}
+
+		stages := make([]*markersStage, 0, len(samples)+4)
+		threads := strconv.Itoa(opt.NumCPUs)
+		sk := strconv.Itoa(k)
+		countFile := func(s *markersSample) string {
+			return filepath.Join(outDir, "count", s.name+extDataFile)
+		}
+
+		for _, s := range samples {
+			_args := []string{"count", "-k", sk, "-K", "-s"}
+			if circular {
+				_args = append(_args, "--circular")
+			}
+			_args = append(_args, "-o", countFile(s))
+			_args = append(_args, s.files...)
+			stages = append(stages, &markersStage{
+				name:    "count:" + s.name,
+				args:    _args,
+				inputs:  s.files,
+				outputs: []string{countFile(s)},
+			})
+		}
+
+		coreFile := filepath.Join(outDir, "core"+extDataFile)
+		_args := []string{"inter", "-o", coreFile}
+		_inputs := make([]string, 0, len(targets))
+		for _, s := range targets {
+			_inputs = append(_inputs, countFile(s))
+		}
+		stages = append(stages, &markersStage{
+			name:    "core",
+			args:    append(_args, _inputs...),
+			inputs:  _inputs,
+			outputs: []string{coreFile},
+		})
+
+		markersFile := filepath.Join(outDir, "markers"+extDataFile)
+		_args = []string{"diff", "-s", "-o", markersFile}
+		_inputs = []string{coreFile}
+		for _, s := range backgrounds {
+			_inputs = append(_inputs, countFile(s))
+		}
+		stages = append(stages, &markersStage{
+			name:    "markers",
+			args:    append(_args, _inputs...),
+			inputs:  _inputs,
+			outputs: []string{markersFile},
+		})
+
+		bedFile := filepath.Join(outDir, "regions.bed")
+		faFile := filepath.Join(outDir, "regions.fa")
+		_args = []string{"map", "-m", strconv.Itoa(minLen)}
+		if circular {
+			_args = append(_args, "--circular")
+		}
+		for _, file := range ref.files {
+			_args = append(_args, "-g", file)
+		}
+		_args = append(_args, markersFile)
+		_inputs = append(append([]string{}, ref.files...), markersFile)
+		stages = append(stages, &markersStage{
+			name:    "regions:bed",
+			args:    append(append([]string{}, _args...), "--out-format", "bed6", "-o", bedFile),
+			inputs:  _inputs,
+			outputs: []string{bedFile},
+		})
+		stages = append(stages, &markersStage{
+			name:    "regions:fasta",
+			args:    append(append([]string{}, _args...), "--out-format", "fasta", "-o", faFile),
+			inputs:  _inputs,
+			outputs: []string{faFile},
+		})
+
+		statsFile := filepath.Join(outDir, "regions.tsv")
+		stages = append(stages, &markersStage{
+			name:    "stats",
+			args:    []string{"(stats)", "-k", sk, bedFile},
+			inputs:  []string{bedFile},
+			outputs: []string{statsFile},
+			run: func() error {
+				return writeMarkersRegionStats(bedFile, statsFile, k)
+			},
+		})
+
+		// ---------------------------------------------------------------
+		// run
+
+		outfh, gw, w, err := outStream("-", false, opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+		tw := newTableWriter(outfh, format, []string{"stage", "status", "time"})
+		tw.WriteHeader()
+
+		rerun := force // once a stage is rerun, all following ones are rerun
+		for i, stage := range stages {
+			stampFile := filepath.Join(outDir, "stages", strings.ReplaceAll(stage.name, ":", "_")+".done")
+			cmdline := strings.Join(stage.args, " ")
+
+			if !rerun && markersStageDone(stampFile, cmdline, stage.inputs, stage.outputs) {
+				if opt.Verbose {
+					log.Infof("[%d/%d] %s: skipped, already done", i+1, len(stages), stage.name)
+				}
+				tw.WriteRecord(stage.name, "skipped", 0)
+				continue
+			}
+			rerun = true
+			os.Remove(stampFile)
+
+			t := time.Now()
+			if stage.run != nil {
+				if opt.Verbose {
+					log.Infof("[%d/%d] %s: running", i+1, len(stages), stage.name)
+				}
+				err = stage.run()
+			} else {
+				if opt.Verbose {
+					log.Infof("[%d/%d] %s: running: unikmer %s", i+1, len(stages), stage.name, cmdline)
+				}
+				_args = append([]string{stage.args[0], "-j", threads, "--verbose"}, stage.args[1:]...)
+				err = runMarkersStage(exe, filepath.Join(outDir, "logs", strings.ReplaceAll(stage.name, ":", "_")+".log"), _args)
+			}
+			if err != nil {
+				outfh.Flush()
+				checkError(fmt.Errorf("stage %s failed: %s", stage.name, err))
+			}
+			stamp, err := markersStamp(cmdline, stage.inputs)
+			checkError(err)
+			checkError(os.WriteFile(stampFile, []byte(stamp), 0644))
+			tw.WriteRecord(stage.name, "done", roundFloat(time.Since(t).Seconds(), 1))
+		}
+
+		if opt.Verbose {
+			log.Infof("marker regions saved to: %s, %s, %s", bedFile, faFile, statsFile)
+		}
+	},
+}
+
+// markersSample is a sample in the sample sheet of "unikmer markers".
+type markersSample struct {
+	name   string
+	target bool
+	files  []string
+}
+
+var reMarkersSampleName = regexp.MustCompile(`^[A-Za-z0-9._\-]+$`)
+
+// readMarkersSampleSheet reads samples from a sample sheet, with 3 columns:
+// sample name, role (target or background), and comma-separated files.
+func readMarkersSampleSheet(file string) ([]*markersSample, error) {
+	brdr, err := breader.NewDefaultBufferedReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	samples := make([]*markersSample, 0, 8)
+	names := make(map[string]interface{}, 8)
+	var line, role, f string
+	var items []string
+	var data interface{}
+	for chunk := range brdr.Ch {
+		if chunk.Err != nil {
+			return nil, errors.Wrap(chunk.Err, file)
+		}
+		for _, data = range chunk.Data {
+			line = strings.TrimRight(data.(string), "\r\n")
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			items = strings.Split(line, "\t")
+			if len(items) < 3 {
+				return nil, fmt.Errorf("3 tab-delimited columns needed in sample sheet: %s", line)
+			}
+
+			role = strings.ToLower(strings.TrimSpace(items[1]))
+			if role == "role" { // header line
+				continue
+			}
+			s := &markersSample{name: strings.TrimSpace(items[0])}
+			switch role {
+			case "target":
+				s.target = true
+			case "background":
+			default:
+				return nil, fmt.Errorf("invalid role of sample %s: %s, available: target, background", s.name, items[1])
+			}
+
+			if !reMarkersSampleName.MatchString(s.name) {
+				return nil, fmt.Errorf("invalid sample name: %s", s.name)
+			}
+			if _, ok := names[s.name]; ok {
+				return nil, fmt.Errorf("duplicated sample name: %s", s.name)
+			}
+			names[s.name] = struct{}{}
+
+			for _, f = range strings.Split(items[2], ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					s.files = append(s.files, f)
+				}
+			}
+			if len(s.files) == 0 {
+				return nil, fmt.Errorf("no sequence files given for sample: %s", s.name)
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+// markersStamp returns the record of a finished stage, including the command
+// line, and sizes and modification times of input files.
+func markersStamp(cmdline string, inputs []string) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(cmdline + "\n")
+	for _, file := range inputs {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "%s\t%d\t%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return buf.String(), nil
+}
+
+// markersStageDone checks whether a stage finished with the same command
+// line and input files, and all its outputs exist.
+func markersStageDone(stampFile string, cmdline string, inputs []string, outputs []string) bool {
+	data, err := os.ReadFile(stampFile)
+	if err != nil {
+		return false
+	}
+	stamp, err := markersStamp(cmdline, inputs)
+	if err != nil || string(data) != stamp {
+		return false
+	}
+	for _, file := range outputs {
+		if _, err = os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runMarkersStage runs a subcommand, with stderr saved in the log file.
+func runMarkersStage(exe string, logFile string, args []string) error {
+	fh, err := os.Create(logFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var stderr bytes.Buffer
+	c := exec.Command(exe, args...)
+	c.Stdout = fh
+	c.Stderr = &stderr
+	err = c.Run()
+	fh.Write(stderr.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeMarkersRegionStats summarizes regions in a BED6 file from "unikmer map",
+// where the score is the number of matched k-mers.
+func writeMarkersRegionStats(bedFile string, outFile string, k int) error {
+	brdr, err := breader.NewDefaultBufferedReader(bedFile)
+	if err != nil {
+		return errors.Wrap(err, bedFile)
+	}
+
+	outfh, gw, w, err := outStream(outFile, false, 0)
+	if err != nil {
+		return err
+	}
+	tw := newTableWriter(outfh, "tsv", []string{"name", "chrom", "start", "end", "length", "kmers", "density"})
+	tw.WriteHeader()
+
+	var line string
+	var items []string
+	var start, end, nk int
+	var density float64
+	var data interface{}
+	for chunk := range brdr.Ch {
+		if chunk.Err != nil {
+			return errors.Wrap(chunk.Err, bedFile)
+		}
+		for _, data = range chunk.Data {
+			line = data.(string)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			items = strings.Split(line, "\t")
+			if len(items) < 5 {
+				return fmt.Errorf("%s: at least five columns needed: %s", bedFile, line)
+			}
+			start, err = strconv.Atoi(items[1])
+			if err != nil {
+				return fmt.Errorf("%s: invalid start position: %s", bedFile, line)
+			}
+			end, err = strconv.Atoi(items[2])
+			if err != nil || end < start {
+				return fmt.Errorf("%s: invalid end position: %s", bedFile, line)
+			}
+			nk, err = strconv.Atoi(items[4])
+			if err != nil {
+				return fmt.Errorf("%s: invalid score: %s", bedFile, line)
+			}
+
+			density = 0
+			if end-start >= k {
+				density = float64(nk) / float64(end-start-k+1)
+			}
+			tw.WriteRecord(items[3], items[0], start, end, end-start, nk, roundFloat(density, 4))
+		}
+	}
+
+	outfh.Flush()
+	if gw != nil {
+		gw.Close()
+	}
+	return w.Close()
+}
+
+func init() {
+	RootCmd.AddCommand(markersCmd)
+
+	markersCmd.Flags().StringP("sample-sheet", "s", "", `sample sheet, type "unikmer markers -h" for details`)
+	markersCmd.Flags().StringP("out-dir", "O", "markers", `output directory`)
+	markersCmd.Flags().IntP("kmer-len", "k", 31, "k-mer size")
+	markersCmd.Flags().StringP("reference", "r", "", "target sample as the reference genome for mapping, the first target by default")
+	markersCmd.Flags().IntP("min-len", "m", 200, "minimum length of marker regions")
+	markersCmd.Flags().BoolP("circular", "", false, "circular genomes")
+	markersCmd.Flags().BoolP("force", "", false, "rerun all stages, ignoring finished ones")
+	markersCmd.Flags().StringP("out-format", "", "tsv", `output format of stage status, available: "tsv", "json" (JSON lines)`)
+}
@@ -49,6 +49,9 @@ Attentions:
 Tips:
   1. If you don't need to compute unique or repeated k-mers, 
      use 'unikmer concat -s', which is faster.
+  2. Use --min-count and --max-count to filter k-mers by the number of
+     occurrences in all input files, e.g., removing k-mers with sequencing
+     errors from the output of 'unikmer count --linear' + 'unikmer sort'.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -56,9 +59,13 @@ Tips:
 		outFile0 := getFlagString(cmd, "out-prefix")
 		unique := getFlagBool(cmd, "unique")
 		repeated := getFlagBool(cmd, "repeated")
+		requireSorted := getFlagBool(cmd, "require-sorted")
+		cr := getCountRange(cmd)
+		if cr != nil && (unique || repeated) {
+			checkError(fmt.Errorf("flags --min-count/--max-count and -u/--unique or -d/--repeated are not compatible"))
+		}
 		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
 		keepTmpDir := getFlagBool(cmd, "keep-tmp-dir")
-		force := getFlagBool(cmd, "force")
 
 		var err error
 
@@ -161,7 +168,7 @@ Tips:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -230,7 +237,7 @@ Tips:
 				log.Info()
 				log.Infof("======= Stage 2: merging from %d chunks =======", len(files))
 			}
-			n, _ := mergeChunksFile(opt, taxondb, files, outFile, k, mode, unique, repeated, true)
+			n, _ := mergeChunksFile(opt, taxondb, files, outFile, k, mode, unique, repeated, cr, nil, requireSorted, true)
 
 			if opt.Verbose {
 				log.Infof("%d k-mers saved to %s", n, outFile)
@@ -248,29 +255,11 @@ Tips:
 		// 	log.Warningf("if the files are of small size, you may use 'unikmer sort -m' instead")
 		// }
 
-		tmpDir := getFlagString(cmd, "tmp-dir")
-		if isStdout(outFile0) {
-			tmpDir = filepath.Join(tmpDir, "stdout.tmp")
-		} else {
-			tmpDir = filepath.Join(tmpDir, filepath.Base(outFile0)+".tmp")
-		}
-
-		existed, err := pathutil.DirExists(tmpDir)
-		checkError(errors.Wrap(err, tmpDir))
-		if existed {
-			empty, err := pathutil.IsEmpty(tmpDir)
-			checkError(errors.Wrap(err, tmpDir))
-			if !empty {
-				if force {
-					checkError(os.RemoveAll(tmpDir))
-				} else {
-					checkError(fmt.Errorf("tmp dir not empty: %s, choose another one or use --force to overwrite", tmpDir))
-				}
-			} else {
-				checkError(os.RemoveAll(tmpDir))
-			}
+		tmpDir, err := makeTmpDir(getTmpRoot(cmd), "unikmer-merge")
+		checkError(errors.Wrap(err, "create tmp dir"))
+		if !keepTmpDir {
+			registerTmpDir(tmpDir)
 		}
-		checkError(os.MkdirAll(tmpDir, 0777))
 
 		tmpFiles := make([]string, 0, 10)
 		iTmpFile := 0
@@ -284,7 +273,7 @@ Tips:
 				if opt.Verbose {
 					log.Infof("[chunk %d] merging k-mers from %d tmp files", iTmpFile, len(_files))
 				}
-				n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, false)
+				n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, cr, nil, requireSorted, false)
 				if opt.Verbose {
 					log.Infof("%d k-mers saved to tmp file: %s", n, outFile1)
 				}
@@ -299,7 +288,7 @@ Tips:
 			if opt.Verbose {
 				log.Infof("[chunk %d] merging k-mers from %d tmp files", iTmpFile, len(_files))
 			}
-			n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, false)
+			n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, cr, nil, requireSorted, false)
 			if opt.Verbose {
 				log.Infof("%d k-mers saved to tmp file: %s", n, outFile1)
 			}
@@ -310,7 +299,7 @@ Tips:
 			log.Info()
 			log.Infof("======= Stage 3: merging from %d chunks (round: 2/2) =======", len(tmpFiles))
 		}
-		n, _ := mergeChunksFile(opt, taxondb, tmpFiles, outFile, k, mode, unique, repeated, true)
+		n, _ := mergeChunksFile(opt, taxondb, tmpFiles, outFile, k, mode, unique, repeated, cr, nil, false, true)
 
 		if opt.Verbose {
 			log.Infof("%d k-mers saved to %s", n, outFile)
@@ -322,22 +311,14 @@ Tips:
 			return
 		}
 
-		if opt.Verbose {
-			log.Infof("removing %d intermediate files", len(tmpFiles)+len(files))
-		}
-		for _, file := range tmpFiles {
-			err := os.Remove(file)
-			if err != nil {
-				checkError(fmt.Errorf("fail to remove intermediate file: %s", file))
-			}
-		}
 		if opt.Verbose {
 			log.Infof("removing tmp dir: %s", tmpDir)
 		}
-		err = os.Remove(tmpDir)
+		err = removeAllWithRetry(tmpDir)
 		if err != nil {
 			checkError(fmt.Errorf("fail to remove temp directory, please manually delete it: %s", tmpDir))
 		}
+		unregisterTmpDir(tmpDir)
 
 	},
 }
@@ -351,9 +332,13 @@ func init() {
 	mergeCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	mergeCmd.Flags().BoolP("unique", "u", false, `remove duplicate k-mers`)
 	mergeCmd.Flags().BoolP("repeated", "d", false, `only print duplicate k-mers`)
+	mergeCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
+	mergeCmd.Flags().IntP("min-count", "", 0, `only output k-mers occurring at least N times in input`)
+	mergeCmd.Flags().IntP("max-count", "", 0, `only output k-mers occurring at most N times in input, 0 for no limit`)
 
 	mergeCmd.Flags().IntP("max-open-files", "M", 400, `max number of open files`)
-	mergeCmd.Flags().StringP("tmp-dir", "t", "./", `directory for intermediate files`)
+	mergeCmd.Flags().StringP("tmp-dir", "t", "./", `directory for intermediate files, the environment variable `+envTmpDir+` is used if not given`)
 	mergeCmd.Flags().BoolP("keep-tmp-dir", "k", false, `keep tmp dir`)
 	mergeCmd.Flags().BoolP("force", "", false, "overwrite tmp dir")
+	mergeCmd.Flags().MarkDeprecated("force", "tmp dirs have unique names now")
 }
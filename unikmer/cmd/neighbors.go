@@ -0,0 +1,236 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/breader"
+	"github.com/shenwei356/kmers"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var neighborsCmd = &cobra.Command{
+	Use:   "neighbors",
+	Short: "Check single-base extensions of query k-mers in binary files",
+	Long: `Check single-base extensions of query k-mers in binary files
+
+For each query k-mer, the 4 possible left extensions (Nxxxx) and 4 possible
+right extensions (xxxxN), i.e., the neighbors in the de Bruijn graph, are
+checked in the k-mer set of the input binary files.
+
+Output columns:
+  kmer     query k-mer
+  exists   whether the query exists in the set
+  left     bases B of existing left neighbors, i.e., B + kmer[:k-1]
+  right    bases B of existing right neighbors, i.e., kmer[1:] + B
+
+Attentions:
+  1. Only k-mers (not hashed) are supported, k-mers of all input files
+     are merged and stored in memory.
+  2. For canonical k-mers, neighbors are checked on both strands.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-file")
+		queries := getFlagNonEmptyStringSlice(cmd, "query")
+		queryFiles := getFlagNonEmptyStringSlice(cmd, "query-file")
+		format := getFlagTableFormat(cmd)
+
+		if len(queries) == 0 && len(queryFiles) == 0 {
+			checkError(fmt.Errorf("one of flags -q/--query and -f/--query-file needed"))
+		}
+		for _, file := range queryFiles {
+			if isStdin(file) && len(files) == 1 && isStdin(files[0]) {
+				checkError(fmt.Errorf("stdin can not be used for both binary files and query files"))
+			}
+		}
+
+		// ---------------------------------------------------------------
+		// k-mer set
+
+		m := make(map[uint64]struct{}, mapInitSize)
+
+		var infh *bufio.Reader
+		var r *os.File
+		var reader0 *unik.Reader
+		var code uint64
+		var k int = -1
+		var canonical bool
+
+		for _, file := range files {
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				if reader.IsHashed() {
+					checkError(fmt.Errorf("hashed k-mers are not supported: %s", file))
+				}
+				if k == -1 {
+					reader0 = reader
+					k = reader.K
+					canonical = reader.IsCanonical()
+				} else {
+					checkCompatibility(reader0, reader, file)
+				}
+
+				for {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					m[code] = struct{}{}
+				}
+			}()
+		}
+
+		if opt.Verbose {
+			log.Infof("%d k-mers loaded", len(m))
+		}
+
+		// ---------------------------------------------------------------
+		// queries
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"kmer", "exists", "left", "right"})
+		tw.WriteHeader()
+
+		has := func(code uint64) bool {
+			if canonical {
+				code = kmers.Canonical(code, k)
+			}
+			_, ok := m[code]
+			return ok
+		}
+
+		var mask uint64
+		if k == 32 {
+			mask = ^uint64(0)
+		} else {
+			mask = (1 << uint(k<<1)) - 1
+		}
+		shift := uint((k - 1) << 1)
+
+		var kcode kmers.KmerCode
+		var b uint64
+		left := make([]byte, 0, 4)
+		right := make([]byte, 0, 4)
+		var nQueries int
+		checkQuery := func(query string) {
+			if query == "" {
+				return
+			}
+			if len(query) != k {
+				checkError(fmt.Errorf("length of query (%d) does not match k (%d): %s", len(query), k, query))
+			}
+			kcode, err = kmers.NewKmerCode([]byte(query))
+			if err != nil {
+				checkError(fmt.Errorf("fail to encode query '%s': %s", query, err))
+			}
+			code = kcode.Code
+
+			left = left[:0]
+			right = right[:0]
+			for b = 0; b < 4; b++ {
+				if has(b<<shift | code>>2) {
+					left = append(left, "ACGT"[b])
+				}
+				if has((code<<2 | b) & mask) {
+					right = append(right, "ACGT"[b])
+				}
+			}
+
+			tw.WriteRecord(query, has(code), string(left), string(right))
+			nQueries++
+		}
+
+		for _, query := range queries {
+			checkQuery(query)
+		}
+
+		var brdr *breader.BufferedReader
+		var data interface{}
+		for _, queryFile := range queryFiles {
+			brdr, err = breader.NewDefaultBufferedReader(queryFile)
+			checkError(errors.Wrap(err, queryFile))
+			for chunk := range brdr.Ch {
+				checkError(chunk.Err)
+				for _, data = range chunk.Data {
+					checkQuery(data.(string))
+				}
+			}
+		}
+
+		if opt.Verbose {
+			log.Infof("%d queries checked", nQueries)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(neighborsCmd)
+
+	neighborsCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	neighborsCmd.Flags().StringSliceP("query", "q", []string{""}, `query k-mers (multiple values delimted by comma supported)`)
+	neighborsCmd.Flags().StringSliceP("query-file", "f", []string{""}, "query file (one k-mer per line)")
+	neighborsCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
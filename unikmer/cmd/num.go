@@ -66,6 +66,7 @@ Attention:
 		showFile := getFlagBool(cmd, "file-name")
 		basename := getFlagBool(cmd, "basename")
 		force := getFlagBool(cmd, "force")
+		format := getFlagTableFormat(cmd)
 
 		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
 		checkError(err)
@@ -77,6 +78,15 @@ Attention:
 			w.Close()
 		}()
 
+		var tw *tableWriter
+		if format != "tsv" {
+			colnames := []string{"number"}
+			if showFile {
+				colnames = append(colnames, "file")
+			}
+			tw = newTableWriter(outfh, format, colnames)
+		}
+
 		var infh *bufio.Reader
 		var r *os.File
 		var reader *unik.Reader
@@ -85,7 +95,7 @@ Attention:
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err = unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -106,12 +116,17 @@ Attention:
 					reader.Number = n
 				}
 
-				if showFile {
-					if basename {
-						outfh.WriteString(fmt.Sprintf("%d\t%s\n", reader.Number, filepath.Base(file)))
+				if basename {
+					file = filepath.Base(file)
+				}
+				if tw != nil {
+					if showFile {
+						tw.WriteRecord(reader.Number, file)
 					} else {
-						outfh.WriteString(fmt.Sprintf("%d\t%s\n", reader.Number, file))
+						tw.WriteRecord(reader.Number)
 					}
+				} else if showFile {
+					outfh.WriteString(fmt.Sprintf("%d\t%s\n", reader.Number, file))
 				} else {
 					outfh.WriteString(fmt.Sprintf("%d\n", reader.Number))
 				}
@@ -128,4 +143,5 @@ func init() {
 	numCmd.Flags().BoolP("file-name", "n", false, `show file name`)
 	numCmd.Flags().BoolP("basename", "b", false, "only output basename of files")
 	numCmd.Flags().BoolP("force", "f", false, "read the whole file and count k-mers")
+	numCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
 }
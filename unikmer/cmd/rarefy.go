@@ -0,0 +1,256 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
+
+	"github.com/spf13/cobra"
+)
+
+var rarefyCmd = &cobra.Command{
+	Use:   "rarefy",
+	Short: "Rarefaction curve of distinct k-mers by subsampling sequences",
+	Long: `Rarefaction curve of distinct k-mers by subsampling sequences
+
+This command subsamples reads/sequences at multiple fractions and reports
+the number of distinct k-mers of each fraction, for estimating whether the
+sequencing depth is adequate.
+
+Methods:
+  1. Every sequence is assigned with a random number u in [0, 1), and it
+     belongs to all fractions >= u. So subsamples are nested, and all
+     fractions are computed in one pass.
+  2. For each k-mer, only the smallest fraction it appears in is recorded.
+  3. With --scale > 1, only hashed k-mers <= MAX_HASH/scale are kept
+     (Scaled MinHash), and the numbers of distinct k-mers are estimated
+     as number * scale, which greatly reduces memory usage.
+     Since the canonical ntHash is the smaller one of hashes of both strands,
+     about 2/scale of canonical k-mers are kept, the estimates are adjusted
+     accordingly.
+
+Attention:
+  1. Binary files (.unik) have no abundance information, so the input
+     should be FASTA/Q files.
+
+Output (TSV or JSON lines):
+  fraction, reads, bases, kmers
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		outFile := getFlagString(cmd, "out-file")
+		format := getFlagTableFormat(cmd)
+
+		k := getFlagPositiveInt(cmd, "kmer-len")
+		canonical := getFlagBool(cmd, "canonical")
+
+		hashed := getFlagBool(cmd, "hash")
+		if k > 32 && !hashed {
+			hashed = true
+			log.Warning("flag -H/--hash is switched on for k > 32")
+		}
+		if hashed && k > 64 {
+			checkError(fmt.Errorf("k-mer size (%d) should be <=64", k))
+		}
+
+		scale := getFlagPositiveInt(cmd, "scale")
+		if scale > 1<<31-1 {
+			checkError(fmt.Errorf("value of flag --scale is too big"))
+		}
+		scaled := scale > 1
+		if scaled && !hashed {
+			hashed = true
+			log.Warning("flag -H/--hash is switched on for scale > 1")
+		}
+		maxHash := uint64(float64(^uint64(0)) / float64(scale))
+
+		seed := getFlagInt64(cmd, "seed")
+
+		fractions := make([]float64, 0, 10)
+		var f float64
+		for _, s := range getFlagCommaSeparatedStrings(cmd, "fractions") {
+			f, err = strconv.ParseFloat(s, 64)
+			if err != nil || f <= 0 || f > 1 {
+				checkError(fmt.Errorf("invalid fraction: %s, a float in range of (0, 1] needed", s))
+			}
+			fractions = append(fractions, f)
+		}
+		if len(fractions) == 0 {
+			checkError(fmt.Errorf("flag -f/--fractions needed"))
+		}
+		if len(fractions) > 1<<16-1 {
+			checkError(fmt.Errorf("too many fractions: %d", len(fractions)))
+		}
+		sort.Float64s(fractions)
+
+		nf := len(fractions)
+		reads := make([]uint64, nf)
+		bases := make([]uint64, nf)
+		kmers := make([]uint64, nf)
+
+		// k-mer -> index of the smallest fraction
+		m := make(map[uint64]uint16, mapInitSize)
+
+		rnd := rand.New(rand.NewSource(seed))
+
+		var record *fastx.Record
+		var fastxReader *fastx.Reader
+		var iter *sketches.Iterator
+		var code uint64
+		var ok bool
+		var u float64
+		var idx, fi int
+		var _idx uint16
+		for _, file := range files {
+			if opt.Verbose {
+				log.Infof("reading sequence file: %s", file)
+			}
+			fastxReader, err = fastx.NewDefaultReader(file)
+			checkError(errors.Wrap(err, file))
+			for {
+				record, err = fastxReader.Read()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+					break
+				}
+
+				u = rnd.Float64()
+				if u >= fractions[nf-1] { // not in any fraction
+					continue
+				}
+				idx = sort.Search(nf, func(i int) bool { return u < fractions[i] })
+
+				reads[idx]++
+				bases[idx] += uint64(len(record.Seq.Seq))
+
+				if hashed {
+					iter, err = sketches.NewHashIterator(record.Seq, k, canonical, false)
+				} else {
+					iter, err = sketches.NewKmerIterator(record.Seq, k, canonical, false)
+				}
+				if err != nil {
+					if err == sketches.ErrShortSeq {
+						continue
+					}
+					checkError(errors.Wrapf(err, "seq: %s", record.Name))
+				}
+
+				for {
+					if hashed {
+						code, ok = iter.NextHash()
+					} else {
+						code, ok, err = iter.NextKmer()
+						if err != nil {
+							checkError(errors.Wrapf(err, "seq: %s", record.Name))
+						}
+					}
+					if !ok {
+						break
+					}
+
+					if scaled && code > maxHash {
+						continue
+					}
+
+					if _idx, ok = m[code]; !ok || int(_idx) > idx {
+						m[code] = uint16(idx)
+					}
+				}
+			}
+		}
+
+		for _, _idx = range m {
+			kmers[_idx]++
+		}
+
+		// cumulative numbers
+		for fi = 1; fi < nf; fi++ {
+			reads[fi] += reads[fi-1]
+			bases[fi] += bases[fi-1]
+			kmers[fi] += kmers[fi-1]
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		// factor for estimating numbers of all k-mers
+		factor := float64(scale)
+		if scaled && canonical {
+			factor /= 2
+		}
+
+		tw := newTableWriter(outfh, format, []string{"fraction", "reads", "bases", "kmers"})
+		tw.WriteHeader()
+		for fi, f = range fractions {
+			tw.WriteRecord(f, reads[fi], bases[fi], uint64(float64(kmers[fi])*factor))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rarefyCmd)
+
+	rarefyCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	rarefyCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+	rarefyCmd.Flags().IntP("kmer-len", "k", 0, "k-mer length")
+	rarefyCmd.Flags().BoolP("canonical", "K", false, "only keep the canonical k-mers")
+	rarefyCmd.Flags().BoolP("hash", "H", false, `use hash of k-mer, automatically on for k>32`)
+	rarefyCmd.Flags().IntP("scale", "D", 1, `scale/down-sample factor`)
+	rarefyCmd.Flags().StringP("fractions", "f", "0.1,0.2,0.3,0.4,0.5,0.6,0.7,0.8,0.9,1", "comma-separated fractions of sequences to sample, in range of (0, 1]")
+	rarefyCmd.Flags().Int64P("seed", "s", 11, "rand seed")
+}
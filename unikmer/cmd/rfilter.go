@@ -26,6 +26,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -55,6 +57,17 @@ Attentions:
   6. But when filtering with -L/--lower-than, you can use
     -n/--save-predictable-norank to save some special ranks without order,
     where rank of the closest higher node is still lower than rank cutoff.
+  7. K-mers can also be restricted to lineages of some taxa with
+     -T/--keep-lineage-of, in the same pass with rank filters. Values can be
+     taxids or scientific names (names.dmp needed). Use --lineage-mode to
+     choose keeping descendants, ancestors, or both of these taxa,
+     the taxa themselves are always kept.
+  8. Use --split-by-rank to write k-mers into one file per taxon at a rank
+     (e.g., one file per genus), named as "<out-prefix>.<rank>-<taxid>.unik",
+     along with a manifest file "<out-prefix>.manifest.tsv" with columns of
+     file, taxid, name (names.dmp needed), and the number of k-mers.
+     K-mers with taxids above the rank are discarded. One file is kept open
+     for each taxon, you may need to increase the limit ("ulimit -n").
 
 Rank file:
   1. Blank lines or lines starting with "#" are ignored.
@@ -102,6 +115,19 @@ Rank file:
 			equals = append(equals, strings.ToLower(val))
 		}
 
+		lineageTaxa := getFlagStringSlice(cmd, "keep-lineage-of")
+		lineageMode := strings.ToLower(getFlagString(cmd, "lineage-mode"))
+		switch lineageMode {
+		case "descendants", "ancestors", "both":
+		default:
+			checkError(fmt.Errorf("invalid value of --lineage-mode: %s, available: descendants, ancestors, both", lineageMode))
+		}
+
+		splitRank := strings.ToLower(getFlagString(cmd, "split-by-rank"))
+		if splitRank != "" && isStdout(outFile) {
+			checkError(fmt.Errorf("flag -o/--out-prefix needed when using --split-by-rank"))
+		}
+
 		listOrder := getFlagBool(cmd, "list-order")
 		listRanks := getFlagBool(cmd, "list-ranks")
 
@@ -133,7 +159,7 @@ Rank file:
 			for r, o := range rankOrder {
 				orders = append(orders, stringutil.StringCount{Key: r, Count: o})
 			}
-			sorts.Quicksort(stringutil.ReversedStringCountList{orders})
+			sorts.Quicksort(stringutil.ReversedStringCountList{StringCountList: orders})
 			preOrder := -1
 			for _, order := range orders {
 				// fmt.Printf("%d\t%s\n", order.Count, order.Key)
@@ -182,7 +208,7 @@ Rank file:
 				}
 				orders = append(orders, stringutil.StringCount{Key: rank, Count: rankOrder[rank]})
 			}
-			sorts.Quicksort(stringutil.ReversedStringCountList{orders})
+			sorts.Quicksort(stringutil.ReversedStringCountList{StringCountList: orders})
 			for _, order := range orders {
 				// fmt.Printf("%d\t%s\n", order.Count, order.Key)
 				fmt.Printf("%s\n", order.Key)
@@ -217,18 +243,47 @@ Rank file:
 		filter, err := newRankFilter(taxondb, rankOrder, noRanks, lower, higher, equals, blackListRanks, discardNoRank, saveNorank)
 		checkError(err)
 
-		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
-			outFile += extDataFile
+		var lineage *lineageFilter
+		if len(lineageTaxa) > 0 {
+			lineage, err = newLineageFilter(opt, taxondb, lineageTaxa, lineageMode)
+			checkError(err)
+			if opt.Verbose {
+				log.Infof("only keep %s of %d taxa", lineageMode, len(lineage.taxids))
+			}
 		}
-		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
-		checkError(err)
-		defer func() {
-			outfh.Flush()
-			if gw != nil {
-				gw.Close()
+
+		var shards *rankShards
+		var outfh *bufio.Writer
+		var gw io.WriteCloser
+		var w *os.File
+		if splitRank != "" {
+			if _, ok := taxondb.Ranks[splitRank]; !ok {
+				checkError(fmt.Errorf("rank not found in taxonomy database: %s", splitRank))
+			}
+			if len(taxondb.Names) == 0 {
+				file := filepath.Join(opt.DataDir, "names.dmp")
+				if existed, _ := pathutil.Exists(file); existed {
+					checkError(errors.Wrap(taxondb.LoadNamesFromNCBI(file), file))
+				} else if opt.Verbose {
+					log.Warningf("names.dmp not found, names will be empty in the manifest file")
+				}
 			}
-			w.Close()
-		}()
+			outFile = strings.TrimSuffix(outFile, extDataFile)
+			shards = newRankShards(opt, taxondb, splitRank, outFile)
+		} else {
+			if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
+				outFile += extDataFile
+			}
+			outfh, gw, w, err = outStream(outFile, opt.Compress, opt.CompressionLevel)
+			checkError(err)
+			defer func() {
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			}()
+		}
 
 		var writer *unik.Writer
 
@@ -244,6 +299,7 @@ Rank file:
 		var n int64
 		var rank string
 		var pass bool
+		var nAbove int64 // k-mers with taxids above the rank for --split-by-rank
 		for i, file := range files {
 			if opt.Verbose {
 				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
@@ -252,7 +308,7 @@ Rank file:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -267,9 +323,15 @@ Rank file:
 
 					mode := reader.Flag
 					mode |= unik.UnikIncludeTaxID
-					writer, err = unik.NewWriter(outfh, k, mode)
-					checkError(errors.Wrap(err, outFile))
-					writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+					if shards != nil {
+						shards.k = k
+						shards.mode = mode
+						shards.maxTaxid = maxUint32N(reader.GetTaxidBytesLength()) // follow reader
+					} else {
+						writer, err = unik.NewWriter(outfh, k, mode)
+						checkError(errors.Wrap(err, outFile))
+						writer.SetMaxTaxid(maxUint32N(reader.GetTaxidBytesLength())) // follow reader
+					}
 				} else {
 					checkCompatibility(reader0, reader, file)
 					if !hasTaxid {
@@ -278,7 +340,7 @@ Rank file:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -290,6 +352,10 @@ Rank file:
 						continue
 					}
 
+					if lineage != nil && !lineage.isPassed(taxid) {
+						continue
+					}
+
 					pass, err = filter.isPassed(taxid)
 					if err != nil {
 						checkError(errors.Wrapf(err, "file: %s, rank: %s", file, rank))
@@ -298,6 +364,15 @@ Rank file:
 						continue
 					}
 
+					if shards != nil {
+						pass, err = shards.write(code, taxid)
+						checkError(err)
+						if !pass {
+							nAbove++
+						}
+						continue
+					}
+
 					n++
 					writer.WriteCodeWithTaxid(code, taxid) // not need to check err
 					// fmt.Printf("%d\t%s\n", taxid, rank)
@@ -313,6 +388,17 @@ Rank file:
 			}
 		}
 
+		if shards != nil {
+			manifest := outFile + ".manifest.tsv"
+			n, err = shards.close(manifest)
+			checkError(err)
+			if opt.Verbose {
+				log.Infof("%d k-mers saved to %d files, listed in %s", n, len(shards.shards), manifest)
+				log.Infof("%d k-mers with taxids above rank '%s' discarded", nAbove, splitRank)
+			}
+			return
+		}
+
 		checkError(writer.Flush())
 		if opt.Verbose {
 			log.Infof("%d k-mers saved to %s", n, outFile)
@@ -337,6 +423,9 @@ func init() {
 
 	rfilterCmd.Flags().StringP("lower-than", "L", "", "output ranks lower than a rank, exclusive with --higher-than")
 	rfilterCmd.Flags().StringP("higher-than", "H", "", "output ranks higher than a rank, exclusive with --lower-than")
+	rfilterCmd.Flags().StringSliceP("keep-lineage-of", "T", []string{}, `only keep taxids on lineages of these taxa (taxids or scientific names), type "unikmer rfilter --help" for details`)
+	rfilterCmd.Flags().StringP("lineage-mode", "", "descendants", `which part of lineages to keep for -T/--keep-lineage-of, available values: descendants, ancestors, both`)
+	rfilterCmd.Flags().StringP("split-by-rank", "", "", `write k-mers into one file per taxon at this rank (e.g., genus), type "unikmer rfilter --help" for details`)
 	rfilterCmd.Flags().StringSliceP("equal-to", "E", []string{}, `output taxIDs with rank equal to some ranks, multiple values can be separated with comma "," (e.g., -E "genus,species"), or give multiple times (e.g., -E genus -E species)`)
 }
 
@@ -721,3 +810,224 @@ subform,subforma
 strain
 isolate
 `
+
+type lineageFilter struct {
+	taxondb *taxdump.Taxonomy
+	taxids  []uint32
+
+	descendants bool
+	ancestors   bool
+
+	cache map[uint32]bool
+}
+
+// newLineageFilter creates a filter keeping taxids on lineages of some taxa,
+// which can be given in taxids or scientific names.
+func newLineageFilter(opt *Options, taxondb *taxdump.Taxonomy, taxa []string, mode string) (*lineageFilter, error) {
+	taxids := make([]uint32, 0, len(taxa))
+	names := make([]string, 0, len(taxa))
+	for _, taxon := range taxa {
+		taxon = strings.TrimSpace(taxon)
+		if taxon == "" {
+			continue
+		}
+		taxid, err := strconv.ParseUint(taxon, 10, 32)
+		if err != nil {
+			names = append(names, taxon)
+			continue
+		}
+		taxids = append(taxids, uint32(taxid))
+	}
+
+	if len(names) > 0 {
+		file := filepath.Join(opt.DataDir, "names.dmp")
+		if opt.Verbose {
+			log.Infof("loading names from: %s", file)
+		}
+		err := taxondb.LoadNamesFromNCBI(file)
+		if err != nil {
+			return nil, fmt.Errorf("err on loading taxonomy names: %s", err)
+		}
+
+		name2taxids := make(map[string][]uint32, len(names))
+		for _, name := range names {
+			name2taxids[strings.ToLower(name)] = nil
+		}
+		var ok bool
+		var lname string
+		for taxid, name := range taxondb.Names {
+			lname = strings.ToLower(name)
+			if _, ok = name2taxids[lname]; ok {
+				name2taxids[lname] = append(name2taxids[lname], taxid)
+			}
+		}
+		for _, name := range names {
+			_taxids := name2taxids[strings.ToLower(name)]
+			if len(_taxids) == 0 {
+				return nil, fmt.Errorf("scientific name not found: %s", name)
+			}
+			if len(_taxids) > 1 {
+				return nil, fmt.Errorf("scientific name matches multiple taxids, please use taxid instead: %s (%v)", name, _taxids)
+			}
+			taxids = append(taxids, _taxids[0])
+		}
+	}
+
+	for _, taxid := range taxids {
+		if _, ok := taxondb.TaxId(taxid); !ok {
+			return nil, fmt.Errorf("taxid not found in taxonomy: %d", taxid)
+		}
+	}
+
+	return &lineageFilter{
+		taxondb:     taxondb,
+		taxids:      taxids,
+		descendants: mode == "descendants" || mode == "both",
+		ancestors:   mode == "ancestors" || mode == "both",
+		cache:       make(map[uint32]bool, 1024),
+	}, nil
+}
+
+func (f *lineageFilter) isPassed(taxid uint32) bool {
+	if pass, ok := f.cache[taxid]; ok {
+		return pass
+	}
+
+	var pass bool
+	var lca uint32
+	for _, t := range f.taxids {
+		lca = f.taxondb.LCA(taxid, t)
+		if lca == 0 {
+			continue
+		}
+		if lca == t && f.descendants || lca == taxid && f.ancestors {
+			pass = true
+			break
+		}
+	}
+
+	f.cache[taxid] = pass
+	return pass
+}
+
+// rankShards writes k-mers into one file per taxon at a rank,
+// e.g., one file per genus.
+type rankShards struct {
+	opt      *Options
+	taxondb  *taxdump.Taxonomy
+	rank     string
+	prefix   string
+	k        int
+	mode     uint32
+	maxTaxid uint32
+
+	cache  map[uint32]uint32 // taxid -> taxid at the rank, 0 for none
+	shards map[uint32]*rankShard
+}
+
+type rankShard struct {
+	file   string
+	outfh  *bufio.Writer
+	gw     io.WriteCloser
+	w      *os.File
+	writer *unik.Writer
+	n      int64
+}
+
+func newRankShards(opt *Options, taxondb *taxdump.Taxonomy, rank string, prefix string) *rankShards {
+	return &rankShards{
+		opt:     opt,
+		taxondb: taxondb,
+		rank:    rank,
+		prefix:  prefix,
+		cache:   make(map[uint32]uint32, 1024),
+		shards:  make(map[uint32]*rankShard, 128),
+	}
+}
+
+// taxidAtRank returns the taxid at the rank on the lineage of a taxid,
+// 0 is returned if the taxid is above the rank or not found.
+func (s *rankShards) taxidAtRank(taxid uint32) uint32 {
+	if t, ok := s.cache[taxid]; ok {
+		return t
+	}
+	var t uint32
+	for _, _t := range s.taxondb.LineageTaxIds(taxid) {
+		if s.taxondb.Rank(_t) == s.rank {
+			t = _t
+			break
+		}
+	}
+	s.cache[taxid] = t
+	return t
+}
+
+// write writes a k-mer to the file of its taxon at the rank,
+// false is returned if the taxid is above the rank or not found.
+func (s *rankShards) write(code uint64, taxid uint32) (bool, error) {
+	t := s.taxidAtRank(taxid)
+	if t == 0 {
+		return false, nil
+	}
+
+	shard, ok := s.shards[t]
+	if !ok {
+		var err error
+		shard = &rankShard{
+			file: fmt.Sprintf("%s.%s-%d%s", s.prefix, strings.ReplaceAll(s.rank, " ", "_"), t, extDataFile),
+		}
+		shard.outfh, shard.gw, shard.w, err = outStream(shard.file, s.opt.Compress, s.opt.CompressionLevel)
+		if err != nil {
+			return false, err
+		}
+		shard.writer, err = unik.NewWriter(shard.outfh, s.k, s.mode)
+		if err != nil {
+			return false, errors.Wrap(err, shard.file)
+		}
+		shard.writer.SetMaxTaxid(s.maxTaxid)
+		s.shards[t] = shard
+	}
+
+	shard.n++
+	return true, shard.writer.WriteCodeWithTaxid(code, taxid)
+}
+
+// close closes all files and writes a manifest file,
+// it returns the number of k-mers written.
+func (s *rankShards) close(manifest string) (int64, error) {
+	taxids := make([]uint32, 0, len(s.shards))
+	for t := range s.shards {
+		taxids = append(taxids, t)
+	}
+	sort.Slice(taxids, func(i, j int) bool { return taxids[i] < taxids[j] })
+
+	outfh, gw, w, err := outStream(manifest, strings.HasSuffix(strings.ToLower(manifest), ".gz"), s.opt.CompressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	outfh.WriteString("file\ttaxid\tname\tkmers\n")
+
+	var n int64
+	var shard *rankShard
+	for _, t := range taxids {
+		shard = s.shards[t]
+		if err = shard.writer.Flush(); err != nil {
+			return 0, errors.Wrap(err, shard.file)
+		}
+		shard.outfh.Flush()
+		if shard.gw != nil {
+			shard.gw.Close()
+		}
+		shard.w.Close()
+
+		fmt.Fprintf(outfh, "%s\t%d\t%s\t%d\n", shard.file, t, s.taxondb.Names[t], shard.n)
+		n += shard.n
+	}
+
+	outfh.Flush()
+	if gw != nil {
+		gw.Close()
+	}
+	w.Close()
+	return n, nil
+}
@@ -63,6 +63,7 @@ Dataset (optional):
   ftp://ftp.ncbi.nih.gov/pub/taxonomy/taxdump.tar.gz , 
   or some other directory, and later you can refer to using flag
   --data-dir or environment variable UNIKMER_DB.
+  Or simply run "unikmer taxdump download".
 
   For GTDB, use 'taxonkit create-taxdump' to create NCBI-style
   taxonomy dump files, or download from:
@@ -100,7 +101,7 @@ func init() {
 	RootCmd.PersistentFlags().BoolP("no-compress", "C", false, "do not compress binary file (not recommended)")
 	RootCmd.PersistentFlags().IntP("compression-level", "", flate.DefaultCompression, "compression level")
 	RootCmd.PersistentFlags().BoolP("compact", "c", false, "write compact binary file with little loss of speed")
-	RootCmd.PersistentFlags().StringP("infile-list", "i", "", "file of input files list (one file per line), if given, they are appended to files from cli arguments")
+	RootCmd.PersistentFlags().StringP("infile-list", "i", "", "file of input files list (one file per line), if given, they are appended to files from cli arguments. tar archives (.tar, .tar.gz, .tgz, .tar.zst) of .unik files are also accepted")
 
 	RootCmd.PersistentFlags().Uint32P("max-taxid", "", 1<<32-1, "for smaller TaxIds, we can use less space to store TaxIds. default value is 1<<32-1, that's enough for NCBI Taxonomy TaxIds")
 	RootCmd.PersistentFlags().BoolP("ignore-taxid", "I", false, "ignore taxonomy information")
@@ -110,6 +111,36 @@ func init() {
 
 	RootCmd.PersistentFlags().BoolP("skip-file-check", "", false, `skip checking input file existence when given files or a file list`)
 
+	RootCmd.PersistentFlags().StringP("buffer-size", "", "64K", `size of buffers for reading and writing each file. Larger values (e.g., 1M) speed up processing multi-GB files on fast disks, in cost of more memory when opening lots of files (e.g., "unikmer merge")`)
+	RootCmd.PersistentFlags().StringP("readahead", "", "0", `prefetch data of this size (e.g., 8M) ahead when reading input files, which helps sequential scans of big files on slow disks or network filesystems. Only supported on Linux, 0 for disabled`)
+
+	RootCmd.PersistentFlags().Float64P("sample-fraction", "", 1, `keep each k-mer read from input binary files with this probability, for quick approximate experiments on huge files. The decision depends on the k-mer and --sample-seed, so a k-mer is kept or dropped consistently across files`)
+	RootCmd.PersistentFlags().Int64P("sample-seed", "", 11, `seed for --sample-fraction`)
+
+	RootCmd.PersistentFlags().StringP("config", "", "", `configuration file of parameters, type "unikmer config -h" for details`)
+
+	RootCmd.PersistentFlags().StringP("cpu-profile", "", "", `write CPU profile to this file, view it with "go tool pprof -http=:8080 cpu.pprof"`)
+	RootCmd.PersistentFlags().StringP("mem-profile", "", "", `write memory (heap) profile to this file on exit, view it with "go tool pprof -http=:8080 mem.pprof"`)
+	RootCmd.PersistentFlags().StringP("trace", "", "", `write execution trace to this file, view it with "go tool trace -http=:8080 trace.out"`)
+
+	RootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		applyConfig(cmd)
+		startProfiling(cmd)
+	}
+	RootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		forgetPartialOutputs()
+		removeSpoolDir()
+		stopProfiling()
+
+		verbose := getFlagBool(cmd, "verbose")
+		if f := cmd.Flags().Lookup("more-verbose"); f != nil && f.Value.String() == "true" {
+			verbose = true
+		}
+		if verbose {
+			reportPeakMemory()
+		}
+	}
+
 	RootCmd.CompletionOptions.DisableDefaultCmd = true
 	RootCmd.SetHelpCommand(&cobra.Command{Hidden: true})
 
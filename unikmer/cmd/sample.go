@@ -103,7 +103,7 @@ Attentions:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -133,7 +133,7 @@ Attentions:
 
 				j = 0
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -0,0 +1,595 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+// built-in test cases
+//
+//go:embed testdata/selftest/*.yaml
+var selftestFS embed.FS
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Run a conformance test suite of subcommands on tiny simulated data",
+	Long: `Run a conformance test suite of subcommands on tiny simulated data
+
+This command generates two tiny related genomes (a.fa and b.fa), runs
+pipelines of subcommands (count -> sort -> inter/diff/union/grep -> map)
+with this executable, and verifies invariants, including:
+
+  1. k-mers counted equal those computed independently.
+  2. k-mers of sorted files are in ascending order without duplicates,
+     and the number of k-mers in the header is right.
+  3. Set algebra identities, e.g., (A ∩ B) ∪ (A - B) = A,
+     and A ∪ B contains k-mers of A and B, and nothing else.
+  4. Round trip of view and dump keeps k-mers unchanged.
+  5. Mapping k-mers of a genome back covers the whole genome.
+
+Results are outputted in tabular format, and the exit status is non-zero
+if any case fails, which helps check the installation after upgrades.
+
+Test cases:
+  Cases are described in YAML files (*.yaml), one file per subcommand.
+  Built-in cases are used by default, which are also available in the
+  source code (unikmer/cmd/testdata/selftest/). Use -d/--case-dir to run
+  cases in a directory instead, e.g., edited or new ones. Each case is
+  run in its own directory with a copy of a.fa and b.fa.
+
+    # k-mers counted equal those computed independently.
+    count:
+      run: [count -k {k} -K -s a.fa -o a, count -k {k} -K a.fa -o a.unsorted]
+      check: [sorted a.unik, kmers a.unik a.fa, kmers a.unsorted.unik a.fa]
+
+  "run" lists subcommands to run in order, where "{k}" is replaced with
+  the value of -k/--kmer-len, and "check" lists checks of output files:
+
+    sorted FILE               sorted, unique, and right number in header
+    nonempty FILE             at least one k-mer
+    equal FILE1 FILE2         sorted files with the same k-mers
+    kmers FILE FASTA          k-mers equal canonical k-mers of sequences
+    subset FILE1 FILE2        all k-mers of FILE1 are in FILE2
+    disjoint FILE1 FILE2      no k-mers are shared
+    union FILE FILE1 ...      k-mers of FILE are the union of the others
+    covers BED FASTA          BED regions cover whole sequences
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		outFile := getFlagString(cmd, "out-file")
+		k := getFlagPositiveInt(cmd, "kmer-len")
+		if k > 32 {
+			checkError(fmt.Errorf("value of -k/--kmer-len should be <= 32"))
+		}
+		seed := getFlagInt64(cmd, "seed")
+		keep := getFlagBool(cmd, "keep-tmp-dir")
+		format := getFlagTableFormat(cmd)
+		caseDir := getFlagString(cmd, "case-dir")
+
+		cases, err := loadSelftestCases(caseDir)
+		checkError(err)
+		if opt.Verbose {
+			log.Infof("%d cases loaded", len(cases))
+		}
+
+		exe, err := os.Executable()
+		checkError(err)
+
+		dir, err := makeTmpDir(getTmpRoot(cmd), "unikmer-selftest")
+		checkError(err)
+		if !keep {
+			registerTmpDir(dir)
+			defer func() {
+				checkError(removeAllWithRetry(dir))
+				unregisterTmpDir(dir)
+			}()
+		} else if opt.Verbose {
+			log.Infof("files are kept in: %s", dir)
+		}
+
+		// ---------------------------------------------------------------
+		// data
+
+		rnd := rand.New(rand.NewSource(seed))
+		randSeq := func(n int) []byte {
+			s := make([]byte, n)
+			for i := range s {
+				s[i] = "ACGT"[rnd.Intn(4)]
+			}
+			return s
+		}
+		seqA := randSeq(5000)
+		seqB := append(append([]byte{}, seqA[:2000]...), randSeq(3000)...)
+		data := map[string][]byte{
+			"a.fa": []byte(">a\n" + string(seqA) + "\n"),
+			"b.fa": []byte(">b\n" + string(seqB) + "\n"),
+		}
+
+		sk := strconv.Itoa(k)
+
+		// run runs a subcommand in a directory.
+		run := func(dir string, args ...string) error {
+			c := exec.Command(exe, args...)
+			c.Dir = dir
+			var stderr bytes.Buffer
+			c.Stderr = &stderr
+			if err := c.Run(); err != nil {
+				return fmt.Errorf("unikmer %s: %s: %s", strings.Join(args, " "), err,
+					strings.TrimSpace(stderr.String()))
+			}
+			return nil
+		}
+
+		// runCase runs a case in its own directory.
+		runCase := func(c *selftestCase) error {
+			dir := filepath.Join(dir, c.name)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+			for file, d := range data {
+				if err := os.WriteFile(filepath.Join(dir, file), d, 0644); err != nil {
+					return err
+				}
+			}
+
+			for _, command := range c.run {
+				if err := run(dir, strings.Fields(strings.ReplaceAll(command, "{k}", sk))...); err != nil {
+					return err
+				}
+			}
+			for _, check := range c.checks {
+				items := strings.Fields(check)
+				if err := selftestChecks[items[0]].fn(dir, k, items[1:]); err != nil {
+					return fmt.Errorf("%s: %s", check, err)
+				}
+			}
+			return nil
+		}
+
+		// ---------------------------------------------------------------
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"case", "pass", "message"})
+		tw.WriteHeader()
+
+		var nFailed int
+		var msg string
+		for _, c := range cases {
+			if opt.Verbose {
+				log.Infof("running case: %s (%s)", c.name, c.file)
+			}
+			err = runCase(c)
+			msg = ""
+			if err != nil {
+				nFailed++
+				msg = err.Error()
+			}
+			tw.WriteRecord(c.name, err == nil, msg)
+			outfh.Flush()
+		}
+
+		if nFailed > 0 {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+			if !keep {
+				removeAllWithRetry(dir)
+			}
+			checkError(fmt.Errorf("%d of %d cases failed", nFailed, len(cases)))
+		}
+		if opt.Verbose {
+			log.Infof("all %d cases passed", len(cases))
+		}
+	},
+}
+
+// selftestCase is a test case described in a YAML file.
+type selftestCase struct {
+	name   string
+	file   string
+	run    []string // subcommands and their args
+	checks []string // checks and their args
+}
+
+// loadSelftestCases loads cases from YAML files in a directory, or the
+// built-in ones if the directory is not given. Cases are sorted by file
+// names and then case names.
+func loadSelftestCases(dir string) ([]*selftestCase, error) {
+	var fsys fs.FS = selftestFS
+	pattern := "testdata/selftest/*.yaml"
+	if dir != "" {
+		fsys = os.DirFS(dir)
+		pattern = "*.yaml"
+	} else {
+		dir = "built-in cases"
+	}
+
+	files, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no case files (*.yaml) found in %s", dir)
+	}
+
+	cases := make([]*selftestCase, 0, len(files))
+	seen := make(map[string]string, len(files))
+	for _, file := range files {
+		fh, err := fsys.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		config, err := parseConfig(fh)
+		fh.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+
+		names := make([]string, 0, len(config))
+		for name := range config {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if file0, ok := seen[name]; ok {
+				return nil, fmt.Errorf("%s: duplicate case %s, which is also in %s", file, name, file0)
+			}
+			seen[name] = file
+
+			c, err := newSelftestCase(name, config[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: case %s: %s", file, name, err)
+			}
+			c.file = path.Base(file)
+			cases = append(cases, c)
+		}
+	}
+	return cases, nil
+}
+
+// newSelftestCase creates a case from keys and values of a YAML section.
+func newSelftestCase(name string, kvs map[string]string) (*selftestCase, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("case names should be plain file names")
+	}
+	c := &selftestCase{name: name}
+	var err error
+	for key, value := range kvs {
+		switch key {
+		case "run":
+			c.run, err = selftestList(value)
+		case "check":
+			c.checks, err = selftestList(value)
+		default:
+			return nil, fmt.Errorf(`unknown key: %s, available: "run" and "check"`, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %s", key, err)
+		}
+	}
+	if len(c.run) == 0 {
+		return nil, fmt.Errorf(`no subcommands given in "run"`)
+	}
+	if len(c.checks) == 0 {
+		return nil, fmt.Errorf(`no checks given in "check"`)
+	}
+
+	for _, command := range c.run {
+		if len(strings.Fields(command)) == 0 {
+			return nil, fmt.Errorf(`empty subcommand in "run"`)
+		}
+	}
+	for _, check := range c.checks {
+		items := strings.Fields(check)
+		if len(items) == 0 {
+			return nil, fmt.Errorf(`empty check in "check"`)
+		}
+		ck, ok := selftestChecks[items[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown check: %s", items[0])
+		}
+		if n := len(items) - 1; ck.nargs >= 0 && n != ck.nargs || ck.nargs < 0 && n < -ck.nargs {
+			return nil, fmt.Errorf("invalid number of arguments: %s, usage: %s %s", check, items[0], ck.usage)
+		}
+	}
+	return c, nil
+}
+
+// selftestList splits a value of a list, which is in the CSV format
+// returned by parseConfig.
+func selftestList(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return csv.NewReader(strings.NewReader(value)).Read()
+}
+
+// selftestCheck is a check of output files of a case.
+type selftestCheck struct {
+	nargs int    // number of arguments, -n for at least n
+	usage string // arguments
+	fn    func(dir string, k int, args []string) error
+}
+
+// checks of cases, arguments are files in the directory of a case.
+var selftestChecks = map[string]*selftestCheck{
+	"sorted": {1, "FILE", func(dir string, k int, args []string) error {
+		_, err := selftestReadCodes(filepath.Join(dir, args[0]), true)
+		return err
+	}},
+	"nonempty": {1, "FILE", func(dir string, k int, args []string) error {
+		codes, err := selftestReadCodes(filepath.Join(dir, args[0]), false)
+		if err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return fmt.Errorf("no k-mers found")
+		}
+		return nil
+	}},
+	"equal": {2, "FILE1 FILE2", func(dir string, k int, args []string) error {
+		a, err := selftestReadCodes(filepath.Join(dir, args[0]), true)
+		if err != nil {
+			return err
+		}
+		b, err := selftestReadCodes(filepath.Join(dir, args[1]), true)
+		if err != nil {
+			return err
+		}
+		return selftestEqual(a, b)
+	}},
+	"kmers": {2, "FILE FASTA", func(dir string, k int, args []string) error {
+		codes, err := selftestReadCodes(filepath.Join(dir, args[0]), false)
+		if err != nil {
+			return err
+		}
+		expected := make([]uint64, 0, len(codes))
+		err = selftestReadSeqs(filepath.Join(dir, args[1]), func(id, s []byte) error {
+			kmers, err := selftestKmers(s, k)
+			expected = append(expected, kmers...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return selftestSameSet(codes, newCodeSet(expected))
+	}},
+	"subset": {2, "FILE1 FILE2", func(dir string, k int, args []string) error {
+		a, err := selftestReadCodes(filepath.Join(dir, args[0]), false)
+		if err != nil {
+			return err
+		}
+		b, err := selftestReadCodes(filepath.Join(dir, args[1]), false)
+		if err != nil {
+			return err
+		}
+		sb := newCodeSet(b)
+		for _, code := range a {
+			if !sb.has(code) {
+				return fmt.Errorf("k-mer of %s not found in %s: %d", args[0], args[1], code)
+			}
+		}
+		return nil
+	}},
+	"disjoint": {2, "FILE1 FILE2", func(dir string, k int, args []string) error {
+		a, err := selftestReadCodes(filepath.Join(dir, args[0]), false)
+		if err != nil {
+			return err
+		}
+		b, err := selftestReadCodes(filepath.Join(dir, args[1]), false)
+		if err != nil {
+			return err
+		}
+		sb := newCodeSet(b)
+		for _, code := range a {
+			if sb.has(code) {
+				return fmt.Errorf("k-mer of %s found in %s: %d", args[0], args[1], code)
+			}
+		}
+		return nil
+	}},
+	"union": {-3, "FILE FILE1 FILE2 ...", func(dir string, k int, args []string) error {
+		codes, err := selftestReadCodes(filepath.Join(dir, args[0]), false)
+		if err != nil {
+			return err
+		}
+		all := make([]uint64, 0, len(codes))
+		for _, file := range args[1:] {
+			c, err := selftestReadCodes(filepath.Join(dir, file), false)
+			if err != nil {
+				return err
+			}
+			all = append(all, c...)
+		}
+		return selftestSameSet(codes, newCodeSet(all))
+	}},
+	"covers": {2, "BED FASTA", func(dir string, k int, args []string) error {
+		data, err := os.ReadFile(filepath.Join(dir, args[0]))
+		if err != nil {
+			return err
+		}
+		var expected strings.Builder
+		err = selftestReadSeqs(filepath.Join(dir, args[1]), func(id, s []byte) error {
+			fmt.Fprintf(&expected, "%s\t0\t%d\n", id, len(s))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if string(data) != expected.String() {
+			return fmt.Errorf("unexpected output: %q, expected: %q", data, expected.String())
+		}
+		return nil
+	}},
+}
+
+// selftestReadSeqs calls fn for every sequence in a FASTA/Q file.
+func selftestReadSeqs(file string, fn func(id, s []byte) error) error {
+	fastxReader, err := fastx.NewDefaultReader(file)
+	if err != nil {
+		return err
+	}
+	defer fastxReader.Close()
+
+	var record *fastx.Record
+	for {
+		record, err = fastxReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s: %s", filepath.Base(file), err)
+		}
+		if err = fn(record.ID, record.Seq.Seq); err != nil {
+			return err
+		}
+	}
+}
+
+// selftestKmers computes canonical k-mers of a sequence, sorted and unique.
+func selftestKmers(s []byte, k int) ([]uint64, error) {
+	sq, err := seq.NewSeq(seq.DNAredundant, s)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := sketches.NewKmerIterator(sq, k, true, false)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]uint64, 0, len(s))
+	var code uint64
+	var ok bool
+	for {
+		code, ok, err = iter.NextKmer()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		codes = append(codes, code)
+	}
+	return newCodeSet(codes), nil
+}
+
+// selftestReadCodes reads all codes of a binary file,
+// and checks the order and the number in header (if known) for sorted files.
+func selftestReadCodes(file string, mustSorted bool) ([]uint64, error) {
+	infh, r, _, err := inStream(file)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInStream(r)
+
+	reader, err := unik.NewReader(infh)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Base(file), err)
+	}
+	if mustSorted && !reader.IsSorted() {
+		return nil, fmt.Errorf("%s: 'sorted' flag expected", filepath.Base(file))
+	}
+
+	codes := make([]uint64, 0, 1024)
+	var code uint64
+	for {
+		code, _, err = reader.ReadCodeWithTaxid()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%s: %s", filepath.Base(file), err)
+		}
+		if reader.IsSorted() && len(codes) > 0 && code <= codes[len(codes)-1] {
+			return nil, fmt.Errorf("%s: k-mers not in ascending order or duplicated", filepath.Base(file))
+		}
+		codes = append(codes, code)
+	}
+	if reader.IsSorted() && reader.Number > 0 && reader.Number != uint64(len(codes)) {
+		return nil, fmt.Errorf("%s: number of k-mers in header (%d) != the real number (%d)", filepath.Base(file), reader.Number, len(codes))
+	}
+	return codes, nil
+}
+
+// selftestEqual checks if two lists of codes are the same.
+func selftestEqual(codes, expected []uint64) error {
+	if len(codes) != len(expected) {
+		return fmt.Errorf("number of k-mers (%d) != the expected (%d)", len(codes), len(expected))
+	}
+	for i, code := range codes {
+		if code != expected[i] {
+			return fmt.Errorf("k-mer #%d (%d) != the expected (%d)", i+1, code, expected[i])
+		}
+	}
+	return nil
+}
+
+// selftestSameSet checks if codes has the same set as sorted and unique expected.
+func selftestSameSet(codes, expected []uint64) error {
+	return selftestEqual(newCodeSet(codes), expected)
+}
+
+func init() {
+	RootCmd.AddCommand(selftestCmd)
+
+	selftestCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	selftestCmd.Flags().IntP("kmer-len", "k", 21, "k-mer length")
+	selftestCmd.Flags().Int64P("seed", "s", 11, "seed of random number generator")
+	selftestCmd.Flags().StringP("tmp-dir", "t", os.TempDir(), `directory for intermediate files, the environment variable `+envTmpDir+` is used if not given`)
+	selftestCmd.Flags().BoolP("keep-tmp-dir", "", false, "keep the directory of intermediate files")
+	selftestCmd.Flags().StringP("case-dir", "d", "", `directory of YAML files (*.yaml) of test cases, the built-in cases are used if not given`)
+	selftestCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
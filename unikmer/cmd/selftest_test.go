@@ -0,0 +1,117 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSelftestCases(t *testing.T) {
+	cases, err := loadSelftestCases("")
+	if err != nil {
+		t.Fatalf("built-in cases: %s", err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no built-in cases found")
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    *selftestCase
+		wantErr bool
+	}{
+		{
+			name: "case",
+			data: "# comment\nunion:\n  run: [count -k {k} a.fa -o a, union a.unik a.unik -o u]\n  check: [sorted u.unik, union u.unik a.unik a.unik]\n",
+			want: &selftestCase{
+				name:   "union",
+				file:   "case.yaml",
+				run:    []string{"count -k {k} a.fa -o a", "union a.unik a.unik -o u"},
+				checks: []string{"sorted u.unik", "union u.unik a.unik a.unik"},
+			},
+		},
+		{
+			name: "single values",
+			data: "[view]\nrun = \"view a.unik -o a.txt\"\ncheck = nonempty a.unik\n",
+			want: &selftestCase{
+				name:   "view",
+				file:   "single values.yaml",
+				run:    []string{"view a.unik -o a.txt"},
+				checks: []string{"nonempty a.unik"},
+			},
+		},
+		{name: "no run", data: "c:\n  check: [sorted a.unik]\n", wantErr: true},
+		{name: "no check", data: "c:\n  run: [view a.unik]\n", wantErr: true},
+		{name: "unknown key", data: "c:\n  run: [view a.unik]\n  check: [sorted a.unik]\n  skip: true\n", wantErr: true},
+		{name: "unknown check", data: "c:\n  run: [view a.unik]\n  check: [same a.unik]\n", wantErr: true},
+		{name: "too few arguments", data: "c:\n  run: [view a.unik]\n  check: [union a.unik b.unik]\n", wantErr: true},
+		{name: "too many arguments", data: "c:\n  run: [view a.unik]\n  check: [sorted a.unik b.unik]\n", wantErr: true},
+		{name: "empty subcommand", data: "c:\n  run: [view a.unik, '']\n  check: [sorted a.unik]\n", wantErr: true},
+		{name: "invalid case name", data: "[../c]\nrun = view a.unik\ncheck = sorted a.unik\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, test.name+".yaml"), []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cases, err := loadSelftestCases(dir)
+			if test.wantErr {
+				if err == nil {
+					t.Error("error expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(cases) != 1 {
+				t.Fatalf("got %d cases, want 1", len(cases))
+			}
+			if !reflect.DeepEqual(cases[0], test.want) {
+				t.Errorf("got %+v, want %+v", cases[0], test.want)
+			}
+		})
+	}
+}
+
+func TestLoadSelftestCasesDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("c:\n  run: [view a.unik]\n  check: [sorted a.unik]\n")
+	for _, file := range []string{"a.yaml", "b.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := loadSelftestCases(dir); err == nil {
+		t.Error("error expected for duplicate cases")
+	}
+
+	if _, err := loadSelftestCases(t.TempDir()); err == nil {
+		t.Error("error expected for a directory without case files")
+	}
+}
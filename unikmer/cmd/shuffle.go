@@ -0,0 +1,361 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var shuffleCmd = &cobra.Command{
+	Use:   "shuffle",
+	Short: "Shuffle k-mers in binary files with a random seed",
+	Long: `Shuffle k-mers in binary files with a random seed
+
+K-mers are output in a random order determined by the seed (-s/--seed),
+e.g., for preparing training data of machine learning models. The output
+is reproducible, i.e., it only depends on the seed and the k-mers (and
+taxids), not the order of input files, the chunk size or the number of
+threads.
+
+How it works:
+  Each k-mer is given a random key by hashing it with the seed, and k-mers
+  are sorted by the keys, in memory or by external merge sort of chunk files
+  with -m/--chunk-size for inputs larger than the RAM.
+
+Attentions:
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. Input files should ALL have or don't have taxid information.
+  3. Duplicated k-mers (with the same taxid) are adjacent in the output.
+  4. The output file is not sorted, which is recorded in the header.
+
+Tips:
+  1. You can use '-m/--chunk-size' to limit memory usage.
+  2. Intermediate files are written with the global compression settings by
+     default, use '--tmp-compress no' to speed up on fast local disks.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outFile := getFlagString(cmd, "out-prefix")
+		seed := getFlagInt64(cmd, "seed")
+		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
+		keepTmpDir := getFlagBool(cmd, "keep-tmp-dir")
+		tmpOpt := getTmpOptions(cmd, opt)
+
+		maxElem, err := ParseByteSize(getFlagString(cmd, "chunk-size"))
+		if err != nil {
+			checkError(fmt.Errorf("parsing byte size: %s", err))
+		}
+		limitMem := maxElem > 0
+
+		var listInitSize int
+		if limitMem {
+			listInitSize = maxElem
+		} else {
+			listInitSize = mapInitSize
+		}
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+		preflightCheck(opt, files, false)
+
+		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
+			outFile += extDataFile
+		}
+
+		// keys of k-mers are mixed codes, which can be decoded back.
+		seedMix := mixCode(uint64(seed))
+
+		var tmpDir string
+		var tmpFiles []string
+
+		var m []uint64
+		var mt []CodeTaxid
+
+		var infh *bufio.Reader
+		var r *os.File
+		var reader0 *unik.Reader
+		var code uint64
+		var taxid uint32
+		var k int = -1
+		var hasTaxid bool
+		var mode, chunkMode uint32
+		var nfiles = len(files)
+
+		// chunks of sorted keys, the 'hashed' flag is set for saving all bits
+		dumpChunk := func() {
+			if tmpDir == "" {
+				tmpDir, err = makeTmpDir(getTmpRoot(cmd), "unikmer-shuffle")
+				checkError(errors.Wrap(err, "create tmp dir"))
+				if !keepTmpDir {
+					registerTmpDir(tmpDir)
+				}
+			}
+
+			outFile1 := chunkFileName(tmpDir, len(tmpFiles)+1)
+			tmpFiles = append(tmpFiles, outFile1)
+
+			var _n int64
+			if hasTaxid {
+				sortCodesTaxids(mt)
+				_n = dumpCodesTaxids2File(mt, nil, k, chunkMode, outFile1, tmpOpt, false, false)
+				mt = mt[:0]
+			} else {
+				sortCodes(m)
+				_n = dumpCodes2File(m, k, chunkMode, outFile1, tmpOpt, false, false)
+				m = m[:0]
+			}
+			if opt.Verbose {
+				log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", len(tmpFiles), _n, outFile1)
+			}
+		}
+
+		for i, file := range files {
+			if opt.Verbose {
+				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+			}
+
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				if k == -1 {
+					reader0 = reader
+					k = reader.K
+					hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+
+					// the 'sorted' flag is not set
+					if opt.Compact && !reader.IsHashed() {
+						mode |= unik.UnikCompact
+					}
+					if reader.IsCanonical() {
+						mode |= unik.UnikCanonical
+					}
+					if reader.IsHashed() {
+						mode |= unik.UnikHashed
+					}
+					if hasTaxid {
+						mode |= unik.UnikIncludeTaxID
+						mt = make([]CodeTaxid, 0, listInitSize)
+					} else {
+						m = make([]uint64, 0, listInitSize)
+					}
+					chunkMode = unik.UnikSorted | unik.UnikHashed | (mode & unik.UnikIncludeTaxID)
+				} else {
+					checkCompatibility(reader0, reader, file)
+					if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
+						if reader.HasTaxidInfo() {
+							checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
+						} else {
+							checkError(fmt.Errorf(`taxid information found in previous files, but missing in this: %s`, file))
+						}
+					}
+				}
+
+				for {
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					if hasTaxid {
+						mt = append(mt, CodeTaxid{Code: mixCode(code ^ seedMix), Taxid: taxid})
+					} else {
+						m = append(m, mixCode(code^seedMix))
+					}
+
+					if limitMem && (len(m) >= maxElem || len(mt) >= maxElem) {
+						dumpChunk()
+					}
+				}
+			}()
+		}
+
+		// ---------------------------------------------------------------
+		// merging chunks of keys into one file
+
+		var keysFile string
+		if len(tmpFiles) > 0 {
+			if len(m) > 0 || len(mt) > 0 {
+				dumpChunk()
+			}
+			m, mt = nil, nil
+
+			files2 := tmpFiles
+			if len(files2) > maxOpenFiles {
+				if opt.Verbose {
+					log.Infof("merging from %d chunks (round: 1/2)", len(files2))
+				}
+				files2 = make([]string, 0, len(tmpFiles)/maxOpenFiles+1)
+				for i := 0; i < len(tmpFiles); i += maxOpenFiles {
+					j := i + maxOpenFiles
+					if j > len(tmpFiles) {
+						j = len(tmpFiles)
+					}
+					outFile1 := chunkFileName(tmpDir, len(tmpFiles)+len(files2)+1)
+					n, _ := mergeChunksFile(tmpOpt, nil, tmpFiles[i:j], outFile1, k, chunkMode, false, false, nil, nil, false, false)
+					if opt.Verbose {
+						log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", len(tmpFiles)+len(files2)+1, n, outFile1)
+					}
+					files2 = append(files2, outFile1)
+				}
+			}
+
+			if opt.Verbose {
+				log.Infof("merging from %d chunks", len(files2))
+			}
+			keysFile = filepath.Join(tmpDir, "keys"+extDataFile)
+			mergeChunksFile(tmpOpt, nil, files2, keysFile, k, chunkMode, false, false, nil, nil, false, false)
+		} else if hasTaxid {
+			if opt.Verbose {
+				log.Infof("shuffling %d k-mers", len(mt))
+			}
+			sortCodesTaxids(mt)
+		} else {
+			if opt.Verbose {
+				log.Infof("shuffling %d k-mers", len(m))
+			}
+			sortCodes(m)
+		}
+
+		// ---------------------------------------------------------------
+		// output
+
+		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		if k == -1 { // no input files
+			return
+		}
+
+		writer, err := unik.NewWriter(outfh, k, mode)
+		checkError(errors.Wrap(err, outFile))
+		writer.SetMaxTaxid(opt.MaxTaxid)
+		if reader0.IsScaled() {
+			writer.SetScale(reader0.GetScale())
+			if reader0.MaxHash > 0 {
+				writer.SetMaxHash(reader0.MaxHash)
+			}
+		}
+
+		var n int64
+		if keysFile != "" {
+			func() {
+				infh, r, _, err = inStream(keysFile)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, keysFile))
+				for {
+					code, taxid, err = reader.ReadCodeWithTaxid()
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, keysFile))
+					}
+					writer.WriteCodeWithTaxid(unmixCode(code)^seedMix, taxid)
+					n++
+				}
+			}()
+		} else if hasTaxid {
+			for _, ct := range mt {
+				writer.WriteCodeWithTaxid(unmixCode(ct.Code)^seedMix, ct.Taxid)
+			}
+			n = int64(len(mt))
+		} else {
+			for _, key := range m {
+				writer.WriteCode(unmixCode(key) ^ seedMix)
+			}
+			n = int64(len(m))
+		}
+		checkError(writer.Flush())
+
+		if opt.Verbose {
+			log.Infof("%d k-mers saved to %s", n, outFile)
+		}
+
+		// cleanning
+
+		if tmpDir == "" || keepTmpDir {
+			return
+		}
+		if opt.Verbose {
+			log.Infof("removing tmp dir: %s", tmpDir)
+		}
+		err = removeAllWithRetry(tmpDir)
+		if err != nil {
+			checkError(fmt.Errorf("fail to remove temp directory, please manually delete it: %s", tmpDir))
+		}
+		unregisterTmpDir(tmpDir)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(shuffleCmd)
+
+	shuffleCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
+	shuffleCmd.Flags().Int64P("seed", "s", 11, `rand seed`)
+	shuffleCmd.Flags().StringP("chunk-size", "m", "", `split input into chunks of N k-mers, supports K/M/G suffix`)
+	shuffleCmd.Flags().StringP("tmp-dir", "t", "./", `directory for intermediate files, the environment variable `+envTmpDir+` is used if not given`)
+	shuffleCmd.Flags().IntP("max-open-files", "M", 400, `max number of open files`)
+	shuffleCmd.Flags().BoolP("keep-tmp-dir", "k", false, `keep tmp dir`)
+	shuffleCmd.Flags().StringP("tmp-compress", "", "auto", `compress intermediate files or not, available: auto (same as the output), yes, no`)
+	shuffleCmd.Flags().IntP("tmp-compression-level", "", flate.DefaultCompression, `compression level of intermediate files, the global --compression-level is used if not given`)
+	shuffleCmd.Flags().StringP("tmp-io-limit", "", "", `maximum speed (bytes per second) of writing intermediate files, supports K/M/G suffix, e.g., 100M. 0 or empty for no limit`)
+}
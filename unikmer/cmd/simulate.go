@@ -0,0 +1,357 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/sketches"
+	"github.com/shenwei356/unik/v5"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Simulate genomes and reads with known k-mer content",
+	Long: `Simulate genomes and reads with known k-mer content
+
+This command simulates related genomes and sequencing reads, along with
+ground-truth k-mer sets, which help validate workflows and test commands.
+
+Methods:
+  1. A random ancestor genome is generated, and each genome is derived
+     from it with substitutions at the rate of -m/--mutation-rate.
+  2. Reads are sampled uniformly from both strands of each genome, with
+     substitution errors at the rate of -e/--error-rate. A fraction
+     (-x/--contamination) of reads are sampled from other genomes.
+     Read headers contain the source genome, position and strand.
+  3. K-mers of genomes are computed in the same way as 'unikmer count'.
+
+Output files in the output directory:
+  genomes.fa          all genomes, named as g1, g2, ...
+  <genome>.fq.gz      reads of each genome
+  <genome>.unik       k-mers of each genome
+  <genome>.private.unik
+                      k-mers only found in this genome
+  shared.unik         k-mers shared by all genomes
+  truth.tsv           numbers of k-mers and reads of each genome
+
+All .unik files are sorted.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		outDir := getFlagString(cmd, "out-dir")
+		force := getFlagBool(cmd, "force")
+		nGenomes := getFlagPositiveInt(cmd, "genomes")
+		genomeLen := getFlagPositiveInt(cmd, "genome-len")
+		mutationRate := getFlagNonNegativeFloat64(cmd, "mutation-rate")
+		nReads := getFlagNonNegativeInt(cmd, "reads")
+		readLen := getFlagPositiveInt(cmd, "read-len")
+		errorRate := getFlagNonNegativeFloat64(cmd, "error-rate")
+		contamination := getFlagNonNegativeFloat64(cmd, "contamination")
+		k := getFlagPositiveInt(cmd, "kmer-len")
+		canonical := getFlagBool(cmd, "canonical")
+		seed := getFlagInt64(cmd, "seed")
+
+		if k > 32 {
+			checkError(fmt.Errorf("k-mer size (%d) should be <=32", k))
+		}
+		if genomeLen < k {
+			checkError(fmt.Errorf("value of -L/--genome-len (%d) should not be smaller than k (%d)", genomeLen, k))
+		}
+		if readLen > genomeLen {
+			checkError(fmt.Errorf("value of -l/--read-len (%d) should not be greater than -L/--genome-len (%d)", readLen, genomeLen))
+		}
+		if mutationRate > 1 {
+			checkError(fmt.Errorf("value of -m/--mutation-rate should be in range of [0, 1]"))
+		}
+		if errorRate > 1 {
+			checkError(fmt.Errorf("value of -e/--error-rate should be in range of [0, 1]"))
+		}
+		if contamination > 1 {
+			checkError(fmt.Errorf("value of -x/--contamination should be in range of [0, 1]"))
+		}
+		if contamination > 0 && nGenomes == 1 {
+			log.Warningf("flag -x/--contamination ignored for only one genome")
+			contamination = 0
+		}
+
+		if outDir == "" {
+			checkError(fmt.Errorf("out dir (flag -o/--out-dir) should not be empty"))
+		}
+		existed, err := pathutil.DirExists(outDir)
+		checkError(errors.Wrap(err, outDir))
+		if existed {
+			empty, err := pathutil.IsEmpty(outDir)
+			checkError(errors.Wrap(err, outDir))
+			if !empty {
+				if force {
+					checkError(os.RemoveAll(outDir))
+				} else {
+					checkError(fmt.Errorf("outdir not empty: %s, you can use --force to overwrite", outDir))
+				}
+			}
+		}
+		checkError(os.MkdirAll(outDir, 0755))
+
+		rnd := rand.New(rand.NewSource(seed))
+		bases := []byte("ACGT")
+
+		// -----------------------------------------------------------------------
+		// genomes
+
+		ancestor := make([]byte, genomeLen)
+		for i := range ancestor {
+			ancestor[i] = bases[rnd.Intn(4)]
+		}
+
+		names := make([]string, nGenomes)
+		genomes := make([][]byte, nGenomes)
+		var nMutations int
+		for i := range genomes {
+			names[i] = fmt.Sprintf("g%d", i+1)
+			genomes[i] = make([]byte, genomeLen)
+			copy(genomes[i], ancestor)
+			nMutations = 0
+			for j := range genomes[i] {
+				if rnd.Float64() < mutationRate {
+					genomes[i][j] = mutateBase(rnd, genomes[i][j])
+					nMutations++
+				}
+			}
+			if opt.Verbose {
+				log.Infof("genome %s simulated with %d substitutions", names[i], nMutations)
+			}
+		}
+
+		file := filepath.Join(outDir, "genomes.fa")
+		outfh, gw, w, err := outStream(file, false, opt.CompressionLevel)
+		checkError(err)
+		var s *seq.Seq
+		for i, genome := range genomes {
+			s, err = seq.NewSeqWithoutValidation(seq.DNA, genome)
+			checkError(err)
+			fmt.Fprintf(outfh, ">%s\n%s\n", names[i], s.FormatSeq(60))
+		}
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+
+		// -----------------------------------------------------------------------
+		// reads
+
+		nContaminated := make([]int, nGenomes)
+		if nReads > 0 {
+			var src, start int
+			var strand byte
+			read := make([]byte, readLen)
+			qual := strings.Repeat("I", readLen)
+			for i := range genomes {
+				file = filepath.Join(outDir, names[i]+".fq.gz")
+				outfh, gw, w, err = outStream(file, true, opt.CompressionLevel)
+				checkError(err)
+
+				for j := 0; j < nReads; j++ {
+					src = i
+					if contamination > 0 && rnd.Float64() < contamination {
+						src = rnd.Intn(nGenomes - 1)
+						if src >= i {
+							src++
+						}
+						nContaminated[i]++
+					}
+
+					start = rnd.Intn(genomeLen - readLen + 1)
+					copy(read, genomes[src][start:start+readLen])
+					strand = '+'
+					if rnd.Intn(2) == 1 {
+						strand = '-'
+						revCompBases(read)
+					}
+					for p := range read {
+						if errorRate > 0 && rnd.Float64() < errorRate {
+							read[p] = mutateBase(rnd, read[p])
+						}
+					}
+
+					fmt.Fprintf(outfh, "@%s_%d source=%s pos=%d strand=%c\n%s\n+\n%s\n",
+						names[i], j+1, names[src], start+1, strand, read, qual)
+				}
+
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+				if opt.Verbose {
+					log.Infof("%d reads of genome %s simulated, %d are from other genomes", nReads, names[i], nContaminated[i])
+				}
+			}
+		}
+
+		// -----------------------------------------------------------------------
+		// ground-truth k-mers
+
+		// k-mer -> the first genome containing it, or -1 for multiple genomes
+		owners := make(map[uint64]int, genomeLen*2)
+		// number of genomes containing a k-mer
+		counts := make(map[uint64]int, genomeLen*2)
+
+		mode := unik.UnikSorted
+		if canonical {
+			mode |= unik.UnikCanonical
+		}
+
+		nKmers := make([]int, nGenomes)
+		var iter *sketches.Iterator
+		var code uint64
+		var ok bool
+		var owner int
+		for i, genome := range genomes {
+			s, err = seq.NewSeqWithoutValidation(seq.DNA, genome)
+			checkError(err)
+			iter, err = sketches.NewKmerIterator(s, k, canonical, false)
+			checkError(errors.Wrap(err, names[i]))
+
+			m := make(map[uint64]struct{}, genomeLen*2)
+			for {
+				code, ok, err = iter.NextKmer()
+				checkError(errors.Wrap(err, names[i]))
+				if !ok {
+					break
+				}
+				m[code] = struct{}{}
+			}
+			nKmers[i] = len(m)
+
+			codes := make([]uint64, 0, len(m))
+			for code = range m {
+				codes = append(codes, code)
+
+				counts[code]++
+				if owner, ok = owners[code]; !ok {
+					owners[code] = i
+				} else if owner != i {
+					owners[code] = -1
+				}
+			}
+			writeSimulatedKmers(opt, filepath.Join(outDir, names[i]+extDataFile), k, mode, codes)
+		}
+
+		// private k-mers
+		privates := make([][]uint64, nGenomes)
+		shared := make([]uint64, 0, mapInitSize)
+		for code, owner = range owners {
+			if owner >= 0 {
+				privates[owner] = append(privates[owner], code)
+			}
+			if counts[code] == nGenomes {
+				shared = append(shared, code)
+			}
+		}
+		for i, codes := range privates {
+			writeSimulatedKmers(opt, filepath.Join(outDir, names[i]+".private"+extDataFile), k, mode, codes)
+		}
+		writeSimulatedKmers(opt, filepath.Join(outDir, "shared"+extDataFile), k, mode, shared)
+
+		file = filepath.Join(outDir, "truth.tsv")
+		outfh, gw, w, err = outStream(file, false, opt.CompressionLevel)
+		checkError(err)
+		tw := newTableWriter(outfh, "tsv", []string{"genome", "kmers", "private", "shared", "reads", "contaminated"})
+		tw.WriteHeader()
+		for i := range genomes {
+			tw.WriteRecord(names[i], nKmers[i], len(privates[i]), len(shared), nReads, nContaminated[i])
+		}
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+
+		if opt.Verbose {
+			log.Infof("%d shared k-mers found in all %d genomes", len(shared), nGenomes)
+			log.Infof("all files saved to: %s", outDir)
+		}
+	},
+}
+
+// mutateBase returns a random base different from b.
+func mutateBase(rnd *rand.Rand, b byte) byte {
+	bases := "ACGT"
+	c := bases[rnd.Intn(3)]
+	if c == b {
+		return 'T'
+	}
+	return c
+}
+
+func writeSimulatedKmers(opt *Options, file string, k int, mode int, codes []uint64) {
+	sortCodes(codes)
+
+	outfh, gw, w, err := outStream(file, opt.Compress, opt.CompressionLevel)
+	checkError(err)
+	defer func() {
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}()
+
+	writer, err := unik.NewWriter(outfh, k, uint32(mode))
+	checkError(errors.Wrap(err, file))
+	writer.Number = uint64(len(codes))
+	for _, code := range codes {
+		checkError(writer.WriteCode(code))
+	}
+	checkError(writer.Flush())
+}
+
+func init() {
+	RootCmd.AddCommand(simulateCmd)
+
+	simulateCmd.Flags().StringP("out-dir", "o", "unikmer-simulate", "output directory")
+	simulateCmd.Flags().BoolP("force", "", false, "overwrite output directory")
+	simulateCmd.Flags().IntP("genomes", "n", 2, "number of genomes")
+	simulateCmd.Flags().IntP("genome-len", "L", 100000, "genome length")
+	simulateCmd.Flags().Float64P("mutation-rate", "m", 0.01, "substitution rate of each genome relative to the ancestor")
+	simulateCmd.Flags().IntP("reads", "N", 10000, "number of reads of each genome")
+	simulateCmd.Flags().IntP("read-len", "l", 150, "read length")
+	simulateCmd.Flags().Float64P("error-rate", "e", 0.001, "sequencing error (substitution) rate")
+	simulateCmd.Flags().Float64P("contamination", "x", 0, "fraction of reads from other genomes")
+	simulateCmd.Flags().IntP("kmer-len", "k", 21, "k-mer length")
+	simulateCmd.Flags().BoolP("canonical", "K", false, "only keep the canonical k-mers")
+	simulateCmd.Flags().Int64P("seed", "s", 11, "rand seed")
+}
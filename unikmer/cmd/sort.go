@@ -22,10 +22,10 @@ package cmd
 
 import (
 	"bufio"
+	"compress/flate"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -34,10 +34,7 @@ import (
 
 	"github.com/shenwei356/bio/taxdump"
 	"github.com/shenwei356/unik/v5"
-	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts"
-	"github.com/twotwotwo/sorts/sortutil"
 )
 
 var sortCmd = &cobra.Command{
@@ -59,6 +56,14 @@ Tips:
   2. Increasing value of -j/--threads can accelerates splitting stage,
      in cost of more memory occupation.
   3. For sorted input files, the memory usage is very low and speed is fast.
+  4. Use --min-count and --max-count to filter k-mers by the number of
+     occurrences in input, e.g., removing k-mers with sequencing errors
+     from the output of 'unikmer count --linear'.
+  5. Intermediate files of -m/--chunk-size are written with the global
+     compression settings by default. On fast local disks, disabling
+     compression with '--tmp-compress no' speeds up sorting, while higher
+     compression levels help on slow network storage. Use --tmp-io-limit
+     to keep shared filesystems responsive.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -67,14 +72,20 @@ Tips:
 		outFile0 := getFlagString(cmd, "out-prefix")
 		unique := getFlagBool(cmd, "unique")
 		repeated := getFlagBool(cmd, "repeated")
-		tmpDir := getFlagString(cmd, "tmp-dir")
+		var tmpDir string
 		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
 		keepTmpDir := getFlagBool(cmd, "keep-tmp-dir")
-		force := getFlagBool(cmd, "force")
+		tmpOpt := getTmpOptions(cmd, opt)
 
 		if unique && repeated {
 			checkError(fmt.Errorf("flag -u/--unique overides -d/--repeated, don't provide both"))
 		}
+		cr := getCountRange(cmd)
+		writeScale := getFlagWriteScale(cmd)
+		var scaler *writeScaler
+		if cr != nil && (unique || repeated) {
+			checkError(fmt.Errorf("flags --min-count/--max-count and -u/--unique or -d/--repeated are not compatible"))
+		}
 
 		maxElem, err := ParseByteSize(getFlagString(cmd, "chunk-size"))
 		if err != nil {
@@ -102,6 +113,7 @@ Tips:
 		}
 
 		checkFileSuffix(opt, extDataFile, files...)
+		preflightCheck(opt, files, false)
 
 		var m []uint64
 		var taxondb *taxdump.Taxonomy
@@ -113,28 +125,11 @@ Tips:
 		}
 
 		if limitMem {
-			if isStdout(outFile0) {
-				tmpDir = filepath.Join(tmpDir, "stdout.tmp")
-			} else {
-				tmpDir = filepath.Join(tmpDir, filepath.Base(outFile0)+".tmp")
-			}
-
-			existed, err := pathutil.DirExists(tmpDir)
-			checkError(errors.Wrap(err, tmpDir))
-			if existed {
-				empty, err := pathutil.IsEmpty(tmpDir)
-				checkError(errors.Wrap(err, tmpDir))
-				if !empty {
-					if force {
-						checkError(os.RemoveAll(tmpDir))
-					} else {
-						checkError(fmt.Errorf("tmp dir not empty: %s, choose another one or use --force to overwrite", tmpDir))
-					}
-				} else {
-					checkError(os.RemoveAll(tmpDir))
-				}
+			tmpDir, err = makeTmpDir(getTmpRoot(cmd), "unikmer-sort")
+			checkError(errors.Wrap(err, "create tmp dir"))
+			if !keepTmpDir {
+				registerTmpDir(tmpDir)
 			}
-			checkError(os.MkdirAll(tmpDir, 0777))
 		}
 
 		var writer *unik.Writer
@@ -169,7 +164,11 @@ Tips:
 			done <- 1
 		}()
 
+		enableGracefulInterrupt()
 		for i, file := range files {
+			if interrupted() {
+				break
+			}
 
 			if opt.Verbose {
 				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
@@ -178,7 +177,7 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -189,13 +188,14 @@ Tips:
 					canonical = reader.IsCanonical()
 					hashed = reader.IsHashed()
 					hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+					scaler = newWriteScaler(writeScale, reader, file)
 
 					if hasTaxid {
 						if opt.Verbose {
 							log.Infof("taxids found in file: %s", file)
 						}
 						mt = make([]CodeTaxid, 0, listInitSize)
-						if unique || repeated {
+						if unique || repeated || cr != nil {
 							taxondb = loadTaxonomy(opt, false)
 						}
 					} else {
@@ -224,13 +224,16 @@ Tips:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
 						}
 						checkError(errors.Wrap(err, file))
 					}
+					if !scaler.keep(code) {
+						continue
+					}
 
 					if hasTaxid {
 						mt = append(mt, CodeTaxid{Code: code, Taxid: taxid})
@@ -239,6 +242,9 @@ Tips:
 					}
 
 					if limitMem && (len(m) >= maxElem || len(mt) >= maxElem) {
+						if interrupted() {
+							return flagBreak
+						}
 						if !hasTmpFile {
 							if opt.Verbose {
 								log.Info()
@@ -264,14 +270,15 @@ Tips:
 								if opt.Verbose {
 									log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(mt))
 								}
-								// sort.Sort(CodeTaxidSlice(mt))
-								sorts.Quicksort(CodeTaxidSlice(mt))
+								sortCodesTaxids(mt)
 							} else {
 								if opt.Verbose {
 									log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(m))
 								}
-								// sort.Sort(unikmer.CodeSlice(m))
-								sortutil.Uint64s(m)
+								sortCodes(m)
+							}
+							if interrupted() {
+								return
 							}
 							if opt.Verbose {
 								log.Infof("[chunk %d] done sorting", iTmpFile)
@@ -280,9 +287,9 @@ Tips:
 
 							var _n int64
 							if hasTaxid {
-								_n = dumpCodesTaxids2File(mt, taxondb, k, mode, outFile, opt, unique, repeated)
+								_n = dumpCodesTaxids2File(mt, taxondb, k, mode, outFile, tmpOpt, unique, repeated)
 							} else {
-								_n = dumpCodes2File(m, k, mode, outFile, opt, unique, repeated)
+								_n = dumpCodes2File(m, k, mode, outFile, tmpOpt, unique, repeated)
 							}
 							if opt.Verbose {
 								log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", iTmpFile, _n, outFile)
@@ -308,6 +315,11 @@ Tips:
 			}
 		}
 
+		if interrupted() {
+			wg.Wait()
+			exitIfInterrupted()
+		}
+
 		if hasTmpFile {
 			// dump remaining k-mers to file
 			if len(m) > 0 || len(mt) > 0 {
@@ -327,14 +339,15 @@ Tips:
 						if opt.Verbose {
 							log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(mt))
 						}
-						// sort.Sort(CodeTaxidSlice(mt))
-						sorts.Quicksort(CodeTaxidSlice(mt))
+						sortCodesTaxids(mt)
 					} else {
 						if opt.Verbose {
 							log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(m))
 						}
-						// sort.Sort(unikmer.CodeSlice(m))
-						sortutil.Uint64s(m)
+						sortCodes(m)
+					}
+					if interrupted() {
+						return
 					}
 					if opt.Verbose {
 						log.Infof("[chunk %d] done sorting", iTmpFile)
@@ -343,9 +356,9 @@ Tips:
 
 					var _n int64
 					if hasTaxid {
-						_n = dumpCodesTaxids2File(mt, taxondb, k, mode, outFile, opt, unique, repeated)
+						_n = dumpCodesTaxids2File(mt, taxondb, k, mode, outFile, tmpOpt, unique, repeated)
 					} else {
-						_n = dumpCodes2File(m, k, mode, outFile, opt, unique, repeated)
+						_n = dumpCodes2File(m, k, mode, outFile, tmpOpt, unique, repeated)
 					}
 					if opt.Verbose {
 						log.Infof("[chunk %d] %d k-mers saved to tmp file: %s", iTmpFile, _n, outFile)
@@ -355,6 +368,7 @@ Tips:
 
 			// wait all k-mers being wrote to files
 			wg.Wait()
+			exitIfInterrupted()
 			close(chN)
 			<-done
 
@@ -373,7 +387,7 @@ Tips:
 					log.Info()
 					log.Infof("======= Stage 2: merging from %d chunks =======", len(files))
 				}
-				n, _ = mergeChunksFile(opt, taxondb, files, outFile, k, mode, unique, repeated, true)
+				n, _ = mergeChunksFile(opt, taxondb, files, outFile, k, mode, unique, repeated, cr, scaler, false, true)
 			} else {
 				if opt.Verbose {
 					log.Info()
@@ -390,7 +404,7 @@ Tips:
 						if opt.Verbose {
 							log.Infof("[chunk %d] sorting k-mers from %d tmp files", iTmpFile, len(_files))
 						}
-						n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, false)
+						n, _ := mergeChunksFile(tmpOpt, taxondb, _files, outFile1, k, mode, unique, repeated, cr, scaler, false, false)
 						if opt.Verbose {
 							log.Infof("%d k-mers saved to tmp file: %s", n, outFile1)
 						}
@@ -405,7 +419,7 @@ Tips:
 					if opt.Verbose {
 						log.Infof("[chunk %d] sorting k-mers from %d tmp files", iTmpFile, len(_files))
 					}
-					n, _ := mergeChunksFile(opt, taxondb, _files, outFile1, k, mode, unique, repeated, false)
+					n, _ := mergeChunksFile(tmpOpt, taxondb, _files, outFile1, k, mode, unique, repeated, cr, scaler, false, false)
 					if opt.Verbose {
 						log.Infof("%d k-mers saved to tmp file: %s", n, outFile1)
 					}
@@ -415,7 +429,7 @@ Tips:
 					log.Info()
 					log.Infof("======= Stage 3: merging from %d chunks (round: 2/2) =======", len(tmpFiles))
 				}
-				n, _ = mergeChunksFile(opt, taxondb, tmpFiles, outFile, k, mode, unique, repeated, true)
+				n, _ = mergeChunksFile(opt, taxondb, tmpFiles, outFile, k, mode, unique, repeated, cr, scaler, false, true)
 			}
 			if opt.Verbose {
 				log.Infof("%d k-mers saved to %s", n, outFile)
@@ -427,22 +441,14 @@ Tips:
 				return
 			}
 
-			if opt.Verbose {
-				log.Infof("removing %d intermediate files", len(tmpFiles)+len(files))
-			}
-			for _, file := range append(files, tmpFiles...) {
-				err := os.Remove(file)
-				if err != nil {
-					checkError(fmt.Errorf("fail to remove intermediate file: %s", file))
-				}
-			}
 			if opt.Verbose {
 				log.Infof("removing tmp dir: %s", tmpDir)
 			}
-			err = os.Remove(tmpDir)
+			err = removeAllWithRetry(tmpDir)
 			if err != nil {
 				checkError(fmt.Errorf("fail to remove temp directory, please manually delete it: %s", tmpDir))
 			}
+			unregisterTmpDir(tmpDir)
 
 			return
 		}
@@ -453,14 +459,12 @@ Tips:
 			if opt.Verbose {
 				log.Infof("sorting %d k-mers", len(mt))
 			}
-			// sort.Sort(CodeTaxidSlice(mt))
-			sorts.Quicksort(CodeTaxidSlice(mt))
+			sortCodesTaxids(mt)
 		} else {
 			if opt.Verbose {
 				log.Infof("sorting %d k-mers", len(m))
 			}
-			// sort.Sort(unikmer.CodeSlice(m))
-			sortutil.Uint64s(m)
+			sortCodes(m)
 		}
 		if opt.Verbose {
 			log.Infof("done sorting")
@@ -478,9 +482,16 @@ Tips:
 		writer, err = unik.NewWriter(outfh, k, mode)
 		checkError(errors.Wrap(err, outFile))
 		writer.SetMaxTaxid(opt.MaxTaxid) // follow taxondb
+		scaler.setHeader(writer)
 
 		var n int
-		if hasTaxid {
+		if cr != nil {
+			if hasTaxid {
+				n = int(dumpCodesInCountRange(writer, nil, mt, taxondb, cr))
+			} else {
+				n = int(dumpCodesInCountRange(writer, m, nil, nil, cr))
+			}
+		} else if hasTaxid {
 			if unique {
 				var last uint64 = ^uint64(0)
 				var first bool = true
@@ -503,8 +514,10 @@ Tips:
 					lca = codeT.Taxid
 				}
 				// do not forget the last one
-				writer.WriteCodeWithTaxid(last, lca)
-				n++
+				if !first {
+					writer.WriteCodeWithTaxid(last, lca)
+					n++
+				}
 			} else if repeated {
 				var last uint64 = ^uint64(0)
 				var count int = 1
@@ -585,9 +598,16 @@ func init() {
 	sortCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
 	sortCmd.Flags().BoolP("unique", "u", false, `remove duplicate k-mers`)
 	sortCmd.Flags().BoolP("repeated", "d", false, `only print duplicate k-mers`)
+	sortCmd.Flags().IntP("min-count", "", 0, `only output k-mers occurring at least N times in input`)
+	sortCmd.Flags().IntP("max-count", "", 0, `only output k-mers occurring at most N times in input, 0 for no limit`)
+	sortCmd.Flags().IntP("scale", "D", 0, helpWriteScale)
 	sortCmd.Flags().StringP("chunk-size", "m", "", `split input into chunks of N k-mers, supports K/M/G suffix, type "unikmer sort -h" for detail`)
-	sortCmd.Flags().StringP("tmp-dir", "t", "./", `directory for intermediate files`)
+	sortCmd.Flags().StringP("tmp-dir", "t", "./", `directory for intermediate files, the environment variable `+envTmpDir+` is used if not given`)
 	sortCmd.Flags().IntP("max-open-files", "M", 400, `max number of open files`)
 	sortCmd.Flags().BoolP("keep-tmp-dir", "k", false, `keep tmp dir`)
+	sortCmd.Flags().StringP("tmp-compress", "", "auto", `compress intermediate files or not, available: auto (same as the output), yes, no. type "unikmer sort -h" for detail`)
+	sortCmd.Flags().IntP("tmp-compression-level", "", flate.DefaultCompression, `compression level of intermediate files, the global --compression-level is used if not given`)
+	sortCmd.Flags().StringP("tmp-io-limit", "", "", `maximum speed (bytes per second) of writing intermediate files, supports K/M/G suffix, e.g., 100M. 0 or empty for no limit`)
 	sortCmd.Flags().BoolP("force", "", false, "overwrite tmp dir")
+	sortCmd.Flags().MarkDeprecated("force", "tmp dirs have unique names now")
 }
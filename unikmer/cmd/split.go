@@ -27,14 +27,15 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/shenwei356/bio/taxdump"
+	"github.com/shenwei356/kmers"
 	"github.com/shenwei356/unik/v5"
 	"github.com/shenwei356/util/pathutil"
-	"github.com/twotwotwo/sorts"
-	"github.com/twotwotwo/sorts/sortutil"
 
 	"github.com/spf13/cobra"
 )
@@ -55,6 +56,22 @@ Tips:
      in cost of more memory occupation.
   3. For sorted input files, the memory usage is very low and speed is fast.
 
+Splitting by prefix:
+  1. Use --by-prefix p to split k-mers into 4^p partitions by the first p
+     bases, i.e., equal-width ranges of the code space. For hashed k-mers,
+     the hash space [0, max hash] is split into 4^p equal-width ranges.
+     So datasets split in the same way can be joined or diffed partition
+     by partition in parallel, e.g., on a cluster.
+  2. Partitions are named as "part_<prefix>.unik" for k-mers, and
+     "part_<index>.unik" for hashed k-mers, all partitions are created even
+     if they are empty. A manifest file "manifest.tsv" lists the files,
+     ranges and numbers of k-mers, with the partitioning scheme in the
+     first line, which should be identical for datasets to join.
+  3. K-mers are streamed into partitions, which are sorted only for ONE
+     sorted input file, otherwise please run "unikmer sort" on them.
+     -m/--chunk-size, -u/--unique and -d/--repeated are not supported.
+  4. One file is kept open for each partition, so p should be <= 5.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -63,6 +80,7 @@ Tips:
 		force := getFlagBool(cmd, "force")
 		unique := getFlagBool(cmd, "unique")
 		repeated := getFlagBool(cmd, "repeated")
+		byPrefix := getFlagNonNegativeInt(cmd, "by-prefix")
 
 		maxElem, err := ParseByteSize(getFlagString(cmd, "chunk-size"))
 		if err != nil {
@@ -70,6 +88,15 @@ Tips:
 		}
 		limitMem := maxElem > 0
 
+		if byPrefix > 0 {
+			if byPrefix > 5 {
+				checkError(fmt.Errorf("value of --by-prefix should be <= 5"))
+			}
+			if limitMem || unique || repeated {
+				checkError(fmt.Errorf("flag --by-prefix is not compatible with -m/--chunk-size, -u/--unique and -d/--repeated"))
+			}
+		}
+
 		var listInitSize int
 		if limitMem {
 			listInitSize = maxElem
@@ -120,6 +147,15 @@ Tips:
 				}
 			}
 			checkError(os.MkdirAll(outDir, 0777))
+
+			// incomplete outputs are removed on interrupt or exit with error.
+			registerTmpDir(outDir)
+			defer unregisterTmpDir(outDir)
+		}
+
+		if byPrefix > 0 {
+			splitByPrefix(opt, files, outDir, byPrefix)
+			return
 		}
 
 		var infh *bufio.Reader
@@ -170,7 +206,7 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -235,7 +271,7 @@ Tips:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -301,14 +337,12 @@ Tips:
 								if opt.Verbose {
 									log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(mt))
 								}
-								// sort.Sort(CodeTaxidSlice(mt))
-								sorts.Quicksort(CodeTaxidSlice(mt))
+								sortCodesTaxids(mt)
 							} else {
 								if opt.Verbose {
 									log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(m))
 								}
-								// sort.Sort(unikmer.CodeSlice(m))
-								sortutil.Uint64s(m)
+								sortCodes(m)
 							}
 
 							var _n int64
@@ -379,8 +413,7 @@ Tips:
 				if opt.Verbose {
 					log.Infof("[chunk %d] sorting %d k-mers", iTmpFile, len(m))
 				}
-				// sort.Sort(unikmer.CodeSlice(m))
-				sortutil.Uint64s(m)
+				sortCodes(m)
 				if opt.Verbose {
 					log.Infof("[chunk %d] done sorting", iTmpFile)
 					log.Infof("[chunk %d] writing to file: %s", iTmpFile, outFile)
@@ -419,4 +452,217 @@ func init() {
 	splitCmd.Flags().BoolP("force", "", false, `overwrite output directory`)
 	splitCmd.Flags().BoolP("unique", "u", false, `split for further removing duplicate k-mers`)
 	splitCmd.Flags().BoolP("repeated", "d", false, `split for further printing duplicate k-mers`)
+	splitCmd.Flags().IntP("by-prefix", "", 0, `split k-mers into 4^p partitions by the first p bases (or ranges of hashes), type "unikmer split -h" for detail`)
+}
+
+// splitByPrefix splits k-mers into 4^p partitions of equal-width ranges
+// of the code space, i.e., by the first p bases of k-mers.
+func splitByPrefix(opt *Options, files []string, outDir string, p int) {
+	var reader0 *unik.Reader
+	var shards *prefixShards
+	var hasTaxid bool
+	var code uint64
+	var taxid uint32
+	nfiles := len(files)
+
+	for i, file := range files {
+		if opt.Verbose {
+			log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+		}
+
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if reader0 == nil {
+				reader0 = reader
+				if !reader.IsHashed() && p > reader.K {
+					checkError(fmt.Errorf("value of --by-prefix (%d) should not be larger than k (%d)", p, reader.K))
+				}
+				hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+
+				var mode uint32
+				if reader.IsCanonical() {
+					mode |= unik.UnikCanonical
+				}
+				if hasTaxid {
+					mode |= unik.UnikIncludeTaxID
+				}
+				if reader.IsHashed() {
+					mode |= unik.UnikHashed
+				}
+				if nfiles == 1 && reader.IsSorted() {
+					mode |= unik.UnikSorted // ranges of a sorted file are sorted
+				} else if opt.Compact && !reader.IsHashed() {
+					mode |= unik.UnikCompact
+				}
+				shards = newPrefixShards(opt, reader, outDir, p, mode)
+			} else {
+				checkCompatibility(reader0, reader, file)
+				if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
+					if reader.HasTaxidInfo() {
+						checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
+					} else {
+						checkError(fmt.Errorf(`taxid information found in previous files, but missing in this: %s`, file))
+					}
+				}
+			}
+
+			for {
+				code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				checkError(shards.write(code, taxid))
+			}
+		}()
+	}
+
+	manifest := filepath.Join(outDir, "manifest.tsv")
+	n, err := shards.close(manifest)
+	checkError(err)
+	if opt.Verbose {
+		log.Infof("%d k-mers saved to %d partitions in dir: %s, listed in %s", n, len(shards.shards), outDir, manifest)
+	}
+}
+
+// prefixShards holds output files of partitions of --by-prefix.
+type prefixShards struct {
+	opt    *Options
+	reader *unik.Reader // for copying header information
+	outDir string
+	p      int
+	mode   uint32
+
+	maxCode uint64
+	width   uint64
+	shards  []*rankShard
+}
+
+func newPrefixShards(opt *Options, reader *unik.Reader, outDir string, p int, mode uint32) *prefixShards {
+	var maxCode uint64
+	if reader.IsHashed() {
+		maxCode = readerMaxHash(reader)
+	} else if reader.K < 32 {
+		maxCode = 1<<(uint(reader.K)<<1) - 1
+	} else {
+		maxCode = ^uint64(0)
+	}
+	nParts := 1 << (uint(p) << 1)
+
+	return &prefixShards{
+		opt:     opt,
+		reader:  reader,
+		outDir:  outDir,
+		p:       p,
+		mode:    mode,
+		maxCode: maxCode,
+		width:   maxCode/uint64(nParts) + 1,
+		shards:  make([]*rankShard, nParts),
+	}
+}
+
+// name returns the name of a partition, i.e., the prefix of k-mers,
+// or the index for hashed k-mers.
+func (s *prefixShards) name(i int) string {
+	if s.reader.IsHashed() {
+		return fmt.Sprintf("%0*d", len(strconv.Itoa(len(s.shards)-1)), i)
+	}
+	return string(kmers.MustDecode(uint64(i), s.p))
+}
+
+// open creates the file of a partition.
+func (s *prefixShards) open(i int) (*rankShard, error) {
+	var err error
+	shard := &rankShard{file: filepath.Join(s.outDir, "part_"+s.name(i)+extDataFile)}
+	shard.outfh, shard.gw, shard.w, err = outStream(shard.file, s.opt.Compress, s.opt.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	shard.writer, err = unik.NewWriter(shard.outfh, s.reader.K, s.mode)
+	if err != nil {
+		return nil, errors.Wrap(err, shard.file)
+	}
+	shard.writer.SetMaxTaxid(s.opt.MaxTaxid)
+	if s.reader.IsScaled() {
+		shard.writer.SetScale(s.reader.GetScale())
+		if s.reader.MaxHash > 0 {
+			shard.writer.SetMaxHash(s.reader.MaxHash)
+		}
+	}
+	s.shards[i] = shard
+	return shard, nil
+}
+
+// write writes a k-mer to the file of its partition.
+func (s *prefixShards) write(code uint64, taxid uint32) error {
+	if code > s.maxCode {
+		return fmt.Errorf("hash %d is greater than the max hash %d, please check the scale of input files", code, s.maxCode)
+	}
+	i := int(code / s.width)
+	shard := s.shards[i]
+	if shard == nil {
+		var err error
+		shard, err = s.open(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	shard.n++
+	return shard.writer.WriteCodeWithTaxid(code, taxid)
+}
+
+// close closes all files, creates empty files for partitions without
+// k-mers, and writes a manifest file. It returns the number of k-mers written.
+func (s *prefixShards) close(manifest string) (int64, error) {
+	outfh, gw, w, err := outStream(manifest, strings.HasSuffix(strings.ToLower(manifest), ".gz"), s.opt.CompressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(outfh, "# scheme: by-prefix=%d, k=%d, canonical=%v, hashed=%v, scale=%d, max-code=%d\n",
+		s.p, s.reader.K, s.reader.IsCanonical(), s.reader.IsHashed(), s.reader.GetScale(), s.maxCode)
+	outfh.WriteString("file\tpartition\tfrom\tto\tkmers\n")
+
+	var n int64
+	var from, to uint64
+	for i, shard := range s.shards {
+		if shard == nil {
+			if shard, err = s.open(i); err != nil {
+				return 0, err
+			}
+		}
+		if err = shard.writer.Flush(); err != nil {
+			return 0, errors.Wrap(err, shard.file)
+		}
+		shard.outfh.Flush()
+		if shard.gw != nil {
+			shard.gw.Close()
+		}
+		shard.w.Close()
+
+		from = uint64(i) * s.width
+		if i == len(s.shards)-1 {
+			to = s.maxCode
+		} else {
+			to = from + s.width - 1
+		}
+		fmt.Fprintf(outfh, "%s\t%s\t%d\t%d\t%d\n", filepath.Base(shard.file), s.name(i), from, to, shard.n)
+		n += shard.n
+	}
+
+	outfh.Flush()
+	if gw != nil {
+		gw.Close()
+	}
+	w.Close()
+	return n, nil
 }
@@ -0,0 +1,350 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var taxcoverCmd = &cobra.Command{
+	Use:   "taxcover",
+	Short: "Measure how well a k-mer set covers genomes of a taxon",
+	Long: `Measure how well a k-mer set covers genomes of a taxon
+
+Given a query k-mer set (-q/--query, e.g., designed markers of a taxon) and
+binary files of genomes with taxids, this command reports the fraction of
+k-mers of each member genome (genomes belonging to the taxon given by
+-t/--taxid) contained in the query set, which is useful for validating the
+inclusivity of marker sets. Results can also be aggregated at a rank
+(-r/--rank) via -s/--summary-file.
+
+The taxid of a genome is the global taxid in the header, or the LCA of
+taxids of all k-mers. Files without taxids are skipped with a warning.
+
+Attentions:
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. Taxonomy data are needed, please specify the directory via --data-dir.
+     names.dmp is optional, names are empty if it's not found.
+  3. Genomes with taxids above the rank are aggregated with their own taxids.
+
+Output columns:
+  file         genome file
+  taxid        taxid of the genome
+  name         name of the taxid
+  <rank>       taxid at the rank
+  kmers        number of k-mers of the genome
+  covered      number of k-mers also in the query set
+  coverage     covered / kmers
+
+Columns of the summary file:
+  taxid        taxid at the rank
+  name         name of the taxid
+  rank         rank of the taxid
+  genomes      number of genomes
+  passed       number of genomes with coverage >= -m/--min-coverage
+  min          minimum coverage
+  mean         mean coverage
+  max          maximum coverage
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		queryFile := getFlagString(cmd, "query")
+		if queryFile == "" {
+			checkError(fmt.Errorf("flag -q/--query needed"))
+		}
+		qtaxid := uint32(getFlagPositiveInt(cmd, "taxid"))
+		rank := getFlagString(cmd, "rank")
+		minCov := getFlagFloat64(cmd, "min-coverage")
+		if minCov < 0 || minCov > 1 {
+			checkError(fmt.Errorf("value of flag -m/--min-coverage should be in range of [0, 1]"))
+		}
+		outFile := getFlagString(cmd, "out-file")
+		summaryFile := getFlagString(cmd, "summary-file")
+		format := getFlagTableFormat(cmd)
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if len(files) == 1 && isStdin(files[0]) {
+			checkError(fmt.Errorf("binary files of genomes needed"))
+		}
+		if opt.Verbose {
+			log.Infof("%d input file(s) given", len(files))
+		}
+
+		checkFileSuffix(opt, extDataFile, append([]string{queryFile}, files...)...)
+		preflightCheck(opt, append([]string{queryFile}, files...), false)
+
+		// ---------------------------------------------------------------
+		// taxonomy
+
+		taxondb := loadTaxonomy(opt, true)
+		if _, ok := taxondb.Nodes[qtaxid]; !ok {
+			checkError(fmt.Errorf("taxid not found in taxonomy database: %d", qtaxid))
+		}
+		if _, ok := taxondb.Ranks[rank]; !ok {
+			checkError(fmt.Errorf("rank not found in taxonomy database: %s", rank))
+		}
+		file := filepath.Join(opt.DataDir, "names.dmp")
+		if existed, _ := pathutil.Exists(file); existed {
+			checkError(errors.Wrap(taxondb.LoadNamesFromNCBI(file), file))
+		} else if opt.Verbose {
+			log.Warningf("names.dmp not found, names will be empty")
+		}
+
+		// taxidAtRank returns the taxid at the rank on the lineage of a taxid,
+		// or the taxid itself if it's above the rank.
+		taxidAtRank := func(taxid uint32) uint32 {
+			for _, t := range taxondb.LineageTaxIds(taxid) {
+				if taxondb.Rank(t) == rank {
+					return t
+				}
+			}
+			return taxid
+		}
+
+		// ---------------------------------------------------------------
+		// query
+
+		if opt.Verbose {
+			log.Infof("loading query k-mers from: %s", queryFile)
+		}
+		infh, r, _, err := inStream(queryFile)
+		checkError(err)
+		reader0, err := unik.NewReader(infh)
+		checkError(errors.Wrap(err, queryFile))
+		closeInStream(r)
+
+		query, err := loadCodeSet([]string{queryFile}, reader0.K, reader0.IsCanonical(), reader0.IsHashed())
+		checkError(err)
+		query = query.sample(opt.Sampler)
+		if opt.Verbose {
+			log.Infof("%d k-mers loaded", len(query))
+		}
+
+		// ---------------------------------------------------------------
+		// genomes
+
+		if opt.Verbose {
+			log.Infof("computing coverage of genomes of taxid %d ...", qtaxid)
+		}
+
+		type taxcoverResult struct {
+			taxid   uint32
+			member  bool
+			kmers   int
+			covered int
+		}
+		results := make([]*taxcoverResult, len(files))
+
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for i, file := range files {
+			tokens <- 1
+			wg.Add(1)
+			go func(i int, file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				var infh *bufio.Reader
+				var r *os.File
+				infh, r, _, err := inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+				checkCompatibility(reader0, reader, file)
+
+				result := &taxcoverResult{}
+				results[i] = result
+
+				if reader.HasGlobalTaxid() {
+					result.taxid = reader.GetGlobalTaxid()
+					// skip non-member genomes without reading k-mers
+					if taxondb.LCA(result.taxid, qtaxid) != qtaxid {
+						return
+					}
+				} else if !reader.HasTaxidInfo() {
+					log.Warningf("no taxid found, skipped: %s", file)
+					return
+				}
+
+				taxids := make(map[uint32]interface{}, 8)
+				var code uint64
+				var taxid uint32
+				var n, c int
+				for {
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					n++
+					if query.has(code) {
+						c++
+					}
+					if taxid > 0 {
+						taxids[taxid] = struct{}{}
+					}
+				}
+
+				if !reader.HasGlobalTaxid() {
+					for taxid = range taxids {
+						if result.taxid == 0 {
+							result.taxid = taxid
+						} else {
+							result.taxid = taxondb.LCA(result.taxid, taxid)
+						}
+					}
+					if result.taxid == 0 || taxondb.LCA(result.taxid, qtaxid) != qtaxid {
+						return
+					}
+				}
+
+				result.member = true
+				result.kmers = n
+				result.covered = c
+			}(i, file)
+		}
+		wg.Wait()
+
+		// ---------------------------------------------------------------
+		// output
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"file", "taxid", "name", rank, "kmers", "covered", "coverage"})
+		tw.WriteHeader()
+
+		type taxcoverSummary struct {
+			taxid           uint32
+			genomes, passed int
+			min, sum, max   float64
+		}
+		summaries := make(map[uint32]*taxcoverSummary, 8)
+		taxa := make([]uint32, 0, 8) // taxa at the rank, in order of first appearance
+
+		var nMembers int
+		var t uint32
+		var cov float64
+		for i, result := range results {
+			if !result.member {
+				continue
+			}
+			nMembers++
+
+			if result.kmers > 0 {
+				cov = float64(result.covered) / float64(result.kmers)
+			} else {
+				cov = 0
+			}
+			t = taxidAtRank(result.taxid)
+			tw.WriteRecord(files[i], result.taxid, taxondb.Names[result.taxid], t,
+				result.kmers, result.covered, roundFloat(cov, 4))
+
+			s, ok := summaries[t]
+			if !ok {
+				s = &taxcoverSummary{taxid: t, min: cov, max: cov}
+				summaries[t] = s
+				taxa = append(taxa, t)
+			}
+			s.genomes++
+			if cov >= minCov {
+				s.passed++
+			}
+			if cov < s.min {
+				s.min = cov
+			}
+			if cov > s.max {
+				s.max = cov
+			}
+			s.sum += cov
+		}
+
+		if opt.Verbose {
+			log.Infof("%d genomes of taxid %d found in %d files", nMembers, qtaxid, len(files))
+		}
+		if nMembers == 0 {
+			log.Warningf("no genomes of taxid %d found", qtaxid)
+		}
+
+		if summaryFile == "" {
+			return
+		}
+
+		outfh2, gw2, w2, err := outStream(summaryFile, strings.HasSuffix(strings.ToLower(summaryFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		tw2 := newTableWriter(outfh2, format, []string{"taxid", "name", "rank", "genomes", "passed", "min", "mean", "max"})
+		tw2.WriteHeader()
+		for _, t = range taxa {
+			s := summaries[t]
+			tw2.WriteRecord(t, taxondb.Names[t], taxondb.Rank(t), s.genomes, s.passed,
+				roundFloat(s.min, 4), roundFloat(s.sum/float64(s.genomes), 4), roundFloat(s.max, 4))
+		}
+		outfh2.Flush()
+		if gw2 != nil {
+			gw2.Close()
+		}
+		w2.Close()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(taxcoverCmd)
+
+	taxcoverCmd.Flags().StringP("query", "q", "", `query binary file, e.g., k-mers of designed markers`)
+	taxcoverCmd.Flags().IntP("taxid", "t", 0, `taxid of the taxon, genomes belonging to which are checked`)
+	taxcoverCmd.Flags().StringP("rank", "r", "species", `rank for aggregating results in the summary file`)
+	taxcoverCmd.Flags().Float64P("min-coverage", "m", 0.9, `minimum coverage for counting passed genomes in the summary file`)
+	taxcoverCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	taxcoverCmd.Flags().StringP("summary-file", "s", "", `file for saving the summary at the rank`)
+	taxcoverCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
@@ -0,0 +1,362 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var taxdumpCmd = &cobra.Command{
+	Use:   "taxdump",
+	Short: "Download and inspect NCBI Taxonomy files in the data directory",
+	Long: `Download and inspect NCBI Taxonomy files in the data directory
+
+The data directory is set by the global flag --data-dir, or environment
+variable UNIKMER_DB, with the default value of ~/.unikmer/.
+
+`,
+}
+
+var taxdumpDefaultURL = "https://ftp.ncbi.nih.gov/pub/taxonomy/taxdump.tar.gz"
+
+// files extracted from taxdump.tar.gz
+var taxdumpFiles = []string{"nodes.dmp", "names.dmp", "merged.dmp", "delnodes.dmp"}
+
+// file storing the version of taxdump files in the data directory
+var taxdumpVersionFile = "taxdump.version"
+
+var taxdumpDownloadCmd = &cobra.Command{
+	Use:     "download",
+	Aliases: []string{"update"},
+	Short:   "Download NCBI Taxonomy taxdump files into the data directory",
+	Long: `Download NCBI Taxonomy taxdump files into the data directory
+
+Steps:
+  1. Downloading taxdump.tar.gz and checking the MD5 checksum.
+  2. Extracting nodes.dmp, names.dmp, merged.dmp and delnodes.dmp into
+     a versioned subdirectory "taxdump-YYYY-MM-DD" in the data directory,
+     where the date is the last modification time of the remote file.
+  3. Copying these files into the data directory, which are used by
+     all taxonomy-dependent commands.
+
+The download is skipped if the version already exists, unless the flag
+-f/--force is given.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		url := getFlagNonEmptyString(cmd, "url")
+		skipMD5 := getFlagBool(cmd, "skip-md5")
+		force := getFlagBool(cmd, "force")
+
+		checkError(os.MkdirAll(opt.DataDir, 0755))
+
+		// version
+		if opt.Verbose {
+			log.Infof("checking remote file: %s", url)
+		}
+		resp, err := http.Head(url)
+		checkError(errors.Wrap(err, url))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			checkError(fmt.Errorf("failed to access %s: %s", url, resp.Status))
+		}
+		modTime := time.Now()
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			if t, err := http.ParseTime(lm); err == nil {
+				modTime = t
+			}
+		}
+		version := "taxdump-" + modTime.Format("2006-01-02")
+		verDir := filepath.Join(opt.DataDir, version)
+
+		existed, err := pathutil.DirExists(verDir)
+		checkError(errors.Wrap(err, verDir))
+		if existed && !force {
+			log.Infof("taxdump files of version %s already exist in %s, use -f/--force to download again", version, opt.DataDir)
+			checkError(activateTaxdump(opt.DataDir, version))
+			return
+		}
+
+		// download
+		tmpFile := filepath.Join(opt.DataDir, "taxdump.tar.gz.tmp")
+		if opt.Verbose {
+			log.Infof("downloading %s", url)
+		}
+		md5sum, err := downloadFile(url, tmpFile)
+		if err != nil {
+			os.Remove(tmpFile)
+			checkError(err)
+		}
+
+		if !skipMD5 {
+			var expected string
+			expected, err = fetchMD5(url + ".md5")
+			if err == nil && expected != md5sum {
+				err = fmt.Errorf("MD5 checksum mismatch for %s: %s (expected: %s)", url, md5sum, expected)
+			}
+			if err != nil {
+				os.Remove(tmpFile)
+				checkError(err)
+			}
+			if opt.Verbose {
+				log.Infof("MD5 checksum matched: %s", md5sum)
+			}
+		}
+
+		// extract
+		checkError(os.MkdirAll(verDir, 0755))
+		err = extractTaxdump(tmpFile, verDir)
+		os.Remove(tmpFile)
+		checkError(err)
+		if opt.Verbose {
+			log.Infof("taxdump files extracted to %s", verDir)
+		}
+
+		checkError(activateTaxdump(opt.DataDir, version))
+		log.Infof("taxdump files of version %s are ready in %s", version, opt.DataDir)
+	},
+}
+
+var taxdumpInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the data directory and versions of taxdump files",
+	Long: `Show the data directory and versions of taxdump files
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var source string
+		if cmd.Flags().Lookup("data-dir").Changed {
+			source = "flag --data-dir"
+		} else if os.Getenv("UNIKMER_DB") != "" {
+			source = "environment variable UNIKMER_DB"
+		} else {
+			source = "default"
+		}
+
+		outfh := bufio.NewWriter(os.Stdout)
+		defer outfh.Flush()
+
+		fmt.Fprintf(outfh, "data directory: %s (%s)\n", opt.DataDir, source)
+
+		existed, err := pathutil.DirExists(opt.DataDir)
+		checkError(errors.Wrap(err, opt.DataDir))
+		if !existed {
+			fmt.Fprintf(outfh, "data directory not created, please run \"unikmer taxdump download\"\n")
+			return
+		}
+
+		var version string
+		data, err := os.ReadFile(filepath.Join(opt.DataDir, taxdumpVersionFile))
+		if err == nil {
+			version = strings.TrimSpace(string(data))
+		} else {
+			version = "unknown"
+		}
+		fmt.Fprintf(outfh, "current version: %s\n", version)
+
+		fmt.Fprintf(outfh, "files:\n")
+		var info os.FileInfo
+		for _, file := range taxdumpFiles {
+			info, err = os.Stat(filepath.Join(opt.DataDir, file))
+			if err != nil {
+				fmt.Fprintf(outfh, "  %-13s missing\n", file)
+				continue
+			}
+			fmt.Fprintf(outfh, "  %-13s %d bytes, modified at %s\n", file, info.Size(), info.ModTime().Format("2006-01-02 15:04:05"))
+		}
+
+		versions, err := filepath.Glob(filepath.Join(opt.DataDir, "taxdump-*"))
+		checkError(err)
+		sort.Strings(versions)
+		fmt.Fprintf(outfh, "available versions:\n")
+		for _, v := range versions {
+			fmt.Fprintf(outfh, "  %s\n", filepath.Base(v))
+		}
+	},
+}
+
+// downloadFile downloads a file and returns its MD5 checksum.
+func downloadFile(url string, file string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", errors.Wrap(err, url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	fh, err := os.Create(file)
+	if err != nil {
+		return "", errors.Wrap(err, file)
+	}
+	defer fh.Close()
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(fh, h), resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, url)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fetchMD5 fetches the checksum from a .md5 file, in the format of "md5  file".
+func fetchMD5(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", errors.Wrap(err, url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, url)
+	}
+	items := strings.Fields(string(data))
+	if len(items) == 0 {
+		return "", fmt.Errorf("invalid MD5 file: %s", url)
+	}
+	return strings.ToLower(items[0]), nil
+}
+
+// extractTaxdump extracts needed files from taxdump.tar.gz to outDir.
+func extractTaxdump(file string, outDir string) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, file)
+	}
+	defer fh.Close()
+
+	gr, err := gzip.NewReader(bufio.NewReaderSize(fh, BufferSize))
+	if err != nil {
+		return errors.Wrap(err, file)
+	}
+	defer gr.Close()
+
+	needed := make(map[string]struct{}, len(taxdumpFiles))
+	for _, f := range taxdumpFiles {
+		needed[f] = struct{}{}
+	}
+
+	tr := tar.NewReader(gr)
+	var hdr *tar.Header
+	var name string
+	var ok bool
+	var outfh *os.File
+	for {
+		hdr, err = tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, file)
+		}
+		name = filepath.Base(hdr.Name)
+		if _, ok = needed[name]; !ok {
+			continue
+		}
+
+		outfh, err = os.Create(filepath.Join(outDir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(outfh, tr)
+		outfh.Close()
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		delete(needed, name)
+	}
+
+	if len(needed) > 0 {
+		missing := make([]string, 0, len(needed))
+		for f := range needed {
+			missing = append(missing, f)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("files missing in %s: %s", file, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// activateTaxdump copies taxdump files of a version to the data directory.
+func activateTaxdump(dataDir string, version string) error {
+	var err error
+	for _, file := range taxdumpFiles {
+		err = copyFile(filepath.Join(dataDir, version, file), filepath.Join(dataDir, file))
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dataDir, taxdumpVersionFile), []byte(version+"\n"), 0644)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, src)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, dst)
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return errors.Wrap(err, dst)
+	}
+	return out.Close()
+}
+
+func init() {
+	RootCmd.AddCommand(taxdumpCmd)
+
+	taxdumpCmd.AddCommand(taxdumpDownloadCmd)
+	taxdumpDownloadCmd.Flags().StringP("url", "u", taxdumpDefaultURL, "URL of taxdump.tar.gz, the MD5 file should be URL + '.md5'")
+	taxdumpDownloadCmd.Flags().BoolP("skip-md5", "", false, "skip MD5 checksum verification")
+	taxdumpDownloadCmd.Flags().BoolP("force", "f", false, "download again even if the version exists")
+
+	taxdumpCmd.AddCommand(taxdumpInfoCmd)
+}
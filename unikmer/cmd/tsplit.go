@@ -53,6 +53,11 @@ Attentions:
 Tips:
   1. Increasing value of -j/--threads can accelerates splitting stage,
      in cost of more memory occupation.
+  2. Use --mux to write all outputs to stdout as a multiplexed stream,
+     which can be read from stdin by other commands, without temporary
+     directories. Files in the stream are named '-/<file name>'.
+       unikmer tsplit in.unik --mux | unikmer info -
+     Note that downstream commands keep the whole stream in memory.
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -61,6 +66,8 @@ Tips:
 		outdir := getFlagString(cmd, "out-dir")
 		force := getFlagBool(cmd, "force")
 		outPrefix := getFlagString(cmd, "out-prefix")
+		muxOut := getFlagBool(cmd, "mux")
+		requireSorted := getFlagBool(cmd, "require-sorted")
 
 		if outPrefix == "" || strings.HasPrefix(outPrefix, ".") {
 			checkError(fmt.Errorf(`-o/--out-prefix should not be empty or starting with "."`))
@@ -82,7 +89,17 @@ Tips:
 
 		var err error
 
-		if outdir == "" {
+		var mux *muxWriter
+		var muxfh *bufio.Writer
+		if muxOut {
+			muxfh = bufio.NewWriterSize(os.Stdout, BufferSize)
+			mux, err = newMuxWriter(muxfh)
+			checkError(err)
+			defer func() {
+				checkError(mux.Close())
+				checkError(muxfh.Flush())
+			}()
+		} else if outdir == "" {
 			if isStdin(files[0]) {
 				outdir = "stdin.tsplit"
 			} else {
@@ -90,7 +107,7 @@ Tips:
 			}
 		}
 		pwd, _ := os.Getwd()
-		if outdir != "./" && outdir != "." && pwd != filepath.Clean(outdir) {
+		if !muxOut && outdir != "./" && outdir != "." && pwd != filepath.Clean(outdir) {
 			existed, err := pathutil.DirExists(outdir)
 			checkError(errors.Wrap(err, outdir))
 			if existed {
@@ -136,7 +153,7 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -172,14 +189,16 @@ Tips:
 					}
 				}
 
+				checker := newSortedChecker(requireSorted, file)
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
 						}
 						checkError(errors.Wrap(err, file))
 					}
+					checker.check(code)
 
 					n++
 					if codes, ok = m[taxid]; ok {
@@ -248,8 +267,17 @@ Tips:
 					<-tokens
 				}()
 
-				_outFile := filepath.Join(outdir, fmt.Sprintf("%s.taxid-%d.k%d%s", outPrefix, taxid, k, extDataFile))
-				_outfh, _gw, _w, _err := outStream(_outFile, opt.Compress, opt.CompressionLevel)
+				_outFile := fmt.Sprintf("%s.taxid-%d.k%d%s", outPrefix, taxid, k, extDataFile)
+				var _outfh *bufio.Writer
+				var _gw io.WriteCloser
+				var _w io.Closer
+				var _err error
+				if muxOut {
+					_outfh, _gw, _w, _err = muxOutStream(mux, _outFile, opt.Compress, opt.CompressionLevel)
+				} else {
+					_outFile = filepath.Join(outdir, _outFile)
+					_outfh, _gw, _w, _err = outStream(_outFile, opt.Compress, opt.CompressionLevel)
+				}
 				checkError(_err)
 				defer func() {
 					_outfh.Flush()
@@ -287,7 +315,11 @@ Tips:
 		<-done
 
 		if opt.Verbose {
-			log.Infof("%d taxids belonging to %d taxids saved to dir: %s", N, len(m), outdir)
+			if muxOut {
+				log.Infof("%d taxids belonging to %d taxids saved to stdout", N, len(m))
+			} else {
+				log.Infof("%d taxids belonging to %d taxids saved to dir: %s", N, len(m), outdir)
+			}
 		}
 	},
 }
@@ -298,4 +330,6 @@ func init() {
 	tsplitCmd.Flags().StringP("out-prefix", "o", "tsplit", `out file prefix`)
 	tsplitCmd.Flags().StringP("out-dir", "O", "", `output directory`)
 	tsplitCmd.Flags().BoolP("force", "", false, `overwrite output directory`)
+	tsplitCmd.Flags().BoolP("mux", "", false, `write all outputs to stdout as a multiplexed stream, instead of files in the output directory`)
+	tsplitCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
 }
@@ -32,7 +32,6 @@ import (
 	"github.com/shenwei356/unik/v5"
 
 	"github.com/spf13/cobra"
-	"github.com/twotwotwo/sorts/sortutil"
 )
 
 var unionCmd = &cobra.Command{
@@ -100,7 +99,7 @@ Tips:
 			}
 			infh, r, _, err = inStream(files[0])
 			checkError(err)
-			defer r.Close()
+			defer closeInStream(r)
 
 			if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
 				outFile += extDataFile
@@ -131,7 +130,7 @@ Tips:
 			flag = func() int {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -184,7 +183,7 @@ Tips:
 				}
 
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -270,8 +269,7 @@ Tips:
 				if opt.Verbose {
 					log.Infof("sorting %d k-mers", len(codes))
 				}
-				// sort.Sort(unikmer.CodeSlice(codes))
-				sortutil.Uint64s(codes)
+				sortCodes(codes)
 				if opt.Verbose {
 					log.Infof("done sorting")
 				}
@@ -291,8 +289,7 @@ Tips:
 				if opt.Verbose {
 					log.Infof("sorting %d k-mers", len(codes))
 				}
-				// sort.Sort(unikmer.CodeSlice(codes))
-				sortutil.Uint64s(codes)
+				sortCodes(codes)
 				if opt.Verbose {
 					log.Infof("done sorting")
 				}
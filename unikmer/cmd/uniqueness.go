@@ -0,0 +1,298 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/unik/v5"
+
+	"github.com/spf13/cobra"
+)
+
+var uniquenessCmd = &cobra.Command{
+	Use:   "uniqueness",
+	Short: "K-mer uniqueness of genome windows against multiple binary files",
+	Long: `K-mer uniqueness of genome windows against multiple binary files
+
+For each k-mer of the genomes, we count the number of binary files (targets)
+containing it, where 0 means it's unique to the genomes. Then for each
+sliding window of the genomes, the distribution of the counts is summarized,
+producing a specificity landscape for selecting primer/CRISPR targets.
+
+Attention:
+  0. All files should have the 'canonical' flag.
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  2. A k-mer belongs to the window where it starts.
+  3. For scaled files, only k-mers (hashes) passing the scale are counted.
+
+Output columns (0-based, half-open window):
+  chrom, start, end,
+  kmers        number of k-mers in the window
+  unique       number of k-mers found in no targets
+  unique_frac  unique/kmers
+  min/median/max  of numbers of targets containing the k-mers
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		reSeqNameStrs := getFlagStringSlice(cmd, "seq-name-filter")
+		reSeqNames := make([]*regexp.Regexp, 0, len(reSeqNameStrs))
+		for _, kw := range reSeqNameStrs {
+			if !reIgnoreCase.MatchString(kw) {
+				kw = reIgnoreCaseStr + kw
+			}
+			re, err := regexp.Compile(kw)
+			if err != nil {
+				checkError(errors.Wrapf(err, "failed to parse regular expression for matching sequence header: %s", kw))
+			}
+			reSeqNames = append(reSeqNames, re)
+		}
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		if len(files) == 1 && isStdin(files[0]) {
+			checkError(fmt.Errorf("stdin not supported, please give me .unik files"))
+		}
+
+		outFile := getFlagString(cmd, "out-file")
+
+		genomes := getFlagStringSlice(cmd, "genome")
+		if len(genomes) == 0 {
+			checkError(fmt.Errorf("flag -g/--genome needed"))
+		}
+
+		window := getFlagPositiveInt(cmd, "window")
+		step := getFlagNonNegativeInt(cmd, "step")
+		if step == 0 {
+			step = window
+		}
+
+		format := getFlagTableFormat(cmd)
+
+		// -----------------------------------------------------------------------
+
+		var infh *bufio.Reader
+		var r *os.File
+		var nfiles = len(files)
+
+		reader0 := preReadCanonicalFiles(opt, files)
+		k := reader0.K
+		var maxHash uint64 = ^uint64(0)
+		if reader0.IsScaled() {
+			maxHash = readerMaxHash(reader0)
+		}
+
+		if window < k {
+			checkError(fmt.Errorf("value of -w/--window (%d) should not be smaller than k (%d)", window, k))
+		}
+
+		// -----------------------------------------------------------------------
+
+		var code uint64
+		var ok bool
+
+		gk := &genomeKmers{
+			files:      genomes,
+			k:          k,
+			hashed:     reader0.IsHashed(),
+			maxHash:    maxHash,
+			reSeqNames: reSeqNames,
+		}
+
+		// k-mers of genomes
+
+		if opt.Verbose {
+			log.Infof("collecting k-mers of genomes")
+		}
+		m := make(map[uint64]*[2]uint32, mapInitSize) // code -> [number of files, 1-based index of the last file]
+		gk.each(nil, func(code uint64, i int) {
+			if _, ok = m[code]; !ok {
+				m[code] = &[2]uint32{}
+			}
+		})
+		if opt.Verbose {
+			log.Infof("%d k-mers collected", len(m))
+		}
+
+		// k-mers in binary files
+
+		var c *[2]uint32
+		for i, file := range files {
+			if opt.Verbose {
+				log.Infof("processing file (%d/%d): %s", i+1, nfiles, file)
+			}
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				idx := uint32(i + 1)
+				for {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					if c, ok = m[code]; !ok {
+						continue
+					}
+					if c[1] == idx { // duplicated k-mer
+						continue
+					}
+					c[0]++
+					c[1] = idx
+				}
+			}()
+		}
+
+		// -----------------------------------------------------------------------
+
+		if opt.Verbose {
+			log.Infof("summarizing windows")
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		tw := newTableWriter(outfh, format, []string{"chrom", "start", "end",
+			"kmers", "unique", "unique_frac", "min", "median", "max"})
+		tw.WriteHeader()
+
+		var id string
+		var counts []int32 // numbers of targets of k-mers at each position, -1 for none
+		buf := make([]int32, 0, window)
+
+		// dump outputs windows of the current sequence.
+		dump := func() {
+			if id == "" {
+				return
+			}
+			L := len(counts)
+			var end, nUnique int
+			var frac float64
+			for start := 0; start < L; start += step {
+				end = start + window
+				if end > L {
+					end = L
+				}
+
+				buf = buf[:0]
+				nUnique = 0
+				for _, v := range counts[start:end] {
+					if v < 0 {
+						continue
+					}
+					buf = append(buf, v)
+					if v == 0 {
+						nUnique++
+					}
+				}
+
+				if len(buf) == 0 {
+					tw.WriteRecord(id, start, end, 0, 0, 0, "NA", "NA", "NA")
+				} else {
+					sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+					frac = math.Round(float64(nUnique)/float64(len(buf))*1e4) / 1e4
+					tw.WriteRecord(id, start, end, len(buf), nUnique, frac,
+						buf[0], median(buf), buf[len(buf)-1])
+				}
+
+				if end == L {
+					break
+				}
+			}
+		}
+
+		gk.each(func(record *fastx.Record) {
+			dump()
+
+			id = string(record.ID)
+			counts = make([]int32, len(record.Seq.Seq))
+			for i := range counts {
+				counts[i] = -1
+			}
+		}, func(code uint64, i int) {
+			counts[i] = int32(m[code][0])
+		})
+		dump()
+	},
+}
+
+// median returns the median of sorted values.
+func median(sorted []int32) float64 {
+	n := len(sorted)
+	if n&1 == 1 {
+		return float64(sorted[n>>1])
+	}
+	return float64(sorted[n>>1-1]+sorted[n>>1]) / 2
+}
+
+func init() {
+	RootCmd.AddCommand(uniquenessCmd)
+
+	uniquenessCmd.Flags().StringSliceP("seq-name-filter", "B", []string{}, `list of regular expressions for filtering out sequences by header/name, case ignored`)
+
+	uniquenessCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	uniquenessCmd.Flags().StringSliceP("genome", "g", []string{}, "genomes in (gzipped) fasta file(s)")
+	uniquenessCmd.Flags().IntP("window", "w", 100, "window size")
+	uniquenessCmd.Flags().IntP("step", "s", 0, "step size of sliding windows, 0 for the window size")
+	uniquenessCmd.Flags().StringP("out-format", "", "tsv", `output format, available: "tsv", "json" (JSON lines)`)
+}
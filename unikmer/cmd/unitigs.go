@@ -0,0 +1,281 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/kmers"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var unitigsCmd = &cobra.Command{
+	Use:   "unitigs",
+	Short: "Construct unitigs from k-mers via compacted de Bruijn graph",
+	Long: `Construct unitigs from k-mers via compacted de Bruijn graph
+
+Unitigs are maximal non-branching paths in the node-centric de Bruijn
+graph of the k-mers, where two k-mers are connected if they overlap
+by k-1 bases, on either strand.
+
+Attentions:
+  1. Only k-mers (not hashed) are supported, k-mers of all input files
+     are merged. Non-canonical k-mers are converted to canonical ones.
+  2. All k-mers are stored in memory.
+  3. Output is in FASTA format, headers are "<index> LN:i:<length>".
+     Unitigs are outputted in order of their smallest k-mer codes,
+     so the output is deterministic.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		outFile := getFlagString(cmd, "out-file")
+		lineWidth := getFlagNonNegativeInt(cmd, "line-width")
+		minLen := getFlagNonNegativeInt(cmd, "min-len")
+
+		// k-mer -> visited
+		m := make(map[uint64]bool, mapInitSize)
+
+		var infh *bufio.Reader
+		var r *os.File
+		var reader0 *unik.Reader
+		var code uint64
+		var k int = -1
+		var canonical bool
+
+		for _, file := range files {
+			func() {
+				infh, r, _, err = inStream(file)
+				checkError(err)
+				defer closeInStream(r)
+
+				reader, err := unik.NewReader(infh)
+				checkError(errors.Wrap(err, file))
+
+				if reader.IsHashed() {
+					checkError(fmt.Errorf("hashed k-mers are not supported: %s", file))
+				}
+				if k == -1 {
+					reader0 = reader
+					k = reader.K
+				} else if reader.K != k {
+					checkError(fmt.Errorf("k-mer length not consistent (%d != %d): %s", reader0.K, reader.K, file))
+				}
+				canonical = reader.IsCanonical()
+
+				for {
+					code, _, err = readCodeWithTaxid(reader, opt.Sampler)
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						checkError(errors.Wrap(err, file))
+					}
+
+					if !canonical {
+						code = kmers.Canonical(code, k)
+					}
+					m[code] = false
+				}
+			}()
+		}
+
+		if opt.Verbose {
+			log.Infof("%d k-mers loaded", len(m))
+		}
+
+		codes := make([]uint64, 0, len(m))
+		for code = range m {
+			codes = append(codes, code)
+		}
+		sortCodes(codes)
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		g := &kmerGraph{k: k, m: m}
+		if k == 32 {
+			g.mask = ^uint64(0)
+		} else {
+			g.mask = (1 << uint(k<<1)) - 1
+		}
+
+		var left, right []byte
+		var unitig []byte
+		var s *seq.Seq
+		var n, nKmers int
+		for _, code = range codes {
+			if m[code] { // visited
+				continue
+			}
+			m[code] = true
+
+			right = g.extend(code, right[:0])
+			left = g.extend(kmers.MustRevComp(code, k), left[:0])
+
+			unitig = unitig[:0]
+			unitig = append(unitig, left...)
+			revCompBases(unitig)
+			unitig = append(unitig, kmers.MustDecode(code, k)...)
+			unitig = append(unitig, right...)
+
+			nKmers += len(unitig) - k + 1
+			if len(unitig) < minLen {
+				continue
+			}
+			s, _ = seq.NewSeqWithoutValidation(seq.DNAredundant, unitig)
+			fmt.Fprintf(outfh, ">%d LN:i:%d\n%s\n", n, len(unitig), s.FormatSeq(lineWidth))
+			n++
+		}
+
+		if opt.Verbose {
+			log.Infof("%d unitigs saved to %s, covering %d k-mers", n, outFile, nKmers)
+		}
+	},
+}
+
+// kmerGraph is a node-centric de Bruijn graph of canonical k-mers.
+type kmerGraph struct {
+	k    int
+	mask uint64
+	m    map[uint64]bool // canonical k-mer -> visited
+}
+
+func (g *kmerGraph) has(code uint64) bool {
+	_, ok := g.m[kmers.Canonical(code, g.k)]
+	return ok
+}
+
+// successor returns the only successor of a k-mer, and the number of successors.
+func (g *kmerGraph) successor(code uint64) (uint64, int) {
+	var next, found uint64
+	var n int
+	for b := uint64(0); b < 4; b++ {
+		next = (code<<2 | b) & g.mask
+		if g.has(next) {
+			found = next
+			n++
+		}
+	}
+	return found, n
+}
+
+// predecessor returns the only predecessor of a k-mer, and the number of predecessors.
+func (g *kmerGraph) predecessor(code uint64) (uint64, int) {
+	var prev, found uint64
+	var n int
+	shift := uint((g.k - 1) << 1)
+	for b := uint64(0); b < 4; b++ {
+		prev = b<<shift | code>>2
+		if g.has(prev) {
+			found = prev
+			n++
+		}
+	}
+	return found, n
+}
+
+// extend extends a k-mer on the right along the non-branching path,
+// marks k-mers as visited, and appends the extended bases to bases.
+func (g *kmerGraph) extend(code uint64, bases []byte) []byte {
+	var next, canonical uint64
+	var n int
+	for {
+		next, n = g.successor(code)
+		if n != 1 {
+			break
+		}
+		if _, n = g.predecessor(next); n != 1 {
+			break
+		}
+		canonical = kmers.Canonical(next, g.k)
+		if g.m[canonical] { // cycle or visited
+			break
+		}
+		g.m[canonical] = true
+
+		bases = append(bases, "ACGT"[next&3])
+		code = next
+	}
+	return bases
+}
+
+// revCompBases computes the reverse complement of bases (ACGT) in place.
+func revCompBases(s []byte) {
+	var b byte
+	for i, j := 0, len(s)-1; i <= j; i, j = i+1, j-1 {
+		b = s[i]
+		s[i], s[j] = complementBase(s[j]), complementBase(b)
+	}
+}
+
+func complementBase(b byte) byte {
+	switch b {
+	case 'A':
+		return 'T'
+	case 'C':
+		return 'G'
+	case 'G':
+		return 'C'
+	case 'T':
+		return 'A'
+	}
+	return 'N'
+}
+
+func init() {
+	RootCmd.AddCommand(unitigsCmd)
+
+	unitigsCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
+	unitigsCmd.Flags().IntP("line-width", "w", 60, "line width of sequences (0 for no wrap)")
+	unitigsCmd.Flags().IntP("min-len", "m", 0, "minimum length of unitigs to output")
+}
@@ -0,0 +1,100 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/breader"
+)
+
+// loadBedRegions reads regions from a BED file, and returns sorted and
+// merged intervals (0-based, left-closed and right-open) of each sequence.
+func loadBedRegions(file string) (map[string][][2]int, error) {
+	brdr, err := breader.NewDefaultBufferedReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	regions := make(map[string][][2]int, 8)
+	var line string
+	var items []string
+	var start, end int
+	var data interface{}
+	for chunk := range brdr.Ch {
+		if chunk.Err != nil {
+			return nil, errors.Wrap(chunk.Err, file)
+		}
+		for _, data = range chunk.Data {
+			line = data.(string)
+			if line == "" || line[0] == '#' ||
+				strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+				continue
+			}
+
+			items = strings.Split(line, "\t")
+			if len(items) < 3 {
+				return nil, fmt.Errorf("%s: at least three columns needed: %s", file, line)
+			}
+			start, err = strconv.Atoi(items[1])
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("%s: invalid start position: %s", file, line)
+			}
+			end, err = strconv.Atoi(items[2])
+			if err != nil || end < start {
+				return nil, fmt.Errorf("%s: invalid end position: %s", file, line)
+			}
+			if end == start {
+				continue
+			}
+
+			regions[items[0]] = append(regions[items[0]], [2]int{start, end})
+		}
+	}
+
+	for id, regs := range regions {
+		regions[id] = mergeRegions(regs)
+	}
+	return regions, nil
+}
+
+// mergeRegions sorts intervals and merges overlapping ones.
+func mergeRegions(regs [][2]int) [][2]int {
+	sort.Slice(regs, func(i, j int) bool { return regs[i][0] < regs[j][0] })
+
+	merged := regs[:1]
+	var last *[2]int
+	for _, r := range regs[1:] {
+		last = &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeRegions(t *testing.T) {
+	tests := []struct {
+		name string
+		regs [][2]int
+		want [][2]int
+	}{
+		{"single", [][2]int{{1, 5}}, [][2]int{{1, 5}}},
+		{"disjoint", [][2]int{{10, 20}, {1, 5}}, [][2]int{{1, 5}, {10, 20}}},
+		{"overlapping", [][2]int{{1, 5}, {3, 8}}, [][2]int{{1, 8}}},
+		{"adjacent", [][2]int{{1, 5}, {5, 8}}, [][2]int{{1, 8}}},
+		{"contained", [][2]int{{1, 10}, {2, 3}, {4, 6}}, [][2]int{{1, 10}}},
+		{"chained", [][2]int{{7, 9}, {1, 4}, {3, 7}, {20, 30}}, [][2]int{{1, 9}, {20, 30}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeRegions(test.regs); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadBedRegions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string][][2]int
+		wantErr bool
+	}{
+		{
+			name: "regions",
+			data: "track name=test\nbrowser position chr1\n# comment\n" +
+				"chr1\t10\t20\tname\t0\t+\nchr2\t0\t5\nchr1\t15\t30\nchr1\t50\t60\n\n",
+			want: map[string][][2]int{
+				"chr1": {{10, 30}, {50, 60}},
+				"chr2": {{0, 5}},
+			},
+		},
+		{
+			name: "empty regions",
+			data: "chr1\t5\t5\nchr2\t1\t3\n",
+			want: map[string][][2]int{
+				"chr2": {{1, 3}},
+			},
+		},
+		{name: "too few columns", data: "chr1\t10\n", wantErr: true},
+		{name: "invalid start", data: "chr1\tx\t20\n", wantErr: true},
+		{name: "negative start", data: "chr1\t-1\t20\n", wantErr: true},
+		{name: "end before start", data: "chr1\t20\t10\n", wantErr: true},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, test.name+".bed")
+			if err := os.WriteFile(file, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadBedRegions(file)
+			if test.wantErr {
+				if err == nil {
+					t.Error("error expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -22,23 +22,607 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
 )
 
 const extDataFile = ".unik"
 
-func checkCompatibility(reader0 *unik.Reader, reader *unik.Reader, file string) {
+// headerDiff is a difference of a header field between two binary files.
+type headerDiff struct {
+	field  string
+	value0 interface{} // value of the reference file
+	value  interface{}
+	fatal  bool // whether the two files can not be used together
+}
+
+func (d headerDiff) String() string {
+	return fmt.Sprintf("%s: %v != %v", d.field, d.value0, d.value)
+}
+
+// compareHeaders returns differences of header fields of two binary files,
+// including k, canonical, hashed, scaled, scale, and taxid-bytes.
+// Differences of scales are not fatal if autoRescale is true,
+// i.e., k-mers are down-sampled to the coarsest scale on reading.
+func compareHeaders(reader0 *unik.Reader, reader *unik.Reader, autoRescale bool) []headerDiff {
+	diffs := make([]headerDiff, 0, 2)
 	if reader0.K != reader.K {
-		checkError(fmt.Errorf(`k-mer length not consistent (%d != %d), please check with "unikmer stats": %s`, reader0.K, reader.K, file))
+		diffs = append(diffs, headerDiff{"k", reader0.K, reader.K, true})
 	}
 	if reader0.IsCanonical() != reader.IsCanonical() {
-		checkError(fmt.Errorf(`'canonical' flags not consistent, please check with "unikmer stats": %s`, file))
+		diffs = append(diffs, headerDiff{"canonical", reader0.IsCanonical(), reader.IsCanonical(), true})
 	}
 	if reader0.IsHashed() != reader.IsHashed() {
-		checkError(fmt.Errorf(`'hashed' flags not consistent, please check with "unikmer stats": %s`, file))
+		diffs = append(diffs, headerDiff{"hashed", reader0.IsHashed(), reader.IsHashed(), true})
 	}
 	if reader0.IsScaled() != reader.IsScaled() {
-		checkError(fmt.Errorf(`'scaled' flags not consistent, please check with "unikmer stats": %s`, file))
+		diffs = append(diffs, headerDiff{"scaled", reader0.IsScaled(), reader.IsScaled(), !autoRescale})
+	} else if reader0.IsScaled() && reader0.GetScale() != reader.GetScale() {
+		diffs = append(diffs, headerDiff{"scale", reader0.GetScale(), reader.GetScale(), !autoRescale})
+	}
+	if reader0.HasTaxidInfo() && reader.HasTaxidInfo() &&
+		reader0.GetTaxidBytesLength() != reader.GetTaxidBytesLength() {
+		// taxids are re-encoded when writing, so it does not matter.
+		diffs = append(diffs, headerDiff{"taxid-bytes", reader0.GetTaxidBytesLength(), reader.GetTaxidBytesLength(), false})
+	}
+	return diffs
+}
+
+// fatalHeaderDiffs returns the fatal ones of header differences, joined with "; ".
+func fatalHeaderDiffs(diffs []headerDiff) string {
+	var s string
+	for _, d := range diffs {
+		if !d.fatal {
+			continue
+		}
+		if s != "" {
+			s += "; "
+		}
+		s += d.String()
+	}
+	return s
+}
+
+func checkCompatibility(reader0 *unik.Reader, reader *unik.Reader, file string) {
+	checkCompatibilityRescaled(reader0, reader, file, nil)
+}
+
+// checkCompatibilityRescaled is the same as checkCompatibility, but differences
+// of scales are allowed if autoScaler, returned by getAutoRescaler, is not nil.
+func checkCompatibilityRescaled(reader0 *unik.Reader, reader *unik.Reader, file string, autoScaler *writeScaler) {
+	if s := fatalHeaderDiffs(compareHeaders(reader0, reader, autoScaler != nil)); s != "" {
+		checkError(fmt.Errorf(`header not compatible with the first file (%s), please check with "unikmer compat": %s`, s, file))
+	}
+}
+
+// preflightCheck reads headers of all input files in parallel and compares
+// them with the first one, before any output file is created. All
+// incompatible files are reported, instead of failing on the first one deep
+// in the processing. Stdin and members of tar archives are skipped, as
+// reading them ahead consumes the data; they are still checked later.
+// It can be disabled by the global flag --skip-flag-check.
+// Differences of scales are allowed if autoRescale is true.
+func preflightCheck(opt *Options, files []string, autoRescale bool) {
+	if opt.SkipFlagCheck || len(files) < 2 {
+		return
+	}
+
+	readers := make([]*unik.Reader, len(files))
+	errs := make([]error, len(files))
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, opt.NumCPUs)
+	for i, file := range files {
+		if isStdin(file) {
+			continue
+		}
+		if _, ok := tarMembers[file]; ok {
+			continue
+		}
+
+		wg.Add(1)
+		tokens <- 1
+		go func(i int, file string) {
+			defer func() {
+				wg.Done()
+				<-tokens
+			}()
+
+			infh, r, _, err := inStream(file)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer closeInStream(r)
+
+			readers[i], errs[i] = unik.NewReader(infh)
+		}(i, file)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			checkError(errors.Wrap(err, files[i]))
+		}
+	}
+
+	var reader0 *unik.Reader
+	var file0 string
+	var s string
+	var n, nChecked int
+	for i, reader := range readers {
+		if reader == nil {
+			continue
+		}
+		nChecked++
+		if reader0 == nil {
+			reader0, file0 = reader, files[i]
+			continue
+		}
+		if s = fatalHeaderDiffs(compareHeaders(reader0, reader, autoRescale)); s != "" {
+			log.Errorf("incompatible with %s: %s: %s", file0, files[i], s)
+			n++
+		}
+	}
+	if n > 0 {
+		checkError(fmt.Errorf(`%d of %d files are not compatible with the first file, please check with "unikmer compat"`, n, nChecked))
+	}
+}
+
+// helpSkipErr is the usage of the flag -e/--skip-err.
+const helpSkipErr = "skip unreadable (e.g., corrupt or truncated) files and files not compatible with the first readable one, " +
+	"with warning messages. All files are fully read in advance for checking"
+
+// skipErrFiles fully reads all input files in parallel, and returns the files
+// which can be read without errors and are compatible with the first readable
+// one, so that a few corrupt files do not abort a big batch job in the middle.
+// Stdin and members of tar archives are kept without checking, as reading them
+// ahead consumes the data. Names of skipped files are written to listFile if given.
+// If firstRequired is true, errors of the first file are fatal.
+// Differences of scales are allowed if autoRescale is true.
+func skipErrFiles(opt *Options, files []string, firstRequired bool, listFile string, autoRescale bool) []string {
+	readers := make([]*unik.Reader, len(files))
+	errs := make([]error, len(files))
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, opt.NumCPUs)
+	for i, file := range files {
+		if isStdin(file) {
+			continue
+		}
+		if _, ok := tarMembers[file]; ok {
+			continue
+		}
+
+		wg.Add(1)
+		tokens <- 1
+		go func(i int, file string) {
+			defer func() {
+				wg.Done()
+				<-tokens
+			}()
+
+			infh, r, _, err := inStream(file)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for {
+				_, _, err = reader.ReadCodeWithTaxid()
+				if err != nil {
+					if err != io.EOF {
+						errs[i] = err
+					}
+					break
+				}
+			}
+			readers[i] = reader
+		}(i, file)
+	}
+	wg.Wait()
+
+	files2 := make([]string, 0, len(files))
+	skipped := make([]string, 0, 8)
+	var reader0 *unik.Reader
+	var file0 string
+	var s string
+	for i, file := range files {
+		if errs[i] == nil && readers[i] != nil && !opt.SkipFlagCheck {
+			if reader0 == nil {
+				reader0, file0 = readers[i], file
+			} else if s = fatalHeaderDiffs(compareHeaders(reader0, readers[i], autoRescale)); s != "" {
+				errs[i] = fmt.Errorf("incompatible with %s: %s", file0, s)
+			}
+		}
+
+		if errs[i] != nil {
+			if i == 0 && firstRequired {
+				checkError(errors.Wrap(errs[i], file))
+			}
+			log.Warningf("skip file: %s: %s", file, errs[i])
+			skipped = append(skipped, file)
+			continue
+		}
+		files2 = append(files2, file)
+	}
+
+	if len(skipped) > 0 {
+		log.Warningf("%d of %d input files skipped for errors", len(skipped), len(files))
+	} else if opt.Verbose {
+		log.Infof("all %d input files passed the check", len(files))
+	}
+
+	if listFile != "" {
+		outfh, gw, w, err := outStream(listFile, strings.HasSuffix(strings.ToLower(listFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		for _, file := range skipped {
+			outfh.WriteString(file + "\n")
+		}
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}
+
+	if len(files2) == 0 {
+		checkError(fmt.Errorf("no valid input files"))
+	}
+	return files2
+}
+
+// readerMaxHash returns the max hash of a scaled binary file.
+// "unikmer count" only records the scale, so we compute it when absent.
+func readerMaxHash(reader *unik.Reader) uint64 {
+	if reader.MaxHash > 0 {
+		return reader.MaxHash
+	}
+	if reader.IsScaled() && reader.GetScale() > 1 {
+		return uint64(float64(^uint64(0)) / float64(reader.GetScale()))
+	}
+	return ^uint64(0)
+}
+
+const helpWriteScale = "down-sample hashed k-mers to a coarser scale on writing, i.e., hashes greater than " +
+	"the max uint64 / scale are dropped, 0 for keeping all"
+
+// writeScaler down-samples hashed k-mers to a coarser scale on writing
+// (-D/--scale), so there's no need to run "unikmer downsample" afterwards.
+// A nil writeScaler keeps all k-mers.
+type writeScaler struct {
+	scale   uint32
+	maxHash uint64
+}
+
+// getFlagWriteScale returns the value of flag -D/--scale.
+func getFlagWriteScale(cmd *cobra.Command) int {
+	scale := getFlagNonNegativeInt(cmd, "scale")
+	if scale > 1<<31-1 {
+		checkError(fmt.Errorf("value of flag -D/--scale is too big"))
+	}
+	return scale
+}
+
+// newWriteScaler returns nil for scale 0. The reader should be the first
+// input file, whose k-mers should be hashed with a scale not coarser than
+// the new one.
+func newWriteScaler(scale int, reader *unik.Reader, file string) *writeScaler {
+	if scale == 0 {
+		return nil
+	}
+	if !reader.IsHashed() {
+		checkError(fmt.Errorf("flag -D/--scale only works for hashed k-mers: %s", file))
+	}
+	maxHash := uint64(float64(^uint64(0)) / float64(scale))
+	if readerMaxHash(reader) < maxHash {
+		checkError(fmt.Errorf("the new scale (%d) should not be smaller than that of input (%d): %s", scale, reader.GetScale(), file))
+	}
+	return &writeScaler{scale: uint32(scale), maxHash: maxHash}
+}
+
+const helpAutoRescale = "when hashed input files have different scales, down-sample k-mers to the coarsest scale on reading, " +
+	"instead of failing. Stdin and members of tar archives are not supported"
+
+// getAutoRescaler reads headers of hashed files, and returns a writeScaler
+// of the coarsest scale if scales differ, or nil if they are the same.
+// Stdin and members of tar archives are not supported, as reading them ahead
+// consumes the data, while scales of all files must be known in advance.
+func getAutoRescaler(opt *Options, files []string) *writeScaler {
+	var scale0, scale uint32
+	var maxHash uint64 = ^uint64(0)
+	var differ bool
+	for _, file := range files {
+		if isStdin(file) {
+			checkError(fmt.Errorf("flag --auto-rescale does not support reading from stdin"))
+		}
+		if _, ok := tarMembers[file]; ok {
+			checkError(fmt.Errorf("flag --auto-rescale does not support members of tar archives: %s", file))
+		}
+
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(errors.Wrap(err, file))
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+			if !reader.IsHashed() {
+				return
+			}
+
+			s := uint32(1)
+			if reader.IsScaled() {
+				s = reader.GetScale()
+			}
+			if scale0 == 0 {
+				scale0 = s
+			} else if s != scale0 {
+				differ = true
+			}
+			if h := readerMaxHash(reader); h < maxHash {
+				maxHash = h
+				scale = s
+			}
+		}()
+	}
+	if !differ {
+		return nil
+	}
+
+	log.Warningf("scales of input files differ, k-mers are down-sampled to the coarsest scale (%d) on reading (--auto-rescale)", scale)
+	return &writeScaler{scale: scale, maxHash: maxHash}
+}
+
+// keep checks whether a code is kept in the new scale.
+func (s *writeScaler) keep(code uint64) bool {
+	return s == nil || code <= s.maxHash
+}
+
+// readCodeWithTaxid reads the next code and taxid kept in the new scale.
+func (s *writeScaler) readCodeWithTaxid(reader *unik.Reader) (uint64, uint32, error) {
+	for {
+		code, taxid, err := reader.ReadCodeWithTaxid()
+		if err != nil || s.keep(code) {
+			return code, taxid, err
+		}
+	}
+}
+
+// setHeader sets the scale and max hash of the output file.
+func (s *writeScaler) setHeader(writer *unik.Writer) {
+	if s == nil {
+		return
+	}
+	writer.SetScale(s.scale)
+	writer.SetMaxHash(s.maxHash)
+}
+
+const helpRequireSorted = "validate the order of k-mers in sorted input files while reading, " +
+	"and abort at the first k-mer out of order"
+
+// sortedChecker validates the order of k-mers of a sorted file while reading
+// (--require-sorted), as a wrong 'sorted' flag in the header leads to subtly
+// wrong results. A nil sortedChecker checks nothing.
+type sortedChecker struct {
+	file string
+	n    uint64 // number of k-mers checked
+	last uint64
+}
+
+// newSortedChecker returns nil if require is false.
+func newSortedChecker(require bool, file string) *sortedChecker {
+	if !require {
+		return nil
+	}
+	return &sortedChecker{file: file}
+}
+
+// check checks whether a code is not smaller than the previous one.
+func (c *sortedChecker) check(code uint64) {
+	if c == nil {
+		return
+	}
+	if c.n > 0 && code < c.last {
+		checkError(fmt.Errorf("k-mers not sorted, the k-mer at offset %d (0-based) is smaller than the previous one: %s", c.n, c.file))
+	}
+	c.last = code
+	c.n++
+}
+
+// codeSet is a sorted list of unique k-mers (hashes) for membership queries,
+// which uses much less memory than a map.
+type codeSet []uint64
+
+// has checks whether a code exists via binary search.
+func (s codeSet) has(code uint64) bool {
+	i, j := 0, len(s)
+	var h int
+	for i < j {
+		h = int(uint(i+j) >> 1)
+		if s[h] < code {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i < len(s) && s[i] == code
+}
+
+// intersectionSize returns the number of codes in both sets.
+func (s codeSet) intersectionSize(t codeSet) int {
+	var i, j, n int
+	for i < len(s) && j < len(t) {
+		if s[i] < t[j] {
+			i++
+		} else if s[i] > t[j] {
+			j++
+		} else {
+			n++
+			i++
+			j++
+		}
+	}
+	return n
+}
+
+// loadCodeSet reads k-mers (hashes) from binary files into a codeSet.
+// The files should have the same k-mer size and 'canonical/hashed' flags as given.
+func loadCodeSet(files []string, k int, canonical bool, hashed bool) (codeSet, error) {
+	codes := make([]uint64, 0, mapInitSize)
+	var needSort bool
+	for _, file := range files {
+		err := func() error {
+			infh, r, _, err := inStream(file)
+			if err != nil {
+				return err
+			}
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+			if reader.K != k {
+				return fmt.Errorf("k-mer size not consistent (%d != %d): %s", reader.K, k, file)
+			}
+			if reader.IsCanonical() != canonical {
+				return fmt.Errorf("'canonical' flag not consistent (%v != %v): %s", reader.IsCanonical(), canonical, file)
+			}
+			if reader.IsHashed() != hashed {
+				return fmt.Errorf("'hashed' flag not consistent (%v != %v): %s", reader.IsHashed(), hashed, file)
+			}
+			if !reader.IsSorted() || len(codes) > 0 {
+				needSort = true
+			}
+
+			var code uint64
+			for {
+				code, _, err = reader.ReadCodeWithTaxid()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					return fmt.Errorf("%s: %s", file, err)
+				}
+				codes = append(codes, code)
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !needSort {
+		return codeSet(codes), nil
+	}
+	return newCodeSet(codes), nil
+}
+
+// newCodeSet sorts codes and removes duplicates in place.
+func newCodeSet(codes []uint64) codeSet {
+	sortCodes(codes)
+	var i int
+	for j, code := range codes {
+		if j > 0 && code == codes[i] {
+			continue
+		}
+		if j > 0 {
+			i++
+		}
+		codes[i] = code
+	}
+	if len(codes) > 0 {
+		codes = codes[:i+1]
+	}
+	return codeSet(codes)
+}
+
+// sample removes codes dropped by the sampler in place.
+func (s codeSet) sample(sampler *recordSampler) codeSet {
+	if sampler == nil {
+		return s
+	}
+	var i int
+	for _, code := range s {
+		if sampler.keep(code) {
+			s[i] = code
+			i++
+		}
+	}
+	return s[:i]
+}
+
+// recordSampler keeps k-mers with a given probability (--sample-fraction).
+// Decisions are made by a seeded hash of the code instead of a shared random
+// number generator, so it's safe for concurrent use, reproducible,
+// and the same k-mer is kept or dropped consistently across files,
+// which keeps the results of set operations meaningful.
+type recordSampler struct {
+	seed      uint64
+	threshold uint64
+}
+
+// newRecordSampler returns nil for fraction >= 1, i.e., keeping all records.
+func newRecordSampler(fraction float64, seed int64) *recordSampler {
+	if fraction >= 1 {
+		return nil
+	}
+	return &recordSampler{
+		seed:      uint64(seed),
+		threshold: uint64(math.Ldexp(fraction, 64)),
+	}
+}
+
+// keep decides whether to keep a code. A nil sampler keeps all.
+func (s *recordSampler) keep(code uint64) bool {
+	if s == nil {
+		return true
+	}
+	return mixCode(code^s.seed) < s.threshold
+}
+
+// mixCode scrambles a code with the finalizer of splitmix64, which makes
+// k-mer codes uniformly distributed, e.g., for sketching them by value.
+func mixCode(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// unmixCode is the inverse function of mixCode.
+func unmixCode(x uint64) uint64 {
+	x ^= x>>31 ^ x>>62
+	x *= 0x319642b2d24d8ec3 // modular inverse of 0x94d049bb133111eb
+	x ^= x>>27 ^ x>>54
+	x *= 0x96de1b173f119089 // modular inverse of 0xbf58476d1ce4e5b9
+	x ^= x>>30 ^ x>>60
+	x -= 0x9e3779b97f4a7c15
+	return x
+}
+
+// readCodeWithTaxid reads the next code and taxid from a binary file,
+// skipping the ones dropped by the sampler.
+func readCodeWithTaxid(reader *unik.Reader, sampler *recordSampler) (uint64, uint32, error) {
+	for {
+		code, taxid, err := reader.ReadCodeWithTaxid()
+		if err != nil || sampler.keep(code) {
+			return code, taxid, err
+		}
 	}
 }
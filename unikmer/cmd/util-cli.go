@@ -39,6 +39,8 @@ var log = logging.MustGetLogger("unikmer")
 func checkError(err error) {
 	if err != nil {
 		log.Error(err)
+		cleanTmpDirs()
+		stopProfiling()
 		os.Exit(-1)
 	}
 }
@@ -189,6 +191,19 @@ func getFlagStringSlice(cmd *cobra.Command, flag string) []string {
 	return value
 }
 
+// getFlagNonEmptyStringSlice is similar to getFlagStringSlice,
+// but empty values, e.g., the default one, are removed.
+func getFlagNonEmptyStringSlice(cmd *cobra.Command, flag string) []string {
+	values := getFlagStringSlice(cmd, flag)
+	values2 := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			values2 = append(values2, value)
+		}
+	}
+	return values2
+}
+
 func getFileList(args []string, checkFile bool) []string {
 	files := make([]string, 0, 1000)
 	if len(args) == 0 {
@@ -252,13 +267,18 @@ func getFileListFromArgsAndFile(cmd *cobra.Command, args []string, checkFileFrom
 		checkError(err)
 		if len(_files) == 0 {
 			log.Warningf("no files found in file list: %s", infileList)
-			return files
+		} else if len(files) == 1 && isStdin(files[0]) {
+			files = _files
+		} else {
+			files = append(files, _files...)
 		}
+	}
 
-		if len(files) == 1 && isStdin(files[0]) {
-			return _files
-		}
-		files = append(files, _files...)
+	files, err := expandTarFiles(files)
+	checkError(err)
+	if !nonUnikInputCmds[cmd.Name()] {
+		files, err = expandMuxStdin(files)
+		checkError(err)
 	}
 	return files
 }
@@ -0,0 +1,410 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const helpFilterExpr = `expression for filtering records, e.g., 'taxid == 562 || gc < 0.6 && kmer =~ "^AC"'. ` +
+	`Fields: code, taxid, kmer (string), gc (GC content of the k-mer). ` +
+	`Operators: == != < <= > >= =~ !~ (regular expression) ! && || and parentheses`
+
+// exprRecord is a record for evaluating a filter expression.
+type exprRecord struct {
+	code  uint64
+	taxid uint32
+	kmer  []byte
+}
+
+// exprFilter is a compiled filter expression.
+type exprFilter struct {
+	expr   string
+	fn     func(*exprRecord) bool
+	fields map[string]bool // fields used
+}
+
+// uses checks if a field is used in the expression.
+func (f *exprFilter) uses(field string) bool {
+	return f.fields[field]
+}
+
+// pass evaluates the expression on a record.
+func (f *exprFilter) pass(rec *exprRecord) bool {
+	return f.fn(rec)
+}
+
+// exprNum is a number, integers are kept as uint64 to avoid losing
+// precision of codes or hashes.
+type exprNum struct {
+	isInt bool
+	u     uint64
+	f     float64
+}
+
+func (a exprNum) cmp(b exprNum) int {
+	if a.isInt && b.isInt {
+		if a.u < b.u {
+			return -1
+		} else if a.u > b.u {
+			return 1
+		}
+		return 0
+	}
+	if a.f < b.f {
+		return -1
+	} else if a.f > b.f {
+		return 1
+	}
+	return 0
+}
+
+const (
+	exprKindBool = iota
+	exprKindNum
+	exprKindStr
+)
+
+var exprKindNames = []string{"boolean", "number", "string"}
+
+// exprNode is a compiled node, only one of the functions is set according to the kind.
+type exprNode struct {
+	kind  int
+	b     func(*exprRecord) bool
+	n     func(*exprRecord) exprNum
+	s     func(*exprRecord) string
+	str   string // value of string literal, for compiling regular expressions
+	isLit bool
+}
+
+type exprToken struct {
+	typ string // "num", "str", "ident", "op", "(", ")", "eof"
+	val string
+	pos int
+}
+
+func tokenizeExpr(expr string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0, 16)
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, exprToken{string(c), string(c), i})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(expr) && expr[j] != c {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			val := expr[i+1 : j]
+			if c == '"' {
+				var err error
+				val, err = strconv.Unquote(expr[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at position %d: %s", i+1, expr[i:j+1])
+				}
+			}
+			tokens = append(tokens, exprToken{"str", val, i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' || c == '-':
+			j := i + 1
+			for j < len(expr) && (expr[j] >= '0' && expr[j] <= '9' || expr[j] == '.' ||
+				expr[j] == 'e' || expr[j] == 'E' || expr[j] == 'x' || expr[j] == 'X' ||
+				expr[j] >= 'a' && expr[j] <= 'f' || expr[j] >= 'A' && expr[j] <= 'F' ||
+				(expr[j] == '-' || expr[j] == '+') && (expr[j-1] == 'e' || expr[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, exprToken{"num", expr[i:j], i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || expr[j] >= 'a' && expr[j] <= 'z' ||
+				expr[j] >= 'A' && expr[j] <= 'Z' || expr[j] >= '0' && expr[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{"ident", expr[i:j], i})
+			i = j
+		default:
+			var op string
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!"} {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character at position %d: %c", i+1, c)
+			}
+			tokens = append(tokens, exprToken{"op", op, i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, exprToken{"eof", "", len(expr)})
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	i      int
+	fields map[string]bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.typ != "eof" {
+		p.i++
+	}
+	return t
+}
+
+// newExprFilter compiles a filter expression.
+func newExprFilter(expr string) (*exprFilter, error) {
+	tokens, err := tokenizeExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, fields: make(map[string]bool, 4)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != "eof" {
+		return nil, fmt.Errorf("unexpected token at position %d: %s", t.pos+1, t.val)
+	}
+	if node.kind != exprKindBool {
+		return nil, fmt.Errorf("the expression should be a boolean, but a %s given", exprKindNames[node.kind])
+	}
+	return &exprFilter{expr: expr, fn: node.b, fields: p.fields}, nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	a, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == "op" && p.peek().val == "||" {
+		t := p.next()
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if a.kind != exprKindBool || b.kind != exprKindBool {
+			return nil, fmt.Errorf("operands of '||' at position %d should be booleans", t.pos+1)
+		}
+		fa, fb := a.b, b.b
+		a = &exprNode{kind: exprKindBool, b: func(r *exprRecord) bool { return fa(r) || fb(r) }}
+	}
+	return a, nil
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	a, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == "op" && p.peek().val == "&&" {
+		t := p.next()
+		b, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if a.kind != exprKindBool || b.kind != exprKindBool {
+			return nil, fmt.Errorf("operands of '&&' at position %d should be booleans", t.pos+1)
+		}
+		fa, fb := a.b, b.b
+		a = &exprNode{kind: exprKindBool, b: func(r *exprRecord) bool { return fa(r) && fb(r) }}
+	}
+	return a, nil
+}
+
+func (p *exprParser) parseNot() (*exprNode, error) {
+	if t := p.peek(); t.typ == "op" && t.val == "!" {
+		p.next()
+		a, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if a.kind != exprKindBool {
+			return nil, fmt.Errorf("operand of '!' at position %d should be a boolean", t.pos+1)
+		}
+		fa := a.b
+		return &exprNode{kind: exprKindBool, b: func(r *exprRecord) bool { return !fa(r) }}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (*exprNode, error) {
+	a, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.typ != "op" {
+		return a, nil
+	}
+	switch t.val {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+	default:
+		return a, nil
+	}
+	p.next()
+	b, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.val == "=~" || t.val == "!~" {
+		if a.kind != exprKindStr || b.kind != exprKindStr || !b.isLit {
+			return nil, fmt.Errorf("operator '%s' at position %d needs a string and a string literal of regular expression", t.val, t.pos+1)
+		}
+		re, err := regexp.Compile(b.str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %s", t.pos+1, err)
+		}
+		fa := a.s
+		if t.val == "=~" {
+			return &exprNode{kind: exprKindBool, b: func(r *exprRecord) bool { return re.MatchString(fa(r)) }}, nil
+		}
+		return &exprNode{kind: exprKindBool, b: func(r *exprRecord) bool { return !re.MatchString(fa(r)) }}, nil
+	}
+
+	if a.kind != b.kind || a.kind == exprKindBool && t.val != "==" && t.val != "!=" {
+		return nil, fmt.Errorf("can not compare a %s with a %s via '%s' at position %d",
+			exprKindNames[a.kind], exprKindNames[b.kind], t.val, t.pos+1)
+	}
+
+	var cmp func(r *exprRecord) int
+	switch a.kind {
+	case exprKindNum:
+		fa, fb := a.n, b.n
+		cmp = func(r *exprRecord) int { return fa(r).cmp(fb(r)) }
+	case exprKindStr:
+		fa, fb := a.s, b.s
+		cmp = func(r *exprRecord) int { return strings.Compare(fa(r), fb(r)) }
+	default:
+		fa, fb := a.b, b.b
+		cmp = func(r *exprRecord) int {
+			if fa(r) == fb(r) {
+				return 0
+			}
+			return 1
+		}
+	}
+
+	var fn func(r *exprRecord) bool
+	switch t.val {
+	case "==":
+		fn = func(r *exprRecord) bool { return cmp(r) == 0 }
+	case "!=":
+		fn = func(r *exprRecord) bool { return cmp(r) != 0 }
+	case "<":
+		fn = func(r *exprRecord) bool { return cmp(r) < 0 }
+	case "<=":
+		fn = func(r *exprRecord) bool { return cmp(r) <= 0 }
+	case ">":
+		fn = func(r *exprRecord) bool { return cmp(r) > 0 }
+	case ">=":
+		fn = func(r *exprRecord) bool { return cmp(r) >= 0 }
+	}
+	return &exprNode{kind: exprKindBool, b: fn}, nil
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.next()
+	switch t.typ {
+	case "(":
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t2 := p.next(); t2.typ != ")" {
+			return nil, fmt.Errorf("missing ')' at position %d", t2.pos+1)
+		}
+		return a, nil
+	case "num":
+		var v exprNum
+		if u, err := strconv.ParseUint(t.val, 0, 64); err == nil {
+			v = exprNum{isInt: true, u: u, f: float64(u)}
+		} else if f, err := strconv.ParseFloat(t.val, 64); err == nil {
+			v = exprNum{f: f}
+		} else {
+			return nil, fmt.Errorf("invalid number at position %d: %s", t.pos+1, t.val)
+		}
+		return &exprNode{kind: exprKindNum, n: func(*exprRecord) exprNum { return v }}, nil
+	case "str":
+		v := t.val
+		return &exprNode{kind: exprKindStr, s: func(*exprRecord) string { return v }, str: v, isLit: true}, nil
+	case "ident":
+		switch t.val {
+		case "true", "false":
+			v := t.val == "true"
+			return &exprNode{kind: exprKindBool, b: func(*exprRecord) bool { return v }}, nil
+		case "code":
+			p.fields[t.val] = true
+			return &exprNode{kind: exprKindNum, n: func(r *exprRecord) exprNum {
+				return exprNum{isInt: true, u: r.code, f: float64(r.code)}
+			}}, nil
+		case "taxid":
+			p.fields[t.val] = true
+			return &exprNode{kind: exprKindNum, n: func(r *exprRecord) exprNum {
+				return exprNum{isInt: true, u: uint64(r.taxid), f: float64(r.taxid)}
+			}}, nil
+		case "kmer":
+			p.fields[t.val] = true
+			return &exprNode{kind: exprKindStr, s: func(r *exprRecord) string { return string(r.kmer) }}, nil
+		case "gc":
+			p.fields[t.val] = true
+			return &exprNode{kind: exprKindNum, n: func(r *exprRecord) exprNum {
+				var n int
+				for _, b := range r.kmer {
+					switch b {
+					case 'G', 'C', 'g', 'c':
+						n++
+					}
+				}
+				if len(r.kmer) == 0 {
+					return exprNum{}
+				}
+				return exprNum{f: float64(n) / float64(len(r.kmer))}
+			}}, nil
+		}
+		return nil, fmt.Errorf("unknown field at position %d: %s, available: code, taxid, kmer, gc", t.pos+1, t.val)
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected token at position %d: %s", t.pos+1, t.val)
+}
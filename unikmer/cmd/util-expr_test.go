@@ -0,0 +1,97 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import "testing"
+
+func TestExprFilter(t *testing.T) {
+	rec := &exprRecord{code: 18446744073709551615, taxid: 562, kmer: []byte("ACGTA")}
+
+	tests := []struct {
+		expr   string
+		want   bool
+		fields []string
+	}{
+		{"taxid == 562", true, []string{"taxid"}},
+		{"taxid != 562", false, []string{"taxid"}},
+		{"taxid > 561 && taxid <= 562", true, []string{"taxid"}},
+		{"taxid >= 563 || taxid < 1", false, []string{"taxid"}},
+		{"code == 18446744073709551615", true, []string{"code"}},
+		{"code > 18446744073709551614", true, []string{"code"}},
+		{"code == 0xffffffffffffffff", true, []string{"code"}},
+		{"gc == 0.4", true, []string{"gc"}},
+		{"gc < 0.5 && gc > 0.3", true, []string{"gc"}},
+		{`kmer == "ACGTA"`, true, []string{"kmer"}},
+		{`kmer =~ "^AC"`, true, []string{"kmer"}},
+		{`kmer !~ "^AC"`, false, []string{"kmer"}},
+		{`kmer =~ "TT"`, false, []string{"kmer"}},
+		{"!(taxid == 562)", false, []string{"taxid"}},
+		{"true", true, nil},
+		{"!false && true", true, nil},
+		{`taxid == 1 || gc < 0.6 && kmer =~ "^AC"`, true, []string{"taxid", "gc", "kmer"}},
+		{`(taxid == 1 || gc < 0.6) && kmer =~ "^T"`, false, []string{"taxid", "gc", "kmer"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			f, err := newExprFilter(test.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := f.pass(rec); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			for _, field := range test.fields {
+				if !f.uses(field) {
+					t.Errorf("field %s should be used", field)
+				}
+			}
+			if len(f.fields) != len(test.fields) {
+				t.Errorf("got %d fields, want %d", len(f.fields), len(test.fields))
+			}
+		})
+	}
+}
+
+func TestExprFilterErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"taxid",
+		"taxid ==",
+		"taxid == 562 &&",
+		"(taxid == 562",
+		"taxid == 562)",
+		"length > 3",
+		`kmer =~ "["`,
+		`taxid == "abc"`,
+		`kmer =~ taxid`,
+		"taxid == 1.2.3",
+		`kmer == "ACG`,
+	}
+
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := newExprFilter(expr); err == nil {
+				t.Errorf("error expected for: %q", expr)
+			}
+		})
+	}
+}
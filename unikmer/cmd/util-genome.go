@@ -0,0 +1,142 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
+	"github.com/shenwei356/unik/v5"
+)
+
+// preReadCanonicalFiles reads headers of binary files, which should be
+// canonical and compatible with each other, and returns the first one.
+func preReadCanonicalFiles(opt *Options, files []string) *unik.Reader {
+	var reader0 *unik.Reader
+	var nfiles = len(files)
+	for i, file := range files {
+		if opt.Verbose {
+			log.Infof("pre-reading file (%d/%d): %s", i+1, nfiles, file)
+		}
+		func() {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			defer closeInStream(r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if reader0 == nil {
+				reader0 = reader
+				if !reader.IsCanonical() {
+					checkError(fmt.Errorf("%s: 'canonical' flag is needed", file))
+				}
+			} else {
+				checkCompatibility(reader0, reader, file)
+			}
+		}()
+	}
+	return reader0
+}
+
+// genomeKmers iterates canonical k-mers (or their hashes) of sequences in
+// genome files, for commands reporting values along genomes.
+type genomeKmers struct {
+	files      []string
+	k          int
+	hashed     bool
+	maxHash    uint64 // k-mers with bigger hashes are skipped, e.g., for scaled files
+	reSeqNames []*regexp.Regexp
+}
+
+// filteredOut checks if a sequence is filtered out by its name.
+func (g *genomeKmers) filteredOut(record *fastx.Record) bool {
+	for _, re := range g.reSeqNames {
+		if re.Match(record.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fnSeq (if not nil) for every sequence not filtered out,
+// and fn for every k-mer of it, with its 0-based position.
+func (g *genomeKmers) each(fnSeq func(record *fastx.Record), fn func(code uint64, i int)) {
+	var fastxReader *fastx.Reader
+	var record *fastx.Record
+	var iter *sketches.Iterator
+	var code uint64
+	var ok bool
+	var err error
+	for _, file := range g.files {
+		fastxReader, err = fastx.NewDefaultReader(file)
+		checkError(errors.Wrap(err, file))
+
+		for {
+			record, err = fastxReader.Read()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				checkError(errors.Wrap(err, file))
+				break
+			}
+
+			if g.filteredOut(record) {
+				continue
+			}
+
+			if fnSeq != nil {
+				fnSeq(record)
+			}
+
+			if g.hashed {
+				iter, err = sketches.NewHashIterator(record.Seq, g.k, true, false)
+			} else {
+				iter, err = sketches.NewKmerIterator(record.Seq, g.k, true, false)
+			}
+			if err != nil {
+				if err == sketches.ErrShortSeq {
+					continue
+				}
+				checkError(errors.Wrapf(err, "seq: %s", record.Name))
+			}
+
+			for {
+				code, ok, err = iter.Next()
+				if !g.hashed && err != nil {
+					checkError(errors.Wrapf(err, "%s: %s", file, record.Name))
+				}
+				if !ok {
+					break
+				}
+				if code > g.maxHash {
+					continue
+				}
+				fn(code, iter.Index())
+			}
+		}
+	}
+}
@@ -27,6 +27,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	gzip "github.com/klauspost/pgzip"
 )
@@ -35,6 +38,12 @@ import (
 var BufferSize = 65536 //os.Getpagesize()
 
 func outStream(file string, gzipped bool, level int) (*bufio.Writer, io.WriteCloser, *os.File, error) {
+	return outStreamWithLimit(file, gzipped, level, nil)
+}
+
+// outStreamWithLimit is similar to outStream, with the writing speed
+// limited by a limiter, which could be nil for no limit.
+func outStreamWithLimit(file string, gzipped bool, level int, limiter *ioLimiter) (*bufio.Writer, io.WriteCloser, *os.File, error) {
 	var w *os.File
 	if file == "-" {
 		w = os.Stdout
@@ -52,50 +61,184 @@ func outStream(file string, gzipped bool, level int) (*bufio.Writer, io.WriteClo
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("fail to write %s: %s", file, err)
 		}
+		registerPartialOutput(file)
+	}
+
+	var w2 io.Writer = w
+	if limiter != nil {
+		w2 = &limitedWriter{w: w, limiter: limiter}
 	}
 
 	if gzipped {
 		// gw := gzip.NewWriter(w)
-		gw, err := gzip.NewWriterLevel(w, level)
+		gw, err := gzip.NewWriterLevel(w2, level)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("fail to write %s: %s", file, err)
 		}
 		return bufio.NewWriterSize(gw, BufferSize), gw, w, nil
 	}
-	return bufio.NewWriterSize(w, BufferSize), nil, w, nil
+	return bufio.NewWriterSize(w2, BufferSize), nil, w, nil
+}
+
+// ioLimiter limits the total speed of writing of multiple writers,
+// to keep shared filesystems responsive.
+type ioLimiter struct {
+	mu   sync.Mutex
+	rate float64 // bytes per second
+	next time.Time
+}
+
+func newIOLimiter(bytesPerSecond int) *ioLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &ioLimiter{rate: float64(bytesPerSecond)}
 }
 
+// wait blocks until n bytes are allowed to write.
+func (l *ioLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *ioLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.limiter.wait(len(p))
+	return w.w.Write(p)
+}
+
+// pooled buffered readers and gzip readers for input streams,
+// for reducing GC pressure when opening lots of files.
+var poolBufReader = &sync.Pool{New: func() interface{} {
+	return bufio.NewReaderSize(nil, BufferSize)
+}}
+
+var poolGzipReader = &sync.Pool{}
+
+// inStreamBuffers records pooled objects of an opened input stream.
+type inStreamBuffers struct {
+	br  *bufio.Reader // reader of the file
+	br2 *bufio.Reader // reader of the gzip reader
+	gr  *gzip.Reader
+}
+
+// size of data to prefetch for input files (--readahead), 0 for disabled
+var inStreamReadahead int64
+
+// opened input streams, *os.File -> *inStreamBuffers
+var openedInStreams sync.Map
+
+// inStream opens a file or stdin ("-"). The returned *os.File should be
+// closed with closeInStream, which recycles buffers for later use.
 func inStream(file string) (*bufio.Reader, *os.File, bool, error) {
 	var err error
 	var r *os.File
+	var src io.Reader // source of the buffered reader
 	var gzipped bool
 	if file == "-" {
 		if !detectStdin() {
 			return nil, nil, gzipped, errors.New("stdin not detected")
 		}
 		r = os.Stdin
+		if stdinReader != nil { // stdin has been peeked
+			src = stdinReader
+		}
+	} else if m, ok := muxMembers[file]; ok {
+		r, err = m.open()
+		if err != nil {
+			return nil, nil, gzipped, fmt.Errorf("fail to read %s: %s", file, err)
+		}
+	} else if m, ok := tarMembers[file]; ok {
+		r, err = openTarMember(m)
+		if err != nil {
+			return nil, nil, gzipped, fmt.Errorf("fail to read %s: %s", file, err)
+		}
 	} else {
 		r, err = os.Open(file)
 		if err != nil {
+			if errors.Is(err, syscall.EMFILE) {
+				return nil, nil, gzipped, fmt.Errorf("fail to read %s: %s. please increase the limit with 'ulimit -n', or decrease the value of -j/--threads (or -M/--max-open-files in 'unikmer sort/merge')", file, err)
+			}
 			return nil, nil, gzipped, fmt.Errorf("fail to read %s: %s", file, err)
 		}
+		adviseSequential(r)
+		src = newPrefetchReader(r, inStreamReadahead)
+	}
+	if src == nil {
+		src = r
 	}
 
-	br := bufio.NewReaderSize(r, BufferSize)
+	bufs := &inStreamBuffers{}
+
+	br := poolBufReader.Get().(*bufio.Reader)
+	br.Reset(src)
+	bufs.br = br
 
 	if gzipped, err = isGzip(br); err != nil {
+		recycleInStreamBuffers(bufs)
 		return nil, nil, gzipped, fmt.Errorf("fail to check is file (%s) gzipped: %s", file, err)
 	} else if gzipped {
-		// gr, err := gzip.NewReader(br)
-		gr, err := gzip.NewReaderN(br, 65536, 8)
+		var gr *gzip.Reader
+		if v := poolGzipReader.Get(); v != nil {
+			gr = v.(*gzip.Reader)
+			err = gr.Reset(br)
+		} else {
+			// gr, err := gzip.NewReader(br)
+			gr, err = gzip.NewReaderN(br, 65536, 8)
+		}
 		if err != nil {
+			recycleInStreamBuffers(bufs)
 			return nil, r, gzipped, fmt.Errorf("fail to create gzip reader for %s: %s", file, err)
 		}
-		br = bufio.NewReaderSize(gr, BufferSize)
+		bufs.gr = gr
+
+		br = poolBufReader.Get().(*bufio.Reader)
+		br.Reset(gr)
+		bufs.br2 = br
 	}
+
+	openedInStreams.Store(r, bufs)
 	return br, r, gzipped, nil
 }
 
+// closeInStream closes the file opened by inStream, and recycles the buffers.
+func closeInStream(r *os.File) error {
+	if v, ok := openedInStreams.LoadAndDelete(r); ok {
+		recycleInStreamBuffers(v.(*inStreamBuffers))
+	}
+	return r.Close()
+}
+
+func recycleInStreamBuffers(bufs *inStreamBuffers) {
+	if bufs.br2 != nil {
+		bufs.br2.Reset(nil)
+		poolBufReader.Put(bufs.br2)
+	}
+	if bufs.gr != nil {
+		if bufs.gr.Close() == nil {
+			poolGzipReader.Put(bufs.gr)
+		}
+	}
+	if bufs.br != nil {
+		bufs.br.Reset(nil)
+		poolBufReader.Put(bufs.br)
+	}
+}
+
 func isGzip(b *bufio.Reader) (bool, error) {
 	return checkBytes(b, []byte{0x1f, 0x8b})
 }
@@ -0,0 +1,349 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// A multiplexed stream carries several logical .unik files in one stream,
+// e.g., a pipe, so that outputs of commands like 'tsplit' can be passed
+// to downstream commands without temporary directories.
+//
+// Format:
+//
+//	magic   "UNIKMUX\x01"
+//	frames  [name length: uint16][name][payload length: uint32][payload]
+//
+// Frames of different files can be interleaved. A frame with an empty
+// payload closes the file of the name, and a frame with an empty name
+// ends the multiplexed stream. Integers are in big endian.
+var muxMagic = []byte("UNIKMUX\x01")
+
+// maximum size of the payload of a frame
+var muxMaxPayload = 1 << 20
+
+// muxWriter writes a multiplexed stream, it's safe for concurrent use.
+type muxWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf [6]byte
+	err error
+}
+
+func newMuxWriter(w io.Writer) (*muxWriter, error) {
+	if _, err := w.Write(muxMagic); err != nil {
+		return nil, err
+	}
+	return &muxWriter{w: w}, nil
+}
+
+func (m *muxWriter) writeFrame(name string, payload []byte) error {
+	if len(name) > 65535 {
+		return fmt.Errorf("name too long in multiplexed stream: %s", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	binary.BigEndian.PutUint16(m.buf[:2], uint16(len(name)))
+	if _, m.err = m.w.Write(m.buf[:2]); m.err != nil {
+		return m.err
+	}
+	if _, m.err = io.WriteString(m.w, name); m.err != nil {
+		return m.err
+	}
+	if name == "" {
+		return nil
+	}
+	binary.BigEndian.PutUint32(m.buf[2:6], uint32(len(payload)))
+	if _, m.err = m.w.Write(m.buf[2:6]); m.err != nil {
+		return m.err
+	}
+	_, m.err = m.w.Write(payload)
+	return m.err
+}
+
+// Close ends the multiplexed stream, the underlying writer is not closed.
+func (m *muxWriter) Close() error {
+	return m.writeFrame("", nil)
+}
+
+// muxStream is a logical file in a multiplexed stream.
+type muxStream struct {
+	m    *muxWriter
+	name string
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	var n, end int
+	for n < len(p) {
+		end = n + muxMaxPayload
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.m.writeFrame(s.name, p[n:end]); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// Close closes the logical file.
+func (s *muxStream) Close() error {
+	return s.m.writeFrame(s.name, nil)
+}
+
+// muxOutStream is similar to outStream, but writes to a logical file
+// in a multiplexed stream.
+func muxOutStream(m *muxWriter, name string, gzipped bool, level int) (*bufio.Writer, io.WriteCloser, *muxStream, error) {
+	w := &muxStream{m: m, name: name}
+
+	if gzipped {
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("fail to write %s: %s", name, err)
+		}
+		return bufio.NewWriterSize(gw, BufferSize), gw, w, nil
+	}
+	return bufio.NewWriterSize(w, BufferSize), nil, w, nil
+}
+
+// virtual path ("-/<name>") -> logical files in a multiplexed stream from stdin.
+// It's only written when expanding file list in the main goroutine.
+var muxMembers = make(map[string]*muxMember)
+
+// muxMemLimit is the maximum total size of data of logical files kept in
+// memory when reading a multiplexed stream, data of files beyond it are
+// written to temporary files.
+var muxMemLimit = 64 << 20
+
+// muxMember is a logical file of a multiplexed stream, whose data are kept
+// in memory or in a temporary file. It can be opened more than once.
+type muxMember struct {
+	buf  *bytes.Buffer
+	fh   *os.File // temporary file, closed after reading the stream
+	file string
+}
+
+// write appends data of a frame, and moves the data to a temporary file
+// if the total size of data in memory exceeds muxMemLimit.
+func (m *muxMember) write(r io.Reader, size int64, mem *int) error {
+	if m.fh == nil && *mem+int(size) > muxMemLimit {
+		fh, err := createSpoolFile()
+		if err != nil {
+			return err
+		}
+		if _, err = fh.Write(m.buf.Bytes()); err != nil {
+			fh.Close()
+			return err
+		}
+		*mem -= m.buf.Len()
+		m.buf = nil
+		m.fh, m.file = fh, fh.Name()
+	}
+
+	if m.fh != nil {
+		_, err := io.CopyN(m.fh, r, size)
+		return err
+	}
+	*mem += int(size)
+	_, err := io.CopyN(m.buf, r, size)
+	return err
+}
+
+func (m *muxMember) closeWriting() error {
+	if m.fh == nil {
+		return nil
+	}
+	err := m.fh.Close()
+	m.fh = nil
+	return err
+}
+
+// open returns a file of the data.
+func (m *muxMember) open() (*os.File, error) {
+	if m.file != "" {
+		return os.Open(m.file)
+	}
+	return openBytes(m.buf.Bytes())
+}
+
+// commands whose inputs are not .unik files, stdin of them is not checked
+// for multiplexed streams, as it's read by other readers.
+var nonUnikInputCmds = map[string]bool{
+	"count":  true,
+	"dump":   true,
+	"encode": true,
+	"decode": true,
+	"rarefy": true,
+}
+
+// buffered reader of stdin, which is created when checking if stdin is
+// a multiplexed stream, and should be used for reading stdin later.
+var stdinReader *bufio.Reader
+
+// readMux reads all logical files of a multiplexed stream, with names in
+// order of appearance. Data of small files are kept in memory, and the others
+// are written to temporary files, see muxMemLimit.
+func readMux(r io.Reader) ([]string, map[string]*muxMember, error) {
+	buf := make([]byte, len(muxMagic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(buf, muxMagic) {
+		return nil, nil, errors.New("invalid multiplexed stream")
+	}
+
+	names := make([]string, 0, 8)
+	data := make(map[string]*muxMember, 8)
+	closed := make(map[string]bool, 8)
+	defer func() {
+		for _, m := range data {
+			m.closeWriting()
+		}
+	}()
+
+	var name string
+	var size uint32
+	var m *muxMember
+	var mem int
+	var ok bool
+	var err error
+	for {
+		if _, err = io.ReadFull(r, buf[:2]); err != nil {
+			return nil, nil, fmt.Errorf("truncated multiplexed stream: %s", err)
+		}
+		nameBuf := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+		if len(nameBuf) == 0 {
+			break
+		}
+		if _, err = io.ReadFull(r, nameBuf); err != nil {
+			return nil, nil, fmt.Errorf("truncated multiplexed stream: %s", err)
+		}
+		name = string(nameBuf)
+
+		if _, err = io.ReadFull(r, buf[:4]); err != nil {
+			return nil, nil, fmt.Errorf("truncated multiplexed stream: %s", err)
+		}
+		size = binary.BigEndian.Uint32(buf[:4])
+
+		if closed[name] {
+			return nil, nil, fmt.Errorf("data of a closed file found in multiplexed stream: %s", name)
+		}
+		if m, ok = data[name]; !ok {
+			m = &muxMember{buf: new(bytes.Buffer)}
+			data[name] = m
+			names = append(names, name)
+		}
+		if size == 0 {
+			closed[name] = true
+			if err = m.closeWriting(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err = m.write(r, int64(size), &mem); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil, fmt.Errorf("truncated multiplexed stream: %s", err)
+			}
+			return nil, nil, err
+		}
+	}
+
+	for _, name = range names {
+		if !closed[name] {
+			return nil, nil, fmt.Errorf("incomplete file in multiplexed stream: %s", name)
+		}
+	}
+	return names, data, nil
+}
+
+// expandMuxStdin replaces stdin in the file list with virtual paths
+// ("-/<name>") of logical files, if stdin is a multiplexed stream.
+func expandMuxStdin(files []string) ([]string, error) {
+	i := -1
+	for j, file := range files {
+		if isStdin(file) {
+			i = j
+			break
+		}
+	}
+	if i < 0 || stdinReader != nil || !detectStdin() {
+		return files, nil
+	}
+
+	stdinReader = bufio.NewReaderSize(os.Stdin, BufferSize)
+	if ok, _ := checkBytes(stdinReader, muxMagic); !ok {
+		return files, nil
+	}
+
+	names, data, err := readMux(stdinReader)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read stdin: %s", err)
+	}
+	if len(names) == 0 {
+		log.Warningf("no files found in multiplexed stream from stdin")
+	}
+
+	files2 := make([]string, 0, len(files)+len(names))
+	files2 = append(files2, files[:i]...)
+	var vfile string
+	for _, name := range names {
+		vfile = "-/" + name
+		muxMembers[vfile] = data[name]
+		files2 = append(files2, vfile)
+	}
+	for _, file := range files[i+1:] {
+		if !isStdin(file) {
+			files2 = append(files2, file)
+		}
+	}
+	return files2, nil
+}
+
+// openBytes returns a pipe streaming the data.
+func openBytes(data []byte) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		// error is ignored, as the reader might be closed before reaching EOF
+		io.Copy(pw, bytes.NewReader(data))
+		pw.Close()
+	}()
+	return pr, nil
+}
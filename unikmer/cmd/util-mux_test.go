@@ -0,0 +1,192 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testMuxStream returns a multiplexed stream of files. Frames of files are
+// interleaved if interleave is true, otherwise files are written one by one.
+func testMuxStream(t *testing.T, names []string, files map[string][]byte, interleave bool) []byte {
+	muxMaxPayload0 := muxMaxPayload
+	muxMaxPayload = 8
+	defer func() { muxMaxPayload = muxMaxPayload0 }()
+
+	var buf bytes.Buffer
+	m, err := newMuxWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := make([]*muxStream, len(names))
+	for i, name := range names {
+		streams[i] = &muxStream{m: m, name: name}
+	}
+
+	if interleave {
+		var end int
+		for pos, more := 0, true; more; pos += muxMaxPayload {
+			more = false
+			for i, name := range names {
+				data := files[name]
+				if pos >= len(data) {
+					continue
+				}
+				if end = pos + muxMaxPayload; end > len(data) {
+					end = len(data)
+				}
+				if _, err = streams[i].Write(data[pos:end]); err != nil {
+					t.Fatal(err)
+				}
+				more = true
+			}
+		}
+		for _, s := range streams {
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	} else {
+		for i, name := range names {
+			if _, err = streams[i].Write(files[name]); err != nil {
+				t.Fatal(err)
+			}
+			if err = streams[i].Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadMux(t *testing.T) {
+	names := []string{"a.unik", "b.unik", "c.unik"}
+	files := map[string][]byte{
+		"a.unik": testData(100, 1),
+		"b.unik": testData(30, 2),
+		"c.unik": {},
+	}
+
+	tests := []struct {
+		name       string
+		memLimit   int
+		interleave bool
+		spilled    map[string]bool // files written to temporary files
+	}{
+		{"in memory", 1 << 20, false, map[string]bool{}},
+		{"interleaved in memory", 1 << 20, true, map[string]bool{}},
+		// a.unik exceeds the limit and is moved to a temporary file,
+		// which releases the memory for b.unik.
+		{"partly in temporary files", 50, false, map[string]bool{"a.unik": true}},
+		{"in temporary files", 0, true, map[string]bool{"a.unik": true, "b.unik": true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSpoolDir(t, spoolMemSize)
+			muxMemLimit0 := muxMemLimit
+			muxMemLimit = test.memLimit
+			defer func() { muxMemLimit = muxMemLimit0 }()
+
+			stream := testMuxStream(t, names, files, test.interleave)
+			gotNames, data, err := readMux(bytes.NewReader(stream))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(gotNames) != len(names) {
+				t.Fatalf("got names %v, want %v", gotNames, names)
+			}
+			for i, name := range names {
+				if gotNames[i] != name {
+					t.Fatalf("got names %v, want %v", gotNames, names)
+				}
+				m := data[name]
+				if spilled := m.file != ""; spilled != test.spilled[name] {
+					t.Errorf("%s: written to temporary file: %v, want %v", name, spilled, test.spilled[name])
+				}
+
+				// logical files can be opened more than once.
+				for j := 0; j < 2; j++ {
+					fh, err := m.open()
+					if err != nil {
+						t.Fatalf("%s: open: %s", name, err)
+					}
+					got, err := io.ReadAll(fh)
+					fh.Close()
+					if err != nil {
+						t.Fatalf("%s: read: %s", name, err)
+					}
+					if !bytes.Equal(got, files[name]) {
+						t.Errorf("%s: data mismatch: got %d bytes, want %d bytes", name, len(got), len(files[name]))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadMuxErrors(t *testing.T) {
+	frame := func(name string, payload []byte) []byte {
+		buf := make([]byte, 2, 6+len(name)+len(payload))
+		binary.BigEndian.PutUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+		buf = append(buf, size[:]...)
+		return append(buf, payload...)
+	}
+	stream := func(frames ...[]byte) []byte {
+		buf := append([]byte{}, muxMagic...)
+		for _, f := range frames {
+			buf = append(buf, f...)
+		}
+		return buf
+	}
+	end := []byte{0, 0}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"invalid magic", []byte("UNIKMUX\x02\x00\x00")},
+		{"no end", stream(frame("a", []byte("xyz")), frame("a", nil))},
+		{"truncated payload", stream(frame("a", []byte("xyz")))[:len(muxMagic)+8]},
+		{"incomplete file", stream(frame("a", []byte("xyz")), end)},
+		{"data after closing", stream(frame("a", []byte("xyz")), frame("a", nil), frame("a", []byte("w")), end)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSpoolDir(t, spoolMemSize)
+			if _, _, err := readMux(bytes.NewReader(test.data)); err == nil {
+				t.Error("error expected")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var profileCPUFile, profileTraceFile *os.File
+var profileMemFile string
+var profileStopOnce sync.Once
+
+// startProfiling starts CPU profiling and tracing if the global flags
+// --cpu-profile and --trace are given.
+func startProfiling(cmd *cobra.Command) {
+	var err error
+
+	if file := getFlagString(cmd, "cpu-profile"); file != "" {
+		profileCPUFile, err = os.Create(file)
+		checkError(errors.Wrap(err, "create CPU profile"))
+		checkError(errors.Wrap(pprof.StartCPUProfile(profileCPUFile), "start CPU profile"))
+	}
+
+	if file := getFlagString(cmd, "trace"); file != "" {
+		profileTraceFile, err = os.Create(file)
+		checkError(errors.Wrap(err, "create trace file"))
+		checkError(errors.Wrap(trace.Start(profileTraceFile), "start trace"))
+	}
+
+	profileMemFile = getFlagString(cmd, "mem-profile")
+}
+
+// stopProfiling stops CPU profiling and tracing, and writes the heap profile.
+// It's also called before exiting on errors, so it does not call checkError.
+func stopProfiling() {
+	profileStopOnce.Do(func() {
+		if profileCPUFile != nil {
+			pprof.StopCPUProfile()
+			profileCPUFile.Close()
+		}
+
+		if profileTraceFile != nil {
+			trace.Stop()
+			profileTraceFile.Close()
+		}
+
+		if profileMemFile != "" {
+			fh, err := os.Create(profileMemFile)
+			if err != nil {
+				log.Errorf("create memory profile: %s", err)
+				return
+			}
+			defer fh.Close()
+
+			runtime.GC()
+			if err = pprof.WriteHeapProfile(fh); err != nil {
+				log.Errorf("write memory profile: %s", err)
+			}
+		}
+	})
+}
+
+// reportPeakMemory reports the peak resident set size (RSS) of the process.
+func reportPeakMemory() {
+	if rss, ok := peakRSS(); ok {
+		log.Infof("peak memory usage (RSS): %s", humanize.IBytes(rss))
+		return
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	log.Infof("peak memory usage (RSS) not available, memory obtained from OS: %s", humanize.IBytes(m.Sys))
+}
@@ -0,0 +1,69 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel the file would be read sequentially,
+// which doubles the default readahead window. Errors are ignored, as it's
+// only a hint.
+func adviseSequential(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// prefetchReader asks the kernel to load the following data of a file
+// into page cache in background (FADV_WILLNEED) when reading, which
+// keeps the disk (or network filesystem) busy while we are decoding.
+type prefetchReader struct {
+	f    *os.File
+	fd   int
+	size int64 // size of data to prefetch
+
+	pos  int64 // current position
+	next int64 // position to prefetch again
+}
+
+// newPrefetchReader returns a reader prefetching size bytes ahead,
+// the file itself is returned for size <= 0.
+func newPrefetchReader(f *os.File, size int64) io.Reader {
+	if size <= 0 {
+		return f
+	}
+	return &prefetchReader{f: f, fd: int(f.Fd()), size: size}
+}
+
+func (r *prefetchReader) Read(p []byte) (int, error) {
+	if r.pos >= r.next {
+		unix.Fadvise(r.fd, r.pos, r.size, unix.FADV_WILLNEED)
+		r.next = r.pos + r.size>>1 // before the prefetched data is used up
+	}
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,293 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/breader"
+)
+
+// scaffoldPart is a piece of a contig placed on a scaffold.
+type scaffoldPart struct {
+	scaffold  string
+	start     int // 0-based start position on the scaffold
+	compStart int // 0-based start position on the contig
+	length    int
+	reverse   bool
+	gapAfter  int // gap length after it, only for contig-order files
+}
+
+// scaffoldLayout describes how contigs are placed on scaffolds,
+// read from an AGP file or a contig-order file.
+type scaffoldLayout struct {
+	parts  map[string][]*scaffoldPart // contig -> parts
+	gaps   map[string][][2]int        // scaffold -> gaps, 0-based, left-closed and right-open
+	orders map[string][]*scaffoldPart // scaffold -> parts, only for contig-order files
+	order  []string                   // scaffolds in the contig-order file
+}
+
+// loadScaffoldLayout reads an AGP (v2.0) file, or a contig-order file with
+// 2-4 tab-delimited columns: scaffold, contig, orientation (+/-, default +),
+// and the length of the gap after the contig (default 100).
+// For contig-order files, positions of contigs are computed with
+// resolve() after knowing the contig lengths.
+func loadScaffoldLayout(file string) (*scaffoldLayout, error) {
+	brdr, err := breader.NewDefaultBufferedReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	l := &scaffoldLayout{
+		parts:  make(map[string][]*scaffoldPart, 1024),
+		gaps:   make(map[string][][2]int, 8),
+		orders: make(map[string][]*scaffoldPart, 8),
+	}
+
+	var line string
+	var items []string
+	var start, end, cStart, cEnd, gap int
+	var data interface{}
+	var isAGP, isOrder bool
+	var p *scaffoldPart
+	for chunk := range brdr.Ch {
+		if chunk.Err != nil {
+			return nil, errors.Wrap(chunk.Err, file)
+		}
+		for _, data = range chunk.Data {
+			line = strings.TrimRight(data.(string), "\r\n")
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			items = strings.Split(line, "\t")
+
+			if len(items) >= 8 { // AGP
+				if isOrder {
+					return nil, fmt.Errorf("%s: mixed AGP and contig-order lines: %s", file, line)
+				}
+				isAGP = true
+
+				start, err = strconv.Atoi(items[1])
+				if err != nil || start < 1 {
+					return nil, fmt.Errorf("%s: invalid object_beg: %s", file, line)
+				}
+				end, err = strconv.Atoi(items[2])
+				if err != nil || end < start {
+					return nil, fmt.Errorf("%s: invalid object_end: %s", file, line)
+				}
+
+				switch items[4] {
+				case "N", "U": // gaps
+					l.gaps[items[0]] = append(l.gaps[items[0]], [2]int{start - 1, end})
+					continue
+				}
+
+				if len(items) < 9 {
+					return nil, fmt.Errorf("%s: 9 columns needed for components: %s", file, line)
+				}
+				cStart, err = strconv.Atoi(items[6])
+				if err != nil || cStart < 1 {
+					return nil, fmt.Errorf("%s: invalid component_beg: %s", file, line)
+				}
+				cEnd, err = strconv.Atoi(items[7])
+				if err != nil || cEnd < cStart || cEnd-cStart != end-start {
+					return nil, fmt.Errorf("%s: invalid component_end: %s", file, line)
+				}
+				l.parts[items[5]] = append(l.parts[items[5]], &scaffoldPart{
+					scaffold:  items[0],
+					start:     start - 1,
+					compStart: cStart - 1,
+					length:    cEnd - cStart + 1,
+					reverse:   items[8] == "-",
+				})
+				continue
+			}
+
+			// contig-order file
+			if isAGP {
+				return nil, fmt.Errorf("%s: mixed AGP and contig-order lines: %s", file, line)
+			}
+			isOrder = true
+			if len(items) < 2 {
+				return nil, fmt.Errorf("%s: at least two columns needed: %s", file, line)
+			}
+			gap = 100
+			if len(items) >= 4 {
+				gap, err = strconv.Atoi(items[3])
+				if err != nil || gap < 0 {
+					return nil, fmt.Errorf("%s: invalid gap length: %s", file, line)
+				}
+			}
+			p = &scaffoldPart{
+				scaffold: items[0],
+				reverse:  len(items) >= 3 && items[2] == "-",
+				gapAfter: gap,
+			}
+			if _, ok := l.orders[items[0]]; !ok {
+				l.order = append(l.order, items[0])
+			}
+			l.orders[items[0]] = append(l.orders[items[0]], p)
+			l.parts[items[1]] = append(l.parts[items[1]], p)
+		}
+	}
+
+	if !isOrder {
+		l.orders = nil
+	}
+	return l, nil
+}
+
+// resolve computes positions of contigs on scaffolds for contig-order files,
+// and sorts gaps.
+func (l *scaffoldLayout) resolve(lengths map[string]int) error {
+	defer func() {
+		for _, gaps := range l.gaps {
+			sort.Slice(gaps, func(i, j int) bool { return gaps[i][0] < gaps[j][0] })
+		}
+	}()
+
+	if l.orders == nil {
+		return nil
+	}
+
+	for contig, parts := range l.parts {
+		length, ok := lengths[contig]
+		if !ok {
+			return fmt.Errorf("contig in the contig-order file not found in genome files: %s", contig)
+		}
+		for _, p := range parts {
+			p.length = length
+		}
+	}
+
+	var offset int
+	for _, scaffold := range l.order {
+		parts := l.orders[scaffold]
+		offset = 0
+		for i, p := range parts {
+			p.start = offset
+			offset += p.length
+			if i < len(parts)-1 && p.gapAfter > 0 {
+				l.gaps[scaffold] = append(l.gaps[scaffold], [2]int{offset, offset + p.gapAfter})
+				offset += p.gapAfter
+			}
+		}
+	}
+	return nil
+}
+
+// mapRegion is a region outputted by "unikmer map".
+type mapRegion struct {
+	seqID    string
+	start    int // 0-based
+	end      int // 1-based
+	nMatched int
+	strand   string
+}
+
+// lift converts a region on a contig to scaffold coordinates.
+// Regions on contigs not in the layout are returned unchanged.
+func (l *scaffoldLayout) lift(r mapRegion) []mapRegion {
+	parts, ok := l.parts[r.seqID]
+	if !ok {
+		return []mapRegion{r}
+	}
+
+	regions := make([]mapRegion, 0, 1)
+	var s, e int
+	for _, p := range parts {
+		s, e = r.start, r.end
+		if s < p.compStart {
+			s = p.compStart
+		}
+		if e > p.compStart+p.length {
+			e = p.compStart + p.length
+		}
+		if s >= e {
+			continue
+		}
+		r2 := mapRegion{seqID: p.scaffold, nMatched: r.nMatched, strand: r.strand}
+		if p.reverse {
+			r2.start = p.start + (p.compStart + p.length - e)
+			r2.end = p.start + (p.compStart + p.length - s)
+			switch r.strand {
+			case "+":
+				r2.strand = "-"
+			case "-":
+				r2.strand = "+"
+			}
+		} else {
+			r2.start = p.start + (s - p.compStart)
+			r2.end = p.start + (e - p.compStart)
+		}
+		regions = append(regions, r2)
+	}
+	return regions
+}
+
+// mergeLiftedRegions sorts regions, and merges overlapping or adjacent ones,
+// and ones only separated by gaps of scaffolds.
+func (l *scaffoldLayout) mergeLiftedRegions(regions []mapRegion) []mapRegion {
+	if len(regions) == 0 {
+		return regions
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].seqID == regions[j].seqID {
+			return regions[i].start < regions[j].start
+		}
+		return regions[i].seqID < regions[j].seqID
+	})
+
+	merged := regions[:1]
+	var last *mapRegion
+	for _, r := range regions[1:] {
+		last = &merged[len(merged)-1]
+		if r.seqID == last.seqID && (r.start <= last.end || l.onlyGaps(r.seqID, last.end, r.start)) {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			last.nMatched += r.nMatched
+			if last.strand != r.strand {
+				last.strand = "."
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// onlyGaps checks if the interval [start, end) is fully covered by gaps.
+func (l *scaffoldLayout) onlyGaps(scaffold string, start, end int) bool {
+	for _, g := range l.gaps[scaffold] {
+		if g[0] <= start && start < g[1] {
+			start = g[1]
+			if start >= end {
+				return true
+			}
+		}
+	}
+	return false
+}
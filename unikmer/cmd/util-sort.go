@@ -30,10 +30,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/shenwei356/bio/taxdump"
 	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+	"github.com/twotwotwo/sorts"
+	"github.com/twotwotwo/sorts/sortutil"
 )
 
 func dumpCodes2File(m []uint64, k int, mode uint32, outFile string, opt *Options, unique bool, repeated bool) int64 {
-	outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+	outfh, gw, w, err := outStreamWithLimit(outFile, opt.Compress, opt.CompressionLevel, opt.WriteLimiter)
 	checkError(err)
 	defer func() {
 		outfh.Flush()
@@ -102,7 +105,7 @@ func dumpCodes2File(m []uint64, k int, mode uint32, outFile string, opt *Options
 }
 
 func dumpCodesTaxids2File(mt []CodeTaxid, taxondb *taxdump.Taxonomy, k int, mode uint32, outFile string, opt *Options, unique bool, repeated bool) int64 {
-	outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+	outfh, gw, w, err := outStreamWithLimit(outFile, opt.Compress, opt.CompressionLevel, opt.WriteLimiter)
 	checkError(err)
 	defer func() {
 		outfh.Flush()
@@ -224,8 +227,8 @@ func (h codeEntryHeap) Pop() interface{} {
 	return x
 }
 
-func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, outFile string, k int, mode uint32, unique bool, repeated bool, finalRound bool) (int64, string) {
-	outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, outFile string, k int, mode uint32, unique bool, repeated bool, cr *countRange, scaler *writeScaler, requireSorted bool, finalRound bool) (int64, string) {
+	outfh, gw, w, err := outStreamWithLimit(outFile, opt.Compress, opt.CompressionLevel, opt.WriteLimiter)
 	checkError(err)
 	defer func() {
 		outfh.Flush()
@@ -237,16 +240,20 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 	var writer *unik.Writer
 	hasTaxid := mode&unik.UnikIncludeTaxID > 0
-	if hasTaxid && taxondb == nil {
+	if hasTaxid && (unique || repeated || cr != nil) && taxondb == nil {
 		checkError(fmt.Errorf("taxon information is need when UnikIncludeTaxID is one"))
 	}
 
 	writer, err = unik.NewWriter(outfh, k, mode)
 	checkError(err)
 	writer.SetMaxTaxid(opt.MaxTaxid)
+	if finalRound {
+		scaler.setHeader(writer)
+	}
 
 	readers := make(map[int]*unik.Reader, len(files))
-	fhs := make([]*os.File, len(files))
+	fhs := make([]*os.File, 0, len(files))
+	checkers := make([]*sortedChecker, len(files))
 
 	var reader *unik.Reader
 	for i, file := range files {
@@ -257,10 +264,11 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 		reader, err := unik.NewReader(infh)
 		checkError(errors.Wrap(err, file))
 		readers[i] = reader
+		checkers[i] = newSortedChecker(requireSorted, file)
 	}
 	defer func() {
 		for _, fh := range fhs {
-			fh.Close()
+			closeInStream(fh)
 		}
 	}()
 
@@ -277,7 +285,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 			reader = readers[i]
 			n := 0
 			for {
-				code, taxid, err = reader.ReadCodeWithTaxid()
+				code, taxid, err = scaler.readCodeWithTaxid(reader)
 				if err != nil {
 					if err == io.EOF {
 						delete(readers, i)
@@ -285,6 +293,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 					}
 					checkError(fmt.Errorf("faild to fill bufer from file '%s': %s", files[i], err))
 				}
+				checkers[i].check(code)
 				n++
 				heap.Push(codes, &codeEntry{idx: i, code: code, taxid: taxid})
 				if n >= maxChunkElem {
@@ -305,7 +314,60 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 	var taxid uint32
 	var count int
 
-	if hasTaxid {
+	if cr != nil && finalRound { // in previous rounds, all k-mers are kept
+		for {
+			if len(*(codes.entries)) == 0 {
+				checkError(fillBuffer())
+			}
+			if len(*(codes.entries)) == 0 {
+				break
+			}
+
+			e = heap.Pop(codes).(*codeEntry)
+			code = e.code
+			taxid = e.taxid
+
+			// -------------------------------------------------
+
+			if code == last {
+				if hasTaxid {
+					lca = taxondb.LCA(taxid, lca)
+				}
+				count++
+			} else {
+				if count > 0 && cr.pass(count) { // not the first one
+					writer.WriteCodeWithTaxid(last, lca)
+					n++
+				}
+
+				count = 1
+				last = code
+				lca = taxid
+			}
+
+			// -------------------------------------------------
+
+			reader = readers[e.idx]
+			if reader != nil {
+				code, taxid, err = scaler.readCodeWithTaxid(reader)
+				if err != nil {
+					if err == io.EOF {
+						delete(readers, e.idx)
+						continue
+					}
+					checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
+				}
+				checkers[e.idx].check(code)
+				heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
+			}
+		}
+
+		// the last one
+		if count > 0 && cr.pass(count) {
+			writer.WriteCodeWithTaxid(last, lca)
+			n++
+		}
+	} else if hasTaxid {
 		if unique {
 			for {
 				if len(*(codes.entries)) == 0 {
@@ -339,7 +401,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -347,13 +409,16 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
 
 			// the last one
-			writer.WriteCodeWithTaxid(last, lca)
-			n++
+			if !first {
+				writer.WriteCodeWithTaxid(last, lca)
+				n++
+			}
 		} else if repeated {
 			for {
 				if len(*(codes.entries)) == 0 {
@@ -396,7 +461,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -404,6 +469,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
@@ -443,7 +509,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -451,6 +517,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
@@ -481,7 +548,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -489,6 +556,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
@@ -537,7 +605,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -545,6 +613,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
@@ -586,7 +655,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 				reader = readers[e.idx]
 				if reader != nil {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = scaler.readCodeWithTaxid(reader)
 					if err != nil {
 						if err == io.EOF {
 							delete(readers, e.idx)
@@ -594,6 +663,7 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 						}
 						checkError(fmt.Errorf("faild to read from file '%s': %s", files[e.idx], err))
 					}
+					checkers[e.idx].check(code)
 					heap.Push(codes, &codeEntry{idx: e.idx, code: code, taxid: taxid})
 				}
 			}
@@ -604,3 +674,89 @@ func mergeChunksFile(opt *Options, taxondb *taxdump.Taxonomy, files []string, ou
 
 	return n, outFile
 }
+
+// countRange is the range of occurrences of k-mers in input,
+// for flags --min-count and --max-count.
+type countRange struct {
+	min int
+	max int // 0 for no limit
+}
+
+// getCountRange returns nil if none of --min-count and --max-count is given.
+func getCountRange(cmd *cobra.Command) *countRange {
+	min := getFlagNonNegativeInt(cmd, "min-count")
+	max := getFlagNonNegativeInt(cmd, "max-count")
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if min == 0 {
+		min = 1
+	}
+	if max > 0 && max < min {
+		checkError(fmt.Errorf("value of --max-count (%d) should not be smaller than --min-count (%d)", max, min))
+	}
+	return &countRange{min: min, max: max}
+}
+
+func (cr *countRange) pass(count int) bool {
+	return count >= cr.min && (cr.max == 0 || count <= cr.max)
+}
+
+// dumpCodesInCountRange writes sorted k-mers occurring within the count range.
+// For k-mers with taxids, LCA of the taxids is computed.
+func dumpCodesInCountRange(writer *unik.Writer, m []uint64, mt []CodeTaxid, taxondb *taxdump.Taxonomy, cr *countRange) int64 {
+	var n int64
+	var last uint64 = ^uint64(0)
+	var count int
+	if mt != nil {
+		var lca uint32
+		for _, codeT := range mt {
+			if codeT.Code == last {
+				lca = taxondb.LCA(codeT.Taxid, lca)
+				count++
+				continue
+			}
+			if count > 0 && cr.pass(count) {
+				writer.WriteCodeWithTaxid(last, lca)
+				n++
+			}
+			count = 1
+			last = codeT.Code
+			lca = codeT.Taxid
+		}
+		if count > 0 && cr.pass(count) {
+			writer.WriteCodeWithTaxid(last, lca)
+			n++
+		}
+		return n
+	}
+
+	for _, code := range m {
+		if code == last {
+			count++
+			continue
+		}
+		if count > 0 && cr.pass(count) {
+			writer.WriteCode(last)
+			n++
+		}
+		count = 1
+		last = code
+	}
+	if count > 0 && cr.pass(count) {
+		writer.WriteCode(last)
+		n++
+	}
+	return n
+}
+
+// sortCodes sorts k-mers in parallel, the number of goroutines is
+// sorts.MaxProcs, which is set by the global flag -j/--threads.
+func sortCodes(codes []uint64) {
+	sortutil.Uint64s(codes)
+}
+
+// sortCodesTaxids sorts k-mer-taxid pairs by k-mers in parallel.
+func sortCodesTaxids(codes []CodeTaxid) {
+	sorts.ByUint64(CodeTaxidSlice(codes))
+}
@@ -0,0 +1,220 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// spoolMemSize is the maximum size of data kept in memory in a spool,
+// the rest is written to a temporary file.
+var spoolMemSize = 4 << 20
+
+// spool buffers a stream which is written once and read once, e.g., a member
+// of a tar archive. Writing never blocks on the reader: unread data is kept in
+// memory up to spoolMemSize, and then written to a temporary file, so a slow
+// or idle reader does not hold the source of the stream.
+type spool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	name string
+
+	bufs [][]byte // data in memory, not read yet
+	mem  int      // size of data in memory
+
+	fh     *os.File // temporary file, once created, all later data are written to it
+	nFile  int64    // size of data in the temporary file
+	nRead  int64    // size of data read from the temporary file
+	done   bool     // writing finished
+	err    error    // error of writing
+	closed bool     // reader closed
+}
+
+func newSpool(name string) *spool {
+	s := &spool{name: name}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write appends data to the spool. Data are discarded if the reader is closed.
+func (s *spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return len(p), nil
+	}
+
+	if s.fh == nil && s.mem+len(p) <= spoolMemSize {
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		s.bufs = append(s.bufs, buf)
+		s.mem += len(p)
+		s.cond.Broadcast()
+		return len(p), nil
+	}
+
+	if s.fh == nil {
+		fh, err := createSpoolFile()
+		if err != nil {
+			return 0, err
+		}
+		s.fh = fh
+	}
+	n, err := s.fh.WriteAt(p, s.nFile)
+	s.nFile += int64(n)
+	s.cond.Broadcast()
+	return n, err
+}
+
+// CloseWithError finishes writing, the error, if not nil, is returned to the reader.
+func (s *spool) CloseWithError(err error) {
+	s.mu.Lock()
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Read reads data in the order of writing, and blocks until data are available.
+func (s *spool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if len(s.bufs) > 0 {
+			n := copy(p, s.bufs[0])
+			if n == len(s.bufs[0]) {
+				s.bufs[0] = nil
+				s.bufs = s.bufs[1:]
+			} else {
+				s.bufs[0] = s.bufs[0][n:]
+			}
+			s.mem -= n
+			return n, nil
+		}
+		if s.nRead < s.nFile {
+			if int64(len(p)) > s.nFile-s.nRead {
+				p = p[:s.nFile-s.nRead]
+			}
+			n, err := s.fh.ReadAt(p, s.nRead)
+			s.nRead += int64(n)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if s.done {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+}
+
+// Close closes the reader, and removes the temporary file.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.bufs = nil
+	s.mem = 0
+	if s.fh != nil {
+		file := s.fh.Name()
+		s.fh.Close()
+		s.fh = nil
+		s.nFile, s.nRead = 0, 0
+		return os.Remove(file)
+	}
+	return nil
+}
+
+// open returns a pipe streaming the data of the spool, the spool is closed
+// after all data are read or the pipe is closed by the reader.
+func (s *spool) open() (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer s.Close()
+		defer pw.Close()
+
+		buf := make([]byte, 64<<10)
+		var n int
+		var err error
+		for {
+			n, err = s.Read(buf)
+			if n > 0 {
+				if _, werr := pw.Write(buf[:n]); werr != nil {
+					return // the reader is closed before reaching EOF
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					checkError(fmt.Errorf("fail to read %s: %s", s.name, err))
+				}
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+// directory of temporary files of spools, which is created on first use.
+var spoolDir string
+var spoolDirErr error
+var spoolDirOnce sync.Once
+
+func createSpoolFile() (*os.File, error) {
+	spoolDirOnce.Do(func() {
+		tmpRoot := os.Getenv(envTmpDir)
+		if tmpRoot == "" {
+			tmpRoot = os.TempDir()
+		}
+		spoolDir, spoolDirErr = makeTmpDir(tmpRoot, "unikmer-spool")
+		if spoolDirErr == nil {
+			registerTmpDir(spoolDir)
+		}
+	})
+	if spoolDirErr != nil {
+		return nil, spoolDirErr
+	}
+	return os.CreateTemp(spoolDir, "spool-*")
+}
+
+// removeSpoolDir removes the directory of temporary files of spools.
+func removeSpoolDir() {
+	if spoolDir == "" {
+		return
+	}
+	if err := removeAllWithRetry(spoolDir); err != nil {
+		log.Warningf("fail to remove temp directory, please manually delete it: %s", spoolDir)
+	}
+	unregisterTmpDir(spoolDir)
+}
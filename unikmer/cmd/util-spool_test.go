@@ -0,0 +1,102 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// useTestSpoolDir makes temporary files of spools created in a directory
+// of the test, which is removed after the test.
+func useTestSpoolDir(t *testing.T, memSize int) {
+	t.Setenv(envTmpDir, t.TempDir())
+	spoolMemSize0 := spoolMemSize
+	spoolMemSize = memSize
+	spoolDir, spoolDirErr, spoolDirOnce = "", nil, sync.Once{}
+	t.Cleanup(func() {
+		removeSpoolDir()
+		spoolMemSize = spoolMemSize0
+		spoolDir, spoolDirErr, spoolDirOnce = "", nil, sync.Once{}
+	})
+}
+
+// testData returns n bytes of data which differ by the seed.
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i) + seed
+	}
+	return data
+}
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name     string
+		memSize  int
+		size     int
+		chunk    int
+		wantFile bool
+	}{
+		{"empty", 16, 0, 4, false},
+		{"in memory", 1 << 10, 100, 7, false},
+		{"exactly in memory", 100, 100, 10, false},
+		{"in temporary file", 16, 100, 7, true},
+		{"all in temporary file", 0, 100, 100, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSpoolDir(t, test.memSize)
+
+			data := testData(test.size, 1)
+			s := newSpool(test.name)
+			var end int
+			for i := 0; i < len(data); i += test.chunk {
+				if end = i + test.chunk; end > len(data) {
+					end = len(data)
+				}
+				if _, err := s.Write(data[i:end]); err != nil {
+					t.Fatalf("write: %s", err)
+				}
+			}
+			s.CloseWithError(nil)
+			if got := s.fh != nil; got != test.wantFile {
+				t.Errorf("temporary file used: %v, want %v", got, test.wantFile)
+			}
+
+			fh, err := s.open()
+			if err != nil {
+				t.Fatalf("open: %s", err)
+			}
+			got, err := io.ReadAll(fh)
+			fh.Close()
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("data mismatch: got %d bytes, want %d bytes", len(got), len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// supported output formats of commands with tabular output.
+var tableFormats = []string{"tsv", "json"}
+
+// getFlagTableFormat returns the value of flag --out-format.
+func getFlagTableFormat(cmd *cobra.Command) string {
+	format := strings.ToLower(getFlagString(cmd, "out-format"))
+	for _, f := range tableFormats {
+		if format == f {
+			return format
+		}
+	}
+	checkError(fmt.Errorf("invalid value of flag --out-format: %s, available: %s",
+		format, strings.Join(tableFormats, ", ")))
+	return ""
+}
+
+// tableWriter writes records of a tabular command in TSV or JSON lines.
+type tableWriter struct {
+	outfh    *bufio.Writer
+	format   string
+	colnames []string
+
+	// symbols of boolean values in TSV format
+	sTrue  string
+	sFalse string
+}
+
+func newTableWriter(outfh *bufio.Writer, format string, colnames []string) *tableWriter {
+	return &tableWriter{
+		outfh:    outfh,
+		format:   format,
+		colnames: colnames,
+		sTrue:    "true",
+		sFalse:   "false",
+	}
+}
+
+// WriteHeader writes the column names, only for TSV format.
+func (w *tableWriter) WriteHeader() {
+	if w.format != "tsv" {
+		return
+	}
+	w.outfh.WriteString(strings.Join(w.colnames, "\t") + "\n")
+}
+
+// WriteRecord writes one record, values should have the same order as colnames.
+func (w *tableWriter) WriteRecord(values ...interface{}) {
+	if len(values) != len(w.colnames) {
+		checkError(fmt.Errorf("number of values (%d) and columns (%d) not match", len(values), len(w.colnames)))
+	}
+
+	switch w.format {
+	case "json":
+		w.outfh.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				w.outfh.WriteByte(',')
+			}
+			key, _ := json.Marshal(w.colnames[i])
+			val, err := json.Marshal(v)
+			checkError(err)
+			w.outfh.Write(key)
+			w.outfh.WriteByte(':')
+			w.outfh.Write(val)
+		}
+		w.outfh.WriteString("}\n")
+	default:
+		for i, v := range values {
+			if i > 0 {
+				w.outfh.WriteByte('\t')
+			}
+			switch v := v.(type) {
+			case bool:
+				w.outfh.WriteString(boolStr(w.sTrue, w.sFalse, v))
+			default:
+				w.outfh.WriteString(fmt.Sprintf("%v", v))
+			}
+		}
+		w.outfh.WriteByte('\n')
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+)
+
+// suffixes of tar archives accepted as bundles of .unik files
+var tarSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.zst"}
+
+func isTarFile(file string) bool {
+	_file := strings.ToLower(file)
+	for _, suffix := range tarSuffixes {
+		if strings.HasSuffix(_file, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarArchive is a tar archive of .unik files, which is read sequentially.
+// Members are streamed in the order of the archive, which is also the order
+// in the file list. A member requested before the previous one is fully
+// streamed waits for it, which never takes long as spools do not block.
+type tarArchive struct {
+	mu   sync.Mutex
+	cond *sync.Cond // signalled when a member is fully read from the archive
+
+	file string
+
+	fh   *os.File
+	dec  io.Closer
+	tr   *tar.Reader
+	idx  int  // index of the next .unik member
+	seen int  // number of members ever reached
+	busy bool // a member is being read from the archive
+
+	pending map[int]*spool // members skipped when seeking a later one
+}
+
+// tarMember is a .unik file in a tar archive.
+type tarMember struct {
+	archive *tarArchive
+	name    string
+	idx     int
+}
+
+// virtual path -> *tarMember.
+// It's only written when expanding file list in the main goroutine.
+var tarMembers = make(map[string]*tarMember)
+
+func (a *tarArchive) open() error {
+	a.close()
+
+	fh, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	a.fh = fh
+
+	var r io.Reader
+	switch _file := strings.ToLower(a.file); {
+	case strings.HasSuffix(_file, ".tar.gz"), strings.HasSuffix(_file, ".tgz"):
+		gr, err := gzip.NewReader(fh)
+		if err != nil {
+			return err
+		}
+		a.dec = gr
+		r = gr
+	case strings.HasSuffix(_file, ".tar.zst"):
+		zr, err := zstd.NewReader(fh)
+		if err != nil {
+			return err
+		}
+		a.dec = zr.IOReadCloser()
+		r = zr
+	default:
+		r = fh
+	}
+
+	a.tr = tar.NewReader(r)
+	a.idx = 0
+	return nil
+}
+
+func (a *tarArchive) close() {
+	if a.dec != nil {
+		a.dec.Close()
+		a.dec = nil
+	}
+	if a.fh != nil {
+		a.fh.Close()
+		a.fh = nil
+	}
+	a.tr = nil
+}
+
+// next returns the header of next .unik member.
+func (a *tarArchive) next() (*tar.Header, error) {
+	for {
+		hdr, err := a.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && strings.HasSuffix(hdr.Name, extDataFile) {
+			return hdr, nil
+		}
+	}
+}
+
+// spool returns a spool of a member, which is filled in background.
+// Members skipped when seeking a later member are spooled for later requests,
+// and a member located before the current position, i.e., requested twice,
+// leads to a rescan of the archive, where members reached before are skipped.
+func (a *tarArchive) spool(m *tarMember) (*spool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.busy {
+		a.cond.Wait()
+	}
+
+	if s, ok := a.pending[m.idx]; ok {
+		delete(a.pending, m.idx)
+		return s, nil
+	}
+
+	if a.tr == nil || a.idx > m.idx {
+		if err := a.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	var hdr *tar.Header
+	var s *spool
+	var err error
+	for {
+		hdr, err = a.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("member not found: %s", m.name)
+			}
+			return nil, err
+		}
+		a.idx++
+		seen := a.idx <= a.seen
+		if !seen {
+			a.seen = a.idx
+		}
+
+		if a.idx-1 == m.idx {
+			if hdr.Name != m.name {
+				return nil, fmt.Errorf("archive changed: %s", a.file)
+			}
+			s = newSpool(m.name)
+			a.busy = true
+			go func() {
+				_, err := io.Copy(s, a.tr)
+				s.CloseWithError(err)
+
+				a.mu.Lock()
+				a.busy = false
+				a.cond.Broadcast()
+				a.mu.Unlock()
+			}()
+			return s, nil
+		}
+
+		if seen {
+			continue
+		}
+		s = newSpool(hdr.Name)
+		_, err = io.Copy(s, a.tr)
+		s.CloseWithError(err)
+		if err != nil {
+			return nil, err
+		}
+		a.pending[a.idx-1] = s
+	}
+}
+
+// expandTarFiles replaces tar archives in the file list with
+// virtual paths ("<archive>/<member>") of .unik files in them.
+func expandTarFiles(files []string) ([]string, error) {
+	var hasTar bool
+	for _, file := range files {
+		if isTarFile(file) {
+			hasTar = true
+			break
+		}
+	}
+	if !hasTar {
+		return files, nil
+	}
+
+	files2 := make([]string, 0, len(files))
+	var hdr *tar.Header
+	var err error
+	var vfile string
+	for _, file := range files {
+		if !isTarFile(file) {
+			files2 = append(files2, file)
+			continue
+		}
+
+		a := &tarArchive{file: file, pending: make(map[int]*spool, 8)}
+		a.cond = sync.NewCond(&a.mu)
+		if err = a.open(); err != nil {
+			return nil, fmt.Errorf("fail to read %s: %s", file, err)
+		}
+		n := 0
+		for {
+			hdr, err = a.next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				a.close()
+				return nil, fmt.Errorf("fail to read %s: %s", file, err)
+			}
+			vfile = file + "/" + strings.TrimPrefix(hdr.Name, "./")
+			tarMembers[vfile] = &tarMember{archive: a, name: hdr.Name, idx: n}
+			files2 = append(files2, vfile)
+			n++
+		}
+		a.close()
+
+		if n == 0 {
+			log.Warningf("no %s files found in archive: %s", extDataFile, file)
+		}
+	}
+	return files2, nil
+}
+
+// openTarMember returns a pipe streaming the data of a member in a tar archive.
+func openTarMember(m *tarMember) (*os.File, error) {
+	s, err := m.archive.spool(m)
+	if err != nil {
+		return nil, err
+	}
+	return s.open()
+}
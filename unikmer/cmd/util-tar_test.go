@@ -0,0 +1,155 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestTar writes a tar archive, which is gzipped for .tar.gz files.
+func writeTestTar(t *testing.T, file string, names []string, files map[string][]byte) {
+	fh, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	var w io.Writer = fh
+	var gw *gzip.Writer
+	if filepath.Ext(file) == ".gz" {
+		gw = gzip.NewWriter(fh)
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTarMembers(t *testing.T) {
+	names := []string{"./x1.unik", "notes.txt", "d/x2.unik", "x3.unik"}
+	files := map[string][]byte{
+		"./x1.unik": testData(1000, 1),
+		"notes.txt": []byte("not a .unik file"),
+		"d/x2.unik": testData(10, 2),
+		"x3.unik":   testData(3000, 3),
+	}
+	members := []string{"x1.unik", "d/x2.unik", "x3.unik"} // virtual paths
+	data := map[string][]byte{
+		"x1.unik":   files["./x1.unik"],
+		"d/x2.unik": files["d/x2.unik"],
+		"x3.unik":   files["x3.unik"],
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		memSize int      // spoolMemSize
+		order   []string // order of reading members
+		openAll bool     // open all members before reading them
+	}{
+		{"in order", "a.tar", 4 << 20, []string{"x1.unik", "d/x2.unik", "x3.unik"}, false},
+		{"gzipped", "a.tar.gz", 4 << 20, []string{"x1.unik", "d/x2.unik", "x3.unik"}, false},
+		{"out of order", "a.tar", 4 << 20, []string{"x3.unik", "x1.unik", "d/x2.unik"}, false},
+		{"out of order, spooled to files", "a.tar.gz", 100, []string{"x3.unik", "d/x2.unik", "x1.unik"}, false},
+		{"opened together", "a.tar", 100, []string{"d/x2.unik", "x3.unik", "x1.unik"}, true},
+		{"read twice", "a.tar", 100, []string{"x1.unik", "x3.unik", "x1.unik", "d/x2.unik", "x3.unik"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestSpoolDir(t, test.memSize)
+
+			dir := t.TempDir()
+			file := filepath.Join(dir, test.file)
+			writeTestTar(t, file, names, files)
+
+			other := filepath.Join(dir, "other.unik")
+			got, err := expandTarFiles([]string{other, file})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := []string{other}
+			for _, m := range members {
+				want = append(want, file+"/"+m)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got files %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("got files %v, want %v", got, want)
+				}
+			}
+
+			fhs := make([]*os.File, len(test.order))
+			read := func(i int) {
+				defer fhs[i].Close()
+				b, err := io.ReadAll(fhs[i])
+				if err != nil {
+					t.Fatalf("%s: read: %s", test.order[i], err)
+				}
+				if !bytes.Equal(b, data[test.order[i]]) {
+					t.Errorf("%s: data mismatch: got %d bytes, want %d bytes",
+						test.order[i], len(b), len(data[test.order[i]]))
+				}
+			}
+			for i, m := range test.order {
+				member, ok := tarMembers[file+"/"+m]
+				if !ok {
+					t.Fatalf("member not found: %s", m)
+				}
+				if fhs[i], err = openTarMember(member); err != nil {
+					t.Fatalf("%s: open: %s", m, err)
+				}
+				if !test.openAll {
+					read(i)
+				}
+			}
+			if test.openAll {
+				for i := range test.order {
+					read(i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// environment variable of the root directory for temporary files,
+// used when the flag -t/--tmp-dir is not given.
+const envTmpDir = "UNIKMER_TMPDIR"
+
+// getTmpRoot returns the root directory for temporary files.
+func getTmpRoot(cmd *cobra.Command) string {
+	tmpRoot := getFlagString(cmd, "tmp-dir")
+	if !cmd.Flags().Lookup("tmp-dir").Changed {
+		if val := os.Getenv(envTmpDir); val != "" {
+			tmpRoot = val
+		}
+	}
+	return tmpRoot
+}
+
+// getTmpOptions returns options for writing intermediate files, with
+// compression settings from --tmp-compress and --tmp-compression-level,
+// and the writing speed limited by --tmp-io-limit.
+func getTmpOptions(cmd *cobra.Command, opt *Options) *Options {
+	tmpOpt := *opt
+
+	switch getFlagString(cmd, "tmp-compress") {
+	case "auto":
+	case "yes":
+		tmpOpt.Compress = true
+	case "no":
+		tmpOpt.Compress = false
+	default:
+		checkError(fmt.Errorf(`invalid value of --tmp-compress: %s, available: auto, yes, no`, getFlagString(cmd, "tmp-compress")))
+	}
+
+	if cmd.Flags().Lookup("tmp-compression-level").Changed {
+		level := getFlagInt(cmd, "tmp-compression-level")
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			checkError(fmt.Errorf("gzip: invalid value of --tmp-compression-level: %d", level))
+		}
+		tmpOpt.CompressionLevel = level
+	}
+
+	limit, err := ParseByteSize(getFlagString(cmd, "tmp-io-limit"))
+	if err != nil {
+		checkError(fmt.Errorf("invalid value of --tmp-io-limit: %s", getFlagString(cmd, "tmp-io-limit")))
+	}
+	tmpOpt.WriteLimiter = newIOLimiter(limit)
+
+	return &tmpOpt
+}
+
+// makeTmpDir creates a temporary directory with a short and unique name
+// in tmpRoot, which avoids conflicts between concurrent runs, and too
+// long paths on Windows.
+func makeTmpDir(tmpRoot string, prefix string) (string, error) {
+	if err := os.MkdirAll(tmpRoot, 0777); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(tmpRoot, prefix+"-*.tmp")
+}
+
+// temporary directories to remove on interrupt or exit with error.
+var tmpDirs = make(map[string]struct{})
+var tmpDirsLock sync.Mutex
+
+func registerTmpDir(dir string) {
+	tmpDirsLock.Lock()
+	tmpDirs[dir] = struct{}{}
+	tmpDirsLock.Unlock()
+}
+
+func unregisterTmpDir(dir string) {
+	tmpDirsLock.Lock()
+	delete(tmpDirs, dir)
+	tmpDirsLock.Unlock()
+}
+
+// cleanTmpDirs removes all registered temporary directories.
+func cleanTmpDirs() {
+	tmpDirsLock.Lock()
+	defer tmpDirsLock.Unlock()
+
+	for dir := range tmpDirs {
+		if err := removeAllWithRetry(dir); err != nil {
+			log.Warningf("fail to remove temp directory, please manually delete it: %s", dir)
+		}
+		delete(tmpDirs, dir)
+	}
+}
+
+// removeAllWithRetry removes a path and retries on failure, as removing
+// files on NFS may fail transiently, e.g., for lingering .nfsXXXX files.
+func removeAllWithRetry(path string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = os.RemoveAll(path); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(100<<i) * time.Millisecond)
+	}
+	return err
+}
+
+// renameWithRetry renames a file and retries on failure, as renaming
+// files on NFS may fail transiently.
+func renameWithRetry(oldpath, newpath string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = os.Rename(oldpath, newpath); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(100<<i) * time.Millisecond)
+	}
+	return err
+}
+
+// output files being written, they are removed on interrupt
+// as they are incomplete.
+var partialOutputs = make(map[string]struct{})
+var partialOutputsLock sync.Mutex
+
+func registerPartialOutput(file string) {
+	partialOutputsLock.Lock()
+	partialOutputs[file] = struct{}{}
+	partialOutputsLock.Unlock()
+}
+
+// forgetPartialOutputs is called when a command finishes successfully.
+func forgetPartialOutputs() {
+	partialOutputsLock.Lock()
+	partialOutputs = make(map[string]struct{})
+	partialOutputsLock.Unlock()
+}
+
+func cleanPartialOutputs() {
+	partialOutputsLock.Lock()
+	defer partialOutputsLock.Unlock()
+
+	for file := range partialOutputs {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Warningf("fail to remove incomplete output file, please manually delete it: %s", file)
+		}
+		delete(partialOutputs, file)
+	}
+}
+
+// interruptCtx is cancelled on SIGINT or SIGTERM, long-running workers
+// should check it and stop early.
+var interruptCtx, cancelInterruptCtx = context.WithCancel(context.Background())
+
+// interrupted returns true if SIGINT or SIGTERM is received.
+func interrupted() bool {
+	return interruptCtx.Err() != nil
+}
+
+// gracefulInterrupt is set by commands whose workers check interrupted(),
+// on interrupt, they are waited to stop instead of being killed right away.
+var gracefulInterrupt int32
+
+// interruptSignal is the received signal.
+var interruptSignal atomic.Value
+
+var exitOnInterruptOnce sync.Once
+
+// enableGracefulInterrupt is called by a command whose workers check interrupted()
+// and stop early, the command has to call exitIfInterrupted() after the workers return.
+// A second interrupt still forces the exit.
+func enableGracefulInterrupt() {
+	atomic.StoreInt32(&gracefulInterrupt, 1)
+}
+
+// exitIfInterrupted removes temporary files and incomplete outputs, and exits,
+// if SIGINT or SIGTERM is received. It should be called after all workers return.
+func exitIfInterrupted() {
+	if interrupted() {
+		exitOnInterrupt()
+	}
+}
+
+func exitOnInterrupt() {
+	exitOnInterruptOnce.Do(func() {
+		sig := interruptSignal.Load().(os.Signal)
+		log.Warningf("interrupted (%s), removing temporary files and incomplete outputs", sig)
+		cleanTmpDirs()
+		cleanPartialOutputs()
+		stopProfiling()
+		if sig == syscall.SIGTERM {
+			os.Exit(143)
+		}
+		os.Exit(130)
+	})
+}
+
+func init() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		interruptSignal.Store(sig)
+		cancelInterruptCtx()
+		if atomic.LoadInt32(&gracefulInterrupt) == 1 {
+			log.Warningf("interrupted (%s), waiting for workers to stop, interrupt again to force exit", sig)
+			<-ch
+		}
+		exitOnInterrupt()
+	}()
+}
@@ -31,9 +31,12 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/bio/seqio/fastx"
 	"github.com/shenwei356/bio/sketches"
 	"github.com/shenwei356/bio/taxdump"
+	"github.com/shenwei356/kmers"
+	"github.com/will-rowe/nthash"
 
 	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
@@ -63,6 +66,10 @@ type Options struct {
 
 	SkipFileCheck bool
 	SkipFlagCheck bool
+
+	Sampler *recordSampler // for --sample-fraction, nil for keeping all
+
+	WriteLimiter *ioLimiter // for throttling writing of intermediate files, nil for no limit
 }
 
 func getOptions(cmd *cobra.Command) *Options {
@@ -90,6 +97,23 @@ func getOptions(cmd *cobra.Command) *Options {
 	runtime.GOMAXPROCS(threads)
 	sorts.MaxProcs = threads
 
+	bufferSize, err := ParseByteSize(getFlagString(cmd, "buffer-size"))
+	if err != nil || bufferSize < 4096 {
+		checkError(fmt.Errorf("invalid value of --buffer-size: %s, should be >= 4K", getFlagString(cmd, "buffer-size")))
+	}
+	BufferSize = bufferSize
+
+	readahead, err := ParseByteSize(getFlagString(cmd, "readahead"))
+	if err != nil {
+		checkError(fmt.Errorf("invalid value of --readahead: %s", getFlagString(cmd, "readahead")))
+	}
+	inStreamReadahead = int64(readahead)
+
+	sampleFraction := getFlagFloat64(cmd, "sample-fraction")
+	if sampleFraction <= 0 || sampleFraction > 1 {
+		checkError(fmt.Errorf("value of --sample-fraction should be in range of (0, 1]: %v", sampleFraction))
+	}
+
 	return &Options{
 		NumCPUs:          threads,
 		Verbose:          getFlagBool(cmd, "verbose"),
@@ -105,6 +129,8 @@ func getOptions(cmd *cobra.Command) *Options {
 
 		SkipFlagCheck: getFlagBool(cmd, "skip-flag-check"),
 		SkipFileCheck: getFlagBool(cmd, "skip-file-check"),
+
+		Sampler: newRecordSampler(sampleFraction, getFlagInt64(cmd, "sample-seed")),
 	}
 }
 
@@ -112,7 +138,7 @@ func checkDataDir(opt *Options) {
 	existed, err := pathutil.DirExists(opt.DataDir)
 	checkError(errors.Wrap(err, opt.DataDir))
 	if !existed {
-		log.Errorf(`data directory not created. please download and decompress ftp://ftp.ncbi.nih.gov/pub/taxonomy/taxdump.tar.gz, and copy "nodes.dmp" to %s`, opt.DataDir)
+		log.Errorf(`data directory not created. please run "unikmer taxdump download", or download and decompress ftp://ftp.ncbi.nih.gov/pub/taxonomy/taxdump.tar.gz, and copy "nodes.dmp" to %s`, opt.DataDir)
 	}
 }
 
@@ -238,7 +264,7 @@ func extendDegenerateSeq(s []byte) (dseqs [][]byte, err error) {
 			}
 
 		} else {
-			return dseqs, fmt.Errorf("invalid degenerate bases: %s", base)
+			return dseqs, fmt.Errorf("invalid degenerate bases: %c", base)
 		}
 	}
 	return dseqs, nil
@@ -391,3 +417,168 @@ func loadHash2Loc(files []string, k int) ([][]byte, map[uint64][2]int, error) {
 	}
 	return sequences, hash2loc, nil
 }
+
+// nKmersOnPositiveStrand returns the number of k-mers on the positive strand.
+// Note that the non-canonical k-mer iterator of sketches also returns
+// k-mers on the negative strand after the positive one.
+func nKmersOnPositiveStrand(seqLen int, k int, circular bool) int {
+	if circular {
+		return seqLen
+	}
+	return seqLen - k + 1
+}
+
+// nKmersWithNonACGT returns the number of k-mer positions on the positive
+// strand containing non-ACGT bases, e.g., N. Such k-mers are not skipped
+// by the iterators, degenerate bases are encoded as one of ACGT.
+func nKmersWithNonACGT(s []byte, k int, circular bool) int {
+	n := len(s)
+	if n < k {
+		return 0
+	}
+	end := n - k + 1
+	if circular {
+		end = n
+	}
+
+	var c, last int // last: 1-based end position of the last non-ACGT base
+	for i := 0; i < end+k-1; i++ {
+		switch s[i%n] {
+		case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+		default:
+			last = i + 1
+		}
+		// the k-mer ending at i starts at i-k+1
+		if i >= k-1 && last > i-k+1 {
+			c++
+		}
+	}
+	return c
+}
+
+// extendCircularSeq appends the leading k-1 bases to the end of a circular
+// sequence in place, so k-mers spanning the end can be iterated with a linear
+// iterator, without cloning the whole sequence as sketches iterators do with
+// circular = true. Sequences shorter than k are left untouched.
+func extendCircularSeq(s *seq.Seq, k int) {
+	if len(s.Seq) < k {
+		return
+	}
+	s.Seq = append(s.Seq, s.Seq[:k-1]...)
+}
+
+// kmerIterator is implemented by *sketches.Iterator and *circularIterator.
+type kmerIterator interface {
+	Next() (code uint64, ok bool, err error)
+	Index() int
+}
+
+// circularIterator iterates k-mers (or hashes) of a circular sequence for
+// more than one round, with wrapping indices, i.e., the index of a k-mer at
+// position i in the r-th round (0-based) is r*length+i. Only k-mers with
+// indices smaller than end are returned. The sequence should be extended with
+// extendCircularSeq first. For non-canonical k-mers, only the positive strand
+// is iterated.
+type circularIterator struct {
+	s         *seq.Seq
+	k         int
+	length    int // length of the original sequence
+	end       int
+	hashed    bool
+	canonical bool
+
+	iter   *sketches.Iterator
+	offset int // index of the first k-mer in the current round
+	n      int // number of k-mers in the current round
+}
+
+func newCircularIterator(s *seq.Seq, k int, length int, end int, hashed bool, canonical bool) (*circularIterator, error) {
+	ci := &circularIterator{s: s, k: k, length: length, end: end, hashed: hashed, canonical: canonical}
+	return ci, ci.reset()
+}
+
+func (ci *circularIterator) reset() (err error) {
+	if ci.hashed {
+		ci.iter, err = sketches.NewHashIterator(ci.s, ci.k, ci.canonical, false)
+	} else {
+		ci.iter, err = sketches.NewKmerIterator(ci.s, ci.k, ci.canonical, false)
+	}
+	ci.n = 0
+	return err
+}
+
+// Next returns the next k-mer code (or hash).
+func (ci *circularIterator) Next() (code uint64, ok bool, err error) {
+	if ci.n == ci.length { // next round
+		ci.offset += ci.length
+		if err = ci.reset(); err != nil {
+			return 0, false, err
+		}
+	}
+	if ci.offset+ci.n >= ci.end {
+		return 0, false, nil
+	}
+	code, ok, err = ci.iter.Next()
+	ci.n++
+	return
+}
+
+// Index returns the wrapping 0-based index of the current k-mer.
+func (ci *circularIterator) Index() int {
+	return ci.offset + ci.iter.Index()
+}
+
+// kmerStrand returns the strand where the canonical k-mer (or ntHash) of
+// a k-mer in the genome comes from: '+' for the k-mer itself, '-' for its
+// reverse complement, and '.' for palindromic k-mers or invalid bases.
+func kmerStrand(kmer []byte, hashed bool) byte {
+	var fwd, rev uint64
+	if hashed {
+		kmer2 := make([]byte, len(kmer))
+		copy(kmer2, kmer)
+		hasher, err := nthash.NewHasher(&kmer2, uint(len(kmer2)))
+		if err != nil {
+			return '.'
+		}
+		fwd, _ = hasher.Next(false)
+
+		rc, _ := seq.NewSeqWithoutValidation(seq.DNAredundant, kmer2)
+		kmer2 = rc.RevComInplace().Seq
+		hasher, err = nthash.NewHasher(&kmer2, uint(len(kmer2)))
+		if err != nil {
+			return '.'
+		}
+		rev, _ = hasher.Next(false)
+	} else {
+		var err error
+		fwd, err = kmers.Encode(kmer)
+		if err != nil {
+			return '.'
+		}
+		rev = kmers.MustRevComp(fwd, len(kmer))
+	}
+
+	if fwd < rev {
+		return '+'
+	}
+	if fwd > rev {
+		return '-'
+	}
+	return '.'
+}
+
+// parseTaxidList parses taxids from values of a flag.
+func parseTaxidList(values []string) (map[uint32]struct{}, error) {
+	taxids := make(map[uint32]struct{}, len(values))
+	for _, val := range values {
+		if val == "" {
+			continue
+		}
+		taxid, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("taxid should be positive integer in range of [1, %d]: %s", maxUint32, val)
+		}
+		taxids[uint32(taxid)] = struct{}{}
+	}
+	return taxids, nil
+}
@@ -41,9 +41,17 @@ var viewCmd = &cobra.Command{
 	Long: `Read and output binary format to plain text
 
 Attentions:
-  1. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  1. The 'canonical/scaled/hashed' flags of all files should be consistent,
+     unless --allow-mixed is given.
   2. Input files should ALL have or don't have taxid information.
-  
+
+Multiple files:
+  1. Use -F/--file-name to add a column of file name in tabular output.
+  2. Use --allow-mixed for files with different k-mer sizes or flags,
+     k-mers are decoded following the settings of each file, and a line of
+     "#<file>" is outputted before k-mers of each file in tabular output,
+     unless -F/--file-name is given.
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -70,6 +78,7 @@ Attentions:
 		outFastq := getFlagBool(cmd, "fastq")
 		showCodeOnly := getFlagBool(cmd, "show-code-only")
 		showTaxidOnly := getFlagBool(cmd, "show-taxid-only")
+		hexCode := getFlagBool(cmd, "hex")
 		genomes := getFlagStringSlice(cmd, "genome")
 		providingGenomes := len(genomes) != 0
 
@@ -78,6 +87,28 @@ Attentions:
 			showTaxid = false
 		}
 
+		showFile := getFlagBool(cmd, "file-name")
+		allowMixed := getFlagBool(cmd, "allow-mixed")
+		if showFile && (outFasta || outFastq) {
+			checkError(fmt.Errorf("flag -F/--file-name is not supported for FASTA/Q output"))
+		}
+		if allowMixed && providingGenomes {
+			checkError(fmt.Errorf("flag --allow-mixed and -g/--genome are not compatible"))
+		}
+		keepTaxids, err := parseTaxidList(getFlagStringSlice(cmd, "keep-taxid"))
+		checkError(err)
+		filterTaxid := len(keepTaxids) > 0
+		if filterTaxid && opt.IgnoreTaxid {
+			checkError(fmt.Errorf("flag --keep-taxid and -I/--ignore-taxid are not compatible"))
+		}
+
+		var filter *exprFilter
+		if expr := getFlagString(cmd, "filter-expr"); expr != "" {
+			filter, err = newExprFilter(expr)
+			checkError(errors.Wrap(err, "invalid value of --filter-expr"))
+		}
+		var rec exprRecord
+
 		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
 		checkError(err)
 		defer func() {
@@ -107,12 +138,14 @@ Attentions:
 		var code uint64
 		var kmer []byte
 		var taxid uint32
+		var scode string
+		var prefix string // file name column
 
 		for _, file := range files {
 			func() {
 				infh, r, _, err = inStream(file)
 				checkError(err)
-				defer r.Close()
+				defer closeInStream(r)
 
 				reader, err := unik.NewReader(infh)
 				checkError(errors.Wrap(err, file))
@@ -146,7 +179,13 @@ Attentions:
 						}
 					}
 				} else {
-					checkCompatibility(reader0, reader, file)
+					if allowMixed {
+						k = reader.K
+						canonical = reader.IsCanonical()
+						hashed = reader.IsHashed()
+					} else {
+						checkCompatibility(reader0, reader, file)
+					}
 					if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
 						if reader.HasTaxidInfo() {
 							checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
@@ -156,12 +195,30 @@ Attentions:
 					}
 				}
 
+				if filterTaxid && !reader.HasTaxidInfo() {
+					checkError(fmt.Errorf("flag --keep-taxid given, but no taxids found in file: %s", file))
+				}
+				if filter != nil {
+					if (filter.uses("kmer") || filter.uses("gc")) && reader.IsHashed() && !providingGenomes {
+						checkError(fmt.Errorf("fields 'kmer' and 'gc' in --filter-expr are not available for hashed k-mers without -g/--genome: %s", file))
+					}
+					if filter.uses("taxid") && !hasTaxid {
+						checkError(fmt.Errorf("field 'taxid' in --filter-expr is not available, as no taxids found in file: %s", file))
+					}
+				}
+
 				if outFastq {
 					quality = strings.Repeat("g", reader.K)
 				}
 
+				if showFile {
+					prefix = file + "\t"
+				} else if allowMixed && !(outFasta || outFastq) {
+					outfh.WriteString("#" + file + "\n")
+				}
+
 				for {
-					code, taxid, err = reader.ReadCodeWithTaxid()
+					code, taxid, err = readCodeWithTaxid(reader, opt.Sampler)
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -169,6 +226,12 @@ Attentions:
 						checkError(errors.Wrap(err, file))
 					}
 
+					if filterTaxid {
+						if _, ok = keepTaxids[taxid]; !ok {
+							continue
+						}
+					}
+
 					if !hashed {
 						kmer = kmers.MustDecode(code, k)
 					} else {
@@ -176,44 +239,53 @@ Attentions:
 							if loc, ok = hash2loc[code]; ok {
 								kmer = sequences[loc[0]][loc[1] : loc[1]+k]
 							} else {
-								kmer = []byte(fmt.Sprintf("%d", code))
-								log.Warningf("fail to decode hash: %d, which is not found in given genomes", code)
+								kmer = []byte(formatCode(code, hexCode))
+								log.Warningf("fail to decode hash: %s, which is not found in given genomes", kmer)
 							}
 						} else {
-							kmer = []byte(fmt.Sprintf("%d", code))
+							kmer = []byte(formatCode(code, hexCode))
+						}
+					}
+
+					if filter != nil {
+						rec.code, rec.taxid, rec.kmer = code, taxid, kmer
+						if !filter.pass(&rec) {
+							continue
 						}
 					}
 
 					if outFasta {
+						scode = formatCode(code, hexCode)
 						if showTaxid {
 							// outfh.WriteString(fmt.Sprintf(">%d %d\n%s\n", code, taxid, kmer))
-							fmt.Fprintf(outfh, ">%d %d\n%s\n", code, taxid, kmer)
+							fmt.Fprintf(outfh, ">%s %d\n%s\n", scode, taxid, kmer)
 						} else {
 							// outfh.WriteString(fmt.Sprintf(">%d\n%s\n", code, kmer))
-							fmt.Fprintf(outfh, ">%d\n%s\n", code, kmer)
+							fmt.Fprintf(outfh, ">%s\n%s\n", scode, kmer)
 						}
 					} else if outFastq {
+						scode = formatCode(code, hexCode)
 						if showTaxid {
 							// outfh.WriteString(fmt.Sprintf("@%d %d\n%s\n+\n%s\n", code, taxid, kmer, quality))
-							fmt.Fprintf(outfh, "@%d %d\n%s\n+\n%s\n", code, taxid, kmer, quality)
+							fmt.Fprintf(outfh, "@%s %d\n%s\n+\n%s\n", scode, taxid, kmer, quality)
 						} else {
 							// outfh.WriteString(fmt.Sprintf("@%d\n%s\n+\n%s\n", code, kmer, quality))
-							fmt.Fprintf(outfh, "@%d\n%s\n+\n%s\n", code, kmer, quality)
+							fmt.Fprintf(outfh, "@%s\n%s\n+\n%s\n", scode, kmer, quality)
 						}
 					} else if showTaxid {
 						// outfh.WriteString(fmt.Sprintf("%s\t%d\n", kmer, taxid))
-						fmt.Fprintf(outfh, "%s\t%d\n", kmer, taxid)
+						fmt.Fprintf(outfh, "%s%s\t%d\n", prefix, kmer, taxid)
 					} else if showTaxidOnly {
 						// outfh.WriteString(fmt.Sprintf("%d\n", taxid))
-						fmt.Fprintf(outfh, "%d\n", taxid)
+						fmt.Fprintf(outfh, "%s%d\n", prefix, taxid)
 					} else if showCodeOnly {
 						// outfh.WriteString(fmt.Sprintf("%d\n", code))
-						fmt.Fprintf(outfh, "%d\n", code)
+						outfh.WriteString(prefix + formatCode(code, hexCode) + "\n")
 					} else if showCode {
 						// outfh.WriteString(fmt.Sprintf("%s\t%d\n", kmer, code))
-						fmt.Fprintf(outfh, "%s\t%d\n", kmer, code)
+						fmt.Fprintf(outfh, "%s%s\t%s\n", prefix, kmer, formatCode(code, hexCode))
 					} else {
-						outfh.WriteString(string(kmer) + "\n")
+						outfh.WriteString(prefix + string(kmer) + "\n")
 					}
 				}
 
@@ -228,9 +300,14 @@ func init() {
 	viewCmd.Flags().StringP("out-file", "o", "-", `out file ("-" for stdout, suffix .gz for gzipped out)`)
 	viewCmd.Flags().BoolP("show-code", "n", false, `show encoded integer along with k-mer`)
 	viewCmd.Flags().BoolP("show-code-only", "N", false, `only show encoded integers, faster than cutting from result of -n/--show-cde`)
+	viewCmd.Flags().BoolP("hex", "x", false, `show encoded integers (or hashes) in hexadecimal format with a prefix of "0x"`)
 	viewCmd.Flags().BoolP("fasta", "a", false, `output in FASTA format, with encoded integer as FASTA header`)
 	viewCmd.Flags().BoolP("fastq", "q", false, `output in FASTQ format, with encoded integer as FASTQ header`)
 	viewCmd.Flags().BoolP("show-taxid", "t", false, "show taxid")
 	viewCmd.Flags().BoolP("show-taxid-only", "T", false, "show taxid only")
 	viewCmd.Flags().StringSliceP("genome", "g", []string{}, "genomes in (gzipped) fasta file(s) for decoding hashed k-mers")
+	viewCmd.Flags().BoolP("file-name", "F", false, "show file name as the first column")
+	viewCmd.Flags().BoolP("allow-mixed", "", false, "allow files with different k-mer sizes or 'canonical/scaled/hashed' flags")
+	viewCmd.Flags().StringSliceP("keep-taxid", "", []string{}, "only output k-mers with these taxids (multiple values delimited by comma supported)")
+	viewCmd.Flags().StringP("filter-expr", "", "", helpFilterExpr)
 }
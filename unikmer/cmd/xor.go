@@ -0,0 +1,265 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/taxdump"
+	"github.com/shenwei356/unik/v5"
+
+	"github.com/spf13/cobra"
+)
+
+var xorCmd = &cobra.Command{
+	Use:   "xor",
+	Short: "Symmetric difference of k-mers in multiple sorted binary files",
+	Long: `Symmetric difference of k-mers in multiple sorted binary files
+
+For two files, k-mers only in one of them are outputted. For more files,
+k-mers present in an odd number of files are outputted.
+
+Attentions:
+  1. All input files should be sorted, and output file is sorted.
+  2. The 'canonical/scaled/hashed' flags of all files should be consistent.
+  3. Input files should ALL have or don't have taxid information.
+     Taxids of k-mers are the LCA of taxids in all files containing them.
+  4. Duplicated k-mers in a file are counted once.
+
+Tips:
+  1. Files are merged in a streaming way, memory usage is very low.
+  2. It's useful for spotting what changed between two versions of a database,
+     and use 'unikmer diff' to see which direction the changes go.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		if opt.Verbose {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", !opt.SkipFileCheck)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+		preflightCheck(opt, files, false)
+
+		outFile := getFlagString(cmd, "out-prefix")
+		requireSorted := getFlagBool(cmd, "require-sorted")
+
+		// ---------------------------------------------------------------
+		// opening all files
+
+		readers := make([]*unik.Reader, len(files))
+		checkers := make([]*sortedChecker, len(files))
+		fhs := make([]*os.File, 0, len(files))
+		defer func() {
+			for _, fh := range fhs {
+				closeInStream(fh)
+			}
+		}()
+
+		var reader0 *unik.Reader
+		var hasTaxid bool
+		for i, file := range files {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+			fhs = append(fhs, r)
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, file))
+
+			if !reader.IsSorted() {
+				checkError(fmt.Errorf("input file should be sorted: %s", file))
+			}
+
+			if i == 0 {
+				reader0 = reader
+				hasTaxid = !opt.IgnoreTaxid && reader.HasTaxidInfo()
+			} else {
+				checkCompatibility(reader0, reader, file)
+				if !opt.IgnoreTaxid && reader.HasTaxidInfo() != hasTaxid {
+					if reader.HasTaxidInfo() {
+						checkError(fmt.Errorf(`taxid information not found in previous files, but found in this: %s`, file))
+					} else {
+						checkError(fmt.Errorf(`taxid information found in previous files, but missing in this: %s`, file))
+					}
+				}
+			}
+			readers[i] = reader
+			checkers[i] = newSortedChecker(requireSorted, file)
+		}
+
+		var taxondb *taxdump.Taxonomy
+		if hasTaxid {
+			taxondb = loadTaxonomy(opt, false)
+		}
+
+		// ---------------------------------------------------------------
+		// output
+
+		if !isStdout(outFile) && !strings.HasSuffix(outFile, extDataFile) {
+			outFile += extDataFile
+		}
+		outfh, gw, w, err := outStream(outFile, opt.Compress, opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		var mode uint32 = unik.UnikSorted
+		if reader0.IsCanonical() {
+			mode |= unik.UnikCanonical
+		}
+		if reader0.IsHashed() {
+			mode |= unik.UnikHashed
+		}
+		if hasTaxid {
+			mode |= unik.UnikIncludeTaxID
+		}
+		writer, err := unik.NewWriter(outfh, reader0.K, mode)
+		checkError(errors.Wrap(err, outFile))
+		writer.SetMaxTaxid(opt.MaxTaxid)
+		if reader0.IsScaled() {
+			writer.SetScale(reader0.GetScale())
+			if reader0.MaxHash > 0 {
+				writer.SetMaxHash(reader0.MaxHash)
+			}
+		}
+
+		// ---------------------------------------------------------------
+		// merging
+
+		read := func(i int) (uint64, uint32, bool) {
+			code, taxid, err := readCodeWithTaxid(readers[i], opt.Sampler)
+			if err != nil {
+				if err == io.EOF {
+					return 0, 0, false
+				}
+				checkError(errors.Wrap(err, files[i]))
+			}
+			checkers[i].check(code)
+			return code, taxid, true
+		}
+
+		var lca func(a, b uint32) uint32
+		if hasTaxid {
+			lca = taxondb.LCA
+		}
+
+		var n int64
+		xorMerge(len(readers), read, lca, func(code uint64, taxid uint32) {
+			if hasTaxid {
+				writer.WriteCodeWithTaxid(code, taxid)
+			} else {
+				writer.WriteCode(code)
+			}
+			n++
+		})
+
+		checkError(writer.Flush())
+		if opt.Verbose {
+			log.Infof("%d k-mers saved to %s", n, outFile)
+		}
+	},
+}
+
+// xorMerge merges sorted codes of n sources, and calls fn for every k-mer
+// present in an odd number of sources. read returns the next code and taxid
+// of a source, or false at the end. Taxids are the LCA of taxids in all
+// sources containing the k-mer, computed with lca, which is nil for data
+// without taxids.
+func xorMerge(n int, read func(i int) (uint64, uint32, bool), lca func(a, b uint32) uint32, fn func(code uint64, taxid uint32)) {
+	// one entry per source in the heap
+	entries := make([]*codeEntry, 0, n)
+	codes := codeEntryHeap{entries: &entries}
+
+	next := func(e *codeEntry) {
+		var ok bool
+		if e.code, e.taxid, ok = read(e.idx); ok {
+			heap.Push(codes, e)
+		}
+	}
+	for i := 0; i < n; i++ {
+		next(&codeEntry{idx: i})
+	}
+
+	// k-mers popped from the heap are processed in groups of the same value
+	var last uint64
+	var taxid uint32
+	var count int               // number of sources containing the k-mer
+	var group int               // index of the group, starting from 1
+	var groups = make([]int, n) // the last group seen in each source
+	var e *codeEntry
+
+	flush := func() {
+		if count&1 == 1 {
+			fn(last, taxid)
+		}
+	}
+
+	for len(entries) > 0 {
+		e = heap.Pop(codes).(*codeEntry)
+
+		if group == 0 || e.code != last {
+			if group > 0 {
+				flush()
+			}
+			group++
+			last, taxid, count = e.code, e.taxid, 0
+		} else if lca != nil {
+			taxid = lca(taxid, e.taxid)
+		}
+		if groups[e.idx] != group { // duplicates in a source are counted once
+			groups[e.idx] = group
+			count++
+		}
+
+		next(e)
+	}
+	if group > 0 {
+		flush()
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(xorCmd)
+
+	xorCmd.Flags().StringP("out-prefix", "o", "-", `out file prefix ("-" for stdout)`)
+	xorCmd.Flags().BoolP("require-sorted", "", false, helpRequireSorted)
+}
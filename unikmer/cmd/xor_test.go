@@ -0,0 +1,126 @@
+// Copyright © 2018-2021 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestXorMerge(t *testing.T) {
+	// a tiny taxonomy: 1 -> 2 -> {3, 4}, 1 -> 5
+	parents := map[uint32]uint32{1: 1, 2: 1, 3: 2, 4: 2, 5: 1}
+	lca := func(a, b uint32) uint32 {
+		ancestors := map[uint32]bool{a: true}
+		for a != 1 {
+			a = parents[a]
+			ancestors[a] = true
+		}
+		for !ancestors[b] {
+			b = parents[b]
+		}
+		return b
+	}
+
+	type kmer struct {
+		code  uint64
+		taxid uint32
+	}
+
+	tests := []struct {
+		name    string
+		sources [][]kmer
+		taxid   bool
+		want    []kmer
+	}{
+		{
+			name:    "two files",
+			sources: [][]kmer{{{1, 0}, {2, 0}, {5, 0}}, {{2, 0}, {3, 0}, {5, 0}, {9, 0}}},
+			want:    []kmer{{1, 0}, {3, 0}, {9, 0}},
+		},
+		{
+			name:    "odd number of files",
+			sources: [][]kmer{{{1, 0}, {2, 0}}, {{1, 0}, {3, 0}}, {{1, 0}, {2, 0}, {3, 0}}},
+			want:    []kmer{{1, 0}},
+		},
+		{
+			name:    "duplicates counted once",
+			sources: [][]kmer{{{1, 0}, {1, 0}, {2, 0}}, {{2, 0}, {2, 0}}, {{4, 0}, {4, 0}}},
+			want:    []kmer{{1, 0}, {4, 0}},
+		},
+		{
+			name:    "empty files",
+			sources: [][]kmer{{}, {{7, 0}}, {}},
+			want:    []kmer{{7, 0}},
+		},
+		{
+			name:    "no k-mers",
+			sources: [][]kmer{{}, {}},
+			want:    nil,
+		},
+		{
+			name:    "LCA of taxids",
+			sources: [][]kmer{{{1, 3}, {2, 3}, {3, 5}}, {{1, 4}, {2, 4}}, {{1, 3}, {4, 4}}},
+			taxid:   true,
+			// k-mer 1 in 3 files: LCA(3, 4, 3) = 2; k-mer 2 in 2 files: dropped
+			want: []kmer{{1, 2}, {3, 5}, {4, 4}},
+		},
+		{
+			name:    "LCA across distant taxa",
+			sources: [][]kmer{{{8, 3}}, {{8, 5}}, {{8, 4}}},
+			taxid:   true,
+			want:    []kmer{{8, 1}},
+		},
+		{
+			name:    "LCA with duplicates in a file",
+			sources: [][]kmer{{{6, 3}, {6, 4}}, {{6, 3}}, {{6, 3}}},
+			taxid:   true,
+			// present in 3 files, taxids of duplicates are also included
+			want: []kmer{{6, 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pos := make([]int, len(test.sources))
+			read := func(i int) (uint64, uint32, bool) {
+				if pos[i] >= len(test.sources[i]) {
+					return 0, 0, false
+				}
+				k := test.sources[i][pos[i]]
+				pos[i]++
+				return k.code, k.taxid, true
+			}
+			var _lca func(a, b uint32) uint32
+			if test.taxid {
+				_lca = lca
+			}
+
+			var got []kmer
+			xorMerge(len(test.sources), read, _lca, func(code uint64, taxid uint32) {
+				got = append(got, kmer{code, taxid})
+			})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
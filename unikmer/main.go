@@ -45,15 +45,7 @@ func init() {
 }
 
 func main() {
-	// go tool pprof -http=:8080 cpu.pprof
-	// defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
-
-	// go tool trace -http=:8080 trace.out
-	// defer profile.Start(profile.TraceProfile, profile.ProfilePath(".")).Stop()
-
-	// go tool pprof -http=:8080 mem.pprof
-	// defer profile.Start(profile.MemProfile, profile.MemProfileRate(1), profile.ProfilePath(".")).Stop()
-	// defer profile.Start(profile.MemProfile, profile.ProfilePath(".")).Stop()
+	// profiling: see the global flags --cpu-profile, --mem-profile and --trace.
 
 	cmd.Execute()
 }